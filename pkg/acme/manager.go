@@ -0,0 +1,586 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"prism/pkg/certs"
+	"prism/pkg/logger"
+	"prism/pkg/secrets"
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+const (
+	// ChallengeHTTP01 is answered by Prism's plain HTTP listener under /.well-known/acme-challenge/.
+	ChallengeHTTP01 = "http-01"
+	// ChallengeTLSALPN01 is answered during the TLS handshake on the HTTPS listener.
+	ChallengeTLSALPN01 = "tls-alpn-01"
+
+	challengePrefix = "/.well-known/acme-challenge/"
+)
+
+// Config configures automatic certificate issuance.
+type Config struct {
+	DirectoryURL string        // e.g., Let's Encrypt, or "https://localhost:14000/dir" for a local Pebble
+	Email        string        // Contact address for the account
+	CABundle     []byte        // Extra PEM roots to trust when talking to the ACME server, e.g., Pebble's
+	RenewBefore  time.Duration // Renew certificates this long before they expire
+	RetryAfter   time.Duration // Wait this long after a failed attempt
+
+	// ChallengeSync is how often TLS-ALPN-01 challenges started by other replicas are loaded,
+	// 2 seconds by default. A replica waits this long before asking the CA to validate.
+	ChallengeSync time.Duration
+}
+
+// Repository is the storage the manager shares with other replicas: the account, pending
+// challenges, per-hostname status and issued certificates. *storage.Repository implements it.
+type Repository interface {
+	ListProjects(ctx context.Context) ([]storage.Project, error)
+	GetACMEAccount(ctx context.Context, directoryURL string) (*storage.ACMEAccount, error)
+	SaveACMEAccount(ctx context.Context, account *storage.ACMEAccount) (*storage.ACMEAccount, error)
+	PutACMEChallenge(ctx context.Context, challenge *storage.ACMEChallenge) error
+	GetACMEChallengeByToken(ctx context.Context, token string) (*storage.ACMEChallenge, error)
+	ListACMEChallenges(ctx context.Context, challengeType string) ([]storage.ACMEChallenge, error)
+	DeleteACMEChallenge(ctx context.Context, token string) error
+	AcquireACMELease(ctx context.Context, hostname, projectID string, ttl time.Duration) (bool, error)
+	SetACMEStatus(ctx context.Context, hostname, status, lastError string, nextAttemptAt *time.Time) error
+	GetACMEStatus(ctx context.Context, hostname string) (*storage.ACMEStatus, error)
+	ReplaceACMECertificate(ctx context.Context, cert *storage.Certificate) error
+}
+
+// CertificateStore serves the issued certificates. *certs.Store implements it.
+type CertificateStore interface {
+	Lookup(hostname string) (certs.Info, bool)
+	Reload(ctx context.Context) error
+}
+
+var (
+	_ Repository       = (*storage.Repository)(nil)
+	_ CertificateStore = (*certs.Store)(nil)
+)
+
+// Manager obtains and renews certificates for projects that enable ACME. All state lives in
+// storage, so any replica can answer challenges and only one replica works on a hostname at a time.
+type Manager struct {
+	cfg        Config
+	repo       Repository
+	box        *secrets.Box
+	store      CertificateStore
+	hub        *websockets.Hub
+	httpClient *http.Client
+
+	mu     sync.Mutex
+	client *acme.Client // Set once the account is loaded
+
+	challenges challenges
+}
+
+// challenges holds the responses to pending challenges in memory, so answering one never
+// costs a storage lookup during a TLS handshake.
+type challenges struct {
+	mu     sync.RWMutex
+	tokens map[string]string           // HTTP-01 token to key authorization, for this replica's orders
+	local  map[string]*tls.Certificate // Hostname to TLS-ALPN-01 certificate, for this replica's orders
+	synced map[string]alpnChallenge    // Hostname to TLS-ALPN-01 challenge, loaded from storage
+}
+
+type alpnChallenge struct {
+	token string
+	cert  *tls.Certificate
+}
+
+// NewManager creates an ACME manager. Issued certificates are stored through repo, with the
+// private keys sealed by box, and the certificate store is reloaded after each issuance.
+// box is required: account and certificate keys are never stored in the clear.
+func NewManager(cfg Config, repo Repository, box *secrets.Box, store CertificateStore, hub *websockets.Hub) (*Manager, error) {
+	if box == nil {
+		return nil, fmt.Errorf("acme requires the server to be configured with PRISM_SECRET_KEY")
+	}
+	if cfg.RenewBefore == 0 {
+		cfg.RenewBefore = certs.ExpiryWarning
+	}
+	if cfg.RetryAfter == 0 {
+		cfg.RetryAfter = time.Hour
+	}
+	if cfg.ChallengeSync == 0 {
+		cfg.ChallengeSync = 2 * time.Second
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(cfg.CABundle) > 0 {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(cfg.CABundle) {
+			return nil, fmt.Errorf("acme CA bundle contains no certificates")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	return &Manager{
+		cfg:        cfg,
+		repo:       repo,
+		box:        box,
+		store:      store,
+		hub:        hub,
+		httpClient: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		challenges: challenges{
+			tokens: make(map[string]string),
+			local:  make(map[string]*tls.Certificate),
+			synced: make(map[string]alpnChallenge),
+		},
+	}, nil
+}
+
+// HTTPHandler answers HTTP-01 challenges and passes every other request to next. Challenges
+// of this replica's orders are answered from memory, those of other replicas from storage.
+func (m *Manager) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, challengePrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.URL.Path, challengePrefix)
+		keyAuth, ok := m.challenges.token(token)
+		if !ok {
+			challenge, err := m.repo.GetACMEChallengeByToken(r.Context(), token)
+			if err != nil || challenge.Hostname != storage.NormalizeHostname(r.Host) {
+				http.Error(w, "Not Found", http.StatusNotFound)
+				return
+			}
+			keyAuth = challenge.KeyAuthorization
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+// TLSConfig extends a server TLS configuration so it can answer TLS-ALPN-01 challenges.
+func (m *Manager) TLSConfig(base *tls.Config) *tls.Config {
+	cfg := base.Clone()
+	cfg.NextProtos = append(cfg.NextProtos, acme.ALPNProto)
+	getCertificate := base.GetCertificate
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			hostname := storage.NormalizeHostname(hello.ServerName)
+			if cert, ok := m.challenges.alpnCertificate(hostname); ok {
+				return cert, nil
+			}
+			return nil, fmt.Errorf("no acme challenge for '%s'", hostname)
+		}
+		return getCertificate(hello)
+	}
+	return cfg
+}
+
+func (c *challenges) token(token string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keyAuth, ok := c.tokens[token]
+	return keyAuth, ok
+}
+
+func (c *challenges) alpnCertificate(hostname string) (*tls.Certificate, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if cert, ok := c.local[hostname]; ok {
+		return cert, true
+	}
+	synced, ok := c.synced[hostname]
+	return synced.cert, ok
+}
+
+// Run checks every interval for hostnames that need a certificate until ctx is cancelled.
+// It also keeps loading the TLS-ALPN-01 challenges started by other replicas.
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	go m.syncChallenges(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := m.RenewAll(ctx); err != nil {
+			log.Printf("Error renewing ACME certificates: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncChallenges loads TLS-ALPN-01 challenges from storage every ChallengeSync until ctx is
+// cancelled. Errors are logged when they start, not on every attempt.
+func (m *Manager) syncChallenges(ctx context.Context) {
+	ticker := time.NewTicker(m.cfg.ChallengeSync)
+	defer ticker.Stop()
+	failing := false
+	for {
+		err := m.loadChallenges(ctx)
+		if err != nil && !failing && ctx.Err() == nil {
+			log.Printf("Error loading ACME challenges: %v\n", err)
+		}
+		failing = err != nil
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// loadChallenges replaces the TLS-ALPN-01 challenges loaded from storage. Validation
+// certificates are only built for challenges that are new since the last load.
+func (m *Manager) loadChallenges(ctx context.Context) error {
+	stored, err := m.repo.ListACMEChallenges(ctx, ChallengeTLSALPN01)
+	if err != nil {
+		return err
+	}
+
+	m.challenges.mu.RLock()
+	previous := m.challenges.synced
+	m.challenges.mu.RUnlock()
+
+	synced := make(map[string]alpnChallenge, len(stored))
+	for _, challenge := range stored {
+		if existing, ok := previous[challenge.Hostname]; ok && existing.token == challenge.Token {
+			synced[challenge.Hostname] = existing
+			continue
+		}
+		client, err := m.account(ctx)
+		if err != nil {
+			return err
+		}
+		cert, err := client.TLSALPN01ChallengeCert(challenge.Token, challenge.Hostname)
+		if err != nil {
+			return fmt.Errorf("failed to build acme validation certificate for %s: %w", challenge.Hostname, err)
+		}
+		synced[challenge.Hostname] = alpnChallenge{token: challenge.Token, cert: &cert}
+	}
+
+	m.challenges.mu.Lock()
+	m.challenges.synced = synced
+	m.challenges.mu.Unlock()
+	return nil
+}
+
+// RenewAll obtains certificates for every ACME-enabled hostname that has none, or whose
+// certificate expires within RenewBefore.
+func (m *Manager) RenewAll(ctx context.Context) error {
+	projects, err := m.repo.ListProjects(ctx)
+	if err != nil {
+		return err
+	}
+	for _, project := range projects {
+		if project.ACME == nil || !project.ACME.Enabled {
+			continue
+		}
+		for _, hostname := range project.Hostnames {
+			if info, ok := m.store.Lookup(hostname); ok && time.Until(info.NotAfter) > m.cfg.RenewBefore {
+				continue
+			}
+			status, err := m.repo.GetACMEStatus(ctx, hostname)
+			if err != nil {
+				return err
+			}
+			if status != nil && status.NextAttemptAt != nil && time.Now().Before(*status.NextAttemptAt) {
+				continue
+			}
+			m.obtainWithLease(ctx, &project, hostname)
+		}
+	}
+	return nil
+}
+
+// obtainWithLease issues a certificate for one hostname unless another replica is already on it,
+// and records the outcome.
+func (m *Manager) obtainWithLease(ctx context.Context, project *storage.Project, hostname string) {
+	acquired, err := m.repo.AcquireACMELease(ctx, hostname, project.ID, 10*time.Minute)
+	if err != nil || !acquired {
+		return
+	}
+
+	logger.LogAndBroadcast(m.hub, project.ID, "Requesting ACME certificate for %s", hostname)
+	if err := m.obtain(ctx, project, hostname); err != nil {
+		next := time.Now().Add(m.cfg.RetryAfter)
+		logger.LogAndBroadcast(m.hub, project.ID, "ACME issuance for %s failed, retrying after %s: %v", hostname, next.Format(time.RFC3339), err)
+		if err := m.repo.SetACMEStatus(ctx, hostname, "failed", err.Error(), &next); err != nil {
+			log.Printf("Error recording ACME status for %s: %v\n", hostname, err)
+		}
+		return
+	}
+
+	if err := m.repo.SetACMEStatus(ctx, hostname, "valid", "", nil); err != nil {
+		log.Printf("Error recording ACME status for %s: %v\n", hostname, err)
+	}
+	if err := m.store.Reload(ctx); err != nil {
+		log.Printf("Error reloading TLS certificates: %v\n", err)
+	}
+	logger.LogAndBroadcast(m.hub, project.ID, "Obtained ACME certificate for %s", hostname)
+}
+
+// obtain runs a full order for one hostname and stores the resulting certificate.
+func (m *Manager) obtain(ctx context.Context, project *storage.Project, hostname string) error {
+	client, err := m.account(ctx)
+	if err != nil {
+		return err
+	}
+
+	challengeType := ChallengeHTTP01
+	if project.ACME.Challenge == ChallengeTLSALPN01 {
+		challengeType = ChallengeTLSALPN01
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(hostname))
+	if err != nil {
+		return fmt.Errorf("failed to create acme order: %w", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, authzURL, challengeType); err != nil {
+			return err
+		}
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	if _, err := client.WaitOrder(waitCtx, order.URI); err != nil {
+		return fmt.Errorf("acme order did not become ready: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: hostname},
+		DNSNames: []string{hostname},
+	}, key)
+	if err != nil {
+		return fmt.Errorf("failed to create CSR: %w", err)
+	}
+	chain, err := finalize(waitCtx, client, order, csr)
+	if err != nil {
+		return err
+	}
+
+	var chainPEM []byte
+	for _, der := range chain {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	_, leaf, err := certs.ParseKeyPair(chainPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	encryptedKey, err := m.box.Seal(keyPEM)
+	if err != nil {
+		return err
+	}
+
+	return m.repo.ReplaceACMECertificate(ctx, &storage.Certificate{
+		ProjectID:    project.ID,
+		Hostnames:    []string{hostname},
+		CertPEM:      string(chainPEM),
+		EncryptedKey: encryptedKey,
+		NotBefore:    leaf.NotBefore,
+		NotAfter:     leaf.NotAfter,
+	})
+}
+
+// finalize submits the CSR and downloads the certificate chain. CreateOrderCert polls the
+// order at the Location of the finalize response, which some CAs, Pebble among them, leave
+// out; the order is then polled at the URL it was created with.
+func finalize(ctx context.Context, client *acme.Client, order *acme.Order, csr []byte) ([][]byte, error) {
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err == nil {
+		return chain, nil
+	}
+	current, waitErr := client.WaitOrder(ctx, order.URI)
+	if waitErr != nil || current.Status != acme.StatusValid {
+		return nil, fmt.Errorf("failed to finalize acme order: %w", err)
+	}
+	if chain, err = client.FetchCert(ctx, current.CertURL, true); err != nil {
+		return nil, fmt.Errorf("failed to download acme certificate: %w", err)
+	}
+	return chain, nil
+}
+
+// authorize publishes the challenge response, in memory and in storage for other replicas,
+// asks the CA to validate it and waits.
+func (m *Manager) authorize(ctx context.Context, client *acme.Client, authzURL, challengeType string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch acme authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == challengeType {
+			challenge = c
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("acme server offered no %s challenge for %s", challengeType, authz.Identifier.Value)
+	}
+
+	hostname := authz.Identifier.Value
+	keyAuth, err := client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return err
+	}
+	var cert tls.Certificate
+	if challengeType == ChallengeTLSALPN01 {
+		if cert, err = client.TLSALPN01ChallengeCert(challenge.Token, hostname); err != nil {
+			return fmt.Errorf("failed to build acme validation certificate: %w", err)
+		}
+	}
+
+	m.challenges.mu.Lock()
+	if challengeType == ChallengeTLSALPN01 {
+		m.challenges.local[hostname] = &cert
+	} else {
+		m.challenges.tokens[challenge.Token] = keyAuth
+	}
+	m.challenges.mu.Unlock()
+	defer func() {
+		m.challenges.mu.Lock()
+		delete(m.challenges.local, hostname)
+		delete(m.challenges.tokens, challenge.Token)
+		m.challenges.mu.Unlock()
+	}()
+
+	err = m.repo.PutACMEChallenge(ctx, &storage.ACMEChallenge{
+		Token:            challenge.Token,
+		Hostname:         hostname,
+		Type:             challengeType,
+		KeyAuthorization: keyAuth,
+		ExpiresAt:        time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		return err
+	}
+	defer m.repo.DeleteACMEChallenge(context.WithoutCancel(ctx), challenge.Token)
+
+	if challengeType == ChallengeTLSALPN01 {
+		// Other replicas load TLS-ALPN-01 challenges periodically; the CA may connect to any of them.
+		if err := sleep(ctx, m.cfg.ChallengeSync); err != nil {
+			return err
+		}
+	}
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("failed to accept acme challenge: %w", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	if _, err := client.WaitAuthorization(waitCtx, authz.URI); err != nil {
+		return fmt.Errorf("acme authorization for %s failed: %w", hostname, err)
+	}
+	return nil
+}
+
+// account returns a client registered with the directory, loading the shared account from
+// storage or creating it on first use.
+func (m *Manager) account(ctx context.Context) (*acme.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client != nil {
+		return m.client, nil
+	}
+
+	stored, err := m.repo.GetACMEAccount(ctx, m.cfg.DirectoryURL)
+	if errors.Is(err, storage.ErrACMEAccountNotFound) {
+		if stored, err = m.register(ctx); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Always use the stored account, in case another replica registered first.
+	keyDER, err := m.box.Open(stored.EncryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyDER)
+	if err != nil {
+		return nil, fmt.Errorf("invalid acme account key: %w", err)
+	}
+	m.client = m.newClient(key)
+	m.client.KID = acme.KeyID(stored.AccountURL)
+	return m.client, nil
+}
+
+// register creates a new account with the directory and stores it.
+func (m *Manager) register(ctx context.Context) (*storage.ACMEAccount, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	account := &acme.Account{}
+	if m.cfg.Email != "" {
+		account.Contact = []string{"mailto:" + m.cfg.Email}
+	}
+	account, err = m.newClient(key).Register(ctx, account, acme.AcceptTOS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register acme account: %w", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	encryptedKey, err := m.box.Seal(keyDER)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := m.repo.SaveACMEAccount(ctx, &storage.ACMEAccount{
+		DirectoryURL: m.cfg.DirectoryURL,
+		AccountURL:   account.URI,
+		EncryptedKey: encryptedKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Registered ACME account %s\n", stored.AccountURL)
+	return stored, nil
+}
+
+func (m *Manager) newClient(key *ecdsa.PrivateKey) *acme.Client {
+	return &acme.Client{Key: key, DirectoryURL: m.cfg.DirectoryURL, HTTPClient: m.httpClient, UserAgent: "prism"}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,340 @@
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/pebble/v2/ca"
+	"github.com/letsencrypt/pebble/v2/db"
+	"github.com/letsencrypt/pebble/v2/va"
+	"github.com/letsencrypt/pebble/v2/wfe"
+
+	"prism/pkg/certs"
+	"prism/pkg/secrets"
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+// fakeRepository keeps the state replicas share in memory.
+type fakeRepository struct {
+	mu           sync.Mutex
+	projects     []storage.Project
+	account      *storage.ACMEAccount
+	challenges   map[string]storage.ACMEChallenge
+	status       map[string]storage.ACMEStatus
+	certificates []storage.Certificate
+}
+
+func newFakeRepository(projects ...storage.Project) *fakeRepository {
+	return &fakeRepository{
+		projects:   projects,
+		challenges: make(map[string]storage.ACMEChallenge),
+		status:     make(map[string]storage.ACMEStatus),
+	}
+}
+
+func (r *fakeRepository) ListProjects(ctx context.Context) ([]storage.Project, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]storage.Project(nil), r.projects...), nil
+}
+
+func (r *fakeRepository) GetACMEAccount(ctx context.Context, directoryURL string) (*storage.ACMEAccount, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.account == nil || r.account.DirectoryURL != directoryURL {
+		return nil, storage.ErrACMEAccountNotFound
+	}
+	account := *r.account
+	return &account, nil
+}
+
+func (r *fakeRepository) SaveACMEAccount(ctx context.Context, account *storage.ACMEAccount) (*storage.ACMEAccount, error) {
+	r.mu.Lock()
+	if r.account == nil {
+		saved := *account
+		r.account = &saved
+	}
+	r.mu.Unlock()
+	return r.GetACMEAccount(ctx, account.DirectoryURL)
+}
+
+func (r *fakeRepository) PutACMEChallenge(ctx context.Context, challenge *storage.ACMEChallenge) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.challenges[challenge.Token] = *challenge
+	return nil
+}
+
+func (r *fakeRepository) GetACMEChallengeByToken(ctx context.Context, token string) (*storage.ACMEChallenge, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	challenge, ok := r.challenges[token]
+	if !ok || challenge.Type != ChallengeHTTP01 {
+		return nil, storage.ErrACMEChallengeNotFound
+	}
+	return &challenge, nil
+}
+
+func (r *fakeRepository) ListACMEChallenges(ctx context.Context, challengeType string) ([]storage.ACMEChallenge, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var challenges []storage.ACMEChallenge
+	for _, challenge := range r.challenges {
+		if challenge.Type == challengeType {
+			challenges = append(challenges, challenge)
+		}
+	}
+	return challenges, nil
+}
+
+func (r *fakeRepository) DeleteACMEChallenge(ctx context.Context, token string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.challenges, token)
+	return nil
+}
+
+func (r *fakeRepository) AcquireACMELease(ctx context.Context, hostname, projectID string, ttl time.Duration) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status[hostname].Status == "pending" {
+		return false, nil
+	}
+	r.status[hostname] = storage.ACMEStatus{Hostname: hostname, ProjectID: projectID, Status: "pending"}
+	return true, nil
+}
+
+func (r *fakeRepository) SetACMEStatus(ctx context.Context, hostname, status, lastError string, nextAttemptAt *time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current := r.status[hostname]
+	current.Status, current.LastError, current.NextAttemptAt = status, lastError, nextAttemptAt
+	r.status[hostname] = current
+	return nil
+}
+
+func (r *fakeRepository) GetACMEStatus(ctx context.Context, hostname string) (*storage.ACMEStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status, ok := r.status[hostname]
+	if !ok {
+		return nil, nil
+	}
+	return &status, nil
+}
+
+func (r *fakeRepository) ReplaceACMECertificate(ctx context.Context, cert *storage.Certificate) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.certificates = append(r.certificates, *cert)
+	return nil
+}
+
+// fakeStore serves no certificates, so every ACME hostname is due.
+type fakeStore struct {
+	mu      sync.Mutex
+	reloads int
+}
+
+func (s *fakeStore) Lookup(hostname string) (certs.Info, bool) {
+	return certs.Info{}, false
+}
+
+func (s *fakeStore) Reload(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reloads++
+	return nil
+}
+
+// pebble is an in-process Pebble ACME server whose validation authority connects to the
+// given ports on localhost.
+type pebble struct {
+	directoryURL string
+	caBundle     []byte // Trusts the directory's TLS certificate
+	roots        *x509.CertPool
+}
+
+func startPebble(t *testing.T, httpPort, tlsPort int) *pebble {
+	t.Setenv("PEBBLE_VA_NOSLEEP", "1")
+	t.Setenv("PEBBLE_WFE_NONCEREJECT", "0")
+
+	logger := log.New(io.Discard, "", 0)
+	store := db.NewMemoryStore()
+	authority := ca.New(logger, store, "", "ecdsa", 0, 1, map[string]ca.Profile{"default": {Description: "default"}})
+	validator := va.New(logger, httpPort, tlsPort, false, "", store)
+	frontEnd := wfe.New(logger, store, validator, authority, nil, false, false, 1, 1)
+
+	server := httptest.NewTLSServer(frontEnd.Handler())
+	t.Cleanup(server.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.GetRootCert(0).Cert)
+	return &pebble{
+		directoryURL: server.URL + wfe.DirectoryPath,
+		caBundle:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+		roots:        roots,
+	}
+}
+
+// listen listens on an ephemeral localhost port.
+func listen(t *testing.T) (net.Listener, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+func newHub() *websockets.Hub {
+	hub := websockets.NewHub()
+	go hub.Run()
+	return hub
+}
+
+func newBox(t *testing.T) *secrets.Box {
+	box, err := secrets.NewBox(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return box
+}
+
+func TestNewManagerRequiresBox(t *testing.T) {
+	if _, err := NewManager(Config{DirectoryURL: "https://localhost:14000/dir"}, newFakeRepository(), nil, &fakeStore{}, nil); err == nil {
+		t.Fatal("expected an error without a secrets box")
+	}
+}
+
+func TestObtainCertificateFromPebble(t *testing.T) {
+	tests := []struct {
+		name      string
+		challenge string
+		replica   bool // Serve challenges from a second manager sharing the repository
+	}{
+		{name: "http-01", challenge: ChallengeHTTP01},
+		{name: "http-01 answered by another replica", challenge: ChallengeHTTP01, replica: true},
+		{name: "tls-alpn-01", challenge: ChallengeTLSALPN01},
+		{name: "tls-alpn-01 answered by another replica", challenge: ChallengeTLSALPN01, replica: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			httpLn, httpPort := listen(t)
+			tlsLn, tlsPort := listen(t)
+			pb := startPebble(t, httpPort, tlsPort)
+
+			repo := newFakeRepository(storage.Project{
+				ID:        "project-1",
+				Hostnames: []string{"localhost"},
+				ACME:      &storage.ACMEConfig{Enabled: true, Challenge: tt.challenge},
+			})
+			box := newBox(t)
+			cfg := Config{DirectoryURL: pb.directoryURL, CABundle: pb.caBundle, ChallengeSync: 500 * time.Millisecond}
+			store := &fakeStore{}
+			hub := newHub()
+			manager, err := NewManager(cfg, repo, box, store, hub)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server := manager
+			if tt.replica {
+				cfg.ChallengeSync = 50 * time.Millisecond
+				if server, err = NewManager(cfg, repo, box, &fakeStore{}, hub); err != nil {
+					t.Fatal(err)
+				}
+				go server.syncChallenges(ctx)
+			}
+			noCertificate := &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return nil, errors.New("no certificate")
+			}}
+			go http.Serve(httpLn, server.HTTPHandler(http.NotFoundHandler()))
+			go http.Serve(tls.NewListener(tlsLn, server.TLSConfig(noCertificate)), http.NotFoundHandler())
+
+			if err := manager.RenewAll(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			status, _ := repo.GetACMEStatus(ctx, "localhost")
+			if status == nil || status.Status != "valid" {
+				t.Fatalf("expected status valid, got %+v", status)
+			}
+			if len(repo.certificates) != 1 {
+				t.Fatalf("expected one stored certificate, got %d", len(repo.certificates))
+			}
+			if store.reloads != 1 {
+				t.Errorf("expected the certificate store to be reloaded once, got %d", store.reloads)
+			}
+			if len(repo.challenges) != 0 || len(manager.challenges.tokens) != 0 || len(manager.challenges.local) != 0 {
+				t.Errorf("expected challenges to be cleaned up")
+			}
+
+			stored := repo.certificates[0]
+			keyPEM, err := box.Open(stored.EncryptedKey)
+			if err != nil {
+				t.Fatalf("failed to open the stored key: %v", err)
+			}
+			cert, leaf, err := certs.ParseKeyPair([]byte(stored.CertPEM), keyPEM)
+			if err != nil {
+				t.Fatalf("stored certificate and key don't match: %v", err)
+			}
+			intermediates := x509.NewCertPool()
+			for _, der := range cert.Certificate[1:] {
+				parsed, err := x509.ParseCertificate(der)
+				if err != nil {
+					t.Fatal(err)
+				}
+				intermediates.AddCert(parsed)
+			}
+			if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "localhost", Roots: pb.roots, Intermediates: intermediates}); err != nil {
+				t.Errorf("issued certificate doesn't verify against Pebble's root: %v", err)
+			}
+			if !stored.NotAfter.Equal(leaf.NotAfter) || stored.ProjectID != "project-1" {
+				t.Errorf("unexpected certificate record %+v", stored)
+			}
+		})
+	}
+}
+
+func TestACMEServerUnreachable(t *testing.T) {
+	repo := newFakeRepository(storage.Project{
+		ID:        "project-1",
+		Hostnames: []string{"app.example.com"},
+		ACME:      &storage.ACMEConfig{Enabled: true},
+	})
+	manager, err := NewManager(Config{DirectoryURL: "http://127.0.0.1:1/dir", RetryAfter: time.Minute}, repo, newBox(t), &fakeStore{}, newHub())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.RenewAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	status, _ := repo.GetACMEStatus(context.Background(), "app.example.com")
+	if status == nil || status.Status != "failed" || status.LastError == "" || status.NextAttemptAt == nil {
+		t.Fatalf("expected a failed status with a retry time, got %+v", status)
+	}
+	// The failed hostname is left alone until its retry time
+	if err := manager.RenewAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if retried, _ := repo.GetACMEStatus(context.Background(), "app.example.com"); !retried.NextAttemptAt.Equal(*status.NextAttemptAt) {
+		t.Errorf("expected no new attempt before %s, got one with retry time %s", status.NextAttemptAt, retried.NextAttemptAt)
+	}
+}
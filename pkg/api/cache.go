@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"prism/pkg/httpcache"
+	"prism/pkg/storage"
+)
+
+// PurgeCacheResponse reports how many cached responses a purge removed.
+type PurgeCacheResponse struct {
+	Purged int `json:"purged"`
+}
+
+// PurgeCacheHandler handles purging a project's cached responses. The optional "path" query
+// parameter limits the purge to one path, or to a path prefix when it ends in "*".
+// responseCache may be nil when the server runs without a response cache.
+func PurgeCacheHandler(repo *storage.Repository, responseCache *httpcache.Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := GetUserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Internal Server Error: User ID not found in context", http.StatusInternalServerError)
+			return
+		}
+
+		// Extract project ID from URL, e.g., /api/v1/projects/{projectID}/cache
+		pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(pathParts) < 4 {
+			http.Error(w, "Bad Request: Invalid URL format", http.StatusBadRequest)
+			return
+		}
+		projectID := pathParts[3]
+
+		if _, err := repo.GetProjectByIDAndUserID(r.Context(), projectID, userID); err != nil {
+			if err == storage.ErrProjectNotFound {
+				http.Error(w, "Not Found: Project not found or not owned by user", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error getting project %s for cache purge: %v", projectID, err)
+			http.Error(w, "Failed to purge cache", http.StatusInternalServerError)
+			return
+		}
+
+		if responseCache == nil {
+			http.Error(w, "Not Found: Response cache is disabled on this server", http.StatusNotFound)
+			return
+		}
+
+		purged := responseCache.Purge(projectID, r.URL.Query().Get("path"))
+		log.Printf("Purged %d cached responses for project %s", purged, projectID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(PurgeCacheResponse{Purged: purged})
+	}
+}
@@ -0,0 +1,292 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"prism/pkg/certs"
+	"prism/pkg/secrets"
+	"prism/pkg/storage"
+)
+
+// UploadCertificateRequest defines the structure for uploading a TLS certificate.
+type UploadCertificateRequest struct {
+	CertificatePEM string `json:"certificate_pem"` // Leaf certificate followed by any intermediates
+	PrivateKeyPEM  string `json:"private_key_pem"`
+}
+
+// reloadCertificates refreshes the certificate store after a certificate change.
+func reloadCertificates(r *http.Request, store *certs.Store) {
+	if err := store.Reload(context.WithoutCancel(r.Context())); err != nil {
+		log.Printf("Error reloading TLS certificates: %v\n", err)
+	}
+}
+
+// UploadCertificateHandler handles uploading a certificate for a project's hostnames.
+func UploadCertificateHandler(repo *storage.Repository, box *secrets.Box, store *certs.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := GetUserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Internal Server Error: User ID not found in context", http.StatusInternalServerError)
+			return
+		}
+
+		// Extract project ID from URL, e.g., /api/v1/projects/{projectID}/certificates
+		pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(pathParts) < 4 {
+			http.Error(w, "Bad Request: Invalid URL format", http.StatusBadRequest)
+			return
+		}
+		projectID := pathParts[3]
+
+		if box == nil {
+			http.Error(w, "Service Unavailable: Certificate uploads require the server to be configured with PRISM_SECRET_KEY", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req UploadCertificateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		_, leaf, err := certs.ParseKeyPair([]byte(req.CertificatePEM), []byte(req.PrivateKeyPEM))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if time.Now().After(leaf.NotAfter) {
+			http.Error(w, "Bad Request: Certificate has already expired", http.StatusBadRequest)
+			return
+		}
+
+		project, err := repo.GetProjectByIDAndUserID(r.Context(), projectID, userID)
+		if err != nil {
+			if err == storage.ErrProjectNotFound {
+				http.Error(w, "Not Found: Project not found or not owned by user", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error getting project %s for certificate upload: %v", projectID, err)
+			http.Error(w, "Failed to upload certificate", http.StatusInternalServerError)
+			return
+		}
+
+		hostnames := certs.Hostnames(leaf)
+		if len(certs.ServedHostnames(hostnames, project.Hostnames)) == 0 {
+			http.Error(w, "Bad Request: Certificate does not cover any of the project's hostnames", http.StatusBadRequest)
+			return
+		}
+
+		encryptedKey, err := box.Seal([]byte(req.PrivateKeyPEM))
+		if err != nil {
+			log.Printf("Error encrypting private key for project %s: %v", projectID, err)
+			http.Error(w, "Failed to upload certificate", http.StatusInternalServerError)
+			return
+		}
+
+		cert, err := repo.CreateCertificate(r.Context(), userID, &storage.Certificate{
+			ProjectID:    projectID,
+			Hostnames:    hostnames,
+			CertPEM:      req.CertificatePEM,
+			EncryptedKey: encryptedKey,
+			Source:       "upload",
+			NotBefore:    leaf.NotBefore,
+			NotAfter:     leaf.NotAfter,
+		})
+		if err != nil {
+			if err == storage.ErrProjectNotFound {
+				http.Error(w, "Not Found: Project not found or not owned by user", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error creating certificate for project %s: %v", projectID, err)
+			http.Error(w, "Failed to upload certificate", http.StatusInternalServerError)
+			return
+		}
+
+		reloadCertificates(r, store)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(cert)
+	}
+}
+
+// ListCertificatesHandler handles listing the certificates of a project.
+func ListCertificatesHandler(repo *storage.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := GetUserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Internal Server Error: User ID not found in context", http.StatusInternalServerError)
+			return
+		}
+
+		// Extract project ID from URL, e.g., /api/v1/projects/{projectID}/certificates
+		pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(pathParts) < 4 {
+			http.Error(w, "Bad Request: Invalid URL format", http.StatusBadRequest)
+			return
+		}
+		projectID := pathParts[3]
+
+		certificates, err := repo.GetCertificatesByProjectID(r.Context(), userID, projectID)
+		if err != nil {
+			if err == storage.ErrProjectNotFound {
+				http.Error(w, "Not Found: Project not found or not owned by user", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error listing certificates for project %s: %v", projectID, err)
+			http.Error(w, "Failed to list certificates", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(certificates)
+	}
+}
+
+// DeleteCertificateHandler handles deleting a certificate.
+func DeleteCertificateHandler(repo *storage.Repository, store *certs.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := GetUserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Internal Server Error: User ID not found in context", http.StatusInternalServerError)
+			return
+		}
+
+		// Extract project ID and certificate ID from URL
+		// e.g., /api/v1/projects/{projectID}/certificates/{certID}
+		pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(pathParts) != 6 {
+			http.Error(w, "Bad Request: Invalid URL format for deleting a certificate", http.StatusBadRequest)
+			return
+		}
+		projectID := pathParts[3]
+		certID := pathParts[5]
+
+		err := repo.DeleteCertificate(r.Context(), userID, projectID, certID)
+		if err != nil {
+			if err == storage.ErrCertificateNotFound {
+				http.Error(w, "Not Found: Certificate not found or you do not have permission to access it", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error deleting certificate %s: %v", certID, err)
+			http.Error(w, "Failed to delete certificate", http.StatusInternalServerError)
+			return
+		}
+
+		reloadCertificates(r, store)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HostnameCertificateStatus describes the certificate state of one project hostname.
+type HostnameCertificateStatus struct {
+	Hostname      string     `json:"hostname"`
+	Status        string     `json:"status"`           // 'valid', 'expiring', 'expired', 'pending', 'failed' or 'none'
+	Source        string     `json:"source,omitempty"` // 'upload', 'acme' or 'file'
+	NotAfter      *time.Time `json:"not_after,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+}
+
+// CertificateStatusHandler handles reporting the certificate served for each project hostname,
+// together with the state of automatic issuance.
+func CertificateStatusHandler(repo *storage.Repository, store *certs.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := GetUserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Internal Server Error: User ID not found in context", http.StatusInternalServerError)
+			return
+		}
+
+		// Extract project ID from URL, e.g., /api/v1/projects/{projectID}/certificate-status
+		pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(pathParts) < 4 {
+			http.Error(w, "Bad Request: Invalid URL format", http.StatusBadRequest)
+			return
+		}
+		projectID := pathParts[3]
+
+		project, err := repo.GetProjectByIDAndUserID(r.Context(), projectID, userID)
+		if err != nil {
+			if err == storage.ErrProjectNotFound {
+				http.Error(w, "Not Found: Project not found or not owned by user", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error getting project %s for certificate status: %v", projectID, err)
+			http.Error(w, "Failed to get certificate status", http.StatusInternalServerError)
+			return
+		}
+
+		acmeStatuses, err := repo.GetACMEStatusesByProjectID(r.Context(), userID, projectID)
+		if err != nil {
+			log.Printf("Error getting ACME status for project %s: %v", projectID, err)
+			http.Error(w, "Failed to get certificate status", http.StatusInternalServerError)
+			return
+		}
+		byHost := make(map[string]storage.ACMEStatus, len(acmeStatuses))
+		for _, status := range acmeStatuses {
+			byHost[status.Hostname] = status
+		}
+
+		now := time.Now()
+		statuses := make([]HostnameCertificateStatus, 0, len(project.Hostnames))
+		for _, hostname := range project.Hostnames {
+			status := HostnameCertificateStatus{Hostname: hostname, Status: "none"}
+			if info, ok := store.Lookup(hostname); ok {
+				status.Source = info.Source
+				status.NotAfter = &info.NotAfter
+				switch remaining := info.NotAfter.Sub(now); {
+				case remaining <= 0:
+					status.Status = "expired"
+				case remaining <= certs.ExpiryWarning:
+					status.Status = "expiring"
+				default:
+					status.Status = "valid"
+				}
+			}
+			// Issuance progress matters when there is no usable certificate yet.
+			if acme, ok := byHost[hostname]; ok {
+				status.LastError = acme.LastError
+				status.NextAttemptAt = acme.NextAttemptAt
+				if status.Status == "none" || status.Status == "expired" {
+					if acme.Status == "pending" || acme.Status == "failed" {
+						status.Status = acme.Status
+					}
+				}
+			}
+			statuses = append(statuses, status)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(statuses)
+	}
+}
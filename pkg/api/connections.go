@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"prism/pkg/conntrack"
+	"prism/pkg/storage"
+)
+
+// ConnectionsHandler lists a project's open client connections (GET) at
+// /api/v1/projects/{projectID}/connections, and closes one of them (DELETE) at
+// /api/v1/projects/{projectID}/connections/{connectionID}.
+func ConnectionsHandler(repo *storage.Repository, conns *conntrack.Table) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := GetUserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Internal Server Error: User ID not found in context", http.StatusInternalServerError)
+			return
+		}
+
+		// Extract IDs from URL, e.g., /api/v1/projects/{projectID}/connections/{connectionID}
+		pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(pathParts) < 5 {
+			http.Error(w, "Bad Request: Invalid URL format", http.StatusBadRequest)
+			return
+		}
+		projectID := pathParts[3]
+
+		if _, err := repo.GetProjectByIDAndUserID(r.Context(), projectID, userID); err != nil {
+			if err == storage.ErrProjectNotFound {
+				http.Error(w, "Not Found: Project not found or not owned by user", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error getting project %s for user %s: %v\n", projectID, userID, err)
+			http.Error(w, "Failed to get project", http.StatusInternalServerError)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(conns.List(projectID))
+			return
+		}
+
+		if len(pathParts) < 6 || pathParts[5] == "" {
+			http.Error(w, "Bad Request: Connection ID missing", http.StatusBadRequest)
+			return
+		}
+		connectionID := pathParts[5]
+		if !conns.Kill(projectID, connectionID) {
+			http.Error(w, "Not Found: Connection not found or already closed", http.StatusNotFound)
+			return
+		}
+		log.Printf("Closed connection %s of project %s on request of user %s", connectionID, projectID, userID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -1,28 +1,57 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"prism/pkg/cache"
+	"prism/pkg/errorpage"
+	"prism/pkg/firewall"
+	"prism/pkg/httpcache"
+	"prism/pkg/l4"
+	"prism/pkg/proxy"
+	"prism/pkg/routing"
+	"prism/pkg/secrets"
 	"prism/pkg/storage"
 )
 
 // CreateProjectRequest defines the structure for creating a new project.
 type CreateProjectRequest struct {
-	Name        string `json:"name"`
-	PathPrefix  string `json:"path_prefix"`
-	UpstreamURL string `json:"upstream_url"`
+	Name        string   `json:"name"`
+	PathPrefix  string   `json:"path_prefix"`
+	UpstreamURL string   `json:"upstream_url"`
+	Hostnames   []string `json:"hostnames,omitempty"`
 }
 
 // UpdateProjectRequest defines the structure for updating an existing project.
 type UpdateProjectRequest struct {
-	Name        *string `json:"name,omitempty"`
-	PathPrefix  *string `json:"path_prefix,omitempty"`
-	UpstreamURL *string `json:"upstream_url,omitempty"`
+	Name        *string   `json:"name,omitempty"`
+	PathPrefix  *string   `json:"path_prefix,omitempty"`
+	UpstreamURL *string   `json:"upstream_url,omitempty"`
+	Hostnames   *[]string `json:"hostnames,omitempty"`
+
+	UpstreamProtocol *string                    `json:"upstream_protocol,omitempty"`
+	ResponseRewrite  *storage.ResponseRewrite   `json:"response_rewrite,omitempty"`
+	ACME             *storage.ACMEConfig        `json:"acme,omitempty"`
+	UpstreamTLS      *UpstreamTLSRequest        `json:"upstream_tls,omitempty"`
+	Cache            *storage.CacheConfig       `json:"cache,omitempty"`
+	Compression      *storage.CompressionConfig `json:"compression,omitempty"`
+	HeaderRules      *[]storage.HeaderRule      `json:"header_rules,omitempty"`
+	SecurityHeaders  *storage.SecurityHeaders   `json:"security_headers,omitempty"`
+	ErrorPages       *storage.ErrorPages        `json:"error_pages,omitempty"`
+	Canary           *storage.Canary            `json:"canary,omitempty"`
+	Mirror           *storage.Mirror            `json:"mirror,omitempty"`
+	Limits           *storage.Limits            `json:"limits,omitempty"`
+	Concurrency      *storage.ConcurrencyLimit  `json:"concurrency,omitempty"`
+	UpstreamPool     *storage.UpstreamPool      `json:"upstream_pool,omitempty"`
+	URLRules         *storage.URLRules          `json:"url_rules,omitempty"`
+	TCP              *storage.TCPProxy          `json:"tcp,omitempty"`
 }
 
 // CreateRuleRequest defines the structure for creating a new rule.
@@ -54,8 +83,76 @@ func HelloHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Hello from the Prism API, user %s!\n", userID)
 }
 
+// normalizeHostnames validates and normalizes the hostnames a project wants to claim.
+func normalizeHostnames(hostnames []string, policy *HostnamePolicy) ([]string, error) {
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, raw := range hostnames {
+		hostname := storage.NormalizeHostname(raw)
+		if hostname == "" || strings.ContainsAny(hostname, "/*@ ") || net.ParseIP(hostname) != nil {
+			return nil, fmt.Errorf("invalid hostname '%s'", raw)
+		}
+		if policy.Reserved(hostname) {
+			return nil, fmt.Errorf("hostname '%s' is reserved", raw)
+		}
+		if !seen[hostname] {
+			seen[hostname] = true
+			normalized = append(normalized, hostname)
+		}
+	}
+	return normalized, nil
+}
+
+// normalizePathPrefix validates a path prefix such as "/app" or "/team/app"
+// and strips any trailing slash.
+func normalizePathPrefix(pathPrefix string) (string, error) {
+	trimmed := strings.TrimSuffix(pathPrefix, "/")
+	if !strings.HasPrefix(trimmed, "/") || strings.Contains(trimmed, "//") {
+		return "", fmt.Errorf("invalid path prefix '%s'", pathPrefix)
+	}
+	return trimmed, nil
+}
+
+// tcpPortTaken reports whether a TCP project other than projectID listens on port.
+func tcpPortTaken(ctx context.Context, repo *storage.Repository, projectID string, port int) (bool, error) {
+	projects, err := repo.ListProjects(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, project := range projects {
+		if project.ID != projectID && project.IsTCP() && project.TCP.ListenPort == port {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// rebuildAttempts is how often rebuildRoutes tries to rebuild the routing table before giving up.
+const rebuildAttempts = 3
+
+// rebuildRoutes refreshes the routing table after a project change, retrying briefly if the
+// database is unavailable. The request context is detached so a client hanging up can't leave
+// the table stale. If every attempt fails it responds with an error and returns false; the
+// change is saved and is picked up by the router's next periodic rebuild.
+func rebuildRoutes(w http.ResponseWriter, r *http.Request, router *routing.Router) bool {
+	ctx := context.WithoutCancel(r.Context())
+	for attempt := 1; ; attempt++ {
+		err := router.Rebuild(ctx)
+		if err == nil {
+			return true
+		}
+		log.Printf("Error rebuilding routing table (attempt %d of %d): %v\n", attempt, rebuildAttempts, err)
+		if attempt == rebuildAttempts {
+			http.Error(w, "Service Unavailable: Change saved, but the routing table could not be rebuilt", http.StatusServiceUnavailable)
+			return false
+		}
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+	}
+}
+
 // CreateProjectHandler handles the creation of new projects.
-func CreateProjectHandler(repo *storage.Repository) http.HandlerFunc {
+// New hostnames are claimed unverified; see VerifyHostnameHandler.
+func CreateProjectHandler(repo *storage.Repository, router *routing.Router, policy *HostnamePolicy) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Ensure only POST requests are handled
 		if r.Method != http.MethodPost {
@@ -84,14 +181,37 @@ func CreateProjectHandler(repo *storage.Repository) http.HandlerFunc {
 			return
 		}
 
+		pathPrefix, err := normalizePathPrefix(req.PathPrefix)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := proxy.ValidateUpstreamURL(req.UpstreamURL); err != nil {
+			http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+			return
+		}
+		hostnames, err := normalizeHostnames(req.Hostnames, policy)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+			return
+		}
+
 		// Create project in database
-		project, err := repo.CreateProject(r.Context(), userID, req.Name, req.PathPrefix, req.UpstreamURL)
+		project, err := repo.CreateProject(r.Context(), userID, req.Name, pathPrefix, req.UpstreamURL, hostnames)
 		if err != nil {
+			if err == storage.ErrHostnameTaken {
+				http.Error(w, "Conflict: Hostname is already used by another project", http.StatusConflict)
+				return
+			}
 			log.Printf("Error creating project for user %s: %v\n", userID, err)
 			http.Error(w, "Failed to create project", http.StatusInternalServerError)
 			return
 		}
 
+		if !rebuildRoutes(w, r, router) {
+			return
+		}
+
 		// Respond with created project
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(project)
@@ -129,7 +249,9 @@ func ListProjectsHandler(repo *storage.Repository) http.HandlerFunc {
 }
 
 // UpdateProjectHandler handles updating an existing project.
-func UpdateProjectHandler(repo *storage.Repository) http.HandlerFunc {
+// New hostnames are claimed unverified; see VerifyHostnameHandler. box seals upstream
+// client keys and may be nil if none are configured.
+func UpdateProjectHandler(repo *storage.Repository, router *routing.Router, policy *HostnamePolicy, box *secrets.Box) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Ensure only PUT requests are handled
 		if r.Method != http.MethodPut {
@@ -160,18 +282,167 @@ func UpdateProjectHandler(repo *storage.Repository) http.HandlerFunc {
 			return
 		}
 
+		update := storage.ProjectUpdate{
+			Name:             req.Name,
+			UpstreamURL:      req.UpstreamURL,
+			UpstreamProtocol: req.UpstreamProtocol,
+			ResponseRewrite:  req.ResponseRewrite,
+			ACME:             req.ACME,
+			Cache:            req.Cache,
+			Compression:      req.Compression,
+			HeaderRules:      req.HeaderRules,
+			SecurityHeaders:  req.SecurityHeaders,
+			ErrorPages:       req.ErrorPages,
+			Canary:           req.Canary,
+			Mirror:           req.Mirror,
+			Limits:           req.Limits,
+			Concurrency:      req.Concurrency,
+			UpstreamPool:     req.UpstreamPool,
+			URLRules:         req.URLRules,
+			TCP:              req.TCP,
+		}
+		if req.UpstreamURL != nil {
+			if err := proxy.ValidateUpstreamURL(*req.UpstreamURL); err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.UpstreamProtocol != nil && !proxy.ValidUpstreamProtocol(*req.UpstreamProtocol) {
+			http.Error(w, "Bad Request: Upstream protocol must be '', 'http1' or 'h2c'", http.StatusBadRequest)
+			return
+		}
+		if req.Compression != nil {
+			if err := proxy.ValidateCompression(req.Compression); err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.HeaderRules != nil {
+			if err := proxy.ValidateHeaderRules(*req.HeaderRules); err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.SecurityHeaders != nil {
+			if err := proxy.ValidateSecurityHeaders(req.SecurityHeaders); err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.ErrorPages != nil {
+			if err := errorpage.Validate(req.ErrorPages); err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Canary != nil {
+			if err := proxy.ValidateCanary(req.Canary); err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Mirror != nil {
+			if err := proxy.ValidateMirror(req.Mirror); err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Limits != nil {
+			if err := firewall.ValidateLimits(req.Limits); err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Concurrency != nil {
+			if err := proxy.ValidateConcurrencyLimit(req.Concurrency); err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.UpstreamPool != nil {
+			if err := proxy.ValidateUpstreamPool(req.UpstreamPool); err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.URLRules != nil {
+			if err := proxy.ValidateURLRules(req.URLRules); err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.TCP != nil {
+			if err := l4.ValidateTCPProxy(req.TCP); err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+			if req.TCP.Enabled {
+				taken, err := tcpPortTaken(r.Context(), repo, projectID, req.TCP.ListenPort)
+				if err != nil {
+					log.Printf("Error checking TCP ports for project %s: %v\n", projectID, err)
+					http.Error(w, "Failed to update project", http.StatusInternalServerError)
+					return
+				}
+				if taken {
+					http.Error(w, "Conflict: Listen port is already used by another project", http.StatusConflict)
+					return
+				}
+			}
+		}
+		if req.ACME != nil && req.ACME.Challenge != "" && req.ACME.Challenge != "http-01" && req.ACME.Challenge != "tls-alpn-01" {
+			http.Error(w, "Bad Request: ACME challenge must be 'http-01' or 'tls-alpn-01'", http.StatusBadRequest)
+			return
+		}
+		if req.Cache != nil {
+			if err := httpcache.ValidateConfig(req.Cache); err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.PathPrefix != nil {
+			pathPrefix, err := normalizePathPrefix(*req.PathPrefix)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+			update.PathPrefix = &pathPrefix
+		}
+		if req.Hostnames != nil {
+			hostnames, err := normalizeHostnames(*req.Hostnames, policy)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+			update.Hostnames = &hostnames
+		}
+		if req.UpstreamTLS != nil {
+			update.UpstreamTLS, update.UpstreamTLSKey, err = upstreamTLSUpdate(req.UpstreamTLS, box)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: Invalid upstream TLS settings: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
 		// Update project in database
-		project, err := repo.UpdateProject(r.Context(), projectID, userID, req.Name, req.PathPrefix, req.UpstreamURL)
+		project, err := repo.UpdateProject(r.Context(), projectID, userID, update)
 		if err != nil {
 			if err == storage.ErrProjectNotFound {
 				http.Error(w, "Not Found: Project not found or not owned by user", http.StatusNotFound)
 				return
 			}
+			if err == storage.ErrHostnameTaken {
+				http.Error(w, "Conflict: Hostname is already used by another project", http.StatusConflict)
+				return
+			}
 			log.Printf("Error updating project %s for user %s: %v\n", projectID, userID, err)
 			http.Error(w, "Failed to update project", http.StatusInternalServerError)
 			return
 		}
 
+		if !rebuildRoutes(w, r, router) {
+			return
+		}
+
 		// Respond with updated project
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(project)
@@ -222,7 +493,7 @@ func GetProjectByIDHandler(repo *storage.Repository) http.HandlerFunc {
 }
 
 // DeleteProjectHandler handles deleting an existing project.
-func DeleteProjectHandler(repo *storage.Repository) http.HandlerFunc {
+func DeleteProjectHandler(repo *storage.Repository, router *routing.Router, proxyFactory *proxy.Factory) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Ensure only DELETE requests are handled
 		if r.Method != http.MethodDelete {
@@ -257,11 +528,41 @@ func DeleteProjectHandler(repo *storage.Repository) http.HandlerFunc {
 			return
 		}
 
+		proxyFactory.Invalidate(projectID)
+		if !rebuildRoutes(w, r, router) {
+			return
+		}
+
 		// Respond with No Content
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
+// validateRule checks a rule against the kind of project it is saved for: TCP projects only
+// take IP rules, which may use CIDRs there. If the rule is rejected, or the project can't be
+// read, it responds with an error and returns false.
+func validateRule(w http.ResponseWriter, r *http.Request, repo *storage.Repository, userID, projectID, ruleType, value string) bool {
+	project, err := repo.GetProjectByIDAndUserID(r.Context(), projectID, userID)
+	if err != nil {
+		if err == storage.ErrProjectNotFound {
+			http.Error(w, "Not Found: Project not found or not owned by user", http.StatusNotFound)
+			return false
+		}
+		log.Printf("Error getting project %s to validate a rule: %v\n", projectID, err)
+		http.Error(w, "Failed to save rule", http.StatusInternalServerError)
+		return false
+	}
+	validate := firewall.ValidateRule
+	if project.IsTCP() {
+		validate = firewall.ValidateTCPRule
+	}
+	if err := validate(ruleType, value); err != nil {
+		http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
 // CreateRuleHandler handles the creation of new rules for a project.
 func CreateRuleHandler(repo *storage.Repository, ruleCache cache.RuleCache) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -294,6 +595,9 @@ func CreateRuleHandler(repo *storage.Repository, ruleCache cache.RuleCache) http
 			http.Error(w, "Type and Value are required fields", http.StatusBadRequest)
 			return
 		}
+		if !validateRule(w, r, repo, userID, projectID, req.Type, req.Value) {
+			return
+		}
 
 		rule, err := repo.CreateRule(r.Context(), userID, projectID, req.Name, req.Type, req.Value, req.Enabled)
 		if err != nil {
@@ -424,6 +728,12 @@ func UpdateRuleHandler(repo *storage.Repository, ruleCache cache.RuleCache) http
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
+		// A partial update can only be validated when it carries both the type and the value.
+		if req.Type != nil && req.Value != nil {
+			if !validateRule(w, r, repo, userID, projectID, *req.Type, *req.Value) {
+				return
+			}
+		}
 
 		// Update rule in the database
 		updatedRule, err := repo.UpdateRule(r.Context(), userID, projectID, ruleID, req.Name, req.Type, req.Value, req.Enabled)
@@ -0,0 +1,224 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"prism/pkg/routing"
+	"prism/pkg/storage"
+)
+
+// challengeLabel prefixes a hostname to form the name of the TXT record that proves ownership of it.
+const challengeLabel = "_prism-challenge."
+
+// HostnamePolicy decides which hostnames projects may claim. The hostnames Prism itself is
+// served on, such as the API and console hosts, are reserved along with their subdomains, and
+// any other hostname is only routed once its owner has published the project's verification
+// token in DNS.
+type HostnamePolicy struct {
+	reserved  []string
+	lookupTXT func(ctx context.Context, name string) ([]string, error)
+}
+
+// NewHostnamePolicy creates a policy that reserves the given hostnames.
+func NewHostnamePolicy(reserved []string) *HostnamePolicy {
+	policy := &HostnamePolicy{lookupTXT: net.DefaultResolver.LookupTXT}
+	for _, hostname := range reserved {
+		if hostname = storage.NormalizeHostname(hostname); hostname != "" {
+			policy.reserved = append(policy.reserved, hostname)
+		}
+	}
+	return policy
+}
+
+// Reserved reports whether a normalized hostname is reserved for Prism itself.
+func (p *HostnamePolicy) Reserved(hostname string) bool {
+	for _, reserved := range p.reserved {
+		if hostname == reserved || strings.HasSuffix(hostname, "."+reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyOwnership checks that the TXT record for a claimed hostname holds the claim's token.
+func (p *HostnamePolicy) verifyOwnership(ctx context.Context, claim storage.HostnameClaim) error {
+	name := challengeLabel + claim.Hostname
+	records, err := p.lookupTXT(ctx, name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return fmt.Errorf("no TXT record found at %s", name)
+	} else if err != nil {
+		return fmt.Errorf("failed to look up %s: %w", name, err)
+	}
+	for _, record := range records {
+		if strings.TrimSpace(record) == claim.VerificationToken {
+			return nil
+		}
+	}
+	return fmt.Errorf("the TXT record at %s does not contain the verification token", name)
+}
+
+// HostnameClaimResponse describes a claimed hostname and the DNS record that verifies it.
+type HostnameClaimResponse struct {
+	storage.HostnameClaim
+	Verified  bool   `json:"verified"`
+	TXTRecord string `json:"txt_record"` // Name of the TXT record that must hold the verification token
+}
+
+func newHostnameClaimResponse(claim storage.HostnameClaim) HostnameClaimResponse {
+	return HostnameClaimResponse{HostnameClaim: claim, Verified: claim.VerifiedAt != nil, TXTRecord: challengeLabel + claim.Hostname}
+}
+
+// VerifyHostnameRequest names the claimed hostname to verify.
+type VerifyHostnameRequest struct {
+	Hostname string `json:"hostname"`
+}
+
+// ListHostnamesHandler lists the hostnames a project has claimed, with their verification
+// tokens, at /api/v1/projects/{projectID}/hostnames.
+func ListHostnamesHandler(repo *storage.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := GetUserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Internal Server Error: User ID not found in context", http.StatusInternalServerError)
+			return
+		}
+
+		// Extract project ID from URL, e.g., /api/v1/projects/{projectID}/hostnames
+		pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(pathParts) < 4 {
+			http.Error(w, "Bad Request: Invalid URL format", http.StatusBadRequest)
+			return
+		}
+		projectID := pathParts[3]
+
+		if _, err := repo.GetProjectByIDAndUserID(r.Context(), projectID, userID); err != nil {
+			if err == storage.ErrProjectNotFound {
+				http.Error(w, "Not Found: Project not found or not owned by user", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error getting project %s for user %s: %v\n", projectID, userID, err)
+			http.Error(w, "Failed to list hostnames", http.StatusInternalServerError)
+			return
+		}
+
+		claims, err := repo.GetHostnameClaims(r.Context(), projectID)
+		if err != nil {
+			log.Printf("Error listing hostnames for project %s: %v\n", projectID, err)
+			http.Error(w, "Failed to list hostnames", http.StatusInternalServerError)
+			return
+		}
+
+		resp := make([]HostnameClaimResponse, 0, len(claims))
+		for _, claim := range claims {
+			resp = append(resp, newHostnameClaimResponse(claim))
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// VerifyHostnameHandler verifies ownership of a claimed hostname at
+// /api/v1/projects/{projectID}/hostnames/verify. The hostname is routed to the project
+// once its _prism-challenge TXT record holds the claim's verification token.
+func VerifyHostnameHandler(repo *storage.Repository, router *routing.Router, policy *HostnamePolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := GetUserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Internal Server Error: User ID not found in context", http.StatusInternalServerError)
+			return
+		}
+
+		// Extract project ID from URL, e.g., /api/v1/projects/{projectID}/hostnames/verify
+		pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(pathParts) < 4 {
+			http.Error(w, "Bad Request: Invalid URL format", http.StatusBadRequest)
+			return
+		}
+		projectID := pathParts[3]
+
+		var req VerifyHostnameRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		hostname := storage.NormalizeHostname(req.Hostname)
+		if policy.Reserved(hostname) {
+			http.Error(w, fmt.Sprintf("Bad Request: hostname '%s' is reserved", req.Hostname), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := repo.GetProjectByIDAndUserID(r.Context(), projectID, userID); err != nil {
+			if err == storage.ErrProjectNotFound {
+				http.Error(w, "Not Found: Project not found or not owned by user", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error getting project %s for user %s: %v\n", projectID, userID, err)
+			http.Error(w, "Failed to verify hostname", http.StatusInternalServerError)
+			return
+		}
+
+		claims, err := repo.GetHostnameClaims(r.Context(), projectID)
+		if err != nil {
+			log.Printf("Error listing hostnames for project %s: %v\n", projectID, err)
+			http.Error(w, "Failed to verify hostname", http.StatusInternalServerError)
+			return
+		}
+		var claim *storage.HostnameClaim
+		for i := range claims {
+			if claims[i].Hostname == hostname {
+				claim = &claims[i]
+			}
+		}
+		if claim == nil {
+			http.Error(w, "Not Found: Hostname not claimed by project", http.StatusNotFound)
+			return
+		}
+
+		if claim.VerifiedAt == nil {
+			if err := policy.verifyOwnership(r.Context(), *claim); err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := repo.MarkHostnameVerified(r.Context(), projectID, hostname); err != nil {
+				if err == storage.ErrHostnameTaken {
+					http.Error(w, "Conflict: Hostname is already used by another project", http.StatusConflict)
+					return
+				}
+				if err == storage.ErrHostnameNotFound {
+					http.Error(w, "Not Found: Hostname not claimed by project", http.StatusNotFound)
+					return
+				}
+				log.Printf("Error verifying hostname %s for project %s: %v\n", hostname, projectID, err)
+				http.Error(w, "Failed to verify hostname", http.StatusInternalServerError)
+				return
+			}
+			if !rebuildRoutes(w, r, router) {
+				return
+			}
+			now := time.Now()
+			claim.VerifiedAt = &now
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(newHostnameClaimResponse(*claim))
+	}
+}
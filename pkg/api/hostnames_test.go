@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"prism/pkg/storage"
+)
+
+func TestNormalizeHostnames(t *testing.T) {
+	policy := NewHostnamePolicy([]string{"Prism.Example.com.", "console.example.net"})
+	tests := []struct {
+		name      string
+		hostnames []string
+		want      []string
+		wantErr   bool
+	}{
+		{name: "normalized and deduplicated", hostnames: []string{"App.Example.com:443", "app.example.com.", "api.example.com"}, want: []string{"app.example.com", "api.example.com"}},
+		{name: "none", hostnames: nil, want: []string{}},
+		{name: "reserved", hostnames: []string{"prism.example.com"}, wantErr: true},
+		{name: "reserved with port", hostnames: []string{"PRISM.example.com:8443"}, wantErr: true},
+		{name: "subdomain of reserved", hostnames: []string{"evil.console.example.net"}, wantErr: true},
+		{name: "lookalike of reserved", hostnames: []string{"notprism.example.com"}, want: []string{"notprism.example.com"}},
+		{name: "wildcard", hostnames: []string{"*.example.com"}, wantErr: true},
+		{name: "IP address", hostnames: []string{"10.0.0.1"}, wantErr: true},
+		{name: "empty", hostnames: []string{" "}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeHostnames(tt.hostnames, policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyOwnership(t *testing.T) {
+	claim := storage.HostnameClaim{Hostname: "app.example.com", VerificationToken: "abc123"}
+	tests := []struct {
+		name    string
+		records []string
+		err     error
+		wantErr bool
+	}{
+		{name: "token published", records: []string{"v=spf1 -all", "abc123"}},
+		{name: "token with whitespace", records: []string{" abc123 "}},
+		{name: "other token", records: []string{"abc1234"}, wantErr: true},
+		{name: "no record", err: &net.DNSError{Err: "no such host", IsNotFound: true}, wantErr: true},
+		{name: "lookup failure", err: errors.New("timeout"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := NewHostnamePolicy(nil)
+			policy.lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+				if name != "_prism-challenge.app.example.com" {
+					t.Errorf("looked up %s", name)
+				}
+				return tt.records, tt.err
+			}
+			if err := policy.verifyOwnership(context.Background(), claim); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
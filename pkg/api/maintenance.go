@@ -0,0 +1,89 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"prism/pkg/firewall"
+	"prism/pkg/routing"
+	"prism/pkg/storage"
+)
+
+// MaintenanceResponse reports a project's maintenance settings and whether they are in effect now.
+type MaintenanceResponse struct {
+	storage.Maintenance
+	Active bool `json:"active"`
+}
+
+// MaintenanceHandler handles reading (GET) and replacing (PUT) a project's maintenance settings
+// at /api/v1/projects/{projectID}/maintenance. Deploy workflows PUT {"enabled": true} before a
+// release and {"enabled": false} after it.
+func MaintenanceHandler(repo *storage.Repository, router *routing.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPut {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := GetUserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Internal Server Error: User ID not found in context", http.StatusInternalServerError)
+			return
+		}
+
+		// Extract project ID from URL, e.g., /api/v1/projects/{projectID}/maintenance
+		pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(pathParts) < 4 {
+			http.Error(w, "Bad Request: Invalid URL format", http.StatusBadRequest)
+			return
+		}
+		projectID := pathParts[3]
+
+		var project *storage.Project
+		var err error
+		if r.Method == http.MethodGet {
+			project, err = repo.GetProjectByIDAndUserID(r.Context(), projectID, userID)
+		} else {
+			var req storage.Maintenance
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			if err := firewall.ValidateMaintenance(&req); err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+				return
+			}
+			project, err = repo.UpdateProject(r.Context(), projectID, userID, storage.ProjectUpdate{Maintenance: &req})
+		}
+		if err != nil {
+			if err == storage.ErrProjectNotFound {
+				http.Error(w, "Not Found: Project not found or not owned by user", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error handling maintenance settings for project %s: %v\n", projectID, err)
+			http.Error(w, "Failed to handle maintenance settings", http.StatusInternalServerError)
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			if !rebuildRoutes(w, r, router) {
+				return
+			}
+			log.Printf("Maintenance for project %s set to enabled=%t\n", projectID, project.Maintenance.Enabled)
+		}
+
+		resp := MaintenanceResponse{}
+		if project.Maintenance != nil {
+			resp.Maintenance = *project.Maintenance
+		}
+		resp.Active = firewall.MaintenanceActive(project.Maintenance, time.Now())
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
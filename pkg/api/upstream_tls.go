@@ -0,0 +1,41 @@
+package api
+
+import (
+	"fmt"
+
+	"prism/pkg/proxy"
+	"prism/pkg/secrets"
+	"prism/pkg/storage"
+)
+
+// UpstreamTLSRequest defines the upstream TLS settings of a project update. The client key is
+// accepted in plain PEM but only ever stored encrypted.
+type UpstreamTLSRequest struct {
+	storage.UpstreamTLS
+	ClientKeyPEM string `json:"client_key,omitempty"`
+}
+
+// upstreamTLSUpdate validates upstream TLS settings and seals the client key. The settings
+// are checked by building the exact TLS configuration the proxy will use.
+func upstreamTLSUpdate(req *UpstreamTLSRequest, box *secrets.Box) (*storage.UpstreamTLS, []byte, error) {
+	settings := req.UpstreamTLS
+	if (settings.ClientCertPEM == "") != (req.ClientKeyPEM == "") {
+		return nil, nil, fmt.Errorf("client_certificate and client_key must be given together")
+	}
+
+	var encryptedKey []byte
+	if req.ClientKeyPEM != "" {
+		if box == nil {
+			return nil, nil, fmt.Errorf("client certificates require the server to be configured with PRISM_SECRET_KEY")
+		}
+		var err error
+		if encryptedKey, err = box.Seal([]byte(req.ClientKeyPEM)); err != nil {
+			return nil, nil, fmt.Errorf("failed to encrypt client key: %w", err)
+		}
+	}
+
+	if _, err := proxy.UpstreamTLSConfig(&settings, encryptedKey, box); err != nil {
+		return nil, nil, err
+	}
+	return &settings, encryptedKey, nil
+}
@@ -16,8 +16,9 @@ type RuleCache interface {
 
 // InMemoryCache is a thread-safe, in-memory implementation of the RuleCache interface.
 type InMemoryCache struct {
-	mu    sync.RWMutex
-	cache map[string][]storage.Rule
+	mu      sync.RWMutex
+	cache   map[string][]storage.Rule
+	onClear []func(projectID string)
 }
 
 // NewInMemoryCache creates and returns a new InMemoryCache instance.
@@ -47,48 +48,18 @@ func (c *InMemoryCache) Set(projectID string, rules []storage.Rule) {
 // This is used for cache invalidation.
 func (c *InMemoryCache) Clear(projectID string) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
 	delete(c.cache, projectID)
-}
-
-// ProjectCache defines the interface for a cache that stores projects.
-type ProjectCache interface {
-	Get(pathPrefix string) (*storage.Project, bool)
-	Set(pathPrefix string, project *storage.Project)
-	Clear(pathPrefix string)
-}
-
-// InMemoryProjectCache is a thread-safe, in-memory implementation of the ProjectCache interface.
-type InMemoryProjectCache struct {
-	mu    sync.RWMutex
-	cache map[string]*storage.Project
-}
-
-// NewInMemoryProjectCache creates and returns a new InMemoryProjectCache instance.
-func NewInMemoryProjectCache() *InMemoryProjectCache {
-	return &InMemoryProjectCache{
-		cache: make(map[string]*storage.Project),
+	onClear := c.onClear
+	c.mu.Unlock()
+	for _, fn := range onClear {
+		fn(projectID)
 	}
 }
 
-// Get retrieves a project for a given pathPrefix from the cache.
-func (c *InMemoryProjectCache) Get(pathPrefix string) (*storage.Project, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	project, found := c.cache[pathPrefix]
-	return project, found
-}
-
-// Set adds or updates the project for a given pathPrefix in the cache.
-func (c *InMemoryProjectCache) Set(pathPrefix string, project *storage.Project) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.cache[pathPrefix] = project
-}
-
-// Clear removes the project for a given pathPrefix from the cache.
-func (c *InMemoryProjectCache) Clear(pathPrefix string) {
+// OnClear registers fn to be called after a project's rules are cleared, i.e., after they
+// changed, so state derived from them (such as listener deny sets) can be rebuilt.
+func (c *InMemoryCache) OnClear(fn func(projectID string)) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	delete(c.cache, pathPrefix)
+	c.onClear = append(c.onClear, fn)
 }
@@ -0,0 +1,366 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"prism/pkg/logger"
+	"prism/pkg/secrets"
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+// ExpiryWarning is how long before expiry a certificate starts producing warnings.
+const ExpiryWarning = 30 * 24 * time.Hour
+
+// expiryReminder is how often the warning for a certificate is repeated while its remaining
+// lifetime stays between two expiryThresholds.
+const expiryReminder = 24 * time.Hour
+
+// expiryThresholds are the remaining lifetimes that trigger a new warning right away, rather
+// than at the next daily reminder. The last one is expiry itself.
+var expiryThresholds = []time.Duration{ExpiryWarning, 14 * 24 * time.Hour, 7 * 24 * time.Hour, 3 * 24 * time.Hour, 24 * time.Hour, 0}
+
+// entry is a loaded certificate together with where it came from.
+type entry struct {
+	cert      *tls.Certificate
+	projectID string // Empty for certificates loaded from disk
+	source    string // Database certificate ID or file path
+	kind      string // 'upload' or 'acme' for database certificates, 'file' for disk
+	hostnames []string
+	notAfter  time.Time
+}
+
+// snapshot is an immutable set of certificates indexed by hostname.
+type snapshot struct {
+	byHost  map[string]*entry
+	entries []*entry
+}
+
+// Store selects certificates by SNI hostname. Certificates come from the database, where
+// private keys are encrypted with a secrets.Box, and optionally from a directory on disk.
+// The set is swapped atomically on Reload, so handshakes never see a half-built store.
+type Store struct {
+	repo    *storage.Repository
+	box     *secrets.Box
+	dir     string
+	hub     *websockets.Hub
+	current atomic.Pointer[snapshot]
+	mu      sync.Mutex // Serializes reloads
+
+	warnMu sync.Mutex
+	warned map[warningKey]expiryWarning // Last warning per certificate
+}
+
+// warningKey identifies a certificate across reloads. A renewed certificate has a new expiry,
+// so its warnings start over.
+type warningKey struct {
+	source   string
+	notAfter int64
+}
+
+// expiryWarning records when a certificate was last warned about, and at which threshold.
+type expiryWarning struct {
+	at    time.Time
+	level int
+}
+
+// NewStore creates an empty certificate store. box may be nil if no certificates are kept in
+// the database, and dir may be empty if none are kept on disk. Call Reload to load them.
+func NewStore(repo *storage.Repository, box *secrets.Box, dir string, hub *websockets.Hub) *Store {
+	s := &Store{repo: repo, box: box, dir: dir, hub: hub, warned: make(map[warningKey]expiryWarning)}
+	s.current.Store(&snapshot{byHost: make(map[string]*entry)})
+	return s
+}
+
+// TLSConfig returns a server TLS configuration that picks certificates from the store.
+func (s *Store) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: s.GetCertificate,
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate. An exact hostname match wins over
+// a wildcard certificate for the parent domain.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if e, ok := s.current.Load().lookup(storage.NormalizeHostname(hello.ServerName)); ok {
+		return e.cert, nil
+	}
+	return nil, fmt.Errorf("no certificate for server name '%s'", hello.ServerName)
+}
+
+// lookup finds the entry for a hostname, falling back to a wildcard for its parent domain.
+func (snap *snapshot) lookup(hostname string) (*entry, bool) {
+	if e, ok := snap.byHost[hostname]; ok {
+		return e, true
+	}
+	if i := strings.IndexByte(hostname, '.'); i > 0 {
+		if e, ok := snap.byHost["*"+hostname[i:]]; ok {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Info describes the certificate currently served for a hostname.
+type Info struct {
+	Source   string    `json:"source"` // 'upload', 'acme' or 'file'
+	NotAfter time.Time `json:"not_after"`
+}
+
+// Lookup reports which certificate, if any, is served for a hostname.
+func (s *Store) Lookup(hostname string) (Info, bool) {
+	e, ok := s.current.Load().lookup(hostname)
+	if !ok {
+		return Info{}, false
+	}
+	return Info{Source: e.kind, NotAfter: e.notAfter}, true
+}
+
+// Reload loads all certificates and replaces the current set.
+func (s *Store) Reload(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := &snapshot{byHost: make(map[string]*entry)}
+
+	if s.dir != "" {
+		entries, err := loadDir(s.dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			snap.add(e, e.hostnames)
+		}
+	}
+
+	if s.box != nil {
+		if err := s.loadDatabase(ctx, snap); err != nil {
+			return err
+		}
+	}
+
+	s.current.Store(snap)
+	log.Printf("Loaded %d TLS certificates covering %d hostnames\n", len(snap.entries), len(snap.byHost))
+	return nil
+}
+
+// loadDatabase adds stored certificates to the snapshot. A certificate is only served for
+// hostnames its project actually owns, so a tenant can't take over another tenant's domain
+// by uploading a certificate for it.
+func (s *Store) loadDatabase(ctx context.Context, snap *snapshot) error {
+	projects, err := s.repo.ListProjects(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load projects for certificates: %w", err)
+	}
+	owned := make(map[string][]string)
+	for _, project := range projects {
+		owned[project.ID] = project.Hostnames
+	}
+
+	stored, err := s.repo.ListCertificates(ctx)
+	if err != nil {
+		return err
+	}
+	for _, c := range stored {
+		keyPEM, err := s.box.Open(c.EncryptedKey)
+		if err != nil {
+			log.Printf("Skipping certificate %s: %v\n", c.ID, err)
+			continue
+		}
+		cert, leaf, err := ParseKeyPair([]byte(c.CertPEM), keyPEM)
+		if err != nil {
+			log.Printf("Skipping certificate %s: %v\n", c.ID, err)
+			continue
+		}
+
+		e := &entry{cert: cert, projectID: c.ProjectID, source: c.ID, kind: c.Source, hostnames: c.Hostnames, notAfter: leaf.NotAfter}
+		snap.add(e, ServedHostnames(c.Hostnames, owned[c.ProjectID]))
+	}
+	return nil
+}
+
+// ServedHostnames returns the project hostnames a certificate is valid for. Certificates
+// are only ever served for these concrete names, never for a bare wildcard, so a wildcard
+// certificate can't be presented for another tenant's subdomain.
+func ServedHostnames(certNames, projectHostnames []string) []string {
+	var served []string
+	for _, hostname := range projectHostnames {
+		i := strings.IndexByte(hostname, '.')
+		for _, name := range certNames {
+			if name == hostname || (strings.HasPrefix(name, "*.") && i > 0 && hostname[i:] == name[1:]) {
+				served = append(served, hostname)
+				break
+			}
+		}
+	}
+	return served
+}
+
+// add registers e for the given hostnames. When two certificates cover the same hostname,
+// the one that expires last is served.
+func (snap *snapshot) add(e *entry, hostnames []string) {
+	snap.entries = append(snap.entries, e)
+	for _, hostname := range hostnames {
+		if existing, ok := snap.byHost[hostname]; ok && existing.notAfter.After(e.notAfter) {
+			continue
+		}
+		snap.byHost[hostname] = e
+	}
+}
+
+// Run reloads the store and checks certificate expiry every interval until ctx is cancelled.
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.CheckExpiry(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Reload(ctx); err != nil {
+				log.Printf("Error reloading TLS certificates: %v\n", err)
+			}
+		}
+	}
+}
+
+// CheckExpiry logs a warning for every certificate that has expired or is about to.
+// Warnings for database certificates are also sent to the owning project's log stream.
+// A certificate is warned about once a day, and again whenever its remaining lifetime
+// crosses one of the expiryThresholds, so frequent checks don't flood the log stream.
+func (s *Store) CheckExpiry(now time.Time) {
+	for _, e := range s.dueWarnings(now) {
+		remaining := e.notAfter.Sub(now)
+		if remaining <= 0 {
+			s.warn(e, "TLS certificate %s for %v EXPIRED on %s", e.source, e.hostnames, e.notAfter.Format(time.RFC3339))
+			continue
+		}
+		s.warn(e, "TLS certificate %s for %v expires in %d days (%s)", e.source, e.hostnames, int(remaining.Hours()/24), e.notAfter.Format(time.RFC3339))
+	}
+}
+
+// dueWarnings returns the certificates to warn about now and records the warnings.
+// Certificates that are no longer loaded are forgotten.
+func (s *Store) dueWarnings(now time.Time) []*entry {
+	s.warnMu.Lock()
+	defer s.warnMu.Unlock()
+
+	var due []*entry
+	warned := make(map[warningKey]expiryWarning)
+	for _, e := range s.current.Load().entries {
+		level := expiryLevel(e.notAfter.Sub(now))
+		if level == 0 {
+			continue
+		}
+		key := warningKey{source: e.source, notAfter: e.notAfter.Unix()}
+		last, ok := s.warned[key]
+		if ok && level <= last.level && now.Sub(last.at) < expiryReminder {
+			warned[key] = last
+			continue
+		}
+		warned[key] = expiryWarning{at: now, level: level}
+		due = append(due, e)
+	}
+	s.warned = warned
+	return due
+}
+
+// expiryLevel returns how many expiryThresholds a remaining lifetime has crossed.
+func expiryLevel(remaining time.Duration) int {
+	level := 0
+	for _, threshold := range expiryThresholds {
+		if remaining <= threshold {
+			level++
+		}
+	}
+	return level
+}
+
+func (s *Store) warn(e *entry, format string, v ...interface{}) {
+	if e.projectID != "" && s.hub != nil {
+		logger.LogAndBroadcast(s.hub, e.projectID, format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// ParseKeyPair parses a PEM certificate chain and private key and checks that they belong
+// together. The chain is not verified against system roots, so certificates issued by a
+// private or self-signed CA load just like publicly trusted ones.
+func ParseKeyPair(certPEM, keyPEM []byte) (*tls.Certificate, *x509.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid certificate or key: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid leaf certificate: %w", err)
+	}
+	cert.Leaf = leaf
+	return &cert, leaf, nil
+}
+
+// Hostnames returns the normalized DNS names a certificate is valid for, falling back
+// to the common name for certificates without SANs.
+func Hostnames(leaf *x509.Certificate) []string {
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	hostnames := make([]string, 0, len(names))
+	for _, name := range names {
+		hostnames = append(hostnames, storage.NormalizeHostname(name))
+	}
+	return hostnames
+}
+
+// loadDir loads certificate/key pairs from a directory. Each "name.crt" (or "name.pem")
+// file must have a matching "name.key" file next to it.
+func loadDir(dir string) ([]*entry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate directory: %w", err)
+	}
+
+	var entries []*entry
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if file.IsDir() || (ext != ".crt" && ext != ".pem") {
+			continue
+		}
+		certPath := filepath.Join(dir, file.Name())
+		keyPath := strings.TrimSuffix(certPath, ext) + ".key"
+
+		certPEM, err := os.ReadFile(certPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", certPath, err)
+		}
+		keyPEM, err := os.ReadFile(keyPath)
+		if os.IsNotExist(err) {
+			continue // A CA bundle or chain file without a key
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", keyPath, err)
+		}
+
+		cert, leaf, err := ParseKeyPair(certPEM, keyPEM)
+		if err != nil {
+			log.Printf("Skipping certificate %s: %v\n", certPath, err)
+			continue
+		}
+		entries = append(entries, &entry{cert: cert, source: certPath, kind: "file", hostnames: Hostnames(leaf), notAfter: leaf.NotAfter})
+	}
+	return entries, nil
+}
@@ -0,0 +1,58 @@
+package certs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckExpiryWarnsOncePerThreshold(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewStore(nil, nil, "", nil)
+	s.current.Store(&snapshot{entries: []*entry{
+		{source: "soon", hostnames: []string{"app.example.com"}, notAfter: start.Add(20 * 24 * time.Hour)},
+		{source: "later", hostnames: []string{"www.example.com"}, notAfter: start.Add(90 * 24 * time.Hour)},
+	}})
+
+	steps := []struct {
+		name  string
+		after time.Duration
+		want  []string
+	}{
+		{name: "first check", after: 0, want: []string{"soon"}},
+		{name: "an hour later", after: time.Hour, want: nil},
+		{name: "a day later", after: 24 * time.Hour, want: []string{"soon"}},
+		{name: "same day again", after: 30 * time.Hour, want: nil},
+		{name: "crossed 14 days", after: 6*24*time.Hour + time.Minute, want: []string{"soon"}},
+		{name: "shortly after crossing", after: 6*24*time.Hour + time.Hour, want: nil},
+		{name: "expired", after: 20*24*time.Hour + time.Second, want: []string{"soon"}},
+		{name: "expired, same day", after: 20*24*time.Hour + time.Hour, want: nil},
+		{name: "expired, next day", after: 21*24*time.Hour + time.Hour, want: []string{"soon"}},
+	}
+	for _, step := range steps {
+		var got []string
+		for _, e := range s.dueWarnings(start.Add(step.after)) {
+			got = append(got, e.source)
+		}
+		if len(got) != len(step.want) || (len(got) > 0 && got[0] != step.want[0]) {
+			t.Errorf("%s: warned about %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestCheckExpiryRenewedCertificate(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewStore(nil, nil, "", nil)
+	s.current.Store(&snapshot{entries: []*entry{{source: "/etc/prism/app.crt", notAfter: now.Add(10 * 24 * time.Hour)}}})
+	if due := s.dueWarnings(now); len(due) != 1 {
+		t.Fatalf("expected a warning for the expiring certificate, got %d", len(due))
+	}
+
+	// The file is replaced with a renewed certificate that still expires within the warning window
+	s.current.Store(&snapshot{entries: []*entry{{source: "/etc/prism/app.crt", notAfter: now.Add(25 * 24 * time.Hour)}}})
+	if due := s.dueWarnings(now.Add(time.Hour)); len(due) != 1 {
+		t.Fatalf("expected a fresh warning for the renewed certificate, got %d", len(due))
+	}
+	if len(s.warned) != 1 {
+		t.Errorf("expected warnings for replaced certificates to be forgotten, have %d", len(s.warned))
+	}
+}
@@ -0,0 +1,297 @@
+// Package conntrack keeps a table of the client connections Prism is serving, over HTTP and raw
+// TCP, so operators can see who is connected, enforce idle timeouts and close connections.
+package conntrack
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Entry is a snapshot of one tracked connection.
+type Entry struct {
+	ID           string    `json:"id"`
+	Protocol     string    `json:"protocol"` // 'http' or 'tcp'
+	ClientAddr   string    `json:"client_addr"`
+	ProjectID    string    `json:"project_id,omitempty"` // Empty until a request is routed; see Table.List for HTTP
+	Upstream     string    `json:"upstream,omitempty"`
+	State        string    `json:"state"` // HTTP: 'new', 'active', 'idle' or 'hijacked'; TCP: 'connecting' or 'established'
+	BytesIn      int64     `json:"bytes_in"`
+	BytesOut     int64     `json:"bytes_out"`
+	StartedAt    time.Time `json:"started_at"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// Conn is a tracked connection. Bytes read and written through it are counted, and closing it
+// removes it from its table.
+type Conn struct {
+	net.Conn
+	table    *Table
+	id       string
+	protocol string
+	started  time.Time
+
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	lastActivity atomic.Int64 // Unix nanoseconds
+
+	mu        sync.Mutex
+	projectID string
+	upstream  string
+	projects  map[string]string // Every project the connection has served, with its latest upstream
+	state     string
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.bytesIn.Add(int64(n))
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.bytesOut.Add(int64(n))
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Close closes the connection and removes it from the table.
+func (c *Conn) Close() error {
+	c.table.remove(c)
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the connection when the underlying one supports it, as TCP does.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// SetProject records the project and upstream the connection is being served for. An HTTP
+// keep-alive connection may carry requests for several projects; it stays listed under each.
+func (c *Conn) SetProject(projectID, upstream string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.projectID, c.upstream = projectID, upstream
+	if c.projects == nil {
+		c.projects = make(map[string]string)
+	}
+	c.projects[projectID] = upstream
+}
+
+// SetState records the connection's state.
+func (c *Conn) SetState(state string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+}
+
+// Entry returns a snapshot of the connection, with the project of its latest request.
+func (c *Conn) Entry() Entry {
+	entry, _ := c.entry("")
+	return entry
+}
+
+// entry returns a snapshot of the connection as seen by one of the projects it has served,
+// or with its latest project when projectID is empty. It reports false if the connection
+// never served projectID.
+func (c *Conn) entry(projectID string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	upstream, served := c.projects[projectID]
+	if projectID == "" {
+		projectID, upstream, served = c.projectID, c.upstream, true
+	}
+	if !served {
+		return Entry{}, false
+	}
+	return Entry{
+		ID:           c.id,
+		Protocol:     c.protocol,
+		ClientAddr:   c.Conn.RemoteAddr().String(),
+		ProjectID:    projectID,
+		Upstream:     upstream,
+		State:        c.state,
+		BytesIn:      c.bytesIn.Load(),
+		BytesOut:     c.bytesOut.Load(),
+		StartedAt:    c.started,
+		LastActivity: time.Unix(0, c.lastActivity.Load()),
+	}, true
+}
+
+// Table tracks open client connections. For HTTP, serve from Listener and set the server's
+// ConnState and ConnContext hooks; the firewall then tags each connection with its project.
+type Table struct {
+	idleTimeout time.Duration
+	nextID      atomic.Uint64
+
+	mu    sync.Mutex
+	conns map[string]*Conn
+}
+
+// NewTable creates a connection table. Connections without traffic for idleTimeout are closed
+// by Run, except HTTP connections with a request in flight; zero disables the timeout.
+func NewTable(idleTimeout time.Duration) *Table {
+	return &Table{idleTimeout: idleTimeout, conns: make(map[string]*Conn)}
+}
+
+// Track adds a connection to the table. Use the returned Conn in place of c.
+func (t *Table) Track(c net.Conn, protocol, state string) *Conn {
+	now := time.Now()
+	conn := &Conn{
+		Conn:     c,
+		table:    t,
+		id:       strconv.FormatUint(t.nextID.Add(1), 10),
+		protocol: protocol,
+		started:  now,
+		state:    state,
+	}
+	conn.lastActivity.Store(now.UnixNano())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[conn.id] = conn
+	return conn
+}
+
+func (t *Table) remove(c *Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c.id)
+}
+
+// List returns the connections of a project, or every connection when projectID is empty,
+// oldest first. An HTTP connection is listed under every project it has carried requests for,
+// each seeing its own upstream; the full list shows the project of its latest request.
+func (t *Table) List(projectID string) []Entry {
+	t.mu.Lock()
+	conns := make([]*Conn, 0, len(t.conns))
+	for _, c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+
+	entries := []Entry{}
+	for _, c := range conns {
+		if entry, ok := c.entry(projectID); ok {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].StartedAt.Before(entries[j].StartedAt) })
+	return entries
+}
+
+// Kill closes a connection of a project, i.e., one listed under it. It reports false if the
+// project has no such connection.
+func (t *Table) Kill(projectID, id string) bool {
+	t.mu.Lock()
+	c, ok := t.conns[id]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if _, served := c.entry(projectID); !served {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+// Run closes idle connections every interval until ctx is cancelled.
+func (t *Table) Run(ctx context.Context, interval time.Duration) {
+	if t.idleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.closeIdle(time.Now())
+		}
+	}
+}
+
+// closeIdle closes every connection without traffic for the idle timeout. HTTP connections
+// with a request in flight are left to the project's request timeout.
+func (t *Table) closeIdle(now time.Time) {
+	t.mu.Lock()
+	var idle []*Conn
+	for _, c := range t.conns {
+		if now.Sub(time.Unix(0, c.lastActivity.Load())) >= t.idleTimeout {
+			idle = append(idle, c)
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range idle {
+		if entry := c.Entry(); entry.Protocol != "http" || entry.State != http.StateActive.String() {
+			c.Close()
+		}
+	}
+}
+
+// Listener wraps an HTTP listener so every accepted connection is tracked. Wrap the plain TCP
+// listener, beneath any TLS.
+func (t *Table) Listener(ln net.Listener) net.Listener {
+	return &listener{Listener: ln, table: t}
+}
+
+type listener struct {
+	net.Listener
+	table *Table
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.table.Track(c, "http", http.StateNew.String()), nil
+}
+
+// ConnState is an http.Server ConnState hook that records each connection's state.
+func (t *Table) ConnState(c net.Conn, state http.ConnState) {
+	if conn := unwrap(c); conn != nil && state != http.StateClosed {
+		conn.SetState(state.String())
+	}
+}
+
+type connKey struct{}
+
+// ConnContext is an http.Server ConnContext hook that makes the tracked connection available
+// to the requests it carries, through FromContext.
+func (t *Table) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if conn := unwrap(c); conn != nil {
+		return context.WithValue(ctx, connKey{}, conn)
+	}
+	return ctx
+}
+
+// FromContext returns the tracked connection carrying a request, or nil if it isn't tracked.
+func FromContext(ctx context.Context) *Conn {
+	conn, _ := ctx.Value(connKey{}).(*Conn)
+	return conn
+}
+
+// unwrap finds the tracked connection beneath an HTTP server's connection.
+func unwrap(c net.Conn) *Conn {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+	conn, _ := c.(*Conn)
+	return conn
+}
@@ -0,0 +1,176 @@
+package conntrack
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// pipe returns a tracked connection and its peer.
+func pipe(t *testing.T, table *Table, protocol, state string) (*Conn, net.Conn) {
+	t.Helper()
+	c, peer := net.Pipe()
+	t.Cleanup(func() { c.Close(); peer.Close() })
+	return table.Track(c, protocol, state), peer
+}
+
+func TestCloseIdle(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		protocol   string
+		state      string
+		idleFor    time.Duration
+		wantClosed bool
+	}{
+		{name: "idle keep-alive", protocol: "http", state: http.StateIdle.String(), idleFor: 2 * time.Minute, wantClosed: true},
+		{name: "new without a request", protocol: "http", state: http.StateNew.String(), idleFor: 2 * time.Minute, wantClosed: true},
+		{name: "hijacked WebSocket", protocol: "http", state: http.StateHijacked.String(), idleFor: 2 * time.Minute, wantClosed: true},
+		{name: "request in flight", protocol: "http", state: http.StateActive.String(), idleFor: time.Hour},
+		{name: "recent keep-alive", protocol: "http", state: http.StateIdle.String(), idleFor: 30 * time.Second},
+		{name: "exactly the timeout", protocol: "tcp", state: "established", idleFor: time.Minute, wantClosed: true},
+		{name: "idle TCP", protocol: "tcp", state: "established", idleFor: 2 * time.Minute, wantClosed: true},
+		{name: "TCP still connecting", protocol: "tcp", state: "connecting", idleFor: 2 * time.Minute, wantClosed: true},
+		{name: "busy TCP", protocol: "tcp", state: "established", idleFor: time.Second},
+	}
+
+	table := NewTable(time.Minute)
+	conns := make([]*Conn, len(tests))
+	for i, tt := range tests {
+		conns[i], _ = pipe(t, table, tt.protocol, tt.state)
+		conns[i].lastActivity.Store(now.Add(-tt.idleFor).UnixNano())
+	}
+	table.closeIdle(now)
+
+	open := map[string]bool{}
+	for _, entry := range table.List("") {
+		open[entry.ID] = true
+	}
+	for i, tt := range tests {
+		if closed := !open[conns[i].id]; closed != tt.wantClosed {
+			t.Errorf("%s: closed = %v, want %v", tt.name, closed, tt.wantClosed)
+		}
+		if tt.wantClosed {
+			if _, err := conns[i].Conn.Write([]byte("x")); err == nil {
+				t.Errorf("%s: removed from the table but still open", tt.name)
+			}
+		}
+	}
+}
+
+func TestRunWithoutIdleTimeout(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		NewTable(0).Run(context.Background(), time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run must return at once when the idle timeout is disabled")
+	}
+}
+
+func TestListAndKillAcrossProjects(t *testing.T) {
+	table := NewTable(0)
+	shared, _ := pipe(t, table, "http", http.StateIdle.String())
+	shared.SetProject("p1", "http://a:8080")
+	shared.SetProject("p2", "http://b:8080") // The same keep-alive connection, another hostname
+	own, _ := pipe(t, table, "tcp", "established")
+	own.SetProject("p1", "db:5432")
+	unrouted, _ := pipe(t, table, "http", http.StateNew.String())
+
+	tests := []struct {
+		projectID string
+		want      map[string]string // Connection ID to the upstream the project sees
+	}{
+		{projectID: "p1", want: map[string]string{shared.id: "http://a:8080", own.id: "db:5432"}},
+		{projectID: "p2", want: map[string]string{shared.id: "http://b:8080"}},
+		{projectID: "p3", want: map[string]string{}},
+		{projectID: "", want: map[string]string{shared.id: "http://b:8080", own.id: "db:5432", unrouted.id: ""}},
+	}
+	for _, tt := range tests {
+		entries := table.List(tt.projectID)
+		if len(entries) != len(tt.want) {
+			t.Errorf("List(%q) returned %d connections, want %d", tt.projectID, len(entries), len(tt.want))
+		}
+		for i, entry := range entries {
+			upstream, ok := tt.want[entry.ID]
+			if !ok || entry.Upstream != upstream {
+				t.Errorf("List(%q): unexpected entry %+v", tt.projectID, entry)
+			}
+			if tt.projectID != "" && entry.ProjectID != tt.projectID {
+				t.Errorf("List(%q): entry shows project %q", tt.projectID, entry.ProjectID)
+			}
+			if i > 0 && entry.StartedAt.Before(entries[i-1].StartedAt) {
+				t.Errorf("List(%q) is not oldest first", tt.projectID)
+			}
+		}
+	}
+
+	if table.Kill("p2", own.id) {
+		t.Error("a project must not close a connection it never served")
+	}
+	if table.Kill("p1", "999") {
+		t.Error("Kill reported closing an unknown connection")
+	}
+	if !table.Kill("p1", shared.id) {
+		t.Error("expected p1 to close the keep-alive connection it shares with p2")
+	}
+	if len(table.List("p2")) != 0 {
+		t.Error("a closed connection is still listed")
+	}
+	if table.Kill("p1", shared.id) {
+		t.Error("Kill reported closing a connection twice")
+	}
+}
+
+func TestCountsBytes(t *testing.T) {
+	table := NewTable(0)
+	conn, peer := pipe(t, table, "tcp", "established")
+	go func() {
+		peer.Write([]byte("hello"))
+		buf := make([]byte, 3)
+		peer.Read(buf)
+	}()
+
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	if entry := conn.Entry(); entry.BytesIn != 5 || entry.BytesOut != 3 {
+		t.Errorf("counted %d bytes in and %d out, want 5 and 3", entry.BytesIn, entry.BytesOut)
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+	table := NewTable(0)
+	conn, _ := pipe(t, table, "http", http.StateNew.String())
+
+	for name, c := range map[string]net.Conn{
+		"plain": conn,
+		"TLS":   tls.Server(conn, &tls.Config{}),
+	} {
+		table.ConnState(c, http.StateActive)
+		if got := FromContext(table.ConnContext(context.Background(), c)); got != conn {
+			t.Errorf("%s: ConnContext did not expose the tracked connection", name)
+		}
+		if state := conn.Entry().State; state != http.StateActive.String() {
+			t.Errorf("%s: state = %q, want active", name, state)
+		}
+		conn.SetState(http.StateNew.String())
+	}
+
+	untracked, peer := net.Pipe()
+	defer untracked.Close()
+	defer peer.Close()
+	if FromContext(table.ConnContext(context.Background(), untracked)) != nil {
+		t.Error("expected no tracked connection for an untracked one")
+	}
+}
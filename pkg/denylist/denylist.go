@@ -0,0 +1,301 @@
+// Package denylist drops connections from denied IP addresses as they are accepted, before a
+// single byte of the request is read. Deny sets are fed from several named sources, such as a
+// project's ip_block rules, reputation lists and temporary bans.
+package denylist
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"prism/pkg/logger"
+	"prism/pkg/websockets"
+)
+
+// dropLogInterval is how often a listener reports the connections it dropped.
+const dropLogInterval = 10 * time.Second
+
+// Set is a set of denied addresses and prefixes, gathered from named sources. Lookups don't
+// lock and cost one map lookup per distinct prefix length in the set.
+type Set struct {
+	mu      sync.Mutex
+	sources map[string][]netip.Prefix
+	bans    map[netip.Addr]time.Time
+
+	prefixes atomic.Pointer[prefixIndex]
+	banned   atomic.Pointer[map[netip.Addr]time.Time]
+}
+
+// prefixIndex is an immutable snapshot of every source's prefixes, by prefix length.
+type prefixIndex struct {
+	bits     []int
+	byLength map[int]map[netip.Prefix]string // Masked prefix to its source
+}
+
+// New creates an empty deny set.
+func New() *Set {
+	s := &Set{sources: make(map[string][]netip.Prefix), bans: make(map[netip.Addr]time.Time)}
+	s.prefixes.Store(&prefixIndex{byLength: map[int]map[netip.Prefix]string{}})
+	s.banned.Store(&map[netip.Addr]time.Time{})
+	return s
+}
+
+// Replace sets the entries of one source, e.g., "rules" or "reputation:spamhaus", replacing
+// whatever it held before. Values are IP addresses or CIDRs; values that are neither are
+// skipped and reported in the returned error, while the others still take effect.
+func (s *Set) Replace(source string, values []string) error {
+	var prefixes []netip.Prefix
+	var invalid []string
+	for _, value := range values {
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			invalid = append(invalid, value)
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	s.mu.Lock()
+	if len(prefixes) == 0 {
+		delete(s.sources, source)
+	} else {
+		s.sources[source] = prefixes
+	}
+	s.rebuild()
+	s.mu.Unlock()
+
+	if len(invalid) > 0 {
+		return fmt.Errorf("skipped %d invalid entries in %s, e.g., '%s'", len(invalid), source, invalid[0])
+	}
+	return nil
+}
+
+// rebuild publishes a new prefix index from the sources. s.mu must be held.
+func (s *Set) rebuild() {
+	index := &prefixIndex{byLength: make(map[int]map[netip.Prefix]string)}
+	for source, prefixes := range s.sources {
+		for _, prefix := range prefixes {
+			bits := prefix.Bits()
+			if index.byLength[bits] == nil {
+				index.byLength[bits] = make(map[netip.Prefix]string)
+				index.bits = append(index.bits, bits)
+			}
+			index.byLength[bits][prefix] = source
+		}
+	}
+	slices.Sort(index.bits)
+	s.prefixes.Store(index)
+}
+
+// Ban denies a single address for d, e.g., after it tripped a rate limit. Banning it again
+// replaces the expiry.
+func (s *Set) Ban(addr netip.Addr, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	bans := make(map[netip.Addr]time.Time, len(s.bans)+1)
+	for banned, until := range s.bans {
+		if now.Before(until) {
+			bans[banned] = until
+		}
+	}
+	bans[addr.Unmap()] = now.Add(d)
+	s.bans = bans
+	s.banned.Store(&bans)
+}
+
+// Contains reports whether addr is denied, and by which source ("ban" for bans).
+func (s *Set) Contains(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	if until, ok := (*s.banned.Load())[addr]; ok && time.Now().Before(until) {
+		return "ban", true
+	}
+	index := s.prefixes.Load()
+	for _, bits := range index.bits {
+		if bits > addr.BitLen() {
+			break
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if source, ok := index.byLength[bits][prefix]; ok {
+			return source, true
+		}
+	}
+	return "", false
+}
+
+// LoadFile replaces a source with the reputation list in path: one IP address or CIDR per
+// line, with '#' starting a comment. It returns the number of entries loaded; invalid lines
+// are skipped and reported in the error.
+func (s *Set) LoadFile(source, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	values, err := readList(f)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	err = s.Replace(source, values)
+	return len(s.sourceEntries(source)), err
+}
+
+func (s *Set) sourceEntries(source string) []netip.Prefix {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sources[source]
+}
+
+// RefreshFile loads a reputation list into a source every interval until ctx is cancelled, so
+// lists updated on disk by a cron job take effect. A list that can't be read keeps its last
+// good entries.
+func (s *Set) RefreshFile(ctx context.Context, source, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := s.LoadFile(source, path); err != nil {
+			log.Printf("Error loading deny list %s from %s (%d entries loaded): %v\n", source, path, n, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readList reads the entries of a list, without comments and blank lines.
+func readList(r io.Reader) ([]string, error) {
+	var values []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			values = append(values, line)
+		}
+	}
+	return values, scanner.Err()
+}
+
+// parsePrefix parses "192.0.2.7" or "192.0.2.0/24" as a masked prefix.
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Listener drops connections from addresses in its global or local deny set as they are
+// accepted. Wrap the plain TCP listener, beneath TLS and connection tracking, so denied
+// clients cost neither a handshake nor a table entry.
+type Listener struct {
+	net.Listener
+	name   string
+	global *Set // Shared by every listener; may be nil
+	local  *Set // This listener's own; may be nil
+	hub    *websockets.Hub
+
+	dropped atomic.Uint64
+	logged  atomic.Uint64 // dropped when last reported
+	lastLog atomic.Int64  // Unix nanoseconds
+}
+
+// Wrap returns ln dropping connections denied by global or local, either of which may be nil.
+// name identifies the listener in logs, e.g., "https" or "tcp:5432". The HTTP listeners serve
+// every project, so they only take the global set, which firewall.DenyRules and the firewall's
+// bans feed:
+//
+//	ln = conns.Listener(denylist.Wrap(ln, "https", global, nil, hub))
+//	server.ServeTLS(ln, "", "")
+//
+// Behind a load balancer, wrap the PROXY protocol listener instead of the plain one, so the
+// client's address is checked; see proxyproto.Config.Wrap.
+func Wrap(ln net.Listener, name string, global, local *Set, hub *websockets.Hub) *Listener {
+	return &Listener{Listener: ln, name: name, global: global, local: local, hub: hub}
+}
+
+// Accept returns the next connection from an address that isn't denied.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if _, denied := l.Denied(remoteAddr(conn)); !denied {
+			return conn, nil
+		}
+		conn.Close()
+		l.dropped.Add(1)
+		l.reportDrops()
+	}
+}
+
+// Denied reports whether addr is in the listener's global or local deny set, and by which source.
+func (l *Listener) Denied(addr netip.Addr) (string, bool) {
+	if !addr.IsValid() {
+		return "", false
+	}
+	if l.global != nil {
+		if source, ok := l.global.Contains(addr); ok {
+			return source, true
+		}
+	}
+	if l.local != nil {
+		return l.local.Contains(addr)
+	}
+	return "", false
+}
+
+// Dropped returns how many connections the listener has dropped.
+func (l *Listener) Dropped() uint64 {
+	return l.dropped.Load()
+}
+
+// reportDrops logs the connections dropped since the last report, at most once per
+// dropLogInterval, so a flood doesn't turn into a flood of log lines.
+func (l *Listener) reportDrops() {
+	now := time.Now().UnixNano()
+	last := l.lastLog.Load()
+	if now-last < int64(dropLogInterval) || !l.lastLog.CompareAndSwap(last, now) {
+		return
+	}
+	dropped := l.dropped.Load()
+	logger.LogAndBroadcast(l.hub, "", "Listener %s dropped %d connections from denied addresses (%d in total)", l.name, dropped-l.logged.Swap(dropped), dropped)
+}
+
+// remoteAddr returns the IP address of a connection's peer, or the zero Addr if it has none.
+func remoteAddr(conn net.Conn) netip.Addr {
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return tcpAddr.AddrPort().Addr().Unmap()
+	}
+	addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
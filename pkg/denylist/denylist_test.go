@@ -0,0 +1,162 @@
+package denylist
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"prism/pkg/websockets"
+)
+
+func TestContains(t *testing.T) {
+	s := New()
+	if err := s.Replace("rules", []string{"203.0.113.7", "198.51.100.0/24", "2001:db8::/32", "::ffff:192.0.2.0/120"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Replace("reputation:test", []string{"10.0.0.0/8", "10.1.0.0/16"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr       string
+		wantSource string
+		wantOK     bool
+	}{
+		{addr: "203.0.113.7", wantSource: "rules", wantOK: true},
+		{addr: "203.0.113.8"},
+		{addr: "198.51.100.200", wantSource: "rules", wantOK: true},
+		{addr: "198.51.101.1"},
+		{addr: "10.200.0.1", wantSource: "reputation:test", wantOK: true},
+		{addr: "10.1.2.3", wantSource: "reputation:test", wantOK: true},
+		{addr: "2001:db8:1::1", wantSource: "rules", wantOK: true},
+		{addr: "2001:db9::1"},
+		{addr: "::ffff:203.0.113.7", wantSource: "rules", wantOK: true}, // 4-in-6 client, IPv4 entry
+		{addr: "192.0.2.9", wantSource: "rules", wantOK: true},          // IPv4 client, 4-in-6 entry
+		{addr: "::ffff:192.0.2.9", wantSource: "rules", wantOK: true},
+		{addr: "192.0.3.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			source, ok := s.Contains(netip.MustParseAddr(tt.addr))
+			if source != tt.wantSource || ok != tt.wantOK {
+				t.Errorf("Contains(%s) = %q, %v; want %q, %v", tt.addr, source, ok, tt.wantSource, tt.wantOK)
+			}
+		})
+	}
+
+	s.Replace("reputation:test", nil)
+	if _, ok := s.Contains(netip.MustParseAddr("10.200.0.1")); ok {
+		t.Error("an emptied source still denies its addresses")
+	}
+	if _, ok := s.Contains(netip.MustParseAddr("203.0.113.7")); !ok {
+		t.Error("replacing one source dropped another")
+	}
+}
+
+func TestReplaceSkipsInvalidEntries(t *testing.T) {
+	s := New()
+	err := s.Replace("rules", []string{"203.0.113.7", "not an address", "10.0.0.0/40"})
+	if err == nil || !strings.Contains(err.Error(), "skipped 2") {
+		t.Errorf("err = %v, want 2 entries reported", err)
+	}
+	if _, ok := s.Contains(netip.MustParseAddr("203.0.113.7")); !ok {
+		t.Error("a valid entry was dropped with the invalid ones")
+	}
+}
+
+func TestBan(t *testing.T) {
+	s := New()
+	addr := netip.MustParseAddr("203.0.113.7")
+	s.Ban(addr, 50*time.Millisecond)
+	if source, ok := s.Contains(addr); !ok || source != "ban" {
+		t.Fatalf("banned address: %q, %v", source, ok)
+	}
+	if _, ok := s.Contains(netip.MustParseAddr("::ffff:203.0.113.7")); !ok {
+		t.Error("the ban missed the 4-in-6 form of the address")
+	}
+	if _, ok := s.Contains(netip.MustParseAddr("203.0.113.8")); ok {
+		t.Error("a ban covered another address")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := s.Contains(addr); ok {
+		t.Error("an expired ban still denies the address")
+	}
+
+	s.Ban(addr, time.Hour)
+	s.Ban(netip.MustParseAddr("198.51.100.1"), time.Hour)
+	if _, ok := s.Contains(addr); !ok {
+		t.Error("a second ban lifted the first")
+	}
+}
+
+func TestReadList(t *testing.T) {
+	list := `# Reputation list
+203.0.113.7
+  198.51.100.0/24   # trailing comment
+
+	2001:db8::/32
+#198.51.101.1
+`
+	got, err := readList(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"203.0.113.7", "198.51.100.0/24", "2001:db8::/32"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readList = %q, want %q", got, want)
+	}
+}
+
+func TestListenerDropsDenied(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := websockets.NewHub()
+	go hub.Run()
+	local := New()
+	wrapped := Wrap(ln, "test", nil, local, hub)
+	defer wrapped.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := wrapped.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	local.Replace("rules", []string{"127.0.0.1"})
+	denied, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer denied.Close()
+	denied.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := denied.Read(make([]byte, 1)); err == nil {
+		t.Fatal("a denied connection was not closed")
+	}
+	if wrapped.Dropped() != 1 {
+		t.Errorf("Dropped() = %d, want 1", wrapped.Dropped())
+	}
+
+	local.Replace("rules", nil)
+	allowed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowed.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("an allowed connection was never accepted")
+	}
+}
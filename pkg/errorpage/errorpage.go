@@ -0,0 +1,235 @@
+// Package errorpage renders the responses Prism itself sends when it blocks or cannot serve a
+// request: a project's own HTML page, an RFC 9457 problem+json document, or plain text.
+package errorpage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"prism/pkg/storage"
+)
+
+// Kind names the situation an error page is shown for.
+type Kind string
+
+const (
+	Block        Kind = "block"         // A firewall rule rejected the request
+	RateLimit    Kind = "rate_limit"    // The client sent too many requests
+	Maintenance  Kind = "maintenance"   // The project is in a maintenance window
+	UpstreamDown Kind = "upstream_down" // The upstream could not be reached
+	Overloaded   Kind = "overloaded"    // The project has too many requests in flight
+	Error        Kind = "error"         // Any other error Prism answers itself
+)
+
+// Kinds lists the kinds a project can define pages for.
+var Kinds = []Kind{Block, RateLimit, Maintenance, UpstreamDown, Overloaded, Error}
+
+// maxTemplateSize bounds the HTML template a project may store for one kind.
+const maxTemplateSize = 64 << 10
+
+// Data is what HTML templates can refer to, e.g., {{.RequestID}}.
+type Data struct {
+	Status           int
+	Title            string
+	Detail           string
+	RequestID        string
+	SupportReference string
+	Project          string
+}
+
+// problem is an RFC 9457 problem details document with Prism's extension members.
+type problem struct {
+	Type             string `json:"type"`
+	Title            string `json:"title"`
+	Status           int    `json:"status"`
+	Detail           string `json:"detail,omitempty"`
+	Instance         string `json:"instance,omitempty"`
+	RequestID        string `json:"request_id,omitempty"`
+	SupportReference string `json:"support_reference,omitempty"`
+}
+
+var defaultTitles = map[Kind]string{
+	Block:        "Request blocked",
+	RateLimit:    "Too many requests",
+	Maintenance:  "Down for maintenance",
+	UpstreamDown: "Service unavailable",
+	Overloaded:   "Service busy",
+}
+
+var defaultTemplate = template.Must(template.New("default").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>{{.Status}} {{.Title}}</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto; color: #333">
+<h1>{{.Title}}</h1>
+{{if .Detail}}<p>{{.Detail}}</p>{{end}}
+{{if .SupportReference}}<p>If this keeps happening, contact {{.SupportReference}}{{if .RequestID}} and quote request ID <code>{{.RequestID}}</code>{{end}}.</p>
+{{else if .RequestID}}<p>Request ID: <code>{{.RequestID}}</code></p>{{end}}
+</body>
+</html>
+`))
+
+// templates caches parsed project templates by their source.
+var templates sync.Map
+
+// Write sends the error response for kind. message is the plain-text body used when the project
+// has no error pages or the client asks for neither HTML nor JSON. project may be nil when no
+// project matched the request.
+func Write(w http.ResponseWriter, r *http.Request, project *storage.Project, kind Kind, status int, message string) {
+	var cfg *storage.ErrorPages
+	if project != nil && project.ErrorPages != nil && project.ErrorPages.Enabled {
+		cfg = project.ErrorPages
+	}
+	if cfg == nil {
+		http.Error(w, message, status)
+		return
+	}
+
+	page := cfg.Pages[string(kind)]
+	data := Data{
+		Status:           status,
+		Title:            page.Title,
+		Detail:           page.Detail,
+		RequestID:        r.Header.Get("X-Request-ID"),
+		SupportReference: cfg.SupportReference,
+		Project:          project.Name,
+	}
+	if data.Title == "" {
+		data.Title = defaultTitles[kind]
+	}
+	if data.Title == "" {
+		data.Title = http.StatusText(status)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	switch negotiate(r.Header.Get("Accept")) {
+	case "html":
+		writeHTML(w, page.HTML, data)
+	case "json":
+		writeProblem(w, r, page.Type, data)
+	default:
+		body := message
+		if data.RequestID != "" {
+			body += "\nRequest ID: " + data.RequestID
+		}
+		if data.SupportReference != "" {
+			body += "\nSupport: " + data.SupportReference
+		}
+		http.Error(w, body, status)
+	}
+}
+
+func writeHTML(w http.ResponseWriter, source string, data Data) {
+	tmpl := defaultTemplate
+	if source != "" {
+		parsed, err := parseTemplate(source)
+		if err != nil {
+			// Validated when saved, so this only happens for templates stored before validation
+			log.Printf("Invalid error page template: %v\n", err)
+		} else {
+			tmpl = parsed
+		}
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		log.Printf("Error rendering error page: %v\n", err)
+		body.Reset()
+		defaultTemplate.Execute(&body, data)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(data.Status)
+	w.Write(body.Bytes())
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, problemType string, data Data) {
+	if problemType == "" {
+		problemType = "about:blank"
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(data.Status)
+	json.NewEncoder(w).Encode(problem{
+		Type:             problemType,
+		Title:            data.Title,
+		Status:           data.Status,
+		Detail:           data.Detail,
+		Instance:         r.URL.Path,
+		RequestID:        data.RequestID,
+		SupportReference: data.SupportReference,
+	})
+}
+
+func parseTemplate(source string) (*template.Template, error) {
+	if cached, ok := templates.Load(source); ok {
+		return cached.(*template.Template), nil
+	}
+	tmpl, err := template.New("page").Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	templates.Store(source, tmpl)
+	return tmpl, nil
+}
+
+// negotiate picks "html" or "json" from an Accept header, or "" for plain text. A format must be
+// named explicitly: wildcards alone (as sent by curl) keep the plain-text response, and HTML wins a tie.
+func negotiate(accept string) string {
+	htmlQ := acceptQuality(accept, "text/html")
+	jsonQ := max(acceptQuality(accept, "application/problem+json"), acceptQuality(accept, "application/json"))
+	switch {
+	case htmlQ > 0 && htmlQ >= jsonQ:
+		return "html"
+	case jsonQ > 0:
+		return "json"
+	}
+	return ""
+}
+
+// acceptQuality returns the q-value an Accept header gives exactly mediaType, or 0 if it is not listed.
+func acceptQuality(accept, mediaType string) float64 {
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), mediaType) {
+			continue
+		}
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = parsed
+				}
+			}
+		}
+		return quality
+	}
+	return 0
+}
+
+// Validate checks a project's error pages before they are saved.
+func Validate(cfg *storage.ErrorPages) error {
+	for name, page := range cfg.Pages {
+		if !slices.Contains(Kinds, Kind(name)) {
+			return fmt.Errorf("unknown error page '%s'; expected one of block, rate_limit, maintenance, upstream_down, overloaded or error", name)
+		}
+		if len(page.HTML) > maxTemplateSize {
+			return fmt.Errorf("HTML for error page '%s' is larger than %d bytes", name, maxTemplateSize)
+		}
+		if page.HTML != "" {
+			tmpl, err := template.New("page").Parse(page.HTML)
+			if err != nil {
+				return fmt.Errorf("invalid HTML template for error page '%s': %w", name, err)
+			}
+			if err := tmpl.Execute(&bytes.Buffer{}, Data{}); err != nil {
+				return fmt.Errorf("HTML template for error page '%s' fails to render: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
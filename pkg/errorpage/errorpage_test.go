@@ -0,0 +1,155 @@
+package errorpage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"prism/pkg/storage"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "", want: ""},
+		{accept: "*/*", want: ""},
+		{accept: "text/*", want: ""},
+		{accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", want: "html"},
+		{accept: "application/json", want: "json"},
+		{accept: "application/problem+json", want: "json"},
+		{accept: "Application/JSON", want: "json"},
+		{accept: "text/html;q=0.5, application/json", want: "json"},
+		{accept: "text/html, application/json", want: "html"},
+		{accept: "application/json;q=0.9, text/html;q=0.9", want: "html"},
+		{accept: "text/html;q=0", want: ""},
+		{accept: "text/plain", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			if got := negotiate(tt.accept); got != tt.want {
+				t.Errorf("negotiate(%q) = %q, want %q", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
+
+func newRequest(accept string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	r.Header.Set("X-Request-ID", "req-1")
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	return r
+}
+
+func TestWrite(t *testing.T) {
+	project := &storage.Project{Name: "shop", ErrorPages: &storage.ErrorPages{
+		Enabled:          true,
+		SupportReference: "support@example.com",
+		Pages: map[string]storage.ErrorPage{
+			"block": {Title: "Nope", Detail: "Not <here>", Type: "https://example.com/problems/blocked", HTML: `<p>{{.Title}}|{{.Detail}}|{{.RequestID}}|{{.Project}}|{{.Status}}</p>`},
+		},
+	}}
+
+	t.Run("HTML template", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		Write(w, newRequest("text/html"), project, Block, http.StatusForbidden, "Forbidden")
+		if w.Code != http.StatusForbidden || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+			t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		if want := "<p>Nope|Not &lt;here&gt;|req-1|shop|403</p>"; w.Body.String() != want {
+			t.Errorf("body = %q, want %q", w.Body.String(), want)
+		}
+		if w.Header().Get("Cache-Control") != "no-store" {
+			t.Error("error page may be cached")
+		}
+	})
+
+	t.Run("default HTML page", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		Write(w, newRequest("text/html"), project, Maintenance, http.StatusServiceUnavailable, "Service Unavailable")
+		body := w.Body.String()
+		for _, want := range []string{"Down for maintenance", "support@example.com", "req-1"} {
+			if !strings.Contains(body, want) {
+				t.Errorf("default page is missing %q:\n%s", want, body)
+			}
+		}
+	})
+
+	t.Run("problem JSON", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		Write(w, newRequest("application/json"), project, Block, http.StatusForbidden, "Forbidden")
+		if got := w.Header().Get("Content-Type"); got != "application/problem+json" {
+			t.Fatalf("Content-Type = %q", got)
+		}
+		var doc problem
+		if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+			t.Fatal(err)
+		}
+		want := problem{Type: "https://example.com/problems/blocked", Title: "Nope", Status: 403, Detail: "Not <here>", Instance: "/admin", RequestID: "req-1", SupportReference: "support@example.com"}
+		if doc != want {
+			t.Errorf("got %+v, want %+v", doc, want)
+		}
+	})
+
+	t.Run("problem JSON defaults", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		Write(w, newRequest("application/problem+json"), project, Error, http.StatusNotFound, "Not Found")
+		var doc problem
+		json.Unmarshal(w.Body.Bytes(), &doc)
+		if doc.Type != "about:blank" || doc.Title != "Not Found" || doc.Status != 404 {
+			t.Errorf("got %+v", doc)
+		}
+	})
+
+	t.Run("plain text", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		Write(w, newRequest("*/*"), project, Block, http.StatusForbidden, "Forbidden: blocked by firewall")
+		if want := "Forbidden: blocked by firewall\nRequest ID: req-1\nSupport: support@example.com\n"; w.Body.String() != want {
+			t.Errorf("body = %q, want %q", w.Body.String(), want)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		disabled := &storage.Project{ErrorPages: &storage.ErrorPages{Pages: project.ErrorPages.Pages}}
+		Write(w, newRequest("text/html"), disabled, Block, http.StatusForbidden, "Forbidden")
+		if w.Body.String() != "Forbidden\n" {
+			t.Errorf("body = %q, want the plain message", w.Body.String())
+		}
+	})
+
+	t.Run("no project", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		Write(w, newRequest("application/json"), nil, Error, http.StatusNotFound, "Not Found")
+		if w.Code != http.StatusNotFound || w.Body.String() != "Not Found\n" {
+			t.Errorf("status %d, body %q", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		pages   map[string]storage.ErrorPage
+		wantErr bool
+	}{
+		{name: "every kind", pages: map[string]storage.ErrorPage{"block": {}, "rate_limit": {}, "maintenance": {}, "upstream_down": {}, "error": {}}},
+		{name: "template", pages: map[string]storage.ErrorPage{"block": {HTML: `<h1>{{.Title}}</h1>{{if .RequestID}}{{.RequestID}}{{end}}`}}},
+		{name: "unknown kind", pages: map[string]storage.ErrorPage{"teapot": {}}, wantErr: true},
+		{name: "unparsable template", pages: map[string]storage.ErrorPage{"block": {HTML: `{{.Title`}}, wantErr: true},
+		{name: "unknown field", pages: map[string]storage.ErrorPage{"block": {HTML: `{{.Password}}`}}, wantErr: true},
+		{name: "too large", pages: map[string]storage.ErrorPage{"block": {HTML: strings.Repeat("x", maxTemplateSize+1)}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(&storage.ErrorPages{Pages: tt.pages}); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
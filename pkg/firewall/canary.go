@@ -0,0 +1,66 @@
+package firewall
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"prism/pkg/logger"
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+// armStats are running totals for one arm of a project's canary release.
+type armStats struct {
+	requests atomic.Int64
+	errors   atomic.Int64 // 5xx responses
+	latency  atomic.Int64 // Total, in nanoseconds
+}
+
+// canaryStats holds *armStats by project ID and arm.
+var canaryStats sync.Map
+
+// recordArm adds a finished request to its arm's totals and logs both, so the two arms of a
+// release can be compared in the project's log stream.
+func recordArm(hub *websockets.Hub, project *storage.Project, arm string, r *http.Request, status int, elapsed time.Duration) {
+	value, _ := canaryStats.LoadOrStore(project.ID+"\x00"+arm, &armStats{})
+	stats := value.(*armStats)
+	requests := stats.requests.Add(1)
+	errors := stats.errors.Load()
+	if status >= 500 {
+		errors = stats.errors.Add(1)
+	}
+	average := time.Duration(stats.latency.Add(int64(elapsed)) / requests)
+	logger.LogAndBroadcast(hub, project.ID, "Canary %s arm: %s %s -> %d in %s (%d requests, %d errors, %s average)",
+		arm, r.Method, r.URL.Path, status, elapsed.Round(time.Millisecond), requests, errors, average.Round(time.Millisecond))
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 && status >= 200 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+func (sr *statusRecorder) Flush() {
+	http.NewResponseController(sr.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
@@ -0,0 +1,60 @@
+package firewall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+func TestStatusRecorder(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w http.ResponseWriter)
+		want  int
+	}{
+		{name: "explicit", write: func(w http.ResponseWriter) { w.WriteHeader(http.StatusBadGateway) }, want: http.StatusBadGateway},
+		{name: "implicit", write: func(w http.ResponseWriter) { w.Write([]byte("ok")) }, want: http.StatusOK},
+		{name: "after early hints", write: func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusEarlyHints)
+			w.WriteHeader(http.StatusNotFound)
+		}, want: http.StatusNotFound},
+		{name: "second WriteHeader ignored", write: func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusCreated)
+			w.WriteHeader(http.StatusInternalServerError)
+		}, want: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+			tt.write(recorder)
+			if recorder.status != tt.want {
+				t.Errorf("status = %d, want %d", recorder.status, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordArm(t *testing.T) {
+	hub := websockets.NewHub()
+	go hub.Run()
+	project := &storage.Project{ID: "canary-stats-test"}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	recordArm(hub, project, "canary", r, http.StatusOK, 10*time.Millisecond)
+	recordArm(hub, project, "canary", r, http.StatusServiceUnavailable, 30*time.Millisecond)
+	recordArm(hub, project, "stable", r, http.StatusOK, time.Millisecond)
+
+	value, _ := canaryStats.Load(project.ID + "\x00canary")
+	stats := value.(*armStats)
+	if stats.requests.Load() != 2 || stats.errors.Load() != 1 || time.Duration(stats.latency.Load()) != 40*time.Millisecond {
+		t.Errorf("canary arm: %d requests, %d errors, %s total", stats.requests.Load(), stats.errors.Load(), time.Duration(stats.latency.Load()))
+	}
+	value, _ = canaryStats.Load(project.ID + "\x00stable")
+	if stats := value.(*armStats); stats.requests.Load() != 1 || stats.errors.Load() != 0 {
+		t.Errorf("stable arm: %d requests, %d errors", stats.requests.Load(), stats.errors.Load())
+	}
+}
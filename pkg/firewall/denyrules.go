@@ -0,0 +1,111 @@
+package firewall
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	"prism/pkg/cache"
+	"prism/pkg/denylist"
+	"prism/pkg/logger"
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+// DenyRules keeps the "rules" source of the deny set shared by the HTTP listeners in step with
+// the projects' ip_block rules. Those listeners serve every HTTP project and can't tell which
+// one a connection is for, so only the addresses that every HTTP project blocks are dropped at
+// accept; Middleware still applies each project's own rules.
+type DenyRules struct {
+	repo      *storage.Repository
+	ruleCache cache.RuleCache
+	set       *denylist.Set
+	hub       *websockets.Hub
+
+	mu       sync.Mutex
+	projects []storage.Project // HTTP projects as of the last rebuild
+}
+
+// NewDenyRules feeds set from the HTTP projects' rules. Register it with the router and the
+// rule cache so the set follows project and rule changes:
+//
+//	router.OnRebuild(rules.Sync)
+//	ruleCache.OnClear(rules.RulesChanged)
+func NewDenyRules(repo *storage.Repository, ruleCache cache.RuleCache, set *denylist.Set, hub *websockets.Hub) *DenyRules {
+	return &DenyRules{repo: repo, ruleCache: ruleCache, set: set, hub: hub}
+}
+
+// Sync reloads the set from the rules of projects, the full list after a routing table rebuild.
+func (d *DenyRules) Sync(projects []storage.Project) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.projects = d.projects[:0]
+	for _, project := range projects {
+		if !project.IsTCP() { // TCP projects have listeners, and deny sets, of their own
+			d.projects = append(d.projects, project)
+		}
+	}
+	d.reload()
+}
+
+// RulesChanged reloads the set after a project's rules changed. It is meant for the rule
+// cache's OnClear hook.
+func (d *DenyRules) RulesChanged(projectID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reload()
+}
+
+// reload replaces the set's rules source. If any project's rules can't be read, the set is left
+// unchanged until the next change or rebuild. d.mu must be held.
+func (d *DenyRules) reload() {
+	rules := make([][]storage.Rule, 0, len(d.projects))
+	for i := range d.projects {
+		project := &d.projects[i]
+		projectRules, found := d.ruleCache.Get(project.ID)
+		if !found {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			var err error
+			projectRules, err = d.repo.GetRulesByProjectID(ctx, project.UserID, project.ID)
+			cancel()
+			if err != nil {
+				logger.LogAndBroadcast(d.hub, project.ID, "Error getting rules for project '%s'; the listeners' deny set is unchanged: %v", project.Name, err)
+				return
+			}
+			d.ruleCache.Set(project.ID, projectRules)
+		}
+		rules = append(rules, projectRules)
+	}
+	d.set.Replace("rules", commonBlocks(rules))
+}
+
+// commonBlocks returns the addresses blocked by the enabled ip_block rules of every rule list.
+// HTTP ip_block rules match the client address exactly, so only values in the canonical form
+// of an address are taken.
+func commonBlocks(rules [][]storage.Rule) []string {
+	if len(rules) == 0 {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, projectRules := range rules {
+		seen := make(map[string]bool)
+		for _, rule := range projectRules {
+			if !rule.Enabled || rule.Type != "ip_block" || seen[rule.Value] {
+				continue
+			}
+			if addr, err := netip.ParseAddr(rule.Value); err != nil || addr.String() != rule.Value {
+				continue
+			}
+			seen[rule.Value] = true
+			counts[rule.Value]++
+		}
+	}
+	var blocked []string
+	for value, n := range counts {
+		if n == len(rules) {
+			blocked = append(blocked, value)
+		}
+	}
+	return blocked
+}
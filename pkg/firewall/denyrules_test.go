@@ -0,0 +1,66 @@
+package firewall
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"prism/pkg/cache"
+	"prism/pkg/denylist"
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+func TestCommonBlocks(t *testing.T) {
+	block := func(value string) storage.Rule { return storage.Rule{Type: "ip_block", Value: value, Enabled: true} }
+	tests := []struct {
+		name  string
+		rules [][]storage.Rule
+		want  []string
+	}{
+		{name: "no projects"},
+		{name: "one project", rules: [][]storage.Rule{{block("203.0.113.7"), block("198.51.100.1")}}, want: []string{"198.51.100.1", "203.0.113.7"}},
+		{name: "blocked by every project", rules: [][]storage.Rule{{block("203.0.113.7"), block("198.51.100.1")}, {block("203.0.113.7")}}, want: []string{"203.0.113.7"}},
+		{name: "a project without rules", rules: [][]storage.Rule{{block("203.0.113.7")}, nil}},
+		{name: "duplicates count once", rules: [][]storage.Rule{{block("203.0.113.7"), block("203.0.113.7")}, {block("198.51.100.1")}}},
+		{name: "disabled rules", rules: [][]storage.Rule{{{Type: "ip_block", Value: "203.0.113.7"}}}},
+		{name: "other rule types", rules: [][]storage.Rule{{{Type: "keyword_block", Value: "203.0.113.7", Enabled: true}}}},
+		{name: "values HTTP never matches", rules: [][]storage.Rule{{block("203.0.113.0/24"), block("2001:DB8::1"), block("bad")}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := commonBlocks(tt.rules)
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("commonBlocks = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDenyRules(t *testing.T) {
+	hub := websockets.NewHub()
+	go hub.Run()
+	ruleCache := cache.NewInMemoryCache()
+	ruleCache.Set("web", []storage.Rule{{Type: "ip_block", Value: "203.0.113.7", Enabled: true}})
+	ruleCache.Set("api", []storage.Rule{{Type: "ip_block", Value: "203.0.113.7", Enabled: true}})
+	ruleCache.Set("db", nil)
+	set := denylist.New()
+	rules := NewDenyRules(nil, ruleCache, set, hub)
+	addr := netip.MustParseAddr("203.0.113.7")
+
+	rules.Sync([]storage.Project{
+		{ID: "web"},
+		{ID: "api"},
+		{ID: "db", TCP: &storage.TCPProxy{Enabled: true}}, // Has a listener of its own
+	})
+	if _, ok := set.Contains(addr); !ok {
+		t.Fatal("an address every HTTP project blocks was not denied")
+	}
+
+	ruleCache.Set("api", nil)
+	rules.RulesChanged("api")
+	if _, ok := set.Contains(addr); ok {
+		t.Error("an address one project no longer blocks is still denied")
+	}
+}
@@ -1,53 +1,90 @@
 package firewall
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"prism/pkg/cache"
+	"prism/pkg/conntrack"
+	"prism/pkg/denylist"
+	"prism/pkg/errorpage"
+	"prism/pkg/httpcache"
 	"prism/pkg/logger"
 	"prism/pkg/proxy"
+	"prism/pkg/routing"
 	"prism/pkg/storage"
 	"prism/pkg/websockets"
+	"strconv"
 	"strings"
+	"time"
 )
 
-// Middleware uses a storage.Repository and a cache to check requests and dynamically proxy them.
-func Middleware(repo *storage.Repository, projectCache cache.ProjectCache, ruleCache cache.RuleCache, proxyFactory *proxy.Factory, hub *websockets.Hub) func(next http.Handler) http.Handler {
+// Middleware uses a routing table to resolve projects, a storage.Repository and a cache to check
+// requests against the project's rules, and dynamically proxies them.
+// responseCache may be nil to disable response caching for every project. Clients flooding a
+// rate_limit rule are banned in bans, the deny set shared by the listeners, which may be nil.
+func Middleware(router *routing.Router, repo *storage.Repository, ruleCache cache.RuleCache, responseCache *httpcache.Cache, proxyFactory *proxy.Factory, bans *denylist.Set, hub *websockets.Hub) func(next http.Handler) http.Handler {
+	limiter := newRateLimiter()
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
 			clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+			// Assign the request ID up front so header rules and logs for both directions agree
+			proxy.EnsureRequestID(r)
 
-			// 1. Extract path prefix for project lookup
-			pathSegments := strings.Split(r.URL.Path, "/")
-			var pathPrefix string
-			if len(pathSegments) > 1 && pathSegments[1] != "" {
-				pathPrefix = "/" + pathSegments[1]
-			} else {
-				http.Error(w, "Not Found: Project path prefix missing", http.StatusNotFound)
+			// 1. Resolve the project from the routing table: hostname first, then the longest path prefix
+			project, pathPrefix, upstreamPath, found := router.Match(requestHostname(r), r.URL.Path)
+			if !found {
+				logger.LogAndBroadcast(hub, "", "No project found for host '%s' and path '%s'", r.Host, r.URL.Path)
+				deny(w, r, nil, errorpage.Error, http.StatusNotFound, "Not Found: No project matches this host or path")
 				return
 			}
 
-			// 2. Get Project from cache or database
-			project, found := projectCache.Get(pathPrefix)
-			if !found {
-				logger.LogAndBroadcast(hub, "", "PROJECT CACHE MISS for path prefix: %s", pathPrefix)
-				var err error
-				project, err = repo.GetProjectByPathPrefix(ctx, pathPrefix)
-				if err != nil {
-					logger.LogAndBroadcast(hub, "", "Error getting project for path prefix '%s': %v", pathPrefix, err)
-					http.Error(w, fmt.Sprintf("Not Found: Project '%s' not found or error: %v", pathPrefix, err), http.StatusNotFound)
+			logger.LogAndBroadcast(hub, project.ID, "Found project '%s' with upstream: %s", project.Name, project.UpstreamURL)
+			conn := conntrack.FromContext(ctx)
+			if conn != nil {
+				conn.SetProject(project.ID, project.UpstreamURL)
+			}
+
+			// Enforce the project's request limits before doing any other work for the request
+			if limits := project.Limits; limits != nil {
+				if status, message := checkRequestLimits(limits, r); status != 0 {
+					logger.LogAndBroadcast(hub, project.ID, "Rejected request from %s for project '%s' with %d: %s", clientIP, project.Name, status, message)
+					deny(w, r, project, errorpage.Error, status, message)
 					return
 				}
-				projectCache.Set(pathPrefix, project) // Store in cache for next time
-			} else {
-				logger.LogAndBroadcast(hub, "", "PROJECT CACHE HIT for path prefix: %s", pathPrefix)
+				if limits.MaxBodyBytes > 0 && r.Body != nil && r.Body != http.NoBody {
+					// Bodies of unknown length are cut off while streaming; the proxy answers 413
+					r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBodyBytes)
+				}
+				if limits.RequestTimeout > 0 && !proxy.IsWebSocketUpgrade(r) {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, time.Duration(limits.RequestTimeout)*time.Second)
+					defer cancel()
+					r = r.WithContext(ctx)
+				}
 			}
 
-			logger.LogAndBroadcast(hub, project.ID, "Found project '%s' with upstream: %s", project.Name, project.UpstreamURL)
+			// Projects in maintenance only let allowlisted clients through
+			if m := project.Maintenance; MaintenanceActive(m, time.Now()) {
+				if !maintenanceBypass(m, r, clientIP) {
+					logger.LogAndBroadcast(hub, project.ID, "Project '%s' is in maintenance; rejected request from %s", project.Name, clientIP)
+					message := m.Message
+					if message == "" {
+						message = "Service Unavailable: Down for maintenance"
+					}
+					w.Header().Set("Retry-After", maintenanceRetryAfter(m, time.Now()))
+					deny(w, r, project, errorpage.Maintenance, http.StatusServiceUnavailable, message)
+					return
+				}
+				if m.BypassHeader != "" {
+					r.Header.Del(m.BypassHeader) // The token is for Prism, not the upstream
+				}
+			}
 
-			// 3. Get Rules for the Project (from cache or database)
+			// 2. Get Rules for the Project (from cache or database)
 			rules, found := ruleCache.Get(project.ID)
 			if !found {
 				logger.LogAndBroadcast(hub, project.ID, "CACHE MISS for project %s. Fetching rules from DB.", project.ID)
@@ -55,7 +92,7 @@ func Middleware(repo *storage.Repository, projectCache cache.ProjectCache, ruleC
 				dbRules, err := repo.GetRulesByProjectID(ctx, project.UserID, project.ID)
 				if err != nil {
 					logger.LogAndBroadcast(hub, project.ID, "Error getting rules for project '%s': %v", project.Name, err)
-					http.Error(w, fmt.Sprintf("Internal Server Error: Failed to get rules for project '%s'", project.Name), http.StatusInternalServerError)
+					deny(w, r, project, errorpage.Error, http.StatusInternalServerError, fmt.Sprintf("Internal Server Error: Failed to get rules for project '%s'", project.Name))
 					return
 				}
 				rules = dbRules
@@ -64,7 +101,8 @@ func Middleware(repo *storage.Repository, projectCache cache.ProjectCache, ruleC
 				logger.LogAndBroadcast(hub, project.ID, "CACHE HIT for project %s.", project.ID)
 			}
 
-			// 4. Apply Firewall Rules
+			// 3. Apply Firewall Rules
+			// gRPC rules see the method path as the upstream will, without the project's prefix
 			for _, rule := range rules {
 				if !rule.Enabled {
 					continue
@@ -73,35 +111,201 @@ func Middleware(repo *storage.Repository, projectCache cache.ProjectCache, ruleC
 				case "ip_block":
 					if clientIP == rule.Value {
 						logger.LogAndBroadcast(hub, project.ID, "Blocked request from IP: %s for project '%s'", clientIP, project.Name)
-						http.Error(w, "Forbidden: blocked by firewall", http.StatusForbidden)
+						deny(w, r, project, errorpage.Block, http.StatusForbidden, "Forbidden: blocked by firewall")
 						return
 					}
+				case "ip_allow":
+					// Only applies to TCP projects; kept if the project goes back to HTTP
 				case "keyword_block":
 					if strings.Contains(r.URL.String(), rule.Value) {
 						logger.LogAndBroadcast(hub, project.ID, "Blocked request containing keyword '%s' for project '%s': %s", rule.Value, project.Name, r.URL.Path)
-						http.Error(w, "Forbidden: blocked by firewall", http.StatusForbidden)
+						deny(w, r, project, errorpage.Block, http.StatusForbidden, "Forbidden: blocked by firewall")
 						return
 					}
+				case "grpc_method_block":
+					if proxy.IsGRPC(r) && grpcMethodMatches(rule.Value, upstreamPath) {
+						logger.LogAndBroadcast(hub, project.ID, "Blocked gRPC call to %s from %s for project '%s'", upstreamPath, clientIP, project.Name)
+						deny(w, r, project, errorpage.Block, http.StatusForbidden, "Forbidden: blocked by firewall")
+						return
+					}
+				case "grpc_metadata_block":
+					if proxy.IsGRPC(r) && grpcMetadataMatches(rule.Value, r.Header) {
+						logger.LogAndBroadcast(hub, project.ID, "Blocked gRPC call to %s with metadata '%s' for project '%s'", upstreamPath, rule.Value, project.Name)
+						deny(w, r, project, errorpage.Block, http.StatusForbidden, "Forbidden: blocked by firewall")
+						return
+					}
+				case "rate_limit":
+					limit, err := parseRateLimit(rule.Value)
+					if err != nil {
+						deny(w, r, project, errorpage.Error, http.StatusInternalServerError, "Internal Server Error: Invalid rate limit rule")
+						return
+					}
+					if allowed, wait, rejected := limiter.allow(rule.ID, clientIP, limit, time.Now()); !allowed {
+						logger.LogAndBroadcast(hub, project.ID, "Rate limited request from IP: %s for project '%s'", clientIP, project.Name)
+						if addr, err := netip.ParseAddr(clientIP); err == nil && bans != nil && rejected%floodRejections == 0 {
+							bans.Ban(addr, floodBanDuration)
+							logger.LogAndBroadcast(hub, project.ID, "Banned IP %s from every listener for %s after %d rate limited requests in a row for project '%s'", clientIP, floodBanDuration, rejected, project.Name)
+						}
+						w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())))
+						deny(w, r, project, errorpage.RateLimit, http.StatusTooManyRequests, "Too Many Requests: rate limit exceeded")
+						return
+					}
+				case "ws_max_message_size", "ws_rate_limit", "ws_keyword_block", "ws_regex_block":
+					// Applied to WebSocket messages once the connection is upgraded
 				// Add more rule types here (e.g., header_block, body_block)
 				default:
-					http.Error(w, fmt.Sprintf("Internal Server Error: Unknown rule type '%s'", rule.Type), http.StatusInternalServerError)
+					deny(w, r, project, errorpage.Error, http.StatusInternalServerError, fmt.Sprintf("Internal Server Error: Unknown rule type '%s'", rule.Type))
+					return
+				}
+			}
+
+			// Answer the project's redirects, then rewrite the URL the upstream will see
+			if location, status, ok := proxy.Redirect(r, project, pathPrefix, upstreamPath); ok {
+				logger.LogAndBroadcast(hub, project.ID, "Redirecting %s %s to '%s' with %d for project '%s'", r.Method, r.URL.Path, location, status, project.Name)
+				http.Redirect(w, r, location, status)
+				return
+			}
+			upstreamPath = proxy.RewriteURL(project, r.URL, upstreamPath)
+
+			// Pick the arm of a canary release; the canary is the same project with another upstream
+			arm := proxy.SelectArm(w, r, project, pathPrefix)
+			armed := proxy.ArmProject(project, arm)
+			// then the target of the arm's upstream pool that serves this client
+			target := proxyFactory.SelectTarget(w, r, armed, pathPrefix)
+			if conn != nil {
+				conn.SetProject(project.ID, target.UpstreamURL)
+			}
+
+			// 4. Dynamically create and serve the reverse proxy
+			// Projects matched by path prefix need the prefix removed from the request URL
+			// e.g., /my-project/some/path -> /some/path, and rewrite rules may map the path further.
+			// Other projects own the whole path space and are proxied as-is.
+			upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != upstreamPath {
+					originalPath := r.URL.Path
+					r.URL.Path, r.URL.RawPath = upstreamPath, ""
+					// If the path becomes empty after trimming, set it to / to avoid issues
+					if r.URL.Path == "" {
+						r.URL.Path = "/"
+					}
+					logger.LogAndBroadcast(hub, project.ID, "Rewriting URL from '%s' to '%s' for upstream '%s'", originalPath, r.URL.Path, target.UpstreamURL)
+				}
+
+				if proxy.IsWebSocketUpgrade(r) {
+					policy, err := proxy.NewWebSocketPolicy(rules)
+					if err != nil {
+						logger.LogAndBroadcast(hub, project.ID, "Invalid WebSocket rule for project '%s': %v", project.Name, err)
+						deny(w, r, project, errorpage.Error, http.StatusInternalServerError, "Internal Server Error: Invalid WebSocket rule")
+						return
+					}
+					if arm == proxy.ArmCanary {
+						logger.LogAndBroadcast(hub, project.ID, "Canary %s arm: WebSocket from %s", arm, clientIP)
+					}
+					proxyFactory.ServeWebSocket(w, r, target, policy, hub)
 					return
 				}
+
+				// Wait for one of the project's upstream slots, or shed the request if there are none
+				release, err := proxyFactory.Acquire(r.Context(), target)
+				if err != nil {
+					if r.Context().Err() != nil {
+						return // The client gave up while queued
+					}
+					running, waiting := proxyFactory.InFlight(project.ID)
+					logger.LogAndBroadcast(hub, project.ID, "Shed %s %s from %s for project '%s': %v (%d in flight, %d queued)", r.Method, r.URL.Path, clientIP, project.Name, err, running, waiting)
+					w.Header().Set("Retry-After", "1")
+					deny(w, r, project, errorpage.Overloaded, http.StatusServiceUnavailable, "Service Unavailable: Too many concurrent requests")
+					return
+				}
+				defer release()
+
+				reverseProxy, err := proxyFactory.NewReverseProxy(target, pathPrefix, hub)
+				if err != nil {
+					logger.LogAndBroadcast(hub, project.ID, "Cannot proxy project '%s': %v", project.Name, err)
+					deny(w, r, project, errorpage.UpstreamDown, http.StatusBadGateway, "Bad Gateway: Invalid upstream URL")
+					return
+				}
+				reverseProxy.ServeHTTP(w, r)
+			})
+
+			// Mirror a sample of requests that passed the rules once the primary response is done,
+			// and report each arm separately while a canary release is running
+			if !proxy.IsWebSocketUpgrade(r) {
+				mirrored := proxyFactory.Mirror(r, project, upstreamPath, hub)
+				canary := project.Canary != nil && project.Canary.Enabled
+				if mirrored != nil || canary {
+					recorder := &statusRecorder{ResponseWriter: w}
+					started := time.Now()
+					defer func() {
+						elapsed := time.Since(started)
+						if canary {
+							recordArm(hub, project, arm, r, recorder.status, elapsed)
+						}
+						if mirrored != nil {
+							mirrored(recorder.status, elapsed)
+						}
+					}()
+					w = recorder
+				}
 			}
 
-			// 5. Dynamically create and serve the reverse proxy
-			// The request URL needs to be rewritten to remove the path prefix
-			// e.g., /my-project/some/path -> /some/path
-			originalPath := r.URL.Path
-			r.URL.Path = strings.TrimPrefix(r.URL.Path, pathPrefix)
-			// If the path becomes empty after trimming, set it to / to avoid issues
-			if r.URL.Path == "" {
-				r.URL.Path = "/"
+			// 5. Response header rules are applied on the way out, after the response cache, so stored
+			// responses don't carry per-request values like {request_id}. WebSocket handshakes get
+			// them from ServeWebSocket.
+			if len(project.HeaderRules) > 0 && !proxy.IsWebSocketUpgrade(r) {
+				w = proxy.ResponseHeaderWriter(w, r, target, upstreamPath)
 			}
-			logger.LogAndBroadcast(hub, project.ID, "Rewriting URL from '%s' to '%s' for upstream '%s'", originalPath, r.URL.Path, project.UpstreamURL)
 
-			reverseProxy := proxyFactory.NewReverseProxy(project.UpstreamURL)
-			reverseProxy.ServeHTTP(w, r)
+			// 6. Answer from the response cache if the project enables it; it calls upstream on a miss
+			if project.Cache != nil && project.Cache.Enabled && responseCache != nil && !proxy.IsWebSocketUpgrade(r) {
+				// Cached per arm, not per target: the targets of a pool serve the same content
+				responseCache.Serve(w, r, armed, upstream)
+				return
+			}
+			upstream.ServeHTTP(w, r)
 		})
 	}
 }
+
+// ValidateRule checks that a rule has a known type and a value that type can use, so that
+// mistakes are reported when the rule is saved rather than when traffic arrives.
+func ValidateRule(ruleType, value string) error {
+	switch ruleType {
+	case "ip_block", "keyword_block":
+		return nil
+	case "rate_limit":
+		_, err := parseRateLimit(value)
+		return err
+	case "ws_max_message_size", "ws_rate_limit", "ws_keyword_block", "ws_regex_block":
+		_, err := proxy.NewWebSocketPolicy([]storage.Rule{{Type: ruleType, Value: value, Enabled: true}})
+		return err
+	case "grpc_method_block":
+		return validateGRPCMethod(value)
+	case "grpc_metadata_block":
+		return validateGRPCMetadata(value)
+	}
+	return fmt.Errorf("unknown rule type '%s'", ruleType)
+}
+
+// deny rejects a request with the project's error page for kind, or with the equivalent gRPC
+// status for gRPC calls so that gRPC clients report a meaningful error instead of a protocol failure.
+// project is nil when no project matched.
+func deny(w http.ResponseWriter, r *http.Request, project *storage.Project, kind errorpage.Kind, status int, message string) {
+	if proxy.IsGRPC(r) {
+		proxy.WriteGRPCError(w, proxy.GRPCStatusFromHTTP(status), message)
+		return
+	}
+	errorpage.Write(w, r, project, kind, status, message)
+}
+
+// requestHostname returns the normalized hostname a request was addressed to,
+// taken from the Host header or, failing that, the TLS SNI server name.
+func requestHostname(r *http.Request) string {
+	if r.Host != "" {
+		return storage.NormalizeHostname(r.Host)
+	}
+	if r.TLS != nil {
+		return storage.NormalizeHostname(r.TLS.ServerName)
+	}
+	return ""
+}
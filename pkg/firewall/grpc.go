@@ -0,0 +1,61 @@
+package firewall
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// grpcMethodPattern turns a grpc_method_block value into a pattern for the request path.
+// Values name a method ("pkg.Service/Method"), a whole service ("pkg.Service"), or use
+// glob wildcards ("pkg.Service/Delete*", "admin.*/*").
+func grpcMethodPattern(value string) string {
+	pattern := "/" + strings.TrimPrefix(value, "/")
+	if !strings.Contains(pattern[1:], "/") {
+		pattern += "/*"
+	}
+	return pattern
+}
+
+// grpcMethodMatches reports whether the path of a gRPC call, "/pkg.Service/Method", matches
+// a grpc_method_block value.
+func grpcMethodMatches(value, requestPath string) bool {
+	matched, _ := path.Match(grpcMethodPattern(value), requestPath)
+	return matched
+}
+
+func validateGRPCMethod(value string) error {
+	if strings.Count(grpcMethodPattern(value), "/") != 2 {
+		return fmt.Errorf("grpc_method_block must look like 'pkg.Service/Method' or 'pkg.Service', got '%s'", value)
+	}
+	if _, err := path.Match(grpcMethodPattern(value), ""); err != nil {
+		return fmt.Errorf("invalid grpc_method_block pattern '%s': %w", value, err)
+	}
+	return nil
+}
+
+// grpcMetadataMatches reports whether a call carries the metadata named by a
+// grpc_metadata_block value: "key" blocks any call with that key, "key=value" only calls
+// where one of its values is exactly value.
+func grpcMetadataMatches(value string, header http.Header) bool {
+	key, want, hasValue := strings.Cut(value, "=")
+	values := header.Values(key)
+	if !hasValue {
+		return len(values) > 0
+	}
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+func validateGRPCMetadata(value string) error {
+	key, _, _ := strings.Cut(value, "=")
+	if key == "" || strings.ContainsAny(key, " \t:") {
+		return fmt.Errorf("grpc_metadata_block must look like 'key' or 'key=value', got '%s'", value)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package firewall
+
+import (
+	"fmt"
+	"net/netip"
+
+	"prism/pkg/storage"
+)
+
+// ClientAllowed applies a TCP project's ip_allow and ip_block rules to a client address. Rule
+// values are addresses or CIDRs. If any ip_allow rule is enabled, only clients matching one get
+// through; ip_block rules then reject the clients they match. It returns the rule behind a
+// rejection, or nil when an allowlist matched nothing. HTTP projects only block exact addresses
+// and ignore ip_allow; see Middleware.
+func ClientAllowed(rules []storage.Rule, clientIP string) (bool, *storage.Rule) {
+	addr, addrErr := netip.ParseAddr(clientIP)
+	matches := func(rule storage.Rule) bool {
+		if rule.Value == clientIP {
+			return true
+		}
+		prefix, err := parseIPOrPrefix(rule.Value)
+		return err == nil && addrErr == nil && prefix.Contains(addr.Unmap())
+	}
+
+	allowlisted, allowed := false, false
+	for _, rule := range rules {
+		if rule.Enabled && rule.Type == "ip_allow" {
+			allowlisted = true
+			if matches(rule) {
+				allowed = true
+				break
+			}
+		}
+	}
+	if allowlisted && !allowed {
+		return false, nil
+	}
+	for i, rule := range rules {
+		if rule.Enabled && rule.Type == "ip_block" && matches(rule) {
+			return false, &rules[i]
+		}
+	}
+	return true, nil
+}
+
+// ValidateTCPRule is ValidateRule for TCP projects, which only apply ip_allow and ip_block
+// rules, and take an IP address or a CIDR for either.
+func ValidateTCPRule(ruleType, value string) error {
+	switch ruleType {
+	case "ip_allow", "ip_block":
+		if _, err := parseIPOrPrefix(value); err != nil {
+			return fmt.Errorf("invalid IP or CIDR '%s'", value)
+		}
+		return nil
+	}
+	return fmt.Errorf("rule type '%s' does not apply to TCP projects; use ip_allow or ip_block", ruleType)
+}
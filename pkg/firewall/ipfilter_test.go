@@ -0,0 +1,67 @@
+package firewall
+
+import (
+	"testing"
+
+	"prism/pkg/storage"
+)
+
+func TestClientAllowed(t *testing.T) {
+	block := func(value string) storage.Rule { return storage.Rule{Type: "ip_block", Value: value, Enabled: true} }
+	allow := func(value string) storage.Rule { return storage.Rule{Type: "ip_allow", Value: value, Enabled: true} }
+	tests := []struct {
+		name     string
+		rules    []storage.Rule
+		clientIP string
+		want     bool
+	}{
+		{name: "no rules", clientIP: "203.0.113.7", want: true},
+		{name: "exact block", rules: []storage.Rule{block("203.0.113.7")}, clientIP: "203.0.113.7"},
+		{name: "CIDR block", rules: []storage.Rule{block("203.0.113.0/24")}, clientIP: "203.0.113.7"},
+		{name: "outside the block", rules: []storage.Rule{block("203.0.113.0/24")}, clientIP: "198.51.100.1", want: true},
+		{name: "IPv4-mapped client", rules: []storage.Rule{block("203.0.113.0/24")}, clientIP: "::ffff:203.0.113.7"},
+		{name: "IPv6 CIDR", rules: []storage.Rule{block("2001:db8::/32")}, clientIP: "2001:db8::1"},
+		{name: "allowlisted", rules: []storage.Rule{allow("10.0.0.0/8")}, clientIP: "10.1.2.3", want: true},
+		{name: "not allowlisted", rules: []storage.Rule{allow("10.0.0.0/8")}, clientIP: "203.0.113.7"},
+		{name: "disabled allowlist", rules: []storage.Rule{{Type: "ip_allow", Value: "10.0.0.0/8"}}, clientIP: "203.0.113.7", want: true},
+		{name: "block within the allowlist", rules: []storage.Rule{allow("10.0.0.0/8"), block("10.0.0.5")}, clientIP: "10.0.0.5"},
+		{name: "other rule types ignored", rules: []storage.Rule{{Type: "keyword_block", Value: "203.0.113.7", Enabled: true}}, clientIP: "203.0.113.7", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := ClientAllowed(tt.rules, tt.clientIP); got != tt.want {
+				t.Errorf("ClientAllowed(%s) = %v, want %v", tt.clientIP, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTCPRule(t *testing.T) {
+	tests := []struct {
+		ruleType string
+		value    string
+		wantErr  bool
+	}{
+		{ruleType: "ip_block", value: "203.0.113.7"},
+		{ruleType: "ip_block", value: "203.0.113.0/24"},
+		{ruleType: "ip_allow", value: "2001:db8::/32"},
+		{ruleType: "ip_allow", value: "not an address", wantErr: true},
+		{ruleType: "ip_block", value: "10.0.0.0/33", wantErr: true},
+		{ruleType: "keyword_block", value: "admin", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ruleType+" "+tt.value, func(t *testing.T) {
+			if err := ValidateTCPRule(tt.ruleType, tt.value); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// HTTP projects keep exact-match ip_block rules and have no ip_allow
+	if err := ValidateRule("ip_block", "not an address"); err != nil {
+		t.Errorf("HTTP ip_block: %v", err)
+	}
+	if err := ValidateRule("ip_allow", "10.0.0.0/8"); err == nil {
+		t.Error("HTTP projects accepted an ip_allow rule")
+	}
+}
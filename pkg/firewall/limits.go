@@ -0,0 +1,70 @@
+package firewall
+
+import (
+	"fmt"
+	"net/http"
+
+	"prism/pkg/storage"
+)
+
+// Upper bounds for per-project limits, so a typo can't effectively disable them.
+const (
+	maxLimitTimeout     = 3600 // Seconds
+	maxLimitHeaderBytes = 1 << 20
+	maxLimitURLLength   = 1 << 16
+)
+
+// checkRequestLimits checks a request against the project's URL, header and declared body size
+// limits. It returns 0 if the request is within them, or the status and message to reject it with.
+func checkRequestLimits(limits *storage.Limits, r *http.Request) (int, string) {
+	if limits == nil {
+		return 0, ""
+	}
+	if limits.MaxURLLength > 0 && len(r.RequestURI) > limits.MaxURLLength {
+		return http.StatusRequestURITooLong, fmt.Sprintf("URI Too Long: request URL exceeds %d bytes", limits.MaxURLLength)
+	}
+	if limits.MaxHeaderBytes > 0 && headerBytes(r) > limits.MaxHeaderBytes {
+		return http.StatusRequestHeaderFieldsTooLarge, fmt.Sprintf("Request Header Fields Too Large: headers exceed %d bytes", limits.MaxHeaderBytes)
+	}
+	if limits.MaxBodyBytes > 0 && r.ContentLength > limits.MaxBodyBytes {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("Content Too Large: request body exceeds %d bytes", limits.MaxBodyBytes)
+	}
+	return 0, ""
+}
+
+// headerBytes approximates the size of a request's header block as sent on the wire.
+func headerBytes(r *http.Request) int {
+	size := len("Host: \r\n") + len(r.Host)
+	for name, values := range r.Header {
+		for _, value := range values {
+			size += len(name) + len(": \r\n") + len(value)
+		}
+	}
+	return size
+}
+
+// ValidateLimits checks per-project limits before they are saved.
+func ValidateLimits(limits *storage.Limits) error {
+	timeouts := map[string]int{
+		"connect_timeout":         limits.ConnectTimeout,
+		"tls_handshake_timeout":   limits.TLSHandshakeTimeout,
+		"response_header_timeout": limits.ResponseHeaderTimeout,
+		"idle_timeout":            limits.IdleTimeout,
+		"request_timeout":         limits.RequestTimeout,
+	}
+	for name, seconds := range timeouts {
+		if seconds < 0 || seconds > maxLimitTimeout {
+			return fmt.Errorf("%s must be between 0 and %d seconds", name, maxLimitTimeout)
+		}
+	}
+	if limits.MaxBodyBytes < 0 {
+		return fmt.Errorf("max_body_bytes must not be negative")
+	}
+	if limits.MaxHeaderBytes < 0 || limits.MaxHeaderBytes > maxLimitHeaderBytes {
+		return fmt.Errorf("max_header_bytes must be between 0 and %d", maxLimitHeaderBytes)
+	}
+	if limits.MaxURLLength < 0 || limits.MaxURLLength > maxLimitURLLength {
+		return fmt.Errorf("max_url_length must be between 0 and %d", maxLimitURLLength)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package firewall
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"prism/pkg/storage"
+)
+
+// defaultMaintenanceRetryAfter is sent when a maintenance window has neither an end nor a Retry-After.
+const defaultMaintenanceRetryAfter = 5 * time.Minute
+
+// MaintenanceActive reports whether a project is in maintenance at now: switched on, and
+// inside its schedule if it has one.
+func MaintenanceActive(m *storage.Maintenance, now time.Time) bool {
+	if m == nil || !m.Enabled {
+		return false
+	}
+	if m.StartsAt != nil && now.Before(*m.StartsAt) {
+		return false
+	}
+	if m.EndsAt != nil && !now.Before(*m.EndsAt) {
+		return false
+	}
+	return true
+}
+
+// maintenanceBypass reports whether a request may reach the upstream during maintenance, either
+// because the client is allowlisted or because it sent the bypass header with the right token.
+func maintenanceBypass(m *storage.Maintenance, r *http.Request, clientIP string) bool {
+	if addr, err := netip.ParseAddr(clientIP); err == nil {
+		for _, allowed := range m.AllowIPs {
+			if prefix, err := parseIPOrPrefix(allowed); err == nil && prefix.Contains(addr.Unmap()) {
+				return true
+			}
+		}
+	}
+	if m.BypassHeader != "" && m.BypassToken != "" {
+		token := r.Header.Get(m.BypassHeader)
+		return subtle.ConstantTimeCompare([]byte(token), []byte(m.BypassToken)) == 1
+	}
+	return false
+}
+
+// maintenanceRetryAfter returns the Retry-After value, in seconds, for a maintenance response.
+func maintenanceRetryAfter(m *storage.Maintenance, now time.Time) string {
+	retryAfter := defaultMaintenanceRetryAfter
+	if m.RetryAfter > 0 {
+		retryAfter = time.Duration(m.RetryAfter) * time.Second
+	} else if m.EndsAt != nil {
+		retryAfter = m.EndsAt.Sub(now)
+	}
+	return strconv.Itoa(int(math.Ceil(max(retryAfter, time.Second).Seconds())))
+}
+
+// parseIPOrPrefix parses "192.0.2.7" or "192.0.2.0/24" as a prefix.
+func parseIPOrPrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ValidateMaintenance checks maintenance settings before they are saved.
+func ValidateMaintenance(m *storage.Maintenance) error {
+	if m.StartsAt != nil && m.EndsAt != nil && !m.EndsAt.After(*m.StartsAt) {
+		return fmt.Errorf("maintenance must end after it starts")
+	}
+	if m.RetryAfter < 0 {
+		return fmt.Errorf("retry_after must not be negative")
+	}
+	for _, allowed := range m.AllowIPs {
+		if _, err := parseIPOrPrefix(allowed); err != nil {
+			return fmt.Errorf("invalid IP or CIDR '%s' in allow_ips", allowed)
+		}
+	}
+	if (m.BypassHeader == "") != (m.BypassToken == "") {
+		return fmt.Errorf("bypass_header and bypass_token must be set together")
+	}
+	if m.BypassHeader != "" && strings.ContainsAny(m.BypassHeader, " \t\r\n:") {
+		return fmt.Errorf("invalid bypass header name '%s'", m.BypassHeader)
+	}
+	if m.BypassToken != "" && len(m.BypassToken) < 16 {
+		return fmt.Errorf("bypass_token must be at least 16 characters")
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package firewall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"prism/pkg/storage"
+)
+
+func TestMaintenanceActive(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	earlier, later := now.Add(-time.Hour), now.Add(time.Hour)
+	tests := []struct {
+		name string
+		m    *storage.Maintenance
+		want bool
+	}{
+		{name: "none", m: nil, want: false},
+		{name: "off", m: &storage.Maintenance{StartsAt: &earlier}, want: false},
+		{name: "on", m: &storage.Maintenance{Enabled: true}, want: true},
+		{name: "inside window", m: &storage.Maintenance{Enabled: true, StartsAt: &earlier, EndsAt: &later}, want: true},
+		{name: "before window", m: &storage.Maintenance{Enabled: true, StartsAt: &later}, want: false},
+		{name: "after window", m: &storage.Maintenance{Enabled: true, EndsAt: &earlier}, want: false},
+		{name: "at the end", m: &storage.Maintenance{Enabled: true, EndsAt: &now}, want: false},
+		{name: "at the start", m: &storage.Maintenance{Enabled: true, StartsAt: &now}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MaintenanceActive(tt.m, now); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaintenanceBypass(t *testing.T) {
+	m := &storage.Maintenance{
+		Enabled:      true,
+		AllowIPs:     []string{"192.0.2.7", "198.51.100.0/24", "2001:db8::/32"},
+		BypassHeader: "X-Maintenance-Bypass",
+		BypassToken:  "0123456789abcdef",
+	}
+	tests := []struct {
+		name     string
+		clientIP string
+		token    string
+		want     bool
+	}{
+		{name: "allowed IP", clientIP: "192.0.2.7", want: true},
+		{name: "allowed CIDR", clientIP: "198.51.100.200", want: true},
+		{name: "IPv4-mapped IPv6", clientIP: "::ffff:198.51.100.1", want: true},
+		{name: "allowed IPv6 CIDR", clientIP: "2001:db8::1", want: true},
+		{name: "other IP", clientIP: "192.0.2.8", want: false},
+		{name: "unparsable IP", clientIP: "", want: false},
+		{name: "token", clientIP: "203.0.113.1", token: "0123456789abcdef", want: true},
+		{name: "wrong token", clientIP: "203.0.113.1", token: "0123456789abcdeX", want: false},
+		{name: "token prefix", clientIP: "203.0.113.1", token: "0123456789", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.token != "" {
+				r.Header.Set("X-Maintenance-Bypass", tt.token)
+			}
+			if got := maintenanceBypass(m, r, tt.clientIP); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Without a configured token, an empty header must not match an empty token
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if maintenanceBypass(&storage.Maintenance{Enabled: true}, r, "203.0.113.1") {
+		t.Error("request bypassed maintenance without a token configured")
+	}
+}
+
+func TestMaintenanceRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	inTenMinutes, inHalfASecond, past := now.Add(10*time.Minute), now.Add(500*time.Millisecond), now.Add(-time.Minute)
+	tests := []struct {
+		name string
+		m    *storage.Maintenance
+		want string
+	}{
+		{name: "default", m: &storage.Maintenance{}, want: "300"},
+		{name: "configured", m: &storage.Maintenance{RetryAfter: 120, EndsAt: &inTenMinutes}, want: "120"},
+		{name: "until the end of the window", m: &storage.Maintenance{EndsAt: &inTenMinutes}, want: "600"},
+		{name: "rounded up", m: &storage.Maintenance{EndsAt: &inHalfASecond}, want: "1"},
+		{name: "never below a second", m: &storage.Maintenance{EndsAt: &past}, want: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := maintenanceRetryAfter(tt.m, now); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateMaintenance(t *testing.T) {
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	tests := []struct {
+		name    string
+		m       storage.Maintenance
+		wantErr bool
+	}{
+		{name: "window", m: storage.Maintenance{Enabled: true, StartsAt: &start, EndsAt: &end, AllowIPs: []string{"192.0.2.7", "10.0.0.0/8"}}},
+		{name: "bypass", m: storage.Maintenance{BypassHeader: "X-Bypass", BypassToken: "0123456789abcdef"}},
+		{name: "ends before it starts", m: storage.Maintenance{StartsAt: &end, EndsAt: &start}, wantErr: true},
+		{name: "negative retry_after", m: storage.Maintenance{RetryAfter: -1}, wantErr: true},
+		{name: "bad IP", m: storage.Maintenance{AllowIPs: []string{"192.0.2.300"}}, wantErr: true},
+		{name: "header without token", m: storage.Maintenance{BypassHeader: "X-Bypass"}, wantErr: true},
+		{name: "bad header", m: storage.Maintenance{BypassHeader: "X Bypass", BypassToken: "0123456789abcdef"}, wantErr: true},
+		{name: "short token", m: storage.Maintenance{BypassHeader: "X-Bypass", BypassToken: "short"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateMaintenance(&tt.m); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
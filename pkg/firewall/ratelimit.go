@@ -0,0 +1,105 @@
+package firewall
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often idle buckets are dropped.
+const rateLimitSweepInterval = time.Minute
+
+// A client that has floodRejections requests in a row rate limited is flooding rather than
+// retrying, and is banned from every listener for floodBanDuration. Clients that wait for
+// Retry-After never get there.
+const (
+	floodRejections  = 100
+	floodBanDuration = time.Minute
+)
+
+// rateLimit is a parsed rate_limit value: a number of requests per interval, with bursts up
+// to the same number.
+type rateLimit struct {
+	perSecond float64
+	burst     float64
+}
+
+// parseRateLimit parses a rate such as "20/s", "600/m" or "20" (per second).
+func parseRateLimit(value string) (rateLimit, error) {
+	count, unit, _ := strings.Cut(value, "/")
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 {
+		return rateLimit{}, fmt.Errorf("rate_limit must look like '20/s' or '600/m', got '%s'", value)
+	}
+	switch unit {
+	case "", "s":
+		return rateLimit{perSecond: n, burst: n}, nil
+	case "m":
+		return rateLimit{perSecond: n / 60, burst: n}, nil
+	}
+	return rateLimit{}, fmt.Errorf("rate_limit must look like '20/s' or '600/m', got '%s'", value)
+}
+
+type rateKey struct {
+	ruleID   string
+	clientIP string
+}
+
+type bucket struct {
+	tokens   float64
+	last     time.Time
+	limit    rateLimit
+	rejected int // Requests rejected since the last one allowed
+}
+
+// rateLimiter keeps a token bucket per rate_limit rule and client IP.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[rateKey]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[rateKey]*bucket)}
+}
+
+// allow takes a token from the client's bucket for a rule. When the bucket is empty it returns
+// false, how long until the next request would be allowed, and how many requests in a row the
+// client has now had rejected.
+func (l *rateLimiter) allow(ruleID, clientIP string, limit rateLimit, now time.Time) (bool, time.Duration, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	key := rateKey{ruleID: ruleID, clientIP: clientIP}
+	b := l.buckets[key]
+	if b == nil || b.limit != limit { // A changed rule starts over
+		b = &bucket{tokens: limit.burst, last: now, limit: limit}
+		l.buckets[key] = b
+	}
+	b.tokens = min(limit.burst, b.tokens+now.Sub(b.last).Seconds()*limit.perSecond)
+	b.last = now
+	if b.tokens < 1 {
+		b.rejected++
+		wait := math.Ceil((1 - b.tokens) / limit.perSecond)
+		return false, time.Duration(wait) * time.Second, b.rejected
+	}
+	b.tokens--
+	b.rejected = 0
+	return true, 0, 0
+}
+
+// sweep drops buckets that have refilled completely, which behave exactly like new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.limit.perSecond >= b.limit.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package firewall
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    rateLimit
+		wantErr bool
+	}{
+		{value: "20", want: rateLimit{perSecond: 20, burst: 20}},
+		{value: "20/s", want: rateLimit{perSecond: 20, burst: 20}},
+		{value: "600/m", want: rateLimit{perSecond: 10, burst: 600}},
+		{value: "0/s", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "20/h", wantErr: true},
+		{value: "fast", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseRateLimit(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter()
+	limit := rateLimit{perSecond: 1, burst: 3}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if allowed, _, _ := limiter.allow("r1", "203.0.113.7", limit, now); !allowed {
+			t.Fatalf("request %d within the burst was limited", i+1)
+		}
+	}
+	allowed, wait, _ := limiter.allow("r1", "203.0.113.7", limit, now)
+	if allowed || wait != time.Second {
+		t.Errorf("request over the burst: allowed %v, wait %v", allowed, wait)
+	}
+	if allowed, _, _ := limiter.allow("r1", "198.51.100.1", limit, now); !allowed {
+		t.Error("another client was limited")
+	}
+	if allowed, _, _ := limiter.allow("r2", "203.0.113.7", limit, now); !allowed {
+		t.Error("another rule was limited")
+	}
+	if allowed, _, _ := limiter.allow("r1", "203.0.113.7", limit, now.Add(time.Second)); !allowed {
+		t.Error("request after a token refilled was limited")
+	}
+	if allowed, _, _ := limiter.allow("r1", "203.0.113.7", rateLimit{perSecond: 1, burst: 5}, now.Add(time.Second)); !allowed {
+		t.Error("a changed limit did not start over")
+	}
+
+	// A minute later every bucket has refilled and is swept
+	limiter.allow("r1", "192.0.2.1", limit, now.Add(time.Minute))
+	if len(limiter.buckets) != 1 {
+		t.Errorf("%d buckets after the sweep, want 1", len(limiter.buckets))
+	}
+}
+
+func TestRateLimiterCountsRejections(t *testing.T) {
+	limiter := newRateLimiter()
+	limit := rateLimit{perSecond: 1, burst: 1}
+	now := time.Now()
+
+	limiter.allow("r1", "203.0.113.7", limit, now)
+	for want := 1; want <= 3; want++ {
+		if _, _, rejected := limiter.allow("r1", "203.0.113.7", limit, now); rejected != want {
+			t.Fatalf("rejected = %d, want %d", rejected, want)
+		}
+	}
+	if allowed, _, rejected := limiter.allow("r1", "203.0.113.7", limit, now.Add(time.Second)); !allowed || rejected != 0 {
+		t.Errorf("after a refill: allowed %v, rejected %d", allowed, rejected)
+	}
+	if _, _, rejected := limiter.allow("r1", "203.0.113.7", limit, now.Add(time.Second)); rejected != 1 {
+		t.Errorf("an allowed request did not reset the count: rejected %d", rejected)
+	}
+}
@@ -0,0 +1,384 @@
+package httpcache
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"prism/pkg/logger"
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+// entry is one stored response, i.e. one variant of a URL.
+type entry struct {
+	key         string // Project, upstream, host and URL
+	projectID   string
+	path        string // Public request path, for purging
+	varyHeaders []string
+	varyValues  string // Values of varyHeaders in the request that produced the response
+	status      int
+	header      http.Header
+	body        []byte
+	storedAt    time.Time
+	initialAge  time.Duration
+	freshness   freshness
+	size        int64
+	elem        *list.Element
+}
+
+func (e *entry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.storedAt)
+}
+
+// Cache is an in-memory HTTP cache shared by all projects, bounded by the total size of the
+// stored responses. The least recently used responses are evicted first.
+type Cache struct {
+	maxBytes  int64
+	maxObject int64
+	hub       *websockets.Hub
+
+	mu           sync.Mutex
+	variants     map[string][]*entry
+	lru          *list.List // Front is most recently used
+	size         int64
+	revalidating map[*entry]bool
+}
+
+// New creates a cache holding at most maxBytes of responses. Single responses larger than
+// a sixteenth of that, or 8 MiB, are never stored.
+func New(maxBytes int64, hub *websockets.Hub) *Cache {
+	return &Cache{
+		maxBytes:     maxBytes,
+		maxObject:    min(maxBytes/16, 8<<20),
+		hub:          hub,
+		variants:     make(map[string][]*entry),
+		lru:          list.New(),
+		revalidating: make(map[*entry]bool),
+	}
+}
+
+// Serve answers r from the cache when possible and otherwise calls next, storing what it
+// returns. It must see the public request path, before any project prefix is stripped,
+// since that is the path responses are purged by.
+func (c *Cache) Serve(w http.ResponseWriter, r *http.Request, project *storage.Project, next http.Handler) {
+	reqCC := parseCacheControl(r.Header.Values("Cache-Control"))
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" || reqCC.has("no-store") {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	defaults := freshness{
+		staleWhileRevalidate: time.Duration(project.Cache.StaleWhileRevalidate) * time.Second,
+		staleIfError:         time.Duration(project.Cache.StaleIfError) * time.Second,
+	}
+	// The upstream is part of the key so each arm of a canary release is cached separately
+	key := project.ID + "\x00" + project.UpstreamURL + "\x00" + storage.NormalizeHostname(r.Host) + "\x00" + r.URL.RequestURI()
+	now := time.Now()
+
+	e := c.lookup(key, r)
+	if e == nil {
+		c.fetch(w, r, project, key, nil, defaults, next)
+		return
+	}
+
+	age := e.age(now)
+	revalidate := e.freshness.mustRevalidate || reqCC.has("no-cache")
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		revalidate = true
+	}
+	if !revalidate && age < e.freshness.lifetime {
+		c.serveEntry(w, r, e, now, "HIT")
+		return
+	}
+	if !revalidate && age < e.freshness.lifetime+e.freshness.staleWhileRevalidate {
+		c.serveEntry(w, r, e, now, "STALE")
+		c.revalidateInBackground(r, project, key, e, defaults, next)
+		return
+	}
+	c.fetch(w, r, project, key, e, defaults, next)
+}
+
+// fetch forwards the request upstream, revalidating the stale entry e if there is one.
+// A 304 refreshes e; a server error may be answered with e if stale-if-error allows it.
+func (c *Cache) fetch(w http.ResponseWriter, r *http.Request, project *storage.Project, key string, e *entry, defaults freshness, next http.Handler) {
+	now := time.Now()
+	upstreamReq := r.Clone(r.Context()) // next may rewrite the path, which the entry is stored by
+	staleOnError := false
+	if e != nil {
+		upstreamReq = conditionalRequest(r, r.Context(), e)
+		staleOnError = e.age(now) < e.freshness.lifetime+e.freshness.staleIfError
+	}
+
+	cw := newCaptureWriter(w, c.maxObject, func(status int) bool {
+		return (e != nil && status == http.StatusNotModified) || (staleOnError && status >= 500)
+	})
+	next.ServeHTTP(cw, upstreamReq)
+
+	switch {
+	case cw.held && cw.status == http.StatusNotModified:
+		c.serveEntry(w, r, c.refresh(e, cw.header, now), now, "REVALIDATED")
+	case cw.held:
+		logger.LogAndBroadcast(c.hub, project.ID, "Upstream answered %s with %d, serving stale cached response", r.URL.Path, cw.status)
+		c.serveEntry(w, r, e, now, "STALE")
+	default:
+		c.storeResponse(r, project, key, e, cw, now, defaults)
+	}
+}
+
+// revalidateInBackground refreshes e without holding up the client, at most once at a time.
+func (c *Cache) revalidateInBackground(r *http.Request, project *storage.Project, key string, e *entry, defaults freshness, next http.Handler) {
+	c.mu.Lock()
+	if c.revalidating[e] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[e] = true
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), time.Minute)
+	req := conditionalRequest(r, ctx, e)
+	go func() {
+		defer cancel()
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, e)
+			c.mu.Unlock()
+		}()
+
+		now := time.Now()
+		cw := newCaptureWriter(nil, c.maxObject, func(int) bool { return true })
+		next.ServeHTTP(cw, req.Clone(ctx)) // next may rewrite the path, which the entry is stored by
+		if cw.status == http.StatusNotModified {
+			c.refresh(e, cw.header, now)
+			return
+		}
+		// Judged by req, not r: the client's request is done, so its context is already canceled
+		c.storeResponse(req, project, key, e, cw, now, defaults)
+	}()
+}
+
+// conditionalRequest clones r for revalidating e, replacing the client's own validators.
+func conditionalRequest(r *http.Request, ctx context.Context, e *entry) *http.Request {
+	req := r.Clone(ctx)
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	if etag := e.header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	return req
+}
+
+// storeResponse stores a complete upstream response if it is cacheable, replacing old, and
+// drops old otherwise.
+func (c *Cache) storeResponse(r *http.Request, project *storage.Project, key string, old *entry, cw *captureWriter, now time.Time, defaults freshness) {
+	f, ok := storable(r, cw.status, cw.header, now, defaults)
+	if !ok || cw.overflow || cw.truncated(r) {
+		// A new answer that may not be stored replaces the old one; an error doesn't.
+		if old != nil && cw.status < 500 {
+			c.remove(old)
+		}
+		return
+	}
+
+	header := cw.header.Clone()
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	header.Del("X-Cache")
+	varyHeaders := varyHeaderNames(header)
+	e := &entry{
+		key:         key,
+		projectID:   project.ID,
+		path:        r.URL.Path,
+		varyHeaders: varyHeaders,
+		varyValues:  varyValues(r, varyHeaders),
+		status:      cw.status,
+		header:      header,
+		body:        cw.body.Bytes(),
+		storedAt:    now,
+		initialAge:  ageHeader(header),
+		freshness:   f,
+	}
+	c.insert(e, old)
+}
+
+// refresh updates a stored response with the headers of a 304 and restarts its lifetime.
+func (c *Cache) refresh(e *entry, notModified http.Header, now time.Time) *entry {
+	header := e.header.Clone()
+	header.Del("Age") // The stored response's age restarts with the 304, which may send its own
+	for name, values := range notModified {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Content-Type", "Content-Range", "X-Cache":
+			continue
+		}
+		header[name] = values
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+
+	refreshed := *e
+	refreshed.header = header
+	refreshed.storedAt = now
+	refreshed.initialAge = ageHeader(header)
+	refreshed.elem = nil
+	if f, ok := storable(&http.Request{Header: http.Header{}}, e.status, header, now, e.freshness); ok {
+		refreshed.freshness = f
+	}
+	c.insert(&refreshed, e)
+	return &refreshed
+}
+
+// serveEntry writes a stored response, answering the client's own If-None-Match with a 304.
+func (c *Cache) serveEntry(w http.ResponseWriter, r *http.Request, e *entry, now time.Time, result string) {
+	for name, values := range e.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.Header().Set("Age", strconv.Itoa(int(e.age(now).Seconds())))
+	w.Header().Set("X-Cache", result)
+
+	if etagMatches(r.Header.Get("If-None-Match"), e.header.Get("ETag")) {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.body)))
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// lookup finds the stored variant of key that matches the request and marks it as used.
+func (c *Cache) lookup(key string, r *http.Request) *entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.variants[key] {
+		if varyValues(r, e.varyHeaders) == e.varyValues {
+			c.lru.MoveToFront(e.elem)
+			return e
+		}
+	}
+	return nil
+}
+
+// insert stores e, replacing old (which may be nil or already evicted) and any other variant
+// with the same Vary values, then evicts entries until the cache fits its bound.
+func (c *Cache) insert(e, old *entry) {
+	e.size = int64(len(e.body)) + headerSize(e.header) + int64(len(e.key))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old != nil && old.elem != nil {
+		c.removeLocked(old)
+	}
+	for _, existing := range c.variants[e.key] {
+		if existing.varyValues == e.varyValues {
+			c.removeLocked(existing)
+			break
+		}
+	}
+	e.elem = c.lru.PushFront(e)
+	c.variants[e.key] = append(c.variants[e.key], e)
+	c.size += e.size
+
+	for c.size > c.maxBytes && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back().Value.(*entry))
+	}
+}
+
+func (c *Cache) remove(e *entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.elem != nil {
+		c.removeLocked(e)
+	}
+}
+
+func (c *Cache) removeLocked(e *entry) {
+	c.lru.Remove(e.elem)
+	e.elem = nil
+	c.size -= e.size
+	variants := c.variants[e.key]
+	for i, v := range variants {
+		if v == e {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(c.variants, e.key)
+	} else {
+		c.variants[e.key] = variants
+	}
+}
+
+// Purge removes a project's stored responses and returns how many were removed. An empty
+// path removes all of them; a path ending in "*" removes every path with that prefix.
+func (c *Cache) Purge(projectID, path string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prefix, isPrefix := strings.CutSuffix(path, "*")
+	var doomed []*entry
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*entry)
+		if e.projectID != projectID {
+			continue
+		}
+		if path == "" || e.path == path || (isPrefix && strings.HasPrefix(e.path, prefix)) {
+			doomed = append(doomed, e)
+		}
+	}
+	for _, e := range doomed {
+		c.removeLocked(e)
+	}
+	return len(doomed)
+}
+
+// varyHeaderNames returns the canonical request header names listed in a response's Vary.
+func varyHeaderNames(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// varyValues identifies the variant a request selects.
+func varyValues(r *http.Request, names []string) string {
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+func ageHeader(header http.Header) time.Duration {
+	age, err := strconv.ParseInt(header.Get("Age"), 10, 64)
+	if err != nil || age < 0 {
+		return 0
+	}
+	return time.Duration(age) * time.Second
+}
+
+func headerSize(header http.Header) int64 {
+	var n int64
+	for name, values := range header {
+		for _, value := range values {
+			n += int64(len(name) + len(value) + 4)
+		}
+	}
+	return n
+}
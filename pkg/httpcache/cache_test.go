@@ -0,0 +1,360 @@
+package httpcache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+var testProject = &storage.Project{ID: "p1", UpstreamURL: "http://upstream", Cache: &storage.CacheConfig{Enabled: true}}
+
+func newTestCache(t *testing.T) *Cache {
+	t.Helper()
+	hub := websockets.NewHub()
+	go hub.Run()
+	return New(64<<20, hub)
+}
+
+// get sends a GET for url through the cache and returns the recorded response. Like net/http,
+// it cancels the request's context once the handler returns.
+func get(c *Cache, url string, header http.Header, next http.Handler) *httptest.ResponseRecorder {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := httptest.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	c.Serve(w, r, testProject, next)
+	return w
+}
+
+// waitRevalidated waits for background revalidations to finish.
+func waitRevalidated(t *testing.T, c *Cache) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		pending := len(c.revalidating)
+		c.mu.Unlock()
+		if pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background revalidation did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServeFreshness(t *testing.T) {
+	tests := []struct {
+		name          string
+		header        http.Header // Upstream response headers
+		request       http.Header // Headers of the second request
+		wantSecond    string      // X-Cache of the second request
+		wantUpstreams int32
+	}{
+		{
+			name:          "fresh",
+			header:        http.Header{"Cache-Control": {"max-age=60"}},
+			wantSecond:    "HIT",
+			wantUpstreams: 1,
+		},
+		{
+			name:          "expired without validators",
+			header:        http.Header{"Cache-Control": {"max-age=60"}, "Age": {"61"}},
+			wantSecond:    "MISS",
+			wantUpstreams: 2,
+		},
+		{
+			name:          "revalidated with an ETag",
+			header:        http.Header{"Etag": {`"v1"`}},
+			wantSecond:    "REVALIDATED",
+			wantUpstreams: 2,
+		},
+		{
+			name:          "client asks for revalidation",
+			header:        http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}},
+			request:       http.Header{"Cache-Control": {"no-cache"}},
+			wantSecond:    "REVALIDATED",
+			wantUpstreams: 2,
+		},
+		{
+			name:          "client max-age",
+			header:        http.Header{"Cache-Control": {"max-age=60"}, "Age": {"30"}, "Etag": {`"v1"`}},
+			request:       http.Header{"Cache-Control": {"max-age=10"}},
+			wantSecond:    "REVALIDATED",
+			wantUpstreams: 2,
+		},
+		{
+			name:          "must-revalidate",
+			header:        http.Header{"Cache-Control": {"max-age=60, must-revalidate"}, "Age": {"61"}, "Etag": {`"v1"`}},
+			wantSecond:    "REVALIDATED",
+			wantUpstreams: 2,
+		},
+		{
+			name:          "no-store",
+			header:        http.Header{"Cache-Control": {"no-store, max-age=60"}},
+			wantSecond:    "MISS",
+			wantUpstreams: 2,
+		},
+		{
+			name:          "private",
+			header:        http.Header{"Cache-Control": {"private, max-age=60"}},
+			wantSecond:    "MISS",
+			wantUpstreams: 2,
+		},
+		{
+			name:          "sets a cookie",
+			header:        http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}},
+			wantSecond:    "MISS",
+			wantUpstreams: 2,
+		},
+		{
+			name:          "nothing to go by",
+			header:        http.Header{},
+			wantSecond:    "MISS",
+			wantUpstreams: 2,
+		},
+		{
+			name:          "client refuses storage",
+			header:        http.Header{"Cache-Control": {"max-age=60"}},
+			request:       http.Header{"Cache-Control": {"no-store"}},
+			wantSecond:    "",
+			wantUpstreams: 2,
+		},
+		{
+			name:          "range request",
+			header:        http.Header{"Cache-Control": {"max-age=60"}},
+			request:       http.Header{"Range": {"bytes=0-1"}},
+			wantSecond:    "",
+			wantUpstreams: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			var upstreams atomic.Int32
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreams.Add(1)
+				for name, values := range tt.header {
+					w.Header()[name] = values
+				}
+				if etagMatches(r.Header.Get("If-None-Match"), tt.header.Get("ETag")) {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Write([]byte("hello"))
+			})
+
+			if first := get(c, "http://app.example.com/page", nil, next); first.Header().Get("X-Cache") != "MISS" {
+				t.Fatalf("first request: X-Cache = %q, want MISS", first.Header().Get("X-Cache"))
+			}
+			second := get(c, "http://app.example.com/page", tt.request, next)
+			if got := second.Header().Get("X-Cache"); got != tt.wantSecond {
+				t.Errorf("second request: X-Cache = %q, want %q", got, tt.wantSecond)
+			}
+			if second.Code == http.StatusOK && second.Body.String() != "hello" {
+				t.Errorf("second request: body = %q", second.Body.String())
+			}
+			if got := upstreams.Load(); got != tt.wantUpstreams {
+				t.Errorf("upstream saw %d requests, want %d", got, tt.wantUpstreams)
+			}
+		})
+	}
+}
+
+func TestServeClientValidators(t *testing.T) {
+	c := newTestCache(t)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("hello"))
+	})
+	get(c, "http://app.example.com/page", nil, next)
+
+	w := get(c, "http://app.example.com/page", http.Header{"If-None-Match": {`W/"v1"`}}, next)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("expected an empty 304 for a matching If-None-Match, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+	w = get(c, "http://app.example.com/page", http.Header{"If-None-Match": {`"v0"`}}, next)
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("expected the stored response for a stale If-None-Match, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestServeVary(t *testing.T) {
+	c := newTestCache(t)
+	var upstreams atomic.Int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreams.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("hello in " + r.Header.Get("Accept-Language")))
+	})
+
+	steps := []struct {
+		language  string
+		wantCache string
+	}{
+		{language: "en", wantCache: "MISS"},
+		{language: "fr", wantCache: "MISS"},
+		{language: "en", wantCache: "HIT"},
+		{language: "fr", wantCache: "HIT"},
+		{language: "", wantCache: "MISS"},
+		{language: "", wantCache: "HIT"},
+	}
+	for i, step := range steps {
+		var header http.Header
+		if step.language != "" {
+			header = http.Header{"Accept-Language": {step.language}}
+		}
+		w := get(c, "http://app.example.com/page", header, next)
+		if got := w.Header().Get("X-Cache"); got != step.wantCache {
+			t.Errorf("request %d (%q): X-Cache = %q, want %q", i+1, step.language, got, step.wantCache)
+		}
+		if want := "hello in " + step.language; w.Body.String() != want {
+			t.Errorf("request %d (%q): body = %q, want %q", i+1, step.language, w.Body.String(), want)
+		}
+	}
+	if got := upstreams.Load(); got != 3 {
+		t.Errorf("upstream saw %d requests, want 3", got)
+	}
+
+	// Hostnames are part of the key
+	if w := get(c, "http://other.example.com/page", http.Header{"Accept-Language": {"en"}}, next); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("expected a miss for another hostname, got %q", w.Header().Get("X-Cache"))
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		notModified bool // The upstream still has the stored version
+		wantBody    string
+	}{
+		{name: "upstream changed", wantBody: "new"},
+		{name: "upstream unchanged", notModified: true, wantBody: "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			var upstreams atomic.Int32
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if upstreams.Add(1) == 1 {
+					// Already past its lifetime, but within stale-while-revalidate
+					w.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=30")
+					w.Header().Set("Age", "61")
+					w.Header().Set("ETag", `"old"`)
+					w.Write([]byte("old"))
+					return
+				}
+				if r.Header.Get("If-None-Match") != `"old"` {
+					t.Errorf("revalidation sent If-None-Match %q", r.Header.Get("If-None-Match"))
+				}
+				w.Header().Set("Cache-Control", "max-age=60")
+				if tt.notModified {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", `"new"`)
+				w.Write([]byte("new"))
+			})
+
+			get(c, "http://app.example.com/page", nil, next)
+			w := get(c, "http://app.example.com/page", nil, next)
+			if w.Header().Get("X-Cache") != "STALE" || w.Body.String() != "old" {
+				t.Fatalf("expected the stale response while revalidating, got %q %q", w.Header().Get("X-Cache"), w.Body.String())
+			}
+			waitRevalidated(t, c)
+
+			w = get(c, "http://app.example.com/page", nil, next)
+			if w.Header().Get("X-Cache") != "HIT" || w.Body.String() != tt.wantBody {
+				t.Errorf("after revalidating: X-Cache = %q, body = %q; want HIT %q", w.Header().Get("X-Cache"), w.Body.String(), tt.wantBody)
+			}
+			if got := upstreams.Load(); got != 2 {
+				t.Errorf("upstream saw %d requests, want 2", got)
+			}
+		})
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	c := newTestCache(t)
+	var upstreams atomic.Int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upstreams.Add(1) == 1 {
+			w.Header().Set("Cache-Control", "max-age=60, stale-if-error=30")
+			w.Header().Set("Age", "61")
+			w.Write([]byte("old"))
+			return
+		}
+		http.Error(w, "down", http.StatusBadGateway)
+	})
+
+	get(c, "http://app.example.com/page", nil, next)
+	w := get(c, "http://app.example.com/page", nil, next)
+	if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "STALE" || w.Body.String() != "old" {
+		t.Errorf("expected the stale response instead of the error, got %d %q %q", w.Code, w.Header().Get("X-Cache"), w.Body.String())
+	}
+	// The error doesn't replace the stored response
+	if w := get(c, "http://app.example.com/page", nil, next); w.Body.String() != "old" {
+		t.Errorf("expected the stale response to survive the error, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestPurge(t *testing.T) {
+	c := newTestCache(t)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(r.URL.Path))
+	})
+	for _, path := range []string{"/a", "/assets/app.js", "/assets/app.css"} {
+		get(c, "http://app.example.com"+path, nil, next)
+	}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{path: "/missing", want: 0},
+		{path: "/assets/*", want: 2},
+		{path: "/assets/*", want: 0},
+		{path: "", want: 1},
+	}
+	for _, tt := range tests {
+		if got := c.Purge(testProject.ID, tt.path); got != tt.want {
+			t.Errorf("Purge(%q) = %d, want %d", tt.path, got, tt.want)
+		}
+	}
+	if c.size != 0 || c.lru.Len() != 0 || len(c.variants) != 0 {
+		t.Errorf("expected an empty cache, have %d bytes in %d entries", c.size, c.lru.Len())
+	}
+}
+
+func TestEviction(t *testing.T) {
+	c := newTestCache(t)
+	c.maxBytes = 3000
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write(make([]byte, 1000))
+	})
+	get(c, "http://app.example.com/1", nil, next)
+	get(c, "http://app.example.com/2", nil, next)
+	get(c, "http://app.example.com/1", nil, next) // Now more recently used than /2
+	get(c, "http://app.example.com/3", nil, next)
+
+	// Only two responses fit, so /2 was evicted
+	for _, tt := range []struct{ path, want string }{{"/1", "HIT"}, {"/3", "HIT"}, {"/2", "MISS"}} {
+		if got := get(c, "http://app.example.com"+tt.path, nil, next).Header().Get("X-Cache"); got != tt.want {
+			t.Errorf("%s: X-Cache = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package httpcache
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+)
+
+// captureWriter records an upstream response while passing it through to the client. When
+// hold returns true for the status, the response is kept from the client entirely, so the
+// cache can answer instead (e.g., a 304 to its own revalidation, or an error it can hide).
+type captureWriter struct {
+	w        http.ResponseWriter // nil for background revalidation
+	hold     func(status int) bool
+	limit    int64
+	header   http.Header
+	status   int
+	held     bool
+	body     bytes.Buffer
+	overflow bool // The body exceeded limit and was not recorded in full
+}
+
+func newCaptureWriter(w http.ResponseWriter, limit int64, hold func(status int) bool) *captureWriter {
+	return &captureWriter{w: w, hold: hold, limit: limit, header: make(http.Header)}
+}
+
+func (cw *captureWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.status != 0 || status < 200 {
+		return // Informational responses aren't recorded
+	}
+	cw.status = status
+	cw.held = cw.w == nil || cw.hold(status)
+	if cw.held {
+		return
+	}
+	for name, values := range cw.header {
+		cw.w.Header()[name] = values
+	}
+	cw.w.Header().Set("X-Cache", "MISS")
+	cw.w.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.overflow {
+		if int64(cw.body.Len()+len(b)) > cw.limit {
+			cw.overflow = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(b)
+		}
+	}
+	if cw.held {
+		return len(b), nil
+	}
+	return cw.w.Write(b)
+}
+
+// Flush implements http.Flusher so streamed responses still reach the client promptly.
+func (cw *captureWriter) Flush() {
+	if !cw.held && cw.w != nil {
+		if flusher, ok := cw.w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+// truncated reports whether the recorded body is cut short, e.g., because the upstream or the
+// client went away mid-response.
+func (cw *captureWriter) truncated(r *http.Request) bool {
+	if r.Context().Err() != nil {
+		return true
+	}
+	if length, err := strconv.Atoi(cw.header.Get("Content-Length")); err == nil {
+		return length != cw.body.Len()
+	}
+	return false
+}
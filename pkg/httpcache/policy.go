@@ -0,0 +1,153 @@
+package httpcache
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"prism/pkg/storage"
+)
+
+// maxStaleWindow bounds the project defaults for stale-while-revalidate and stale-if-error.
+const maxStaleWindow = 7 * 24 * 60 * 60
+
+// ValidateConfig checks a project's cache settings. The stale windows are in seconds.
+func ValidateConfig(c *storage.CacheConfig) error {
+	if c.StaleWhileRevalidate < 0 || c.StaleWhileRevalidate > maxStaleWindow {
+		return fmt.Errorf("cache stale_while_revalidate must be between 0 and %d seconds", maxStaleWindow)
+	}
+	if c.StaleIfError < 0 || c.StaleIfError > maxStaleWindow {
+		return fmt.Errorf("cache stale_if_error must be between 0 and %d seconds", maxStaleWindow)
+	}
+	return nil
+}
+
+// cacheControl holds the directives of Cache-Control headers, lowercased, with their arguments.
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	cc := cacheControl{}
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the duration argument of a directive such as max-age.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	arg, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheableStatus lists the status codes that may be stored, per RFC 9110 section 15.1.
+var cacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// freshness describes how long a stored response may be served.
+type freshness struct {
+	lifetime             time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	mustRevalidate       bool // Never serve stale without revalidating first
+}
+
+// storable decides whether a response may be stored by a shared cache and for how long.
+// Responses without an explicit lifetime are still stored if they carry validators, so later
+// requests can be answered with a cheap revalidation.
+func storable(req *http.Request, status int, header http.Header, now time.Time, defaults freshness) (freshness, bool) {
+	if !cacheableStatus[status] {
+		return freshness{}, false
+	}
+	cc := parseCacheControl(header.Values("Cache-Control"))
+	if cc.has("no-store") || cc.has("private") || header.Get("Set-Cookie") != "" || header.Get("Vary") == "*" {
+		return freshness{}, false
+	}
+	if req.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return freshness{}, false
+	}
+
+	f := freshness{
+		staleWhileRevalidate: defaults.staleWhileRevalidate,
+		staleIfError:         defaults.staleIfError,
+		mustRevalidate:       cc.has("no-cache") || cc.has("must-revalidate") || cc.has("proxy-revalidate"),
+	}
+	if d, ok := cc.seconds("stale-while-revalidate"); ok {
+		f.staleWhileRevalidate = d
+	}
+	if d, ok := cc.seconds("stale-if-error"); ok {
+		f.staleIfError = d
+	}
+
+	explicit := true
+	if d, ok := cc.seconds("s-maxage"); ok {
+		f.lifetime = d
+	} else if d, ok := cc.seconds("max-age"); ok {
+		f.lifetime = d
+	} else if expires := header.Get("Expires"); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			date := now
+			if d, err := http.ParseTime(header.Get("Date")); err == nil {
+				date = d
+			}
+			f.lifetime = max(0, t.Sub(date))
+		}
+	} else if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil && status == http.StatusOK {
+		// Heuristic freshness: 10% of the time since the last modification, at most a day
+		f.lifetime = min(24*time.Hour, max(0, now.Sub(lastModified))/10)
+	} else {
+		explicit = false
+	}
+	if cc.has("no-cache") {
+		f.lifetime = 0
+	}
+
+	if !explicit && header.Get("ETag") == "" && header.Get("Last-Modified") == "" {
+		return freshness{}, false
+	}
+	return f, true
+}
+
+// hopByHopHeaders are not stored with a response.
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package httpcache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"prism/pkg/storage"
+)
+
+func TestStorable(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	defaults := freshness{staleWhileRevalidate: 10 * time.Second}
+	tests := []struct {
+		name          string
+		status        int
+		header        http.Header
+		authorization bool
+		want          freshness
+		wantOK        bool
+	}{
+		{
+			name:   "max-age",
+			status: 200,
+			header: http.Header{"Cache-Control": {"max-age=60"}},
+			want:   freshness{lifetime: time.Minute, staleWhileRevalidate: 10 * time.Second},
+			wantOK: true,
+		},
+		{
+			name:   "s-maxage wins over max-age",
+			status: 200,
+			header: http.Header{"Cache-Control": {"max-age=60, s-maxage=300"}},
+			want:   freshness{lifetime: 5 * time.Minute, staleWhileRevalidate: 10 * time.Second},
+			wantOK: true,
+		},
+		{
+			name:   "response overrides the project's stale windows",
+			status: 200,
+			header: http.Header{"Cache-Control": {"max-age=60, stale-while-revalidate=30, stale-if-error=600"}},
+			want:   freshness{lifetime: time.Minute, staleWhileRevalidate: 30 * time.Second, staleIfError: 10 * time.Minute},
+			wantOK: true,
+		},
+		{
+			name:   "Expires relative to Date",
+			status: 200,
+			header: http.Header{"Date": {now.Add(-time.Hour).Format(http.TimeFormat)}, "Expires": {now.Format(http.TimeFormat)}},
+			want:   freshness{lifetime: time.Hour, staleWhileRevalidate: 10 * time.Second},
+			wantOK: true,
+		},
+		{
+			name:   "heuristic from Last-Modified",
+			status: 200,
+			header: http.Header{"Last-Modified": {now.Add(-10 * time.Hour).Format(http.TimeFormat)}},
+			want:   freshness{lifetime: time.Hour, staleWhileRevalidate: 10 * time.Second},
+			wantOK: true,
+		},
+		{
+			name:   "heuristic is capped at a day",
+			status: 200,
+			header: http.Header{"Last-Modified": {now.Add(-365 * 24 * time.Hour).Format(http.TimeFormat)}},
+			want:   freshness{lifetime: 24 * time.Hour, staleWhileRevalidate: 10 * time.Second},
+			wantOK: true,
+		},
+		{
+			name:   "no-cache stores for revalidation only",
+			status: 200,
+			header: http.Header{"Cache-Control": {"no-cache, max-age=60"}},
+			want:   freshness{staleWhileRevalidate: 10 * time.Second, mustRevalidate: true},
+			wantOK: true,
+		},
+		{
+			name:   "ETag alone",
+			status: 200,
+			header: http.Header{"Etag": {`"v1"`}},
+			want:   freshness{staleWhileRevalidate: 10 * time.Second},
+			wantOK: true,
+		},
+		{
+			name:   "cacheable error status",
+			status: 404,
+			header: http.Header{"Cache-Control": {"max-age=60"}},
+			want:   freshness{lifetime: time.Minute, staleWhileRevalidate: 10 * time.Second},
+			wantOK: true,
+		},
+		{
+			name:          "public response to an authorized request",
+			status:        200,
+			header:        http.Header{"Cache-Control": {"public, max-age=60"}},
+			authorization: true,
+			want:          freshness{lifetime: time.Minute, staleWhileRevalidate: 10 * time.Second},
+			wantOK:        true,
+		},
+		{name: "uncacheable status", status: 500, header: http.Header{"Cache-Control": {"max-age=60"}}},
+		{name: "partial content", status: 206, header: http.Header{"Cache-Control": {"max-age=60"}}},
+		{name: "no-store", status: 200, header: http.Header{"Cache-Control": {"no-store"}}},
+		{name: "private", status: 200, header: http.Header{"Cache-Control": {"private, max-age=60"}}},
+		{name: "Vary *", status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}},
+		{name: "nothing to go by", status: 200, header: http.Header{}},
+		{name: "authorized request", status: 200, header: http.Header{"Cache-Control": {"max-age=60"}}, authorization: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{Header: http.Header{}}
+			if tt.authorization {
+				req.Header.Set("Authorization", "Bearer token")
+			}
+			got, ok := storable(req, tt.status, tt.header, now, defaults)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("storable = %+v, %v; want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch string
+		etag        string
+		want        bool
+	}{
+		{`"v1"`, `"v1"`, true},
+		{`W/"v1"`, `"v1"`, true},
+		{`"v1"`, `W/"v1"`, true},
+		{`"v0", "v1"`, `"v1"`, true},
+		{`*`, `"v1"`, true},
+		{`"v0"`, `"v1"`, false},
+		{``, `"v1"`, false},
+		{`*`, ``, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.ifNoneMatch, tt.etag); got != tt.want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", tt.ifNoneMatch, tt.etag, got, tt.want)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  storage.CacheConfig
+		wantErr bool
+	}{
+		{name: "enabled", config: storage.CacheConfig{Enabled: true}},
+		{name: "stale windows", config: storage.CacheConfig{Enabled: true, StaleWhileRevalidate: 60, StaleIfError: 86400}},
+		{name: "longest windows", config: storage.CacheConfig{StaleWhileRevalidate: maxStaleWindow, StaleIfError: maxStaleWindow}},
+		{name: "negative stale-while-revalidate", config: storage.CacheConfig{StaleWhileRevalidate: -1}, wantErr: true},
+		{name: "negative stale-if-error", config: storage.CacheConfig{StaleIfError: -1}, wantErr: true},
+		{name: "stale-while-revalidate too long", config: storage.CacheConfig{StaleWhileRevalidate: maxStaleWindow + 1}, wantErr: true},
+		{name: "stale-if-error too long", config: storage.CacheConfig{StaleIfError: maxStaleWindow + 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateConfig(&tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
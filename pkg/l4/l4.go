@@ -0,0 +1,370 @@
+// Package l4 proxies raw TCP for projects with TCP enabled. Each such project gets its own
+// listener; connections are checked against the project's IP rules as they are accepted and
+// then piped to the upstream byte for byte.
+package l4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"prism/pkg/cache"
+	"prism/pkg/conntrack"
+	"prism/pkg/denylist"
+	"prism/pkg/firewall"
+	"prism/pkg/logger"
+	"prism/pkg/proxy"
+	"prism/pkg/proxyproto"
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+const (
+	defaultConnectTimeout = 10 * time.Second
+	maxTCPTimeout         = 86400 // Seconds
+	copyBufferSize        = 32 << 10
+)
+
+// Server runs the listeners of every TCP project.
+type Server struct {
+	repo      *storage.Repository
+	ruleCache cache.RuleCache
+	conns     *conntrack.Table // May be nil
+	deny      *denylist.Set    // Shared with the HTTP listeners; may be nil
+	hub       *websockets.Hub
+
+	mu        sync.Mutex
+	listeners map[string]*listener // By project ID
+}
+
+// listener accepts connections for one project on its port.
+type listener struct {
+	ln      net.Listener
+	port    int
+	trusted []string                        // Peers allowed to send PROXY protocol headers
+	project atomic.Pointer[storage.Project] // Replaced when settings change; applies to new connections
+	deny    *denylist.Set                   // Fed from the project's ip_block rules
+	active  atomic.Int64
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{} // Client connections, closed with the listener
+}
+
+// NewServer creates a TCP proxy server. Register Sync with the router so listeners follow
+// project changes, router.OnRebuild(server.Sync), and RulesChanged with the rule cache so
+// listeners drop newly blocked addresses, ruleCache.OnClear(server.RulesChanged). Accepted
+// connections are added to conns, and addresses in deny are dropped on every listener; both
+// may be nil.
+func NewServer(repo *storage.Repository, ruleCache cache.RuleCache, conns *conntrack.Table, deny *denylist.Set, hub *websockets.Hub) *Server {
+	return &Server{
+		repo:      repo,
+		ruleCache: ruleCache,
+		conns:     conns,
+		deny:      deny,
+		hub:       hub,
+		listeners: make(map[string]*listener),
+	}
+}
+
+// Sync starts a listener for every TCP project that has none, moves listeners whose port
+// changed, and stops the listeners of projects that are gone or no longer TCP, closing their
+// connections. Projects whose port can't be bound are logged and retried on the next Sync.
+func (s *Server) Sync(projects []storage.Project) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[string]*storage.Project)
+	for i := range projects {
+		if projects[i].IsTCP() {
+			project := projects[i]
+			wanted[project.ID] = &project
+		}
+	}
+	for id, l := range s.listeners {
+		if project, ok := wanted[id]; !ok || project.TCP.ListenPort != l.port || !slices.Equal(project.TCP.ProxyProtocolFrom, l.trusted) {
+			l.close()
+			delete(s.listeners, id)
+			logger.LogAndBroadcast(s.hub, id, "Stopped TCP listener on port %d", l.port)
+		}
+	}
+	for id, project := range wanted {
+		if l, ok := s.listeners[id]; ok {
+			l.project.Store(project)
+			continue
+		}
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", project.TCP.ListenPort))
+		if err != nil {
+			logger.LogAndBroadcast(s.hub, id, "Cannot listen for TCP project '%s' on port %d: %v", project.Name, project.TCP.ListenPort, err)
+			continue
+		}
+		if len(project.TCP.ProxyProtocolFrom) > 0 {
+			// Read client addresses from the load balancer before the deny sets look at them
+			wrapped, err := proxyproto.NewListener(ln, project.TCP.ProxyProtocolFrom, 0)
+			if err != nil {
+				ln.Close()
+				logger.LogAndBroadcast(s.hub, id, "Cannot listen for TCP project '%s' on port %d: %v", project.Name, project.TCP.ListenPort, err)
+				continue
+			}
+			ln = wrapped
+		}
+		deny := denylist.New()
+		l := &listener{
+			ln:      denylist.Wrap(ln, fmt.Sprintf("tcp:%d", project.TCP.ListenPort), s.deny, deny, s.hub),
+			port:    project.TCP.ListenPort,
+			trusted: project.TCP.ProxyProtocolFrom,
+			deny:    deny,
+			conns:   make(map[net.Conn]struct{}),
+		}
+		l.project.Store(project)
+		s.loadDenyRules(l)
+		s.listeners[id] = l
+		logger.LogAndBroadcast(s.hub, id, "TCP project '%s' listening on port %d, proxying to %s", project.Name, l.port, project.TCP.Upstream)
+		go s.accept(l)
+	}
+}
+
+// Close stops every listener and closes their connections.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, l := range s.listeners {
+		l.close()
+		delete(s.listeners, id)
+	}
+}
+
+// RulesChanged reloads the ip_block rules a project's listener drops addresses by. It is meant
+// for the rule cache's OnClear hook, which runs whenever a project's rules change.
+func (s *Server) RulesChanged(projectID string) {
+	s.mu.Lock()
+	l, ok := s.listeners[projectID]
+	s.mu.Unlock()
+	if ok {
+		s.loadDenyRules(l)
+	}
+}
+
+// loadDenyRules feeds the project's enabled ip_block rules to its listener's deny set. The
+// rules are still checked after accept, which also covers ip_allow rules and values that are
+// neither IPs nor CIDRs.
+func (s *Server) loadDenyRules(l *listener) {
+	project := l.project.Load()
+	rules, err := s.rules(project)
+	if err != nil {
+		logger.LogAndBroadcast(s.hub, project.ID, "Error getting rules for project '%s'; its listener deny set is unchanged: %v", project.Name, err)
+		return
+	}
+	var blocked []string
+	for _, rule := range rules {
+		if rule.Enabled && rule.Type == "ip_block" {
+			blocked = append(blocked, rule.Value)
+		}
+	}
+	l.deny.Replace("rules", blocked) // Invalid values are left to the rule check after accept
+}
+
+func (s *Server) accept(l *listener) {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error accepting TCP connection on port %d: %v\n", l.port, err)
+			time.Sleep(50 * time.Millisecond) // e.g., out of file descriptors; don't spin
+			continue
+		}
+		go s.serve(l, conn)
+	}
+}
+
+// serve checks a client against the project's rules and limits, then pipes it to the upstream.
+func (s *Server) serve(l *listener, client net.Conn) {
+	project := l.project.Load()
+	settings := project.TCP
+	clientIP, _, _ := net.SplitHostPort(client.RemoteAddr().String())
+
+	rules, err := s.rules(project)
+	if err != nil {
+		logger.LogAndBroadcast(s.hub, project.ID, "Error getting rules for project '%s'; refused TCP connection from %s: %v", project.Name, clientIP, err)
+		client.Close()
+		return
+	}
+	if allowed, _ := firewall.ClientAllowed(rules, clientIP); !allowed {
+		logger.LogAndBroadcast(s.hub, project.ID, "Blocked TCP connection from IP: %s for project '%s'", clientIP, project.Name)
+		client.Close()
+		return
+	}
+	if s.conns != nil {
+		tracked := s.conns.Track(client, "tcp", "connecting")
+		tracked.SetProject(project.ID, settings.Upstream)
+		client = tracked
+	}
+	if !l.track(client, settings.MaxConnections) {
+		logger.LogAndBroadcast(s.hub, project.ID, "Refused TCP connection from %s for project '%s': %d connections already open", clientIP, project.Name, settings.MaxConnections)
+		client.Close()
+		return
+	}
+	defer l.untrack(client)
+
+	connectTimeout := defaultConnectTimeout
+	if settings.ConnectTimeout > 0 {
+		connectTimeout = time.Duration(settings.ConnectTimeout) * time.Second
+	}
+	upstream, err := net.DialTimeout("tcp", settings.Upstream, connectTimeout)
+	if err != nil {
+		logger.LogAndBroadcast(s.hub, project.ID, "TCP connection from %s for project '%s' failed: cannot reach upstream %s: %v", clientIP, project.Name, settings.Upstream, err)
+		client.Close()
+		return
+	}
+
+	if tracked, ok := client.(*conntrack.Conn); ok {
+		tracked.SetState("established")
+	}
+
+	started := time.Now()
+	logger.LogAndBroadcast(s.hub, project.ID, "TCP connection from %s to %s opened (%d active)", client.RemoteAddr(), settings.Upstream, l.active.Load())
+	bytesIn, bytesOut := pipe(client, upstream, time.Duration(settings.IdleTimeout)*time.Second)
+	logger.LogAndBroadcast(s.hub, project.ID, "TCP connection from %s to %s closed after %s: %d bytes in, %d bytes out (%d active)",
+		client.RemoteAddr(), settings.Upstream, time.Since(started).Round(time.Millisecond), bytesIn, bytesOut, l.active.Load()-1)
+}
+
+// rules returns the project's rules from the rule cache, loading them on a miss.
+func (s *Server) rules(project *storage.Project) ([]storage.Rule, error) {
+	if rules, found := s.ruleCache.Get(project.ID); found {
+		return rules, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rules, err := s.repo.GetRulesByProjectID(ctx, project.UserID, project.ID)
+	if err != nil {
+		return nil, err
+	}
+	s.ruleCache.Set(project.ID, rules)
+	return rules, nil
+}
+
+// track registers a client connection, unless max connections are already open.
+func (l *listener) track(conn net.Conn, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns == nil || (max > 0 && len(l.conns) >= max) {
+		return false // The listener is closed, or full
+	}
+	l.conns[conn] = struct{}{}
+	l.active.Add(1)
+	return true
+}
+
+func (l *listener) untrack(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.conns[conn]; ok {
+		delete(l.conns, conn)
+		l.active.Add(-1)
+	}
+}
+
+// close stops accepting and closes every open connection; their pipes then end on their own.
+func (l *listener) close() {
+	l.ln.Close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
+// pipe copies between client and upstream until both directions are done, and returns the
+// bytes received from the client and sent to it. A direction that ends cleanly half-closes its
+// destination so the other can finish; an error or idle timeout ends both.
+func pipe(client, upstream net.Conn, idle time.Duration) (bytesIn, bytesOut int64) {
+	var lastActivity atomic.Int64
+	lastActivity.Store(time.Now().UnixNano())
+	var in, out atomic.Int64
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn, n *atomic.Int64) {
+		defer wg.Done()
+		err := copyIdle(dst, src, n, &lastActivity, idle)
+		if err == nil {
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+				return
+			}
+		}
+		client.Close()
+		upstream.Close()
+	}
+	go copyHalf(upstream, client, &in)
+	go copyHalf(client, upstream, &out)
+	wg.Wait()
+	client.Close()
+	upstream.Close()
+	return in.Load(), out.Load()
+}
+
+// copyIdle copies src to dst, counting bytes into n. With an idle timeout, it fails once
+// neither direction has seen traffic for that long; it returns nil when src ends cleanly.
+func copyIdle(dst, src net.Conn, n, lastActivity *atomic.Int64, idle time.Duration) error {
+	buf := make([]byte, copyBufferSize)
+	for {
+		if idle > 0 {
+			src.SetReadDeadline(time.Now().Add(idle))
+		}
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			lastActivity.Store(time.Now().UnixNano())
+			nw, werr := dst.Write(buf[:nr])
+			n.Add(int64(nw))
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, lastActivity.Load())) < idle {
+				continue // The other direction is still active
+			}
+			return err
+		}
+	}
+}
+
+// ValidateTCPProxy checks TCP proxy settings before they are saved.
+func ValidateTCPProxy(settings *storage.TCPProxy) error {
+	if (settings.Enabled || settings.ListenPort != 0) && (settings.ListenPort < 1 || settings.ListenPort > 65535) {
+		return fmt.Errorf("listen_port must be between 1 and 65535")
+	}
+	if settings.Enabled || settings.Upstream != "" {
+		host, port, err := net.SplitHostPort(settings.Upstream)
+		if err != nil || host == "" || port == "" {
+			return fmt.Errorf("upstream must be 'host:port'")
+		}
+		if err := proxy.ValidateUpstreamHost(host); err != nil {
+			return err
+		}
+	}
+	if settings.ConnectTimeout < 0 || settings.ConnectTimeout > maxTCPTimeout || settings.IdleTimeout < 0 || settings.IdleTimeout > maxTCPTimeout {
+		return fmt.Errorf("connect_timeout and idle_timeout must be between 0 and %d seconds", maxTCPTimeout)
+	}
+	if settings.MaxConnections < 0 {
+		return fmt.Errorf("max_connections must not be negative")
+	}
+	if _, err := proxyproto.ParseTrusted(settings.ProxyProtocolFrom); err != nil {
+		return fmt.Errorf("proxy_protocol_from: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package l4
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"prism/pkg/cache"
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+// echoUpstream starts a TCP server on loopback that echoes whatever it receives.
+func echoUpstream(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// newTestServer returns a server whose rule cache already holds rules for project p1.
+func newTestServer(rules []storage.Rule) *Server {
+	hub := websockets.NewHub()
+	go hub.Run()
+	ruleCache := cache.NewInMemoryCache()
+	ruleCache.Set("p1", rules)
+	return NewServer(nil, ruleCache, nil, nil, hub)
+}
+
+// listen starts a listener for the project on a loopback port, as Sync would, and returns its
+// address.
+func listen(t *testing.T, s *Server, settings storage.TCPProxy) (string, *listener) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.Enabled = true
+	l := &listener{ln: ln, port: ln.Addr().(*net.TCPAddr).Port, conns: make(map[net.Conn]struct{})}
+	l.project.Store(&storage.Project{ID: "p1", Name: "test", TCP: &settings})
+	t.Cleanup(l.close)
+	go s.accept(l)
+	return ln.Addr().String(), l
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// echoes reports whether a message sent on conn comes back.
+func echoes(conn net.Conn) bool {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return false
+	}
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(conn, buf)
+	return err == nil && string(buf) == "ping"
+}
+
+// closedByProxy reports whether the proxy closed conn within wait.
+func closedByProxy(conn net.Conn, wait time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(wait))
+	_, err := conn.Read(make([]byte, 1))
+	var netErr net.Error
+	return err != nil && !(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func TestAcceptAppliesIPRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []storage.Rule
+		want  bool
+	}{
+		{name: "no rules", want: true},
+		{name: "blocked address", rules: []storage.Rule{{Type: "ip_block", Value: "127.0.0.1", Enabled: true}}},
+		{name: "blocked CIDR", rules: []storage.Rule{{Type: "ip_block", Value: "127.0.0.0/8", Enabled: true}}},
+		{name: "disabled block", rules: []storage.Rule{{Type: "ip_block", Value: "127.0.0.0/8"}}, want: true},
+		{name: "allowlisted", rules: []storage.Rule{{Type: "ip_allow", Value: "127.0.0.0/8", Enabled: true}}, want: true},
+		{name: "not allowlisted", rules: []storage.Rule{{Type: "ip_allow", Value: "10.0.0.0/8", Enabled: true}}},
+		{name: "allowlisted then blocked", rules: []storage.Rule{
+			{Type: "ip_allow", Value: "127.0.0.0/8", Enabled: true},
+			{Type: "ip_block", Value: "127.0.0.1/32", Enabled: true},
+		}},
+	}
+	upstream := echoUpstream(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, _ := listen(t, newTestServer(tt.rules), storage.TCPProxy{Upstream: upstream})
+			conn := dial(t, addr)
+			if tt.want && !echoes(conn) {
+				t.Error("an allowed client was not proxied")
+			}
+			if !tt.want && !closedByProxy(conn, 2*time.Second) {
+				t.Error("a rejected client was not disconnected")
+			}
+		})
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	addr, l := listen(t, newTestServer(nil), storage.TCPProxy{Upstream: echoUpstream(t), MaxConnections: 1})
+
+	first := dial(t, addr)
+	if !echoes(first) {
+		t.Fatal("the first connection was not proxied")
+	}
+	if second := dial(t, addr); !closedByProxy(second, 2*time.Second) {
+		t.Error("a connection over max_connections was accepted")
+	}
+
+	first.Close()
+	for deadline := time.Now().Add(2 * time.Second); l.active.Load() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the closed connection was never released")
+		}
+	}
+	if !echoes(dial(t, addr)) {
+		t.Error("a connection was refused after the slot was released")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	addr, _ := listen(t, newTestServer(nil), storage.TCPProxy{Upstream: echoUpstream(t), IdleTimeout: 1})
+	conn := dial(t, addr)
+	if !echoes(conn) {
+		t.Fatal("connection was not proxied")
+	}
+	started := time.Now()
+	if !closedByProxy(conn, 5*time.Second) {
+		t.Fatal("an idle connection was not closed")
+	}
+	if elapsed := time.Since(started); elapsed < 900*time.Millisecond {
+		t.Errorf("connection closed after %s, before the idle timeout", elapsed)
+	}
+}
+
+func TestSync(t *testing.T) {
+	// Find a free port for Sync to listen on
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	s := newTestServer(nil)
+	defer s.Close()
+	project := storage.Project{ID: "p1", Name: "test", TCP: &storage.TCPProxy{Enabled: true, ListenPort: port, Upstream: echoUpstream(t)}}
+	s.Sync([]storage.Project{project})
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	conn := dial(t, addr)
+	if !echoes(conn) {
+		t.Fatal("the synced listener did not proxy")
+	}
+
+	project.TCP = &storage.TCPProxy{ListenPort: port, Upstream: project.TCP.Upstream}
+	s.Sync([]storage.Project{project})
+	if !closedByProxy(conn, 2*time.Second) {
+		t.Error("disabling TCP left a connection open")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("disabling TCP left the port open")
+	}
+}
+
+func TestValidateTCPProxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings storage.TCPProxy
+		wantErr  bool
+	}{
+		{name: "valid", settings: storage.TCPProxy{Enabled: true, ListenPort: 15432, Upstream: "db.internal:5432", IdleTimeout: 3600}},
+		{name: "disabled and empty", settings: storage.TCPProxy{}},
+		{name: "no port", settings: storage.TCPProxy{Enabled: true, Upstream: "db.internal:5432"}, wantErr: true},
+		{name: "port out of range", settings: storage.TCPProxy{Enabled: true, ListenPort: 70000, Upstream: "db.internal:5432"}, wantErr: true},
+		{name: "upstream without port", settings: storage.TCPProxy{Enabled: true, ListenPort: 15432, Upstream: "db.internal"}, wantErr: true},
+		{name: "blocked upstream", settings: storage.TCPProxy{Enabled: true, ListenPort: 15432, Upstream: "169.254.169.254:80"}, wantErr: true},
+		{name: "timeout too long", settings: storage.TCPProxy{Enabled: true, ListenPort: 15432, Upstream: "db.internal:5432", ConnectTimeout: 86401}, wantErr: true},
+		{name: "negative max connections", settings: storage.TCPProxy{Enabled: true, ListenPort: 15432, Upstream: "db.internal:5432", MaxConnections: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateTCPProxy(&tt.settings); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
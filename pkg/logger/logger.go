@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 
@@ -13,3 +14,15 @@ func LogAndBroadcast(hub *websockets.Hub, projectID, format string, v ...interfa
 	log.Println(msg)
 	hub.BroadcastLog(projectID, msg)
 }
+
+// BroadcastEvent logs and broadcasts a structured event as a single JSON line, so log
+// consumers can parse it instead of matching message text.
+func BroadcastEvent(hub *websockets.Hub, projectID string, event interface{}) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding event: %v\n", err)
+		return
+	}
+	log.Println(string(line))
+	hub.BroadcastLog(projectID, string(line))
+}
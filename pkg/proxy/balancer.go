@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"prism/pkg/storage"
+)
+
+// affinityCookie pins a client to a target when a pool uses Prism-issued cookies.
+const affinityCookie = "prism_upstream"
+
+// Passive health defaults for upstream pools.
+const (
+	defaultFailureThreshold = 3
+	defaultFailureCooldown  = 30 * time.Second
+	maxPoolTargets          = 64
+)
+
+// pool is the balancing state of one project's targets.
+type pool struct {
+	next atomic.Uint64 // Round-robin position
+
+	mu     sync.Mutex
+	health map[string]*targetHealth
+}
+
+// targetHealth tracks consecutive failures of one target; it is out of rotation until downUntil.
+type targetHealth struct {
+	failures  int
+	downUntil time.Time
+}
+
+// poolTargets returns every target of a project: its upstream URL followed by the pool's targets.
+func poolTargets(project *storage.Project) []string {
+	targets := []string{project.UpstreamURL}
+	for _, target := range project.UpstreamPool.Targets {
+		if target != project.UpstreamURL {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// SelectTarget picks the target of the project's upstream pool that serves r, and returns the
+// project as the proxy should see it: a copy pointing at that target. Projects without a pool
+// are returned as they are. Clients pinned to a target that became unhealthy move to another
+// healthy one, and to it alone; with a Prism-issued cookie, the cookie is reissued for it.
+func (f *Factory) SelectTarget(w http.ResponseWriter, r *http.Request, project *storage.Project, cookiePath string) *storage.Project {
+	settings := project.UpstreamPool
+	if settings == nil || len(settings.Targets) == 0 {
+		return project
+	}
+	targets := poolTargets(project)
+	p := f.poolFor(project.ID)
+	healthy := p.healthy(targets, time.Now())
+
+	var target string
+	switch settings.Affinity {
+	case "cookie":
+		if cookie, err := r.Cookie(affinityCookie); err == nil {
+			for _, candidate := range healthy {
+				if targetID(candidate) == cookie.Value {
+					target = candidate
+				}
+			}
+		}
+		if target == "" {
+			target = healthy[p.next.Add(1)%uint64(len(healthy))]
+			if cookiePath == "" {
+				cookiePath = "/"
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     affinityCookie,
+				Value:    targetID(target),
+				Path:     cookiePath,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+	case "ip", "hash":
+		if key := affinityKey(r, settings); key != "" {
+			target = rendezvous(healthy, key)
+		}
+	}
+	if target == "" {
+		target = healthy[p.next.Add(1)%uint64(len(healthy))]
+	}
+
+	selected := *project
+	selected.UpstreamURL = target
+	return &selected
+}
+
+// affinityKey returns the value a hashed pool pins clients by, or "" if the request has none.
+func affinityKey(r *http.Request, settings *storage.UpstreamPool) string {
+	if settings.Affinity == "ip" {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return ip
+	}
+	source, name, _ := strings.Cut(settings.HashOn, ":")
+	if source == "header" {
+		return r.Header.Get(name)
+	}
+	if cookie, err := r.Cookie(name); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// rendezvous picks the target with the highest hash for key. Removing a target only moves the
+// keys that were on it, and they return when it comes back.
+func rendezvous(targets []string, key string) string {
+	var best string
+	var bestScore uint64
+	for _, target := range targets {
+		h := fnv.New64a()
+		h.Write([]byte(key + "\x00" + target))
+		if score := h.Sum64(); best == "" || score > bestScore {
+			best, bestScore = target, score
+		}
+	}
+	return best
+}
+
+// targetID identifies a target in the affinity cookie without revealing its URL.
+func targetID(target string) string {
+	h := fnv.New64a()
+	h.Write([]byte(target))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func (f *Factory) poolFor(projectID string) *pool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.pools[projectID]
+	if !ok {
+		p = &pool{health: make(map[string]*targetHealth)}
+		f.pools[projectID] = p
+	}
+	return p
+}
+
+// healthy returns the targets in rotation at now. If every target is down, all are returned:
+// trying one is better than failing every request.
+func (p *pool) healthy(targets []string, now time.Time) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var up []string
+	for _, target := range targets {
+		if h, ok := p.health[target]; !ok || !now.Before(h.downUntil) {
+			up = append(up, target)
+		}
+	}
+	if len(up) == 0 {
+		return targets
+	}
+	return up
+}
+
+// reportTarget records the outcome of a request to one of a project's pool targets. After the
+// pool's failure threshold of consecutive failures, the target is taken out of rotation for the
+// cooldown, then given another chance.
+func (f *Factory) reportTarget(project *storage.Project, target string, ok bool) {
+	settings := project.UpstreamPool
+	if settings == nil || len(settings.Targets) == 0 {
+		return
+	}
+	p := f.poolFor(project.ID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, tracked := p.health[target]
+	if ok {
+		if tracked {
+			delete(p.health, target)
+		}
+		return
+	}
+	if !tracked {
+		h = &targetHealth{}
+		p.health[target] = h
+	}
+	h.failures++
+	threshold := settings.FailureThreshold
+	if threshold <= 0 {
+		threshold = defaultFailureThreshold
+	}
+	if h.failures >= threshold {
+		cooldown := defaultFailureCooldown
+		if settings.Cooldown > 0 {
+			cooldown = time.Duration(settings.Cooldown) * time.Second
+		}
+		h.downUntil = time.Now().Add(cooldown)
+		h.failures = 0
+	}
+}
+
+// ValidateUpstreamPool checks upstream pool settings before they are saved.
+func ValidateUpstreamPool(settings *storage.UpstreamPool) error {
+	if len(settings.Targets) > maxPoolTargets {
+		return fmt.Errorf("an upstream pool can have at most %d targets", maxPoolTargets)
+	}
+	for _, target := range settings.Targets {
+		if err := ValidateUpstreamURL(target); err != nil {
+			return fmt.Errorf("pool target '%s': %w", target, err)
+		}
+	}
+	switch settings.Affinity {
+	case "", "cookie", "ip":
+	case "hash":
+		source, name, _ := strings.Cut(settings.HashOn, ":")
+		if (source != "header" && source != "cookie") || name == "" {
+			return fmt.Errorf("hash_on must be 'header:<name>' or 'cookie:<name>'")
+		}
+	default:
+		return fmt.Errorf("affinity must be '', 'cookie', 'hash' or 'ip'")
+	}
+	if settings.FailureThreshold < 0 || settings.Cooldown < 0 {
+		return fmt.Errorf("failure_threshold and cooldown must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"prism/pkg/storage"
+)
+
+func poolProject(affinity, hashOn string) *storage.Project {
+	return &storage.Project{
+		ID:          "p1",
+		UpstreamURL: "http://a:8080",
+		UpstreamPool: &storage.UpstreamPool{
+			Targets:          []string{"http://a:8080", "http://b:8080", "http://c:8080"},
+			Affinity:         affinity,
+			HashOn:           hashOn,
+			FailureThreshold: 2,
+		},
+	}
+}
+
+// selectFor returns the target chosen for r and any affinity cookie set for it.
+func selectFor(f *Factory, project *storage.Project, r *http.Request) (string, *http.Cookie) {
+	w := httptest.NewRecorder()
+	selected := f.SelectTarget(w, r, project, "/app")
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == affinityCookie {
+			return selected.UpstreamURL, cookie
+		}
+	}
+	return selected.UpstreamURL, nil
+}
+
+// takeDown reports enough failures to take target out of rotation.
+func takeDown(f *Factory, project *storage.Project, target string) {
+	for i := 0; i < project.UpstreamPool.FailureThreshold; i++ {
+		f.reportTarget(project, target, false)
+	}
+}
+
+func TestSelectTargetWithoutPool(t *testing.T) {
+	f := NewFactory(nil)
+	for _, project := range []*storage.Project{
+		{ID: "p1", UpstreamURL: "http://a:8080"},
+		{ID: "p1", UpstreamURL: "http://a:8080", UpstreamPool: &storage.UpstreamPool{}},
+	} {
+		if got := f.SelectTarget(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), project, ""); got != project {
+			t.Errorf("expected a project without pool targets to be used as is")
+		}
+	}
+}
+
+func TestSelectTargetRoundRobin(t *testing.T) {
+	f := NewFactory(nil)
+	project := poolProject("", "")
+	counts := map[string]int{}
+	for i := 0; i < 30; i++ {
+		target, cookie := selectFor(f, project, httptest.NewRequest("GET", "/", nil))
+		if cookie != nil {
+			t.Fatal("round robin must not set an affinity cookie")
+		}
+		counts[target]++
+	}
+	for _, target := range project.UpstreamPool.Targets {
+		if counts[target] != 10 {
+			t.Errorf("%s got %d of 30 requests, want 10", target, counts[target])
+		}
+	}
+	if project.UpstreamURL != "http://a:8080" {
+		t.Error("SelectTarget must not modify the project it is given")
+	}
+}
+
+func TestSelectTargetCookieAffinity(t *testing.T) {
+	f := NewFactory(nil)
+	project := poolProject("cookie", "")
+
+	first, cookie := selectFor(f, project, httptest.NewRequest("GET", "/app/", nil))
+	if cookie == nil || cookie.Path != "/app" || !cookie.HttpOnly {
+		t.Fatalf("expected an HttpOnly affinity cookie for /app, got %+v", cookie)
+	}
+	for i := 0; i < 5; i++ {
+		r := httptest.NewRequest("GET", "/app/", nil)
+		r.AddCookie(cookie)
+		target, reissued := selectFor(f, project, r)
+		if target != first || reissued != nil {
+			t.Fatalf("pinned client moved from %s to %s (cookie reissued: %v)", first, target, reissued != nil)
+		}
+	}
+
+	// The pinned target fails: the client moves, and stays on its new target
+	takeDown(f, project, first)
+	r := httptest.NewRequest("GET", "/app/", nil)
+	r.AddCookie(cookie)
+	moved, reissued := selectFor(f, project, r)
+	if moved == first || reissued == nil || reissued.Value == cookie.Value {
+		t.Fatalf("expected the client to move off %s with a new cookie, got %s", first, moved)
+	}
+	r = httptest.NewRequest("GET", "/app/", nil)
+	r.AddCookie(reissued)
+	if target, _ := selectFor(f, project, r); target != moved {
+		t.Errorf("client moved again from %s to %s", moved, target)
+	}
+
+	// A cookie for a target that isn't in the pool is replaced
+	r = httptest.NewRequest("GET", "/app/", nil)
+	r.AddCookie(&http.Cookie{Name: affinityCookie, Value: "unknown"})
+	if _, reissued := selectFor(f, project, r); reissued == nil {
+		t.Error("expected an unknown affinity cookie to be replaced")
+	}
+}
+
+func TestSelectTargetHashAffinity(t *testing.T) {
+	tests := []struct {
+		name     string
+		affinity string
+		hashOn   string
+		request  func(key string) *http.Request
+	}{
+		{
+			name:     "ip",
+			affinity: "ip",
+			request: func(key string) *http.Request {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.RemoteAddr = key + ":40000"
+				return r
+			},
+		},
+		{
+			name:     "header",
+			affinity: "hash",
+			hashOn:   "header:X-Tenant",
+			request: func(key string) *http.Request {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.Header.Set("X-Tenant", key)
+				return r
+			},
+		},
+		{
+			name:     "cookie",
+			affinity: "hash",
+			hashOn:   "cookie:session",
+			request: func(key string) *http.Request {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.AddCookie(&http.Cookie{Name: "session", Value: key})
+				return r
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFactory(nil)
+			project := poolProject(tt.affinity, tt.hashOn)
+
+			keys := make([]string, 60)
+			before := map[string]string{}
+			used := map[string]bool{}
+			for i := range keys {
+				keys[i] = fmt.Sprintf("10.0.0.%d", i+1)
+				before[keys[i]], _ = selectFor(f, project, tt.request(keys[i]))
+				used[before[keys[i]]] = true
+				if again, _ := selectFor(f, project, tt.request(keys[i])); again != before[keys[i]] {
+					t.Fatalf("key %s moved from %s to %s", keys[i], before[keys[i]], again)
+				}
+			}
+			if len(used) != 3 {
+				t.Errorf("expected keys to spread over every target, used %d", len(used))
+			}
+
+			// Only the keys on a failed target move, and they come back when it recovers
+			down := "http://b:8080"
+			takeDown(f, project, down)
+			for _, key := range keys {
+				target, _ := selectFor(f, project, tt.request(key))
+				if target == down || (before[key] != down && target != before[key]) {
+					t.Errorf("key %s went from %s to %s while %s was down", key, before[key], target, down)
+				}
+			}
+			f.reportTarget(project, down, true)
+			for _, key := range keys {
+				if target, _ := selectFor(f, project, tt.request(key)); target != before[key] {
+					t.Errorf("key %s is on %s after recovery, want %s", key, target, before[key])
+				}
+			}
+		})
+	}
+}
+
+func TestSelectTargetFailover(t *testing.T) {
+	f := NewFactory(nil)
+	project := poolProject("", "")
+
+	// Failures below the threshold, or interrupted by a success, keep a target in rotation
+	f.reportTarget(project, "http://a:8080", false)
+	f.reportTarget(project, "http://a:8080", true)
+	f.reportTarget(project, "http://a:8080", false)
+	if got := f.poolFor(project.ID).healthy(poolTargets(project), time.Now()); len(got) != 3 {
+		t.Fatalf("expected every target in rotation, have %v", got)
+	}
+
+	takeDown(f, project, "http://a:8080")
+	takeDown(f, project, "http://b:8080")
+	for i := 0; i < 10; i++ {
+		if target, _ := selectFor(f, project, httptest.NewRequest("GET", "/", nil)); target != "http://c:8080" {
+			t.Fatalf("expected only the healthy target to be used, got %s", target)
+		}
+	}
+
+	// With every target down, all of them are tried rather than failing every request
+	takeDown(f, project, "http://c:8080")
+	used := map[string]bool{}
+	for i := 0; i < 9; i++ {
+		target, _ := selectFor(f, project, httptest.NewRequest("GET", "/", nil))
+		used[target] = true
+	}
+	if len(used) != 3 {
+		t.Errorf("expected every target to be tried when all are down, used %d", len(used))
+	}
+
+	// Targets are back once the cooldown has passed
+	later := time.Now().Add(defaultFailureCooldown + time.Second)
+	if got := f.poolFor(project.ID).healthy(poolTargets(project), later); len(got) != 3 {
+		t.Errorf("expected every target back after the cooldown, have %v", got)
+	}
+}
+
+func TestValidateUpstreamPool(t *testing.T) {
+	many := make([]string, maxPoolTargets+1)
+	for i := range many {
+		many[i] = fmt.Sprintf("http://10.0.0.%d:8080", i+1)
+	}
+	tests := []struct {
+		name    string
+		pool    storage.UpstreamPool
+		wantErr bool
+	}{
+		{name: "round robin", pool: storage.UpstreamPool{Targets: []string{"http://a:8080"}}},
+		{name: "cookie", pool: storage.UpstreamPool{Targets: []string{"http://a:8080"}, Affinity: "cookie"}},
+		{name: "hash on header", pool: storage.UpstreamPool{Affinity: "hash", HashOn: "header:X-Tenant"}},
+		{name: "too many targets", pool: storage.UpstreamPool{Targets: many}, wantErr: true},
+		{name: "invalid target", pool: storage.UpstreamPool{Targets: []string{"ftp://a"}}, wantErr: true},
+		{name: "unknown affinity", pool: storage.UpstreamPool{Affinity: "sticky"}, wantErr: true},
+		{name: "hash without source", pool: storage.UpstreamPool{Affinity: "hash", HashOn: "X-Tenant"}, wantErr: true},
+		{name: "hash without name", pool: storage.UpstreamPool{Affinity: "hash", HashOn: "cookie:"}, wantErr: true},
+		{name: "negative threshold", pool: storage.UpstreamPool{FailureThreshold: -1}, wantErr: true},
+		{name: "negative cooldown", pool: storage.UpstreamPool{Cooldown: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateUpstreamPool(&tt.pool); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
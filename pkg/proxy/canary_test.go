@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"prism/pkg/storage"
+)
+
+func canaryProject(c storage.Canary) *storage.Project {
+	c.Enabled = true
+	if c.UpstreamURL == "" {
+		c.UpstreamURL = "http://canary:8080"
+	}
+	return &storage.Project{ID: "p1", UpstreamURL: "http://stable:8080", Canary: &c}
+}
+
+// selectArm runs SelectArm for a client, returning the arm and the cookie it was given, if any.
+func selectArm(project *storage.Project, remoteAddr string, cookies []*http.Cookie, header http.Header, cookiePath string) (string, *http.Cookie) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = remoteAddr
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	arm := SelectArm(w, r, project, cookiePath)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == canaryCookie {
+			return arm, cookie
+		}
+	}
+	return arm, nil
+}
+
+func TestSelectArmOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		canary  storage.Canary
+		header  http.Header
+		cookies []*http.Cookie
+		want    string
+	}{
+		{name: "header with any value", canary: storage.Canary{Header: "X-Canary"}, header: http.Header{"X-Canary": {"yes"}}, want: ArmCanary},
+		{name: "header with the value", canary: storage.Canary{Header: "X-Canary", HeaderValue: "1"}, header: http.Header{"X-Canary": {"1"}}, want: ArmCanary},
+		{name: "header with another value", canary: storage.Canary{Header: "X-Canary", HeaderValue: "1"}, header: http.Header{"X-Canary": {"2"}}, want: ArmStable},
+		{name: "cookie with any value", canary: storage.Canary{Cookie: "beta"}, cookies: []*http.Cookie{{Name: "beta", Value: "x"}}, want: ArmCanary},
+		{name: "cookie with another value", canary: storage.Canary{Cookie: "beta", CookieValue: "on"}, cookies: []*http.Cookie{{Name: "beta", Value: "off"}}, want: ArmStable},
+		{name: "header beats weight", canary: storage.Canary{Header: "X-Canary", Weight: 0}, header: http.Header{"X-Canary": {"1"}}, want: ArmCanary},
+		{name: "no weight", canary: storage.Canary{Weight: 0}, want: ArmStable},
+		{name: "full weight", canary: storage.Canary{Weight: 100}, want: ArmCanary},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := selectArm(canaryProject(tt.canary), "203.0.113.7:5000", tt.cookies, tt.header, ""); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	disabled := canaryProject(storage.Canary{Weight: 100})
+	disabled.Canary.Enabled = false
+	if got, cookie := selectArm(disabled, "203.0.113.7:5000", nil, nil, ""); got != ArmStable || cookie != nil {
+		t.Errorf("disabled canary: arm %s, cookie %v", got, cookie)
+	}
+}
+
+func TestSelectArmSticky(t *testing.T) {
+	project := canaryProject(storage.Canary{Weight: 30})
+
+	arm, cookie := selectArm(project, "203.0.113.7:5000", nil, nil, "/app")
+	if cookie == nil {
+		t.Fatal("a new client got no canary cookie")
+	}
+	if cookie.Path != "/app" || !cookie.HttpOnly || !canaryClientID.MatchString(cookie.Value) {
+		t.Errorf("cookie = %+v", cookie)
+	}
+	if _, rootCookie := selectArm(project, "203.0.113.7:5000", nil, nil, ""); rootCookie.Path != "/" {
+		t.Errorf("cookie path for a hostname match = %q, want /", rootCookie.Path)
+	}
+
+	// The same address gets the same ID from any port, and the cookie keeps it after an IP change
+	if again, sameCookie := selectArm(project, "203.0.113.7:6000", nil, nil, "/app"); again != arm || sameCookie.Value != cookie.Value {
+		t.Errorf("same address: arm %s, ID %s; want %s, %s", again, sameCookie.Value, arm, cookie.Value)
+	}
+	for i := 0; i < 10; i++ {
+		got, newCookie := selectArm(project, fmt.Sprintf("198.51.100.%d:5000", i), []*http.Cookie{cookie}, nil, "/app")
+		if got != arm || newCookie != nil {
+			t.Fatalf("client with cookie from another address: arm %s, new cookie %v", got, newCookie)
+		}
+	}
+
+	if _, replaced := selectArm(project, "203.0.113.7:5000", []*http.Cookie{{Name: canaryCookie, Value: "not-an-id"}}, nil, "/app"); replaced == nil {
+		t.Error("a malformed client ID was kept")
+	}
+}
+
+func TestSelectArmWeights(t *testing.T) {
+	const clients = 2000
+	onCanary := map[string]bool{}
+	for _, weight := range []int{10, 30, 60} {
+		project := canaryProject(storage.Canary{Weight: weight})
+		count := 0
+		for i := 0; i < clients; i++ {
+			id := &http.Cookie{Name: canaryCookie, Value: fmt.Sprintf("%016x", i*7919)}
+			arm, _ := selectArm(project, "203.0.113.7:5000", []*http.Cookie{id}, nil, "")
+			if arm == ArmCanary {
+				count++
+				onCanary[id.Value] = true
+			} else if onCanary[id.Value] {
+				t.Fatalf("client %s moved back to stable when the weight rose to %d", id.Value, weight)
+			}
+		}
+		if share := count * 100 / clients; share < weight-5 || share > weight+5 {
+			t.Errorf("weight %d sent %d%% of clients to the canary", weight, share)
+		}
+	}
+}
+
+func TestArmProject(t *testing.T) {
+	project := canaryProject(storage.Canary{Weight: 50})
+	if ArmProject(project, ArmStable) != project {
+		t.Error("the stable arm should use the project as-is")
+	}
+	canary := ArmProject(project, ArmCanary)
+	if canary.UpstreamURL != "http://canary:8080" || canary.ID != project.ID || project.UpstreamURL != "http://stable:8080" {
+		t.Errorf("canary upstream %s, ID %s; project upstream %s", canary.UpstreamURL, canary.ID, project.UpstreamURL)
+	}
+}
+
+func TestValidateCanary(t *testing.T) {
+	tests := []struct {
+		name    string
+		canary  storage.Canary
+		wantErr bool
+	}{
+		{name: "valid", canary: storage.Canary{Enabled: true, UpstreamURL: "https://canary.internal", Weight: 10}},
+		{name: "disabled and empty", canary: storage.Canary{}},
+		{name: "weight too high", canary: storage.Canary{Enabled: true, UpstreamURL: "http://c", Weight: 101}, wantErr: true},
+		{name: "negative weight", canary: storage.Canary{Enabled: true, UpstreamURL: "http://c", Weight: -1}, wantErr: true},
+		{name: "no upstream", canary: storage.Canary{Enabled: true}, wantErr: true},
+		{name: "relative upstream", canary: storage.Canary{Enabled: true, UpstreamURL: "/canary"}, wantErr: true},
+		{name: "cookie value without cookie", canary: storage.Canary{CookieValue: "on"}, wantErr: true},
+		{name: "header value without header", canary: storage.Canary{HeaderValue: "1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateCanary(&tt.canary); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"prism/pkg/storage"
+)
+
+// defaultCompressMinSize is the smallest body worth compressing when a project doesn't set one.
+const defaultCompressMinSize = 1024
+
+// defaultCompressTypes are compressed when a project doesn't list its own MIME types.
+var defaultCompressTypes = []string{
+	"text/html", "text/css", "text/plain", "text/xml", "text/javascript",
+	"application/javascript", "application/json", "application/xml",
+	"application/manifest+json", "image/svg+xml",
+}
+
+// maxCompressMinSize bounds min_size, since bodies of unknown length are buffered up to it.
+const maxCompressMinSize = 10 << 20
+
+// compressionEncodings are the codings Prism can produce, in order of preference on a tie.
+var compressionEncodings = []string{"gzip", "deflate"}
+
+// acceptEncodingKey stores the client's Accept-Encoding in the outbound request's context,
+// since the Director may change the header sent upstream.
+type acceptEncodingKey struct{}
+
+// negotiateEncoding picks the coding with the highest q-value in an Accept-Encoding header,
+// or "" if the client accepts none that Prism produces.
+func negotiateEncoding(acceptEncoding string) string {
+	best, bestQ := "", 0.0
+	for _, coding := range compressionEncodings {
+		q := encodingQuality(acceptEncoding, coding)
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// encodingQuality returns the q-value a client gives a coding, using "*" as a fallback.
+func encodingQuality(acceptEncoding, coding string) float64 {
+	q, wildcard := -1.0, -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				quality = parsed
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case coding:
+			q = quality
+		case "*":
+			wildcard = quality
+		}
+	}
+	if q >= 0 {
+		return q
+	}
+	return max(wildcard, 0)
+}
+
+// compressResponse compresses an upstream response the client can decode, unless it is
+// already encoded, too small, of a type not worth compressing, or marked no-transform.
+func compressResponse(resp *http.Response, cfg *storage.CompressionConfig) error {
+	if resp.Request.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusPartialContent {
+		return nil
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return nil
+	}
+	if strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !compressibleType(mediaType, cfg.MimeTypes) {
+		return nil
+	}
+
+	// The response depends on Accept-Encoding from here on, even for clients that get it plain.
+	if !varies(resp.Header, "Accept-Encoding") {
+		resp.Header.Add("Vary", "Accept-Encoding")
+	}
+
+	acceptEncoding, _ := resp.Request.Context().Value(acceptEncodingKey{}).(string)
+	encoding := negotiateEncoding(acceptEncoding)
+	if encoding == "" {
+		return nil
+	}
+
+	minSize := int64(cfg.MinSize)
+	if minSize <= 0 {
+		minSize = defaultCompressMinSize
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < minSize {
+		return nil
+	}
+	if resp.ContentLength < 0 {
+		// Unknown length: look at the start of the body to see whether it is big enough.
+		head := make([]byte, minSize)
+		n, err := io.ReadFull(resp.Body, head)
+		body := readCloser{io.MultiReader(bytes.NewReader(head[:n]), resp.Body), resp.Body}
+		resp.Body = body
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	resp.Body = reencode(resp.Body, func(w io.Writer) io.WriteCloser {
+		if encoding == "deflate" {
+			return zlib.NewWriter(w)
+		}
+		return gzip.NewWriter(w)
+	})
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
+
+// varies reports whether a response's Vary header already covers a request header.
+func varies(header http.Header, name string) bool {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field == "*" || strings.EqualFold(field, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compressibleType reports whether a media type is in the allowlist. Entries may end in
+// "/*" to match a whole family, e.g., "text/*". Event streams are never compressed, since
+// buffering in the compressor would hold back events.
+func compressibleType(mediaType string, allowed []string) bool {
+	if mediaType == "" || mediaType == "text/event-stream" {
+		return false
+	}
+	if len(allowed) == 0 {
+		allowed = defaultCompressTypes
+	}
+	for _, pattern := range allowed {
+		if family, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, family+"/") {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateCompression checks a project's compression settings. MIME types must be lowercase
+// media types without parameters, or a family such as "text/*".
+func ValidateCompression(c *storage.CompressionConfig) error {
+	if c.MinSize < 0 || c.MinSize > maxCompressMinSize {
+		return fmt.Errorf("compression min_size must be between 0 and %d bytes", maxCompressMinSize)
+	}
+	for _, pattern := range c.MimeTypes {
+		mediaType, params, err := mime.ParseMediaType(pattern)
+		family, subtype, _ := strings.Cut(mediaType, "/")
+		if err != nil || len(params) > 0 || mediaType != pattern || family == "*" || subtype == "" ||
+			(subtype != "*" && strings.Contains(subtype, "*")) {
+			return fmt.Errorf("compression mime_types: invalid MIME type %q", pattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"prism/pkg/storage"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"gzip, deflate, br", "gzip"},
+		{"deflate, gzip", "gzip"}, // gzip wins ties
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"GZIP", "gzip"},
+		{"br, zstd", ""},
+		{"*", "gzip"},
+		{"*;q=0.2, gzip;q=0.1", "deflate"},
+		{"gzip;q=0, deflate;q=0", ""},
+		{"identity", ""},
+		{"*;q=0", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.acceptEncoding); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func TestCompressResponse(t *testing.T) {
+	body := strings.Repeat("hello, world ", 200)
+	tests := []struct {
+		name           string
+		method         string
+		status         int
+		header         http.Header
+		body           string
+		unknownLength  bool
+		acceptEncoding string
+		cfg            storage.CompressionConfig
+		wantEncoding   string
+		wantVary       []string
+	}{
+		{
+			name:           "compressed",
+			header:         http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+			acceptEncoding: "gzip",
+			wantEncoding:   "gzip",
+			wantVary:       []string{"Accept-Encoding"},
+		},
+		{
+			name:           "unknown length",
+			header:         http.Header{"Content-Type": {"application/json"}},
+			unknownLength:  true,
+			acceptEncoding: "gzip",
+			wantEncoding:   "gzip",
+			wantVary:       []string{"Accept-Encoding"},
+		},
+		{
+			name:           "Vary already lists Accept-Encoding",
+			header:         http.Header{"Content-Type": {"text/html"}, "Vary": {"Origin, accept-encoding"}},
+			acceptEncoding: "gzip",
+			wantEncoding:   "gzip",
+			wantVary:       []string{"Origin, accept-encoding"},
+		},
+		{
+			name:           "Vary lists another header",
+			header:         http.Header{"Content-Type": {"text/html"}, "Vary": {"Origin"}},
+			acceptEncoding: "gzip",
+			wantEncoding:   "gzip",
+			wantVary:       []string{"Origin", "Accept-Encoding"},
+		},
+		{
+			name:           "custom type family",
+			header:         http.Header{"Content-Type": {"application/vnd.api+json"}},
+			acceptEncoding: "gzip",
+			cfg:            storage.CompressionConfig{MimeTypes: []string{"application/*"}},
+			wantEncoding:   "gzip",
+			wantVary:       []string{"Accept-Encoding"},
+		},
+		{
+			name:     "client accepts no coding",
+			header:   http.Header{"Content-Type": {"text/html"}},
+			wantVary: []string{"Accept-Encoding"},
+		},
+		{
+			name:           "too small",
+			header:         http.Header{"Content-Type": {"text/html"}},
+			body:           "hello",
+			acceptEncoding: "gzip",
+			wantVary:       []string{"Accept-Encoding"},
+		},
+		{
+			name:           "too small with unknown length",
+			header:         http.Header{"Content-Type": {"text/html"}},
+			body:           "hello",
+			unknownLength:  true,
+			acceptEncoding: "gzip",
+			wantVary:       []string{"Accept-Encoding"},
+		},
+		{
+			name:           "below a custom min_size",
+			header:         http.Header{"Content-Type": {"text/html"}},
+			acceptEncoding: "gzip",
+			cfg:            storage.CompressionConfig{MinSize: len(body) + 1},
+			wantVary:       []string{"Accept-Encoding"},
+		},
+		{
+			name:           "already encoded",
+			header:         http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"br"}},
+			acceptEncoding: "gzip",
+		},
+		{
+			name:           "no-transform",
+			header:         http.Header{"Content-Type": {"text/html"}, "Cache-Control": {"public, no-transform"}},
+			acceptEncoding: "gzip",
+		},
+		{
+			name:           "type outside the allowlist",
+			header:         http.Header{"Content-Type": {"image/png"}},
+			acceptEncoding: "gzip",
+		},
+		{
+			name:           "event stream",
+			header:         http.Header{"Content-Type": {"text/event-stream"}},
+			acceptEncoding: "gzip",
+			cfg:            storage.CompressionConfig{MimeTypes: []string{"text/*"}},
+		},
+		{
+			name:           "no content type",
+			header:         http.Header{},
+			acceptEncoding: "gzip",
+		},
+		{
+			name:           "HEAD",
+			method:         http.MethodHead,
+			header:         http.Header{"Content-Type": {"text/html"}},
+			acceptEncoding: "gzip",
+		},
+		{
+			name:           "partial content",
+			status:         http.StatusPartialContent,
+			header:         http.Header{"Content-Type": {"text/html"}},
+			acceptEncoding: "gzip",
+		},
+		{
+			name:           "not modified",
+			status:         http.StatusNotModified,
+			header:         http.Header{"Content-Type": {"text/html"}},
+			acceptEncoding: "gzip",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.method == "" {
+				tt.method = http.MethodGet
+			}
+			if tt.status == 0 {
+				tt.status = http.StatusOK
+			}
+			if tt.body == "" {
+				tt.body = body
+			}
+			ctx := context.WithValue(context.Background(), acceptEncodingKey{}, tt.acceptEncoding)
+			req, _ := http.NewRequestWithContext(ctx, tt.method, "http://upstream/page", nil)
+			resp := &http.Response{
+				StatusCode:    tt.status,
+				Header:        tt.header,
+				Body:          io.NopCloser(strings.NewReader(tt.body)),
+				ContentLength: int64(len(tt.body)),
+				Request:       req,
+			}
+			resp.Header.Set("ETag", `"v1"`)
+			if tt.unknownLength {
+				resp.ContentLength = -1
+			}
+
+			if err := compressResponse(resp, &tt.cfg); err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Header.Get("Content-Encoding"); tt.wantEncoding != "" && got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if got := resp.Header.Values("Vary"); strings.Join(got, "|") != strings.Join(tt.wantVary, "|") {
+				t.Errorf("Vary = %q, want %q", got, tt.wantVary)
+			}
+
+			// Whatever was decided, the client must get the original body back in full
+			var reader io.Reader = resp.Body
+			if tt.wantEncoding != "" {
+				if resp.Header.Get("ETag") != `W/"v1"` {
+					t.Errorf("expected a weak ETag, got %q", resp.Header.Get("ETag"))
+				}
+				zr, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				reader = zr
+			} else if resp.Header.Get("ETag") != `"v1"` {
+				t.Errorf("expected the ETag to be left alone, got %q", resp.Header.Get("ETag"))
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, []byte(tt.body)) {
+				t.Errorf("body changed: got %d bytes, want %d", len(got), len(tt.body))
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     storage.CompressionConfig
+		wantErr bool
+	}{
+		{name: "defaults", cfg: storage.CompressionConfig{Enabled: true}},
+		{name: "custom", cfg: storage.CompressionConfig{MinSize: 256, MimeTypes: []string{"text/*", "application/json", "image/svg+xml"}}},
+		{name: "negative min_size", cfg: storage.CompressionConfig{MinSize: -1}, wantErr: true},
+		{name: "huge min_size", cfg: storage.CompressionConfig{MinSize: 1 << 30}, wantErr: true},
+		{name: "no subtype", cfg: storage.CompressionConfig{MimeTypes: []string{"text"}}, wantErr: true},
+		{name: "empty", cfg: storage.CompressionConfig{MimeTypes: []string{""}}, wantErr: true},
+		{name: "wildcard type", cfg: storage.CompressionConfig{MimeTypes: []string{"*/*"}}, wantErr: true},
+		{name: "partial wildcard", cfg: storage.CompressionConfig{MimeTypes: []string{"text/x-*"}}, wantErr: true},
+		{name: "parameters", cfg: storage.CompressionConfig{MimeTypes: []string{"text/html; charset=utf-8"}}, wantErr: true},
+		{name: "uppercase", cfg: storage.CompressionConfig{MimeTypes: []string{"Text/HTML"}}, wantErr: true},
+		{name: "spaces", cfg: storage.CompressionConfig{MimeTypes: []string{" text/html"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateCompression(&tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"prism/pkg/storage"
+)
+
+// RequestIDHeader carries the ID Prism assigns to every proxied request.
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID accepts IDs set by a trusted client or load balancer in front of Prism.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// EnsureRequestID returns the request's ID, assigning a random one unless the client sent
+// a well-formed X-Request-ID.
+func EnsureRequestID(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); validRequestID.MatchString(id) {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	r.Header.Set(RequestIDHeader, id)
+	return id
+}
+
+// headerTemplateVars are the placeholders header rule values may use.
+var headerTemplateVars = []string{"{client_ip}", "{request_id}", "{host}", "{method}", "{path}", "{project_id}"}
+
+var (
+	headerTemplatePattern = regexp.MustCompile(`\{[a-z_]+\}`)
+	headerNamePattern     = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+)
+
+// headerTemplate expands placeholders for one request. r is the request as received from the
+// client or as sent upstream; both keep the client's address and Host.
+func headerTemplate(r *http.Request, project *storage.Project) *strings.Replacer {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	return strings.NewReplacer(
+		"{client_ip}", clientIP,
+		"{request_id}", r.Header.Get(RequestIDHeader),
+		"{host}", r.Host,
+		"{method}", r.Method,
+		"{path}", r.URL.Path,
+		"{project_id}", project.ID,
+	)
+}
+
+// applyHeaderRules applies the rules of one phase ('request' or 'response') to header, in order.
+func applyHeaderRules(header http.Header, rules []storage.HeaderRule, phase string, vars *strings.Replacer) {
+	for _, rule := range rules {
+		if rule.Phase != phase {
+			continue
+		}
+		switch rule.Op {
+		case "set":
+			header.Set(rule.Name, vars.Replace(rule.Value))
+		case "add":
+			header.Add(rule.Name, vars.Replace(rule.Value))
+		case "remove":
+			if prefix, ok := strings.CutSuffix(rule.Name, "*"); ok {
+				prefix = http.CanonicalHeaderKey(prefix)
+				for name := range header {
+					if strings.HasPrefix(name, prefix) {
+						header.Del(name)
+					}
+				}
+			} else {
+				header.Del(rule.Name)
+			}
+		case "rename":
+			if values := header.Values(rule.Name); len(values) > 0 {
+				header.Del(rule.Name)
+				header[http.CanonicalHeaderKey(rule.Value)] = values
+			}
+		}
+	}
+}
+
+// responseHeaderWriter applies a project's response header rules as the response is written.
+type responseHeaderWriter struct {
+	http.ResponseWriter
+	rules       []storage.HeaderRule
+	vars        *strings.Replacer
+	wroteHeader bool
+}
+
+// ResponseHeaderWriter wraps w so the project's response header rules are applied to
+// whatever is written through it. Applying them on the way out, rather than in the proxy,
+// keeps them out of the response cache: stored responses are exactly what the upstream sent,
+// and values such as {request_id} are filled in for each request they answer. upstreamPath
+// is the path sent upstream, which {path} expands to.
+func ResponseHeaderWriter(w http.ResponseWriter, r *http.Request, project *storage.Project, upstreamPath string) http.ResponseWriter {
+	if upstreamPath == "" {
+		upstreamPath = "/"
+	}
+	upstreamURL := *r.URL
+	upstreamURL.Path = upstreamPath
+	upstreamReq := *r
+	upstreamReq.URL = &upstreamURL
+	return &responseHeaderWriter{ResponseWriter: w, rules: project.HeaderRules, vars: headerTemplate(&upstreamReq, project)}
+}
+
+func (rw *responseHeaderWriter) WriteHeader(status int) {
+	if !rw.wroteHeader && status >= 200 { // Informational responses are passed through as-is
+		rw.wroteHeader = true
+		applyHeaderRules(rw.Header(), rw.rules, "response", rw.vars)
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseHeaderWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher so streamed and gRPC responses still reach the client promptly.
+func (rw *responseHeaderWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *responseHeaderWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// ValidateHeaderRules checks header rules before they are saved.
+func ValidateHeaderRules(rules []storage.HeaderRule) error {
+	for i, rule := range rules {
+		if rule.Phase != "request" && rule.Phase != "response" {
+			return fmt.Errorf("header rule %d: phase must be 'request' or 'response'", i+1)
+		}
+		name := rule.Name
+		if rule.Op == "remove" {
+			// Removals may end in "*" to drop every header with that prefix
+			name = strings.TrimSuffix(name, "*")
+		}
+		if !headerNamePattern.MatchString(name) {
+			return fmt.Errorf("header rule %d: invalid header name '%s'", i+1, rule.Name)
+		}
+		switch rule.Op {
+		case "set", "add":
+			if strings.ContainsAny(rule.Value, "\r\n") {
+				return fmt.Errorf("header rule %d: value must be a single line", i+1)
+			}
+			for _, placeholder := range headerTemplatePattern.FindAllString(rule.Value, -1) {
+				if !slices.Contains(headerTemplateVars, placeholder) {
+					return fmt.Errorf("header rule %d: unknown placeholder %s", i+1, placeholder)
+				}
+			}
+		case "remove":
+		case "rename":
+			if !headerNamePattern.MatchString(rule.Value) {
+				return fmt.Errorf("header rule %d: invalid new header name '%s'", i+1, rule.Value)
+			}
+		default:
+			return fmt.Errorf("header rule %d: op must be 'set', 'add', 'remove' or 'rename'", i+1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"prism/pkg/httpcache"
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+func TestEnsureRequestID(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(RequestIDHeader, "lb-1234.abc:9")
+	if id := EnsureRequestID(r); id != "lb-1234.abc:9" {
+		t.Errorf("a well-formed client ID was replaced with %q", id)
+	}
+
+	for _, sent := range []string{"", "bad id", "x\r\ny", strings.Repeat("a", 129)} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if sent != "" {
+			r.Header[RequestIDHeader] = []string{sent}
+		}
+		id := EnsureRequestID(r)
+		if id == sent || len(id) != 32 || r.Header.Get(RequestIDHeader) != id {
+			t.Errorf("ID for %q = %q, header %q", sent, id, r.Header.Get(RequestIDHeader))
+		}
+	}
+}
+
+func TestApplyHeaderRules(t *testing.T) {
+	project := &storage.Project{ID: "p1"}
+	r := httptest.NewRequest(http.MethodPost, "http://app.example.com/api/items?x=1", nil)
+	r.RemoteAddr = "203.0.113.7:51234"
+	r.Header.Set(RequestIDHeader, "req-1")
+
+	tests := []struct {
+		name   string
+		header http.Header
+		rules  []storage.HeaderRule
+		want   http.Header
+	}{
+		{
+			name:  "set with every placeholder",
+			rules: []storage.HeaderRule{{Phase: "request", Op: "set", Name: "X-Info", Value: "{client_ip} {request_id} {host} {method} {path} {project_id}"}},
+			want:  http.Header{"X-Info": {"203.0.113.7 req-1 app.example.com POST /api/items p1"}},
+		},
+		{
+			name:   "set replaces, add appends",
+			header: http.Header{"X-A": {"old"}, "X-B": {"one"}},
+			rules:  []storage.HeaderRule{{Phase: "request", Op: "set", Name: "x-a", Value: "new"}, {Phase: "request", Op: "add", Name: "X-B", Value: "two"}},
+			want:   http.Header{"X-A": {"new"}, "X-B": {"one", "two"}},
+		},
+		{
+			name:  "unknown placeholder left as-is",
+			rules: []storage.HeaderRule{{Phase: "request", Op: "set", Name: "X-A", Value: "{nope}"}},
+			want:  http.Header{"X-A": {"{nope}"}},
+		},
+		{
+			name:   "remove by name and prefix",
+			header: http.Header{"Server": {"nginx"}, "X-Internal-Id": {"1"}, "X-Internal-Host": {"h"}, "X-Other": {"o"}},
+			rules:  []storage.HeaderRule{{Phase: "request", Op: "remove", Name: "server"}, {Phase: "request", Op: "remove", Name: "x-internal-*"}},
+			want:   http.Header{"X-Other": {"o"}},
+		},
+		{
+			name:   "rename keeps every value",
+			header: http.Header{"X-Old": {"a", "b"}},
+			rules:  []storage.HeaderRule{{Phase: "request", Op: "rename", Name: "X-Old", Value: "x-new"}},
+			want:   http.Header{"X-New": {"a", "b"}},
+		},
+		{
+			name:   "rename of a missing header",
+			header: http.Header{"X-Other": {"o"}},
+			rules:  []storage.HeaderRule{{Phase: "request", Op: "rename", Name: "X-Old", Value: "X-New"}},
+			want:   http.Header{"X-Other": {"o"}},
+		},
+		{
+			name:   "rules run in order",
+			header: http.Header{"X-Old": {"a"}},
+			rules:  []storage.HeaderRule{{Phase: "request", Op: "rename", Name: "X-Old", Value: "X-New"}, {Phase: "request", Op: "set", Name: "X-Old", Value: "b"}},
+			want:   http.Header{"X-New": {"a"}, "X-Old": {"b"}},
+		},
+		{
+			name:  "other phase skipped",
+			rules: []storage.HeaderRule{{Phase: "response", Op: "set", Name: "X-A", Value: "1"}},
+			want:  http.Header{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.header.Clone()
+			if header == nil {
+				header = http.Header{}
+			}
+			applyHeaderRules(header, tt.rules, "request", headerTemplate(r, project))
+			if !reflect.DeepEqual(header, tt.want) {
+				t.Errorf("got %v, want %v", header, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateHeaderRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    storage.HeaderRule
+		wantErr bool
+	}{
+		{name: "set", rule: storage.HeaderRule{Phase: "request", Op: "set", Name: "X-Tenant", Value: "{project_id}"}},
+		{name: "remove prefix", rule: storage.HeaderRule{Phase: "response", Op: "remove", Name: "X-Internal-*"}},
+		{name: "rename", rule: storage.HeaderRule{Phase: "response", Op: "rename", Name: "Server", Value: "X-Server"}},
+		{name: "bad phase", rule: storage.HeaderRule{Phase: "both", Op: "set", Name: "X-A"}, wantErr: true},
+		{name: "bad op", rule: storage.HeaderRule{Phase: "request", Op: "append", Name: "X-A"}, wantErr: true},
+		{name: "bad name", rule: storage.HeaderRule{Phase: "request", Op: "set", Name: "X A"}, wantErr: true},
+		{name: "multi-line value", rule: storage.HeaderRule{Phase: "request", Op: "set", Name: "X-A", Value: "a\r\nX-B: b"}, wantErr: true},
+		{name: "unknown placeholder", rule: storage.HeaderRule{Phase: "request", Op: "set", Name: "X-A", Value: "{user}"}, wantErr: true},
+		{name: "bad new name", rule: storage.HeaderRule{Phase: "request", Op: "rename", Name: "X-A", Value: "X:B"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateHeaderRules([]storage.HeaderRule{tt.rule}); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResponseHeaderWriterWithCache(t *testing.T) {
+	hub := websockets.NewHub()
+	go hub.Run()
+	responseCache := httpcache.New(1<<20, hub)
+	project := &storage.Project{
+		ID:          "p1",
+		Cache:       &storage.CacheConfig{Enabled: true},
+		HeaderRules: []storage.HeaderRule{{Phase: "response", Op: "set", Name: "X-Request-ID", Value: "{request_id}"}, {Phase: "response", Op: "remove", Name: "Server"}},
+	}
+	calls := 0
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Server", "backend")
+		w.Write([]byte("hello"))
+	})
+
+	for i, id := range []string{"first", "second"} {
+		r := httptest.NewRequest(http.MethodGet, "http://app.example.com/page", nil)
+		r.Header.Set(RequestIDHeader, id)
+		w := httptest.NewRecorder()
+		responseCache.Serve(ResponseHeaderWriter(w, r, project, "/page"), r, project, upstream)
+
+		if got := w.Header().Get("X-Request-ID"); got != id {
+			t.Errorf("request %d: X-Request-ID = %q, want %q", i+1, got, id)
+		}
+		if got := w.Header().Get("Server"); got != "" {
+			t.Errorf("request %d: Server = %q, want it removed", i+1, got)
+		}
+		if w.Body.String() != "hello" {
+			t.Errorf("request %d: body = %q", i+1, w.Body.String())
+		}
+	}
+	if calls != 1 {
+		t.Errorf("upstream called %d times, want 1", calls)
+	}
+}
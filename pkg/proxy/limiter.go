@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"prism/pkg/storage"
+)
+
+// defaultQueueTimeout is how long a queued request waits for a slot when a project doesn't say.
+const defaultQueueTimeout = 5 * time.Second
+
+// Errors returned by Factory.Acquire when a request is shed.
+var (
+	ErrQueueFull    = errors.New("too many requests waiting for the upstream")
+	ErrQueueTimeout = errors.New("timed out waiting for the upstream")
+)
+
+// limiter bounds a project's in-flight upstream requests, with a bounded queue in front.
+type limiter struct {
+	settings storage.ConcurrencyLimit
+	slots    chan struct{}
+	waiting  atomic.Int64
+}
+
+// Acquire waits for one of the project's upstream slots and returns the function that frees it.
+// Requests beyond the queue, or that wait longer than the queue timeout, fail with ErrQueueFull
+// or ErrQueueTimeout. Projects without a concurrency limit always get a slot at once.
+func (f *Factory) Acquire(ctx context.Context, project *storage.Project) (func(), error) {
+	l := f.limiterFor(project)
+	if l == nil {
+		return func() {}, nil
+	}
+	release := func() { <-l.slots }
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if l.waiting.Add(1) > int64(l.settings.MaxQueue) {
+		l.waiting.Add(-1)
+		return nil, ErrQueueFull
+	}
+	defer l.waiting.Add(-1)
+
+	timeout := defaultQueueTimeout
+	if l.settings.QueueTimeoutMs > 0 {
+		timeout = time.Duration(l.settings.QueueTimeoutMs) * time.Millisecond
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, ErrQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// InFlight returns how many upstream requests a project has running and waiting.
+func (f *Factory) InFlight(projectID string) (running, waiting int) {
+	f.mu.Lock()
+	l := f.limiters[projectID]
+	f.mu.Unlock()
+	if l == nil {
+		return 0, 0
+	}
+	return len(l.slots), int(l.waiting.Load())
+}
+
+// limiterFor returns the project's limiter, replacing it when the settings changed. Requests
+// holding slots of a replaced limiter release them there, so nothing is lost in the switch.
+func (f *Factory) limiterFor(project *storage.Project) *limiter {
+	settings := project.Concurrency
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if settings == nil || settings.MaxInFlight <= 0 {
+		delete(f.limiters, project.ID)
+		return nil
+	}
+	if l, ok := f.limiters[project.ID]; ok && l.settings == *settings {
+		return l
+	}
+	l := &limiter{settings: *settings, slots: make(chan struct{}, settings.MaxInFlight)}
+	f.limiters[project.ID] = l
+	return l
+}
+
+// ValidateConcurrencyLimit checks concurrency settings before they are saved.
+func ValidateConcurrencyLimit(c *storage.ConcurrencyLimit) error {
+	if c.MaxInFlight < 0 || c.MaxInFlight > 100000 {
+		return fmt.Errorf("max_in_flight must be between 0 and 100000")
+	}
+	if c.MaxQueue < 0 || c.MaxQueue > 100000 {
+		return fmt.Errorf("max_queue must be between 0 and 100000")
+	}
+	if c.QueueTimeoutMs < 0 || c.QueueTimeoutMs > 60000 {
+		return fmt.Errorf("queue_timeout_ms must be between 0 and 60000")
+	}
+	return nil
+}
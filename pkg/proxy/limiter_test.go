@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"prism/pkg/storage"
+)
+
+// waitForQueue waits until n requests of a project are queued.
+func waitForQueue(t *testing.T, f *Factory, projectID string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, waiting := f.InFlight(projectID); waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queued requests", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAcquireQueueBounds(t *testing.T) {
+	f := NewFactory(nil)
+	project := &storage.Project{ID: "p1", Concurrency: &storage.ConcurrencyLimit{MaxInFlight: 2, MaxQueue: 1, QueueTimeoutMs: 5000}}
+	ctx := context.Background()
+
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := f.Acquire(ctx, project)
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		releases = append(releases, release)
+	}
+
+	queued := make(chan error, 1)
+	go func() {
+		release, err := f.Acquire(ctx, project)
+		if err == nil {
+			release()
+		}
+		queued <- err
+	}()
+	waitForQueue(t, f, project.ID, 1)
+
+	if _, err := f.Acquire(ctx, project); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull beyond the queue, got %v", err)
+	}
+	if running, waiting := f.InFlight(project.ID); running != 2 || waiting != 1 {
+		t.Errorf("InFlight = %d running, %d waiting; want 2 and 1", running, waiting)
+	}
+
+	releases[0]()
+	select {
+	case err := <-queued:
+		if err != nil {
+			t.Fatalf("queued request: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued request did not get the freed slot")
+	}
+	releases[1]()
+	if running, waiting := f.InFlight(project.ID); running != 0 || waiting != 0 {
+		t.Errorf("InFlight = %d running, %d waiting after every release; want 0 and 0", running, waiting)
+	}
+}
+
+func TestAcquireShedding(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings storage.ConcurrencyLimit
+		cancel   bool
+		wantErr  error
+	}{
+		{name: "queue timeout", settings: storage.ConcurrencyLimit{MaxInFlight: 1, MaxQueue: 1, QueueTimeoutMs: 20}, wantErr: ErrQueueTimeout},
+		{name: "no queue", settings: storage.ConcurrencyLimit{MaxInFlight: 1}, wantErr: ErrQueueFull},
+		{name: "client gone", settings: storage.ConcurrencyLimit{MaxInFlight: 1, MaxQueue: 1}, cancel: true, wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFactory(nil)
+			project := &storage.Project{ID: "p1", Concurrency: &tt.settings}
+			release, err := f.Acquire(context.Background(), project)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer release()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+			if _, err := f.Acquire(ctx, project); !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if _, waiting := f.InFlight(project.ID); waiting != 0 {
+				t.Errorf("a shed request is still counted as waiting")
+			}
+		})
+	}
+}
+
+func TestAcquireUnlimited(t *testing.T) {
+	f := NewFactory(nil)
+	for _, settings := range []*storage.ConcurrencyLimit{nil, {MaxInFlight: 0, MaxQueue: 10}} {
+		project := &storage.Project{ID: "p1", Concurrency: settings}
+		for i := 0; i < 100; i++ {
+			if _, err := f.Acquire(context.Background(), project); err != nil {
+				t.Fatalf("request %d: %v", i+1, err)
+			}
+		}
+	}
+}
+
+func TestAcquireSettingsChange(t *testing.T) {
+	f := NewFactory(nil)
+	project := &storage.Project{ID: "p1", Concurrency: &storage.ConcurrencyLimit{MaxInFlight: 1}}
+	oldRelease, err := f.Acquire(context.Background(), project)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Raising the limit starts a fresh limiter; the request already running keeps its old slot
+	project = &storage.Project{ID: "p1", Concurrency: &storage.ConcurrencyLimit{MaxInFlight: 2}}
+	for i := 0; i < 2; i++ {
+		if _, err := f.Acquire(context.Background(), project); err != nil {
+			t.Fatalf("request %d under the new limit: %v", i+1, err)
+		}
+	}
+	oldRelease()
+	if _, err := f.Acquire(context.Background(), project); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("releasing an old slot must not free one under the new limit, got %v", err)
+	}
+}
+
+func TestValidateConcurrencyLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings storage.ConcurrencyLimit
+		wantErr  bool
+	}{
+		{name: "disabled", settings: storage.ConcurrencyLimit{}},
+		{name: "typical", settings: storage.ConcurrencyLimit{MaxInFlight: 50, MaxQueue: 100, QueueTimeoutMs: 2000}},
+		{name: "negative in flight", settings: storage.ConcurrencyLimit{MaxInFlight: -1}, wantErr: true},
+		{name: "huge queue", settings: storage.ConcurrencyLimit{MaxInFlight: 1, MaxQueue: 100001}, wantErr: true},
+		{name: "long timeout", settings: storage.ConcurrencyLimit{MaxInFlight: 1, QueueTimeoutMs: 60001}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateConcurrencyLimit(&tt.settings); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
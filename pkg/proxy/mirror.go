@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"prism/pkg/logger"
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+const (
+	// maxMirrorsInFlight bounds the shadow requests running at once across all projects;
+	// requests sampled while it is reached are not mirrored.
+	maxMirrorsInFlight = 64
+	// defaultMirrorBodySize is the largest request body mirrored when a project doesn't set one.
+	defaultMirrorBodySize = 1 << 20
+	mirrorTimeout         = 30 * time.Second
+)
+
+// mirrorHopHeaders are connection-specific and not copied to shadow requests.
+var mirrorHopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// mirrorBody records the request body as the primary request reads it.
+type mirrorBody struct {
+	io.ReadCloser
+	limit int64
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	eof      bool
+	overflow bool
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// recorded returns the whole body, or false if it was too large or not read to the end.
+func (b *mirrorBody) recorded() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes(), b.eof && !b.overflow
+}
+
+// Mirror samples r for the project's shadow upstream. It returns nil if r is not mirrored;
+// otherwise it returns a function to call with the primary response's status and latency once
+// that response is complete, which sends the shadow request in the background. upstreamPath is
+// the path as the primary upstream sees it. Nothing here waits on the shadow upstream.
+func (f *Factory) Mirror(r *http.Request, project *storage.Project, upstreamPath string, hub *websockets.Hub) func(status int, elapsed time.Duration) {
+	m := project.Mirror
+	if m == nil || !m.Enabled || m.UpstreamURL == "" || rand.Float64() >= m.SampleRate {
+		return nil
+	}
+	target, err := url.Parse(m.UpstreamURL)
+	if err != nil {
+		return nil
+	}
+	limit := int64(m.MaxBodySize)
+	if limit <= 0 {
+		limit = defaultMirrorBodySize
+	}
+	if r.ContentLength > limit {
+		logger.LogAndBroadcast(hub, project.ID, "Mirror skipped for %s %s: body of %d bytes is over the %d byte limit", r.Method, r.URL.Path, r.ContentLength, limit)
+		return nil
+	}
+
+	shadow := r.Clone(context.Background())
+	shadow.URL.Path, shadow.URL.RawPath = upstreamPath, ""
+	if shadow.URL.Path == "" {
+		shadow.URL.Path = "/"
+	}
+	httputil.NewSingleHostReverseProxy(target).Director(shadow)
+	shadow.RequestURI = ""
+	for _, name := range mirrorHopHeaders {
+		shadow.Header.Del(name)
+	}
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		shadow.Header.Set("X-Forwarded-For", clientIP)
+	}
+	shadow.Header.Set("X-Mini-NGFW", "true")
+	shadow.Header.Set("X-Prism-Mirror", "true")
+	applyHeaderRules(shadow.Header, project.HeaderRules, "request", headerTemplate(shadow, project))
+
+	var body *mirrorBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &mirrorBody{ReadCloser: r.Body, limit: limit}
+		r.Body = body
+	}
+
+	return func(status int, elapsed time.Duration) {
+		shadow.Body, shadow.ContentLength = http.NoBody, 0
+		if body != nil {
+			data, ok := body.recorded()
+			if !ok {
+				logger.LogAndBroadcast(hub, project.ID, "Mirror skipped for %s %s: body was not read in full or is over the %d byte limit", r.Method, shadow.URL.Path, limit)
+				return
+			}
+			shadow.Body, shadow.ContentLength = io.NopCloser(bytes.NewReader(data)), int64(len(data))
+		}
+
+		select {
+		case f.mirrorSlots <- struct{}{}:
+		default:
+			logger.LogAndBroadcast(hub, project.ID, "Mirror dropped for %s %s: %d shadow requests already in flight", r.Method, shadow.URL.Path, maxMirrorsInFlight)
+			return
+		}
+		go func() {
+			defer func() { <-f.mirrorSlots }()
+			f.sendMirror(shadow, project, status, elapsed, hub)
+		}()
+	}
+}
+
+// sendMirror sends a shadow request, discards the response and logs how it compares to the primary.
+func (f *Factory) sendMirror(shadow *http.Request, project *storage.Project, primaryStatus int, primaryElapsed time.Duration, hub *websockets.Hub) {
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	defer cancel()
+	shadow = shadow.WithContext(ctx)
+
+	started := time.Now()
+	// Not the project's transport: its upstream TLS settings (CA, client certificate, server
+	// name) are for the primary upstream and must not be presented to the shadow
+	resp, err := f.mirrorTransport.RoundTrip(shadow)
+	if err != nil {
+		logger.LogAndBroadcast(hub, project.ID, "Mirror %s %s failed after %s: %v (primary %d in %s)",
+			shadow.Method, shadow.URL.Path, time.Since(started).Round(time.Millisecond), err, primaryStatus, primaryElapsed.Round(time.Millisecond))
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, defaultMirrorBodySize))
+	resp.Body.Close()
+	logger.LogAndBroadcast(hub, project.ID, "Mirror %s %s: shadow %d in %s, primary %d in %s",
+		shadow.Method, shadow.URL.Path, resp.StatusCode, time.Since(started).Round(time.Millisecond), primaryStatus, primaryElapsed.Round(time.Millisecond))
+}
+
+// ValidateMirror checks mirroring settings before they are saved.
+func ValidateMirror(m *storage.Mirror) error {
+	if m.SampleRate < 0 || m.SampleRate > 1 {
+		return fmt.Errorf("mirror sample_rate must be between 0 and 1")
+	}
+	if m.MaxBodySize < 0 || m.MaxBodySize > 10<<20 {
+		return fmt.Errorf("mirror max_body_size must be between 0 and %d bytes", 10<<20)
+	}
+	if m.Enabled || m.UpstreamURL != "" {
+		if err := ValidateUpstreamURL(m.UpstreamURL); err != nil {
+			return fmt.Errorf("mirror upstream_url: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+// shadowRequest is what a shadow upstream received.
+type shadowRequest struct {
+	path        string
+	body        string
+	mirrorFlag  string
+	clientCerts int
+}
+
+func newMirrorHub() *websockets.Hub {
+	hub := websockets.NewHub()
+	go hub.Run()
+	return hub
+}
+
+func TestMirrorToTLSShadow(t *testing.T) {
+	received := make(chan shadowRequest, 1)
+	shadow := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- shadowRequest{path: r.URL.Path, body: string(body), mirrorFlag: r.Header.Get("X-Prism-Mirror"), clientCerts: len(r.TLS.PeerCertificates)}
+	}))
+	shadow.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	shadow.StartTLS()
+	defer shadow.Close()
+
+	f := NewFactory(nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(shadow.Certificate())
+	f.mirrorTransport = newTransport(&tls.Config{RootCAs: roots}, "", nil)
+
+	// The primary's TLS settings would fail verification against the shadow if they were used
+	project := &storage.Project{
+		ID:          "p1",
+		UpstreamURL: "https://primary.internal",
+		UpstreamTLS: &storage.UpstreamTLS{ServerName: "primary.internal", CABundle: "not a PEM bundle"},
+		Mirror:      &storage.Mirror{Enabled: true, UpstreamURL: shadow.URL, SampleRate: 1},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/app/orders", strings.NewReader(`{"id":1}`))
+	done := f.Mirror(r, project, "/orders", newMirrorHub())
+	if done == nil {
+		t.Fatal("request was not sampled at a sample rate of 1")
+	}
+	io.ReadAll(r.Body) // As the primary proxy would
+	done(http.StatusOK, time.Millisecond)
+
+	select {
+	case got := <-received:
+		want := shadowRequest{path: "/orders", body: `{"id":1}`, mirrorFlag: "true"}
+		if got != want {
+			t.Errorf("shadow received %+v, want %+v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow request never arrived")
+	}
+}
+
+func TestMirrorDoesNotAffectPrimary(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(append([]byte("primary:"), body...))
+	}))
+	defer primary.Close()
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	for name, shadowURL := range map[string]string{"slow shadow": slow.URL, "unreachable shadow": down.URL, "failing shadow": failing.URL} {
+		t.Run(name, func(t *testing.T) {
+			f := NewFactory(nil)
+			project := &storage.Project{ID: "p1", UpstreamURL: primary.URL, Mirror: &storage.Mirror{Enabled: true, UpstreamURL: shadowURL, SampleRate: 1}}
+			r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader("payload"))
+			hub := newMirrorHub()
+			done := f.Mirror(r, project, "/orders", hub)
+			reverseProxy, err := f.NewReverseProxy(project, "", hub)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			reverseProxy.ServeHTTP(w, r)
+			started := time.Now()
+			done(w.Code, time.Millisecond)
+			if elapsed := time.Since(started); elapsed > 100*time.Millisecond {
+				t.Errorf("starting the shadow request took %s", elapsed)
+			}
+			if w.Code != http.StatusOK || w.Body.String() != "primary:payload" {
+				t.Errorf("primary response %d %q", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestMirrorSkipsLargeBodies(t *testing.T) {
+	f := NewFactory(nil)
+	project := &storage.Project{ID: "p1", Mirror: &storage.Mirror{Enabled: true, UpstreamURL: "http://shadow", SampleRate: 1, MaxBodySize: 4}}
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too long"))
+	if f.Mirror(r, project, "/", newMirrorHub()) != nil {
+		t.Error("a request declaring a body over max_body_size was mirrored")
+	}
+
+	project.Mirror.SampleRate = 0
+	if f.Mirror(httptest.NewRequest(http.MethodGet, "/", nil), project, "/", newMirrorHub()) != nil {
+		t.Error("a request was mirrored at a sample rate of 0")
+	}
+}
+
+func TestMirrorBody(t *testing.T) {
+	body := &mirrorBody{ReadCloser: io.NopCloser(strings.NewReader("hello")), limit: 5}
+	if _, ok := body.recorded(); ok {
+		t.Error("a body that was not read yet counts as recorded")
+	}
+	io.ReadAll(body)
+	if data, ok := body.recorded(); !ok || string(data) != "hello" {
+		t.Errorf("recorded %q, %v", data, ok)
+	}
+
+	body = &mirrorBody{ReadCloser: io.NopCloser(strings.NewReader("hello!")), limit: 5}
+	if data, _ := io.ReadAll(body); string(data) != "hello!" {
+		t.Errorf("the primary read %q", data)
+	}
+	if _, ok := body.recorded(); ok {
+		t.Error("a body over the limit counts as recorded")
+	}
+}
@@ -1,57 +1,115 @@
 package proxy
 
 import (
+	"context"
+	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"time"
+	"strings"
+	"sync"
+
+	"prism/pkg/secrets"
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
 )
 
-// Factory is a factory for creating reverse proxies.
-type Factory struct{}
+// Factory is a factory for creating reverse proxies. It keeps one pooled transport per
+// project so connections to upstreams are reused across requests, and tracks the health of
+// the targets of projects with an upstream pool.
+type Factory struct {
+	box        *secrets.Box // Opens upstream client keys; may be nil if none are configured
+	mu         sync.Mutex
+	transports map[string]*pooledTransport
+
+	limiters        map[string]*limiter
+	pools           map[string]*pool
+	mirrorSlots     chan struct{}     // One per shadow request in flight
+	mirrorTransport http.RoundTripper // Shared by all shadow requests; never carries a project's upstream TLS
+}
 
 // NewFactory creates a new proxy factory.
-func NewFactory() *Factory {
-	return &Factory{}
+func NewFactory(box *secrets.Box) *Factory {
+	return &Factory{
+		box:             box,
+		transports:      make(map[string]*pooledTransport),
+		limiters:        make(map[string]*limiter),
+		pools:           make(map[string]*pool),
+		mirrorSlots:     make(chan struct{}, maxMirrorsInFlight),
+		mirrorTransport: newTransport(nil, "", nil),
+	}
 }
 
-// NewReverseProxy creates a reverse proxy to forward traffic to the target.
-func (f *Factory) NewReverseProxy(target string) *httputil.ReverseProxy {
-	url, err := url.Parse(target)
+// NewReverseProxy creates a reverse proxy to forward traffic to the project's upstream.
+// pathPrefix is the prefix Prism stripped from the request path, empty for hostname matches.
+// It applies request header rules; response header rules are applied by ResponseHeaderWriter.
+// Upstream failures are broadcast to hub. It returns an error if the stored upstream URL is
+// unusable, e.g., one saved before URLs were validated.
+func (f *Factory) NewReverseProxy(project *storage.Project, pathPrefix string, hub *websockets.Hub) (*httputil.ReverseProxy, error) {
+	url, err := url.Parse(project.UpstreamURL)
 	if err != nil {
-		log.Fatalf("Invalid target URL: %v", err)
+		return nil, fmt.Errorf("invalid upstream URL for project %s: %w", project.ID, err)
+	}
+	if (url.Scheme != "http" && url.Scheme != "https") || url.Host == "" {
+		return nil, fmt.Errorf("invalid upstream URL for project %s: '%s' is not an absolute http or https URL", project.ID, project.UpstreamURL)
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(url)
 
-	// Create a custom transport with increased connection pooling
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		MaxIdleConnsPerHost:   100, // Increase this value
-	}
-	proxy.Transport = transport
+	proxy.Transport = f.transportFor(project)
+
+	rewrite := project.ResponseRewrite
+	if rewrite == nil || !rewrite.Enabled || pathPrefix == "" {
+		rewrite = nil // Nothing to rewrite when the project owns the whole path space
+	}
+
+	compression := project.Compression
+	if compression != nil && !compression.Enabled {
+		compression = nil
+	}
+
+	securityHeaders := project.SecurityHeaders
+	if securityHeaders != nil && !securityHeaders.Enabled {
+		securityHeaders = nil
+	}
 
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
 		originalDirector(req)
 		req.Header.Add("X-Mini-NGFW", "true")
+		applyHeaderRules(req.Header, project.HeaderRules, "request", headerTemplate(req, project))
+		if compression != nil {
+			*req = *req.WithContext(context.WithValue(req.Context(), acceptEncodingKey{}, req.Header.Get("Accept-Encoding")))
+		}
+		if rewrite != nil && rewrite.RewriteBody {
+			// Only ask for encodings the body rewriter can decode
+			if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+				req.Header.Set("Accept-Encoding", "gzip")
+			} else {
+				req.Header.Del("Accept-Encoding")
+			}
+		}
 	}
 
+	proxy.ErrorHandler = f.upstreamErrorHandler(project, url, hub)
+
 	proxy.ModifyResponse = func(resp *http.Response) error {
 		log.Printf("Response from backend: %d\n", resp.StatusCode)
+		f.reportTarget(project, project.UpstreamURL, true)
+		if securityHeaders != nil {
+			applySecurityHeaders(resp.Header, securityHeaders)
+		}
+		if rewrite != nil {
+			if err := rewriteResponse(resp, pathPrefix, url, rewrite.RewriteBody); err != nil {
+				return err
+			}
+		}
+		if compression != nil {
+			return compressResponse(resp, compression)
+		}
 		return nil
 	}
 
-	return proxy
+	return proxy, nil
 }
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// rewriteResponse moves paths in an upstream response back under the project's path prefix.
+// Location and Content-Location headers and cookie paths are always rewritten; HTML and CSS
+// bodies only when rewriteBody is set.
+func rewriteResponse(resp *http.Response, prefix string, upstream *url.URL, rewriteBody bool) error {
+	for _, header := range []string{"Location", "Content-Location"} {
+		if value := resp.Header.Get(header); value != "" {
+			resp.Header.Set(header, rewriteLocation(value, prefix, upstream))
+		}
+	}
+
+	if cookies := resp.Header.Values("Set-Cookie"); len(cookies) > 0 {
+		rewritten := make([]string, len(cookies))
+		for i, cookie := range cookies {
+			rewritten[i] = rewriteCookiePath(cookie, prefix)
+		}
+		resp.Header["Set-Cookie"] = rewritten
+	}
+
+	if rewriteBody {
+		return rewriteResponseBody(resp, prefix)
+	}
+	return nil
+}
+
+// rewriteLocation prefixes root-relative URLs and turns absolute URLs that point at the
+// upstream itself into prefixed root-relative ones, since clients can't reach the upstream.
+func rewriteLocation(value, prefix string, upstream *url.URL) string {
+	location, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+	if location.IsAbs() || location.Host != "" {
+		if !strings.EqualFold(location.Host, upstream.Host) {
+			return value
+		}
+		location.Scheme = ""
+		location.Host = ""
+		location.User = nil
+	} else if !strings.HasPrefix(location.Path, "/") {
+		return value // Relative paths already resolve under the prefix
+	}
+	if !hasPathPrefix(location.Path, prefix) {
+		location.Path = prefix + location.Path
+		location.RawPath = ""
+	}
+	return location.String()
+}
+
+// rewriteCookiePath prefixes the Path attribute of a Set-Cookie header value.
+func rewriteCookiePath(cookie, prefix string) string {
+	parts := strings.Split(cookie, ";")
+	for i, part := range parts[1:] {
+		i++ // The first part is the cookie's name=value pair
+		attr := strings.TrimSpace(part)
+		if len(attr) < 5 || !strings.EqualFold(attr[:5], "path=") {
+			continue
+		}
+		path := attr[5:]
+		if strings.HasPrefix(path, "/") && !hasPathPrefix(path, prefix) {
+			path = strings.TrimSuffix(prefix+path, "/")
+			if path == "" {
+				path = "/"
+			}
+		}
+		parts[i] = " Path=" + path
+	}
+	return strings.Join(parts, ";")
+}
+
+// hasPathPrefix reports whether path is prefix itself or lies below it.
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// rewriteResponseBody wraps an HTML or CSS body in a streaming rewriter, decoding and
+// re-encoding gzip and deflate bodies on the fly. Other encodings are left untouched.
+func rewriteResponseBody(resp *http.Response, prefix string) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "text/css" {
+		return nil
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	body := resp.Body
+	switch encoding {
+	case "", "identity":
+		resp.Body = newPrefixRewriter(body, prefix)
+	case "gzip":
+		decoded, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		resp.Body = reencode(newPrefixRewriter(readCloser{decoded, body}, prefix), func(w io.Writer) io.WriteCloser {
+			return gzip.NewWriter(w)
+		})
+	case "deflate":
+		decoded, err := zlib.NewReader(body)
+		if err != nil {
+			return err
+		}
+		resp.Body = reencode(newPrefixRewriter(readCloser{decoded, body}, prefix), func(w io.Writer) io.WriteCloser {
+			return zlib.NewWriter(w)
+		})
+	default:
+		return nil
+	}
+
+	// The body length changes, and a strong validator no longer matches the bytes sent.
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
+
+// readCloser reads from a decoder but closes the underlying body.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// reencode streams src through an encoder. Closing the returned body stops the encoder
+// goroutine and closes src.
+func reencode(src io.ReadCloser, newEncoder func(io.Writer) io.WriteCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer src.Close()
+		encoder := newEncoder(pw)
+		_, err := io.Copy(encoder, src)
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// rootRelativeMarkers precede a root-relative URL in HTML attributes and CSS. Each ends
+// with the leading slash of the URL.
+var rootRelativeMarkers = [][]byte{
+	[]byte(`href="/`), []byte(`href='/`),
+	[]byte(`src="/`), []byte(`src='/`),
+	[]byte(`action="/`), []byte(`action='/`),
+	[]byte(`formaction="/`), []byte(`formaction='/`),
+	[]byte(`poster="/`), []byte(`poster='/`),
+	[]byte(`url(/`), []byte(`url("/`), []byte(`url('/`),
+	[]byte(`@import "/`), []byte(`@import '/`),
+}
+
+// maxMarkerLen is the length of the longest marker.
+var maxMarkerLen = func() int {
+	n := 0
+	for _, marker := range rootRelativeMarkers {
+		if len(marker) > n {
+			n = len(marker)
+		}
+	}
+	return n
+}()
+
+// prefixRewriter is a streaming reader that inserts the project prefix in front of
+// root-relative URLs. Input that might hold a marker split across reads is kept back
+// until more data arrives.
+type prefixRewriter struct {
+	src     io.ReadCloser
+	prefix  []byte
+	buf     []byte
+	pending []byte
+	out     bytes.Buffer
+	eof     bool
+	err     error
+}
+
+func newPrefixRewriter(src io.ReadCloser, prefix string) *prefixRewriter {
+	return &prefixRewriter{src: src, prefix: []byte(prefix), buf: make([]byte, 32*1024)}
+}
+
+func (p *prefixRewriter) Read(b []byte) (int, error) {
+	for p.out.Len() == 0 {
+		if p.eof {
+			if p.err != nil {
+				return 0, p.err
+			}
+			return 0, io.EOF
+		}
+		n, err := p.src.Read(p.buf)
+		p.pending = append(p.pending, p.buf[:n]...)
+		if err != nil {
+			p.eof = true
+			if err != io.EOF {
+				p.err = err
+			}
+		}
+		consumed := p.rewrite(p.pending, p.eof)
+		p.pending = append(p.pending[:0], p.pending[consumed:]...)
+	}
+	return p.out.Read(b)
+}
+
+func (p *prefixRewriter) Close() error {
+	return p.src.Close()
+}
+
+// rewrite copies data to the output, prefixing URLs after every marker, and returns how many
+// bytes were consumed. Unless final is set, bytes that could start an incomplete marker or
+// that are needed to look past a marker are left for the next call.
+func (p *prefixRewriter) rewrite(data []byte, final bool) int {
+	lookahead := len(p.prefix) + 1
+	i := 0
+	for {
+		pos, markerLen := -1, 0
+		for _, marker := range rootRelativeMarkers {
+			if idx := bytes.Index(data[i:], marker); idx >= 0 && (pos < 0 || idx < pos) {
+				pos, markerLen = idx, len(marker)
+			}
+		}
+
+		if pos < 0 {
+			safe := len(data)
+			if !final {
+				safe = max(i, len(data)-(maxMarkerLen-1))
+			}
+			p.out.Write(data[i:safe])
+			return safe
+		}
+
+		start := i + pos
+		slash := start + markerLen - 1
+		if !final && slash+lookahead >= len(data) {
+			p.out.Write(data[i:start])
+			return start
+		}
+
+		p.out.Write(data[i:slash])
+		rest := data[slash:]
+		if !bytes.HasPrefix(rest, []byte("//")) && !p.alreadyPrefixed(rest) {
+			p.out.Write(p.prefix)
+		}
+		p.out.WriteByte('/')
+		i = slash + 1
+	}
+}
+
+// alreadyPrefixed reports whether the URL at the start of rest is already under the prefix.
+func (p *prefixRewriter) alreadyPrefixed(rest []byte) bool {
+	if !bytes.HasPrefix(rest, p.prefix) {
+		return false
+	}
+	if len(rest) == len(p.prefix) {
+		return true
+	}
+	switch rest[len(p.prefix)] {
+	case '/', '"', '\'', ')', '?', '#':
+		return true
+	}
+	return false
+}
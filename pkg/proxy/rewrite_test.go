@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// chunkReader returns its data n bytes per Read, so markers can be split across reads.
+type chunkReader struct {
+	data []byte
+	n    int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := min(c.n, len(p), len(c.data))
+	copy(p, c.data[:n])
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func (c *chunkReader) Close() error { return nil }
+
+func TestPrefixRewriter(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "double quoted href", in: `<a href="/login">`, want: `<a href="/app/login">`},
+		{name: "single quoted src", in: `<img src='/logo.png'>`, want: `<img src='/app/logo.png'>`},
+		{name: "form action", in: `<form action="/submit" formaction="/alt">`, want: `<form action="/app/submit" formaction="/app/alt">`},
+		{name: "CSS url forms", in: `a{background:url(/a.png)} b{background:url("/b.png")} c{background:url('/c.png')}`, want: `a{background:url(/app/a.png)} b{background:url("/app/b.png")} c{background:url('/app/c.png')}`},
+		{name: "CSS import", in: `@import "/base.css";`, want: `@import "/app/base.css";`},
+		{name: "root itself", in: `<a href="/">`, want: `<a href="/app/">`},
+		{name: "already prefixed", in: `<a href="/app/login"><a href="/app"><a href="/app?x"><a href="/app#top">`, want: `<a href="/app/login"><a href="/app"><a href="/app?x"><a href="/app#top">`},
+		{name: "prefix lookalike", in: `<a href="/application">`, want: `<a href="/app/application">`},
+		{name: "protocol relative", in: `<script src="//cdn.example.com/x.js">`, want: `<script src="//cdn.example.com/x.js">`},
+		{name: "relative", in: `<a href="login"><a href="./x"><a href="../y">`, want: `<a href="login"><a href="./x"><a href="../y">`},
+		{name: "absolute", in: `<a href="https://example.com/x">`, want: `<a href="https://example.com/x">`},
+		{name: "spaced attribute", in: `<a href = "/x">`, want: `<a href = "/x">`},
+		{name: "other attribute", in: `<a title="/x" hrefx="/y">`, want: `<a title="/x" hrefx="/y">`},
+		{name: "marker at EOF", in: `<a href="/`, want: `<a href="/app/`},
+		{name: "partial marker at EOF", in: `<a href="`, want: `<a href="`},
+		{name: "empty", in: ``, want: ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every chunk size, down to a byte per read, must give the same output
+			for n := 1; n <= len(tt.in)+1; n++ {
+				got, err := io.ReadAll(newPrefixRewriter(&chunkReader{data: []byte(tt.in), n: n}, "/app"))
+				if err != nil {
+					t.Fatalf("chunks of %d: %v", n, err)
+				}
+				if string(got) != tt.want {
+					t.Fatalf("chunks of %d: got %s, want %s", n, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPrefixRewriterLargeBody(t *testing.T) {
+	in := strings.Repeat(`<p>filler</p><a href="/x">`, 5000)
+	got, err := io.ReadAll(newPrefixRewriter(&chunkReader{data: []byte(in), n: 4093}, "/app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.ReplaceAll(in, `href="/x"`, `href="/app/x"`); string(got) != want {
+		t.Error("markers across buffer boundaries were not all rewritten")
+	}
+}
+
+func compressBody(t *testing.T, encoding, body string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	default:
+		buf.WriteString(body)
+		return buf.Bytes()
+	}
+	w.Write([]byte(body))
+	w.Close()
+	return buf.Bytes()
+}
+
+func decompressBody(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+	var r io.Reader = bytes.NewReader(body)
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(r)
+	case "deflate":
+		r, err = zlib.NewReader(r)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRewriteResponseBody(t *testing.T) {
+	const body = `<a href="/login">`
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		etag        string
+		want        string
+		wantETag    string
+		rewritten   bool
+	}{
+		{name: "HTML", contentType: "text/html; charset=utf-8", etag: `"v1"`, want: `<a href="/app/login">`, wantETag: `W/"v1"`, rewritten: true},
+		{name: "CSS", contentType: "text/css", want: `<a href="/app/login">`, rewritten: true},
+		{name: "weak ETag kept", contentType: "text/html", etag: `W/"v1"`, want: `<a href="/app/login">`, wantETag: `W/"v1"`, rewritten: true},
+		{name: "gzip", contentType: "text/html", encoding: "gzip", want: `<a href="/app/login">`, rewritten: true},
+		{name: "deflate", contentType: "text/html", encoding: "deflate", want: `<a href="/app/login">`, rewritten: true},
+		{name: "JSON untouched", contentType: "application/json", etag: `"v1"`, want: body, wantETag: `"v1"`},
+		{name: "brotli untouched", contentType: "text/html", encoding: "br", want: body},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := compressBody(t, tt.encoding, body)
+			resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(raw)), ContentLength: int64(len(raw))}
+			resp.Header.Set("Content-Type", tt.contentType)
+			resp.Header.Set("Content-Length", strconv.Itoa(len(raw)))
+			if tt.encoding != "" {
+				resp.Header.Set("Content-Encoding", tt.encoding)
+			}
+			if tt.etag != "" {
+				resp.Header.Set("ETag", tt.etag)
+			}
+
+			if err := rewriteResponseBody(resp, "/app"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if tt.encoding == "br" {
+				if string(got) != string(raw) {
+					t.Errorf("an unsupported encoding must pass through unchanged")
+				}
+			} else if decoded := decompressBody(t, tt.encoding, got); decoded != tt.want {
+				t.Errorf("body = %s, want %s", decoded, tt.want)
+			}
+			if tt.rewritten {
+				if resp.Header.Get("Content-Length") != "" || resp.ContentLength != -1 {
+					t.Errorf("Content-Length kept for a rewritten body")
+				}
+			} else if resp.ContentLength != int64(len(raw)) {
+				t.Errorf("Content-Length changed for a body that was not rewritten")
+			}
+			if got := resp.Header.Get("ETag"); got != tt.wantETag {
+				t.Errorf("ETag = %q, want %q", got, tt.wantETag)
+			}
+		})
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	upstream, _ := url.Parse("http://backend:8080")
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "/login", want: "/app/login"},
+		{value: "/login?next=/home#top", want: "/app/login?next=/home#top"},
+		{value: "/", want: "/app/"},
+		{value: "/app/login", want: "/app/login"},
+		{value: "/application", want: "/app/application"},
+		{value: "login", want: "login"},
+		{value: "../login", want: "../login"},
+		{value: "http://backend:8080/login", want: "/app/login"},
+		{value: "HTTP://BACKEND:8080/login", want: "/app/login"},
+		{value: "//backend:8080/login", want: "/app/login"},
+		{value: "https://example.com/login", want: "https://example.com/login"},
+		{value: "http://backend:9090/login", want: "http://backend:9090/login"},
+		{value: "http://[::1", want: "http://[::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := rewriteLocation(tt.value, "/app", upstream); got != tt.want {
+				t.Errorf("rewriteLocation(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteCookiePath(t *testing.T) {
+	tests := []struct {
+		cookie string
+		want   string
+	}{
+		{cookie: "session=abc; Path=/; HttpOnly", want: "session=abc; Path=/app; HttpOnly"},
+		{cookie: "session=abc; path=/admin", want: "session=abc; Path=/app/admin"},
+		{cookie: "session=abc; Path=/app/x", want: "session=abc; Path=/app/x"},
+		{cookie: "session=abc; Path=/app", want: "session=abc; Path=/app"},
+		{cookie: "session=abc; Path=relative", want: "session=abc; Path=relative"},
+		{cookie: "session=abc; Secure", want: "session=abc; Secure"},
+		{cookie: "path=/x; Domain=example.com", want: "path=/x; Domain=example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cookie, func(t *testing.T) {
+			if got := rewriteCookiePath(tt.cookie, "/app"); got != tt.want {
+				t.Errorf("rewriteCookiePath(%q) = %q, want %q", tt.cookie, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteResponseHeaders(t *testing.T) {
+	upstream, _ := url.Parse("http://backend:8080")
+	resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}
+	resp.Header.Set("Location", "http://backend:8080/login")
+	resp.Header.Set("Content-Location", "/doc")
+	resp.Header.Add("Set-Cookie", "a=1; Path=/")
+	resp.Header.Add("Set-Cookie", "b=2; Path=/x")
+
+	if err := rewriteResponse(resp, "/app", upstream, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get("Location"); got != "/app/login" {
+		t.Errorf("Location = %q", got)
+	}
+	if got := resp.Header.Get("Content-Location"); got != "/app/doc" {
+		t.Errorf("Content-Location = %q", got)
+	}
+	if got := resp.Header.Values("Set-Cookie"); len(got) != 2 || got[0] != "a=1; Path=/app" || got[1] != "b=2; Path=/app/x" {
+		t.Errorf("Set-Cookie = %q", got)
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"prism/pkg/storage"
+)
+
+func TestSecurityHeaderValues(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  storage.SecurityHeaders
+		want map[string]string
+	}{
+		{name: "preset", cfg: storage.SecurityHeaders{Preset: "api"}, want: securityPresets["api"]},
+		{
+			name: "override replaces a preset value",
+			cfg:  storage.SecurityHeaders{Preset: "strict-spa", Overrides: map[string]string{"x-frame-options": "SAMEORIGIN"}},
+			want: map[string]string{
+				"Strict-Transport-Security": securityPresets["strict-spa"]["Strict-Transport-Security"],
+				"Content-Security-Policy":   securityPresets["strict-spa"]["Content-Security-Policy"],
+				"X-Frame-Options":           "SAMEORIGIN",
+				"Referrer-Policy":           "strict-origin-when-cross-origin",
+				"Permissions-Policy":        securityPresets["strict-spa"]["Permissions-Policy"],
+				"X-Content-Type-Options":    "nosniff",
+			},
+		},
+		{
+			name: "empty override drops a preset header",
+			cfg:  storage.SecurityHeaders{Preset: "api", Overrides: map[string]string{"Content-Security-Policy": "", "Strict-Transport-Security": ""}},
+			want: map[string]string{
+				"X-Frame-Options":        "DENY",
+				"Referrer-Policy":        "no-referrer",
+				"Permissions-Policy":     securityPresets["api"]["Permissions-Policy"],
+				"X-Content-Type-Options": "nosniff",
+			},
+		},
+		{
+			name: "overrides alone",
+			cfg:  storage.SecurityHeaders{Overrides: map[string]string{"X-Content-Type-Options": "nosniff", "Referrer-Policy": ""}},
+			want: map[string]string{"X-Content-Type-Options": "nosniff"},
+		},
+		{name: "nothing", cfg: storage.SecurityHeaders{}, want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := securityHeaderValues(&tt.cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecurityHeaderValuesLeavesPresetUnchanged(t *testing.T) {
+	securityHeaderValues(&storage.SecurityHeaders{Preset: "api", Overrides: map[string]string{"X-Frame-Options": ""}})
+	if securityPresets["api"]["X-Frame-Options"] != "DENY" {
+		t.Error("resolving a policy modified the shared preset")
+	}
+}
+
+func TestApplySecurityHeaders(t *testing.T) {
+	cfg := &storage.SecurityHeaders{Overrides: map[string]string{"X-Frame-Options": "DENY", "Referrer-Policy": "no-referrer"}}
+
+	header := http.Header{"X-Frame-Options": {"SAMEORIGIN"}}
+	applySecurityHeaders(header, cfg)
+	if got := header.Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("X-Frame-Options = %q, want the managed value", got)
+	}
+	if got := header.Get("Referrer-Policy"); got != "no-referrer" {
+		t.Errorf("Referrer-Policy = %q", got)
+	}
+
+	cfg.KeepUpstream = true
+	header = http.Header{"X-Frame-Options": {"SAMEORIGIN"}}
+	applySecurityHeaders(header, cfg)
+	if got := header.Get("X-Frame-Options"); got != "SAMEORIGIN" {
+		t.Errorf("X-Frame-Options = %q, want the upstream value kept", got)
+	}
+	if got := header.Get("Referrer-Policy"); got != "no-referrer" {
+		t.Errorf("Referrer-Policy = %q, want it added when the upstream sent none", got)
+	}
+}
+
+func TestValidateSecurityHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     storage.SecurityHeaders
+		wantErr bool
+	}{
+		{name: "preset", cfg: storage.SecurityHeaders{Preset: "strict-spa"}},
+		{name: "overrides only", cfg: storage.SecurityHeaders{Overrides: map[string]string{"content-security-policy": "default-src 'self'"}}},
+		{name: "unknown preset", cfg: storage.SecurityHeaders{Preset: "strict"}, wantErr: true},
+		{name: "unmanaged header", cfg: storage.SecurityHeaders{Overrides: map[string]string{"Server": ""}}, wantErr: true},
+		{name: "multi-line value", cfg: storage.SecurityHeaders{Overrides: map[string]string{"X-Frame-Options": "DENY\r\nX-Evil: 1"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateSecurityHeaders(&tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
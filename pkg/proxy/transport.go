@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"prism/pkg/secrets"
+	"prism/pkg/storage"
+)
+
+// pooledTransport is a project's transport together with the settings it was built from.
+type pooledTransport struct {
+	fingerprint [sha256.Size]byte
+	transport   http.RoundTripper
+}
+
+// transportFor returns the pooled transport of a project, building a new one when the project's
+// upstream TLS or protocol settings changed since the last request.
+func (f *Factory) transportFor(project *storage.Project) http.RoundTripper {
+	fingerprint := transportFingerprint(project)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if pooled, ok := f.transports[project.ID]; ok {
+		if pooled.fingerprint == fingerprint {
+			return pooled.transport
+		}
+		if old, ok := pooled.transport.(*http.Transport); ok {
+			old.CloseIdleConnections()
+		}
+	}
+
+	var transport http.RoundTripper
+	tlsConfig, err := UpstreamTLSConfig(project.UpstreamTLS, project.UpstreamTLSKey, f.box)
+	if err != nil {
+		// Fail the project's requests rather than silently connecting without the configured TLS.
+		log.Printf("Invalid upstream TLS settings for project %s: %v\n", project.ID, err)
+		transport = errorTransport{fmt.Errorf("invalid upstream TLS settings: %w", err)}
+	} else {
+		if project.UpstreamTLS != nil && project.UpstreamTLS.InsecureSkipVerify {
+			log.Printf("WARNING: Upstream certificate verification is DISABLED for project %s\n", project.ID)
+		}
+		transport = newTransport(tlsConfig, project.UpstreamProtocol, project.Limits)
+	}
+	f.transports[project.ID] = &pooledTransport{fingerprint: fingerprint, transport: transport}
+	return transport
+}
+
+// Invalidate drops the pooled transport, concurrency limiter and target health of a project,
+// e.g., after the project was deleted.
+func (f *Factory) Invalidate(projectID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.limiters, projectID)
+	delete(f.pools, projectID)
+	if pooled, ok := f.transports[projectID]; ok {
+		if old, ok := pooled.transport.(*http.Transport); ok {
+			old.CloseIdleConnections()
+		}
+		delete(f.transports, projectID)
+	}
+}
+
+// transportFingerprint identifies the settings a project's transport depends on.
+func transportFingerprint(project *storage.Project) [sha256.Size]byte {
+	data, _ := json.Marshal([]interface{}{project.UpstreamTLS, project.Limits})
+	data = append(data, project.UpstreamProtocol...)
+	return sha256.Sum256(append(data, project.UpstreamTLSKey...))
+}
+
+// Transport timeouts used when a project doesn't set its own (see storage.Limits).
+const (
+	defaultConnectTimeout        = 30 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 60 * time.Second
+	defaultIdleTimeout           = 90 * time.Second
+)
+
+// limitSeconds returns a limit given in seconds as a duration, or fallback if it is unset.
+func limitSeconds(seconds int, fallback time.Duration) time.Duration {
+	if seconds <= 0 {
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// newTransport creates a transport with increased connection pooling, speaking the given
+// upstream protocol (see storage.Project.UpstreamProtocol) with the project's timeouts.
+func newTransport(tlsConfig *tls.Config, protocol string, limits *storage.Limits) *http.Transport {
+	if limits == nil {
+		limits = &storage.Limits{}
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   limitSeconds(limits.ConnectTimeout, defaultConnectTimeout),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       limitSeconds(limits.IdleTimeout, defaultIdleTimeout),
+		TLSHandshakeTimeout:   limitSeconds(limits.TLSHandshakeTimeout, defaultTLSHandshakeTimeout),
+		ResponseHeaderTimeout: limitSeconds(limits.ResponseHeaderTimeout, defaultResponseHeaderTimeout),
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConnsPerHost:   100,
+	}
+
+	switch protocol {
+	case "h2c":
+		// Cleartext HTTP/2 with prior knowledge; HTTPS upstreams still negotiate via ALPN.
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		transport.Protocols.SetHTTP2(true)
+	case "http1":
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP1(true)
+	}
+	return transport
+}
+
+// ValidUpstreamProtocol reports whether protocol is a supported storage.Project.UpstreamProtocol.
+func ValidUpstreamProtocol(protocol string) bool {
+	return protocol == "" || protocol == "http1" || protocol == "h2c"
+}
+
+// UpstreamTLSConfig builds the client TLS configuration for a project's upstream. It returns
+// nil, nil when the project uses the defaults. encryptedKey is opened with box.
+func UpstreamTLSConfig(settings *storage.UpstreamTLS, encryptedKey []byte, box *secrets.Box) (*tls.Config, error) {
+	if settings == nil {
+		return nil, nil
+	}
+
+	minVersion, err := ParseTLSVersion(settings.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:         minVersion,
+		ServerName:         settings.ServerName,
+		InsecureSkipVerify: settings.InsecureSkipVerify,
+	}
+
+	if settings.CABundle != "" {
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM([]byte(settings.CABundle)) {
+			return nil, fmt.Errorf("CA bundle contains no certificates")
+		}
+		cfg.RootCAs = roots
+	}
+
+	if settings.ClientCertPEM != "" {
+		if box == nil {
+			return nil, fmt.Errorf("client certificates require PRISM_SECRET_KEY")
+		}
+		keyPEM, err := box.Open(encryptedKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt client key: %w", err)
+		}
+		cert, err := tls.X509KeyPair([]byte(settings.ClientCertPEM), keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate or key: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// ParseTLSVersion parses a version such as "1.2". An empty string means TLS 1.2.
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version '%s'", version)
+}
+
+// errorTransport fails every request with err, which the reverse proxy reports as a 502.
+type errorTransport struct {
+	err error
+}
+
+func (t errorTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, t.err
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"prism/pkg/storage"
+)
+
+func TestTransportFingerprint(t *testing.T) {
+	base := storage.Project{
+		ID:             "p1",
+		UpstreamURL:    "https://backend",
+		UpstreamTLS:    &storage.UpstreamTLS{ServerName: "backend.internal"},
+		UpstreamTLSKey: []byte("sealed key"),
+		Limits:         &storage.Limits{ConnectTimeout: 5},
+	}
+	same := base
+	same.Name = "renamed"
+	same.UpstreamTLS = &storage.UpstreamTLS{ServerName: "backend.internal"}
+	if transportFingerprint(&base) != transportFingerprint(&same) {
+		t.Error("settings the transport doesn't depend on changed the fingerprint")
+	}
+
+	changes := map[string]func(p *storage.Project){
+		"TLS settings":  func(p *storage.Project) { p.UpstreamTLS = &storage.UpstreamTLS{ServerName: "other.internal"} },
+		"no TLS":        func(p *storage.Project) { p.UpstreamTLS = nil },
+		"client key":    func(p *storage.Project) { p.UpstreamTLSKey = []byte("another key") },
+		"protocol":      func(p *storage.Project) { p.UpstreamProtocol = "h2c" },
+		"timeouts":      func(p *storage.Project) { p.Limits = &storage.Limits{ConnectTimeout: 6} },
+		"no limits":     func(p *storage.Project) { p.Limits = nil },
+		"idle timeout":  func(p *storage.Project) { p.Limits = &storage.Limits{ConnectTimeout: 5, IdleTimeout: 10} },
+		"header budget": func(p *storage.Project) { p.Limits = &storage.Limits{ConnectTimeout: 5, ResponseHeaderTimeout: 1} },
+	}
+	for name, change := range changes {
+		t.Run(name, func(t *testing.T) {
+			changed := base
+			change(&changed)
+			if transportFingerprint(&base) == transportFingerprint(&changed) {
+				t.Error("fingerprint did not change")
+			}
+		})
+	}
+}
+
+func TestTransportFor(t *testing.T) {
+	f := NewFactory(nil)
+	project := &storage.Project{ID: "p1", UpstreamURL: "http://backend"}
+
+	first := f.transportFor(project)
+	if f.transportFor(&storage.Project{ID: "p1", UpstreamURL: "http://backend", Name: "copy"}) != first {
+		t.Error("an unchanged project got a new transport")
+	}
+	if f.transportFor(&storage.Project{ID: "p2", UpstreamURL: "http://backend"}) == first {
+		t.Error("two projects share a transport")
+	}
+
+	project.Limits = &storage.Limits{ResponseHeaderTimeout: 5}
+	changed := f.transportFor(project)
+	if changed == first {
+		t.Fatal("changed limits kept the old transport")
+	}
+	if got := changed.(*http.Transport).ResponseHeaderTimeout; got != 5*time.Second {
+		t.Errorf("ResponseHeaderTimeout = %s, want 5s", got)
+	}
+	if f.transportFor(project) != changed {
+		t.Error("the rebuilt transport was not pooled")
+	}
+
+	f.Invalidate("p1")
+	if f.transportFor(project) == changed {
+		t.Error("an invalidated transport was reused")
+	}
+
+	broken := &storage.Project{ID: "p3", UpstreamURL: "https://backend", UpstreamTLS: &storage.UpstreamTLS{CABundle: "not PEM"}}
+	if _, ok := f.transportFor(broken).(errorTransport); !ok {
+		t.Error("invalid TLS settings did not fail the project's requests")
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	defaults := newTransport(nil, "", nil)
+	if defaults.TLSHandshakeTimeout != defaultTLSHandshakeTimeout || defaults.ResponseHeaderTimeout != defaultResponseHeaderTimeout || defaults.IdleConnTimeout != defaultIdleTimeout {
+		t.Errorf("defaults: handshake %s, headers %s, idle %s", defaults.TLSHandshakeTimeout, defaults.ResponseHeaderTimeout, defaults.IdleConnTimeout)
+	}
+	if defaults.Protocols != nil {
+		t.Error("the default protocol should negotiate")
+	}
+
+	limited := newTransport(nil, "", &storage.Limits{TLSHandshakeTimeout: 2, ResponseHeaderTimeout: 3, IdleTimeout: 4})
+	if limited.TLSHandshakeTimeout != 2*time.Second || limited.ResponseHeaderTimeout != 3*time.Second || limited.IdleConnTimeout != 4*time.Second {
+		t.Errorf("limits: handshake %s, headers %s, idle %s", limited.TLSHandshakeTimeout, limited.ResponseHeaderTimeout, limited.IdleConnTimeout)
+	}
+
+	if h2c := newTransport(nil, "h2c", nil); !h2c.Protocols.UnencryptedHTTP2() || h2c.Protocols.HTTP1() {
+		t.Errorf("h2c protocols = %v", h2c.Protocols)
+	}
+	if http1 := newTransport(nil, "http1", nil); !http1.Protocols.HTTP1() || http1.Protocols.HTTP2() {
+		t.Errorf("http1 protocols = %v", http1.Protocols)
+	}
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"prism/pkg/errorpage"
+	"prism/pkg/logger"
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+// StatusClientClosedRequest is reported, never sent, when the client hangs up before the
+// upstream answers.
+const StatusClientClosedRequest = 499
+
+// blockedUpstreamClasses are address classes a project may not proxy to: link-local covers
+// cloud metadata endpoints such as 169.254.169.254, and the others can't name a single server.
+var blockedUpstreamClasses = map[string]bool{"unspecified": true, "link-local": true, "multicast": true}
+
+// UpstreamAddressClass classifies the host of an upstream URL: "hostname" when it is a name
+// resolved at request time, otherwise "loopback", "private", "link-local", "multicast",
+// "unspecified" or "public".
+func UpstreamAddressClass(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return "loopback"
+	}
+	addr, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return "hostname"
+	}
+	addr = addr.Unmap()
+	switch {
+	case addr.IsUnspecified():
+		return "unspecified"
+	case addr.IsLoopback():
+		return "loopback"
+	case addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast():
+		return "link-local"
+	case addr.IsMulticast():
+		return "multicast"
+	case addr.IsPrivate():
+		return "private"
+	}
+	return "public"
+}
+
+// ValidateUpstreamURL checks an upstream URL before it is saved: an absolute http or https URL
+// with a host, no credentials or fragment, and an address class Prism may proxy to.
+func ValidateUpstreamURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid upstream URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("upstream URL must use http or https, got '%s'", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("upstream URL must include a host")
+	}
+	if u.User != nil {
+		return fmt.Errorf("upstream URL must not contain credentials")
+	}
+	if u.Fragment != "" {
+		return fmt.Errorf("upstream URL must not contain a fragment")
+	}
+	return ValidateUpstreamHost(u.Hostname())
+}
+
+// ValidateUpstreamHost checks that host is of an address class Prism may proxy to.
+func ValidateUpstreamHost(host string) error {
+	if class := UpstreamAddressClass(host); blockedUpstreamClasses[class] {
+		return fmt.Errorf("upstream host %s is not allowed: %s address", host, class)
+	}
+	return nil
+}
+
+// UpstreamErrorEvent is broadcast when a request could not be proxied.
+type UpstreamErrorEvent struct {
+	Event     string    `json:"event"` // Always "upstream_error"
+	Kind      string    `json:"kind"`  // 'dns', 'connect', 'tls', 'timeout', 'protocol', 'body_too_large' or 'canceled'
+	Status    int       `json:"status"`
+	Upstream  string    `json:"upstream"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	RequestID string    `json:"request_id,omitempty"`
+	Error     string    `json:"error"`
+	Time      time.Time `json:"time"`
+}
+
+// classifyUpstreamError names the kind of failure behind a proxy error and the status it maps to:
+// 504 for timeouts, 413 for bodies cut off by the project's limit, and 502 for everything the
+// upstream or the path to it got wrong.
+func classifyUpstreamError(r *http.Request, err error) (string, int) {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCertErr x509.CertificateInvalidError
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return "body_too_large", http.StatusRequestEntityTooLarge
+	case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+		return "canceled", StatusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return "timeout", http.StatusGatewayTimeout
+	case errors.As(err, &dnsErr):
+		return "dns", http.StatusBadGateway
+	case errors.As(err, &certErr) || errors.As(err, &recordErr) || errors.As(err, &alertErr),
+		errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidCertErr):
+		return "tls", http.StatusBadGateway
+	case errors.As(err, &opErr) && (opErr.Op == "remote error" || opErr.Op == "local error"):
+		// crypto/tls reports alerts sent or received during the handshake this way; the alert type itself is unexported
+		return "tls", http.StatusBadGateway
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "connect", http.StatusBadGateway
+	}
+	return "protocol", http.StatusBadGateway
+}
+
+// upstreamErrorMessages are the plain-text bodies for each kind of failure.
+var upstreamErrorMessages = map[string]string{
+	"dns":      "Bad Gateway: Upstream host could not be resolved",
+	"connect":  "Bad Gateway: Upstream refused or did not accept the connection",
+	"tls":      "Bad Gateway: TLS handshake with upstream failed",
+	"timeout":  "Gateway Timeout: Upstream did not respond in time",
+	"protocol": "Bad Gateway: Upstream sent an invalid response",
+}
+
+// upstreamErrorHandler answers requests the proxy could not complete. Each failure is broadcast as
+// an UpstreamErrorEvent and answered with a status for its kind; nothing here ends the process.
+// Failures to reach the upstream count against it in the project's upstream pool.
+func (f *Factory) upstreamErrorHandler(project *storage.Project, target *url.URL, hub *websockets.Hub) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		kind, status := classifyUpstreamError(r, err)
+		logger.BroadcastEvent(hub, project.ID, UpstreamErrorEvent{
+			Event:     "upstream_error",
+			Kind:      kind,
+			Status:    status,
+			Upstream:  target.Host,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			RequestID: r.Header.Get(RequestIDHeader),
+			Error:     err.Error(),
+			Time:      time.Now().UTC(),
+		})
+		switch kind {
+		case "dns", "connect", "tls", "timeout":
+			f.reportTarget(project, project.UpstreamURL, false)
+		case "canceled":
+			return // Nobody is left to answer
+		}
+		// gRPC calls must get their error as a gRPC status, not an HTTP error the client can't interpret.
+		if IsGRPC(r) {
+			WriteGRPCError(w, GRPCStatusFromHTTP(status), strings.ToLower(http.StatusText(status)))
+			return
+		}
+		if kind == "body_too_large" {
+			errorpage.Write(w, r, project, errorpage.Error, status, "Content Too Large: request body exceeds the project's limit")
+			return
+		}
+		errorpage.Write(w, r, project, errorpage.UpstreamDown, status, upstreamErrorMessages[kind])
+	}
+}
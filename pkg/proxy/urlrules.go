@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"prism/pkg/storage"
+)
+
+// maxURLRules bounds the rewrite and the redirect rules of a project, each.
+const maxURLRules = 100
+
+// urlPatterns caches compiled rule patterns by their source.
+var urlPatterns sync.Map
+
+func urlPattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := urlPatterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	urlPatterns.Store(pattern, re)
+	return re, nil
+}
+
+// RewriteURL applies the project's rewrite rules to path, the request path as the upstream will
+// see it, and returns the new path. Query changes are made to u. A replacement containing '?'
+// also sets the query parameters after it.
+func RewriteURL(project *storage.Project, u *url.URL, path string) string {
+	if project.URLRules == nil || len(project.URLRules.Rewrites) == 0 {
+		return path
+	}
+	if path == "" {
+		path = "/"
+	}
+	var query url.Values // Parsed on first use, so untouched queries keep their encoding
+	for _, rule := range project.URLRules.Rewrites {
+		re, err := urlPattern(rule.Match)
+		if err != nil {
+			continue // Rules are validated when saved
+		}
+		match := re.FindStringSubmatchIndex(path)
+		if match == nil {
+			continue
+		}
+		src := path
+		if query == nil && (len(rule.SetQuery) > 0 || len(rule.RemoveQuery) > 0 || strings.Contains(rule.Replace, "?")) {
+			query = u.Query()
+		}
+		if rule.Replace != "" {
+			replaced := string(re.ExpandString(nil, rule.Replace, src, match))
+			newPath, newQuery, hasQuery := strings.Cut(replaced, "?")
+			if hasQuery {
+				added, _ := url.ParseQuery(newQuery)
+				for name, values := range added {
+					query[name] = values
+				}
+			}
+			if !strings.HasPrefix(newPath, "/") {
+				newPath = "/" + newPath
+			}
+			path = newPath
+		}
+		for _, name := range rule.RemoveQuery {
+			query.Del(name)
+		}
+		for name, value := range rule.SetQuery {
+			query.Set(name, string(re.ExpandString(nil, value, src, match)))
+		}
+		if rule.Last {
+			break
+		}
+	}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	return path
+}
+
+// Redirect returns where the project's redirect rules send r, and with which status. path is the
+// request path as the upstream would see it; ok is false if no rule matches.
+func Redirect(r *http.Request, project *storage.Project, pathPrefix, path string) (location string, status int, ok bool) {
+	if project.URLRules == nil || len(project.URLRules.Redirects) == 0 {
+		return "", 0, false
+	}
+	if path == "" {
+		path = "/"
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	for _, rule := range project.URLRules.Redirects {
+		if rule.Scheme != "" && rule.Scheme != scheme {
+			continue
+		}
+		re, err := urlPattern(rule.Match)
+		if err != nil {
+			continue // Rules are validated when saved
+		}
+		match := re.FindStringSubmatchIndex(path)
+		if match == nil {
+			continue
+		}
+		query := ""
+		if r.URL.RawQuery != "" {
+			query = "?" + r.URL.RawQuery
+		}
+		// Capture groups are expanded first, so '$' in the request can't reference them
+		vars := strings.NewReplacer(
+			"{scheme}", scheme,
+			"{host}", r.Host,
+			"{path}", r.URL.EscapedPath(),
+			"{prefix}", pathPrefix,
+			"{query}", query,
+		)
+		location = vars.Replace(string(re.ExpandString(nil, rule.Target, path, match)))
+		status = rule.Status
+		if status == 0 {
+			status = http.StatusFound
+		}
+		return location, status, true
+	}
+	return "", 0, false
+}
+
+// ValidateURLRules checks rewrite and redirect rules before they are saved.
+func ValidateURLRules(rules *storage.URLRules) error {
+	if len(rules.Rewrites) > maxURLRules || len(rules.Redirects) > maxURLRules {
+		return fmt.Errorf("a project can have at most %d rewrite and %d redirect rules", maxURLRules, maxURLRules)
+	}
+	for i, rule := range rules.Rewrites {
+		if rule.Match == "" {
+			return fmt.Errorf("rewrite rule %d: match is required", i+1)
+		}
+		if _, err := regexp.Compile(rule.Match); err != nil {
+			return fmt.Errorf("rewrite rule %d: invalid match: %w", i+1, err)
+		}
+		if strings.ContainsAny(rule.Replace, "\r\n") {
+			return fmt.Errorf("rewrite rule %d: replace must not contain line breaks", i+1)
+		}
+		for _, name := range rule.RemoveQuery {
+			if name == "" {
+				return fmt.Errorf("rewrite rule %d: remove_query names must not be empty", i+1)
+			}
+		}
+		for name := range rule.SetQuery {
+			if name == "" {
+				return fmt.Errorf("rewrite rule %d: set_query names must not be empty", i+1)
+			}
+		}
+	}
+	for i, rule := range rules.Redirects {
+		if rule.Match == "" || rule.Target == "" {
+			return fmt.Errorf("redirect rule %d: match and target are required", i+1)
+		}
+		if _, err := regexp.Compile(rule.Match); err != nil {
+			return fmt.Errorf("redirect rule %d: invalid match: %w", i+1, err)
+		}
+		if strings.ContainsAny(rule.Target, "\r\n") {
+			return fmt.Errorf("redirect rule %d: target must not contain line breaks", i+1)
+		}
+		switch rule.Status {
+		case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return fmt.Errorf("redirect rule %d: status must be 301, 302, 307 or 308", i+1)
+		}
+		if rule.Scheme != "" && rule.Scheme != "http" && rule.Scheme != "https" {
+			return fmt.Errorf("redirect rule %d: scheme must be '', 'http' or 'https'", i+1)
+		}
+	}
+	return nil
+}
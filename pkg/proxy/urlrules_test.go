@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"prism/pkg/storage"
+)
+
+func TestRewriteURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     []storage.RewriteRule
+		target    string // Path and query as the upstream would see them
+		wantPath  string
+		wantQuery string
+	}{
+		{
+			name:     "no match",
+			rules:    []storage.RewriteRule{{Match: `^/old/`, Replace: "/new/"}},
+			target:   "/other?a=1",
+			wantPath: "/other", wantQuery: "a=1",
+		},
+		{
+			name:     "numbered captures",
+			rules:    []storage.RewriteRule{{Match: `^/users/(\d+)/posts/(\d+)$`, Replace: "/posts/$2?author=$1"}},
+			target:   "/users/7/posts/42",
+			wantPath: "/posts/42", wantQuery: "author=7",
+		},
+		{
+			name:     "named captures",
+			rules:    []storage.RewriteRule{{Match: `^/v(?P<version>\d)/(?P<rest>.*)$`, Replace: "/${rest}", SetQuery: map[string]string{"api": "v${version}"}}},
+			target:   "/v2/items?page=3",
+			wantPath: "/items", wantQuery: "api=v2&page=3",
+		},
+		{
+			name:     "leading slash added",
+			rules:    []storage.RewriteRule{{Match: `^/app/(.*)$`, Replace: "$1"}},
+			target:   "/app/index.html",
+			wantPath: "/index.html",
+		},
+		{
+			name:     "empty path matches root",
+			rules:    []storage.RewriteRule{{Match: `^/$`, Replace: "/home"}},
+			target:   "",
+			wantPath: "/home",
+		},
+		{
+			name:     "query only",
+			rules:    []storage.RewriteRule{{Match: `^/search`, RemoveQuery: []string{"debug"}, SetQuery: map[string]string{"source": "proxy"}}},
+			target:   "/search?q=go&debug=1",
+			wantPath: "/search", wantQuery: "q=go&source=proxy",
+		},
+		{
+			name: "rules chain",
+			rules: []storage.RewriteRule{
+				{Match: `^/a/(.*)$`, Replace: "/b/$1"},
+				{Match: `^/b/(.*)$`, Replace: "/c/$1"},
+			},
+			target:   "/a/x",
+			wantPath: "/c/x",
+		},
+		{
+			name: "last stops the chain",
+			rules: []storage.RewriteRule{
+				{Match: `^/a/(.*)$`, Replace: "/b/$1", Last: true},
+				{Match: `^/b/(.*)$`, Replace: "/c/$1"},
+			},
+			target:   "/a/x",
+			wantPath: "/b/x",
+		},
+		{
+			name:     "untouched query keeps its encoding",
+			rules:    []storage.RewriteRule{{Match: `^/old$`, Replace: "/new"}},
+			target:   "/old?b=2&a=%7e",
+			wantPath: "/new", wantQuery: "b=2&a=%7e",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			project := &storage.Project{URLRules: &storage.URLRules{Rewrites: tt.rules}}
+			u, err := url.Parse(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := RewriteURL(project, u, u.Path); got != tt.wantPath {
+				t.Errorf("path = %q, want %q", got, tt.wantPath)
+			}
+			if u.RawQuery != tt.wantQuery {
+				t.Errorf("query = %q, want %q", u.RawQuery, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	tests := []struct {
+		name       string
+		rules      []storage.RedirectRule
+		target     string // As requested, prefix included
+		tls        bool
+		wantOK     bool
+		wantTarget string
+		wantStatus int
+	}{
+		{
+			name:   "no match",
+			rules:  []storage.RedirectRule{{Match: `^/old$`, Target: "/new"}},
+			target: "/app/other",
+		},
+		{
+			name:   "captures and default status",
+			rules:  []storage.RedirectRule{{Match: `^/blog/(\d{4})/(.+)$`, Target: "{prefix}/posts/$2?year=$1"}},
+			target: "/app/blog/2024/hello", wantOK: true,
+			wantTarget: "/app/posts/hello?year=2024", wantStatus: http.StatusFound,
+		},
+		{
+			name:   "named captures",
+			rules:  []storage.RedirectRule{{Match: `^/docs/(?P<page>[a-z]+)$`, Target: "https://docs.example.com/${page}", Status: http.StatusPermanentRedirect}},
+			target: "/app/docs/install", wantOK: true,
+			wantTarget: "https://docs.example.com/install", wantStatus: http.StatusPermanentRedirect,
+		},
+		{
+			name:   "variables",
+			rules:  []storage.RedirectRule{{Match: `.*`, Target: "https://{host}{path}{query}", Status: http.StatusMovedPermanently}},
+			target: "/app/a%20b?x=1", wantOK: true,
+			wantTarget: "https://example.com/app/a%20b?x=1", wantStatus: http.StatusMovedPermanently,
+		},
+		{
+			name:   "dollar in the request is not expanded",
+			rules:  []storage.RedirectRule{{Match: `^/go$`, Target: "/gone{query}"}},
+			target: "/app/go?v=$1", wantOK: true,
+			wantTarget: "/gone?v=$1", wantStatus: http.StatusFound,
+		},
+		{
+			name:   "scheme restricted to http",
+			rules:  []storage.RedirectRule{{Match: `.*`, Target: "https://{host}{path}", Scheme: "http"}},
+			target: "/app/", tls: true,
+		},
+		{
+			name: "first matching rule wins",
+			rules: []storage.RedirectRule{
+				{Match: `.*`, Target: "https://{host}{path}", Scheme: "http"},
+				{Match: `^/$`, Target: "{prefix}/home"},
+			},
+			target: "/app", tls: true, wantOK: true,
+			wantTarget: "/app/home", wantStatus: http.StatusFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			project := &storage.Project{URLRules: &storage.URLRules{Redirects: tt.rules}}
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			upstreamPath := r.URL.Path[len("/app"):]
+			location, status, ok := Redirect(r, project, "/app", upstreamPath)
+			if ok != tt.wantOK || location != tt.wantTarget || status != tt.wantStatus {
+				t.Errorf("got %q %d %v, want %q %d %v", location, status, ok, tt.wantTarget, tt.wantStatus, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestValidateURLRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   storage.URLRules
+		wantErr bool
+	}{
+		{name: "valid", rules: storage.URLRules{
+			Rewrites:  []storage.RewriteRule{{Match: `^/v1/(.*)$`, Replace: "/$1", SetQuery: map[string]string{"v": "1"}}},
+			Redirects: []storage.RedirectRule{{Match: `^/old$`, Target: "/new", Status: http.StatusMovedPermanently, Scheme: "https"}},
+		}},
+		{name: "rewrite without match", rules: storage.URLRules{Rewrites: []storage.RewriteRule{{Replace: "/x"}}}, wantErr: true},
+		{name: "invalid rewrite pattern", rules: storage.URLRules{Rewrites: []storage.RewriteRule{{Match: `(`}}}, wantErr: true},
+		{name: "line break in replace", rules: storage.URLRules{Rewrites: []storage.RewriteRule{{Match: `.*`, Replace: "/a\r\nX: y"}}}, wantErr: true},
+		{name: "empty query name", rules: storage.URLRules{Rewrites: []storage.RewriteRule{{Match: `.*`, RemoveQuery: []string{""}}}}, wantErr: true},
+		{name: "redirect without target", rules: storage.URLRules{Redirects: []storage.RedirectRule{{Match: `.*`}}}, wantErr: true},
+		{name: "line break in target", rules: storage.URLRules{Redirects: []storage.RedirectRule{{Match: `.*`, Target: "/a\nb"}}}, wantErr: true},
+		{name: "non-redirect status", rules: storage.URLRules{Redirects: []storage.RedirectRule{{Match: `.*`, Target: "/a", Status: http.StatusOK}}}, wantErr: true},
+		{name: "unknown scheme", rules: storage.URLRules{Redirects: []storage.RedirectRule{{Match: `.*`, Target: "/a", Scheme: "ftp"}}}, wantErr: true},
+		{name: "too many rules", rules: storage.URLRules{Rewrites: make([]storage.RewriteRule, maxURLRules+1)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateURLRules(&tt.rules); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
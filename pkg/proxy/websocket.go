@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"prism/pkg/errorpage"
+	"prism/pkg/logger"
+	"prism/pkg/storage"
+	"prism/pkg/websockets"
+)
+
+// IsWebSocketUpgrade reports whether r asks to upgrade the connection to the WebSocket protocol.
+func IsWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ServeWebSocket proxies a WebSocket upgrade to the project's upstream and then relays frames in
+// both directions. Messages from the client are checked against policy; a violation closes both
+// sides. Lifecycle events are sent to the project's log stream.
+func (f *Factory) ServeWebSocket(w http.ResponseWriter, r *http.Request, project *storage.Project, policy *WebSocketPolicy, hub *websockets.Hub) {
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok || r.ProtoMajor != 1 {
+		http.Error(w, "Bad Request: WebSocket upgrades require HTTP/1.1", http.StatusBadRequest)
+		return
+	}
+
+	target, err := url.Parse(project.UpstreamURL)
+	if err != nil {
+		logger.LogAndBroadcast(hub, project.ID, "Invalid upstream URL for project '%s': %v", project.Name, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	outReq := r.Clone(r.Context())
+	httputil.NewSingleHostReverseProxy(target).Director(outReq)
+	outReq.Body = nil
+	outReq.ContentLength = 0
+	outReq.Header.Set("X-Mini-NGFW", "true")
+	if prior := outReq.Header.Get("X-Forwarded-For"); prior != "" {
+		outReq.Header.Set("X-Forwarded-For", prior+", "+clientIP)
+	} else {
+		outReq.Header.Set("X-Forwarded-For", clientIP)
+	}
+	applyHeaderRules(outReq.Header, project.HeaderRules, "request", headerTemplate(outReq, project))
+	// Compressed frames can't be inspected, so never negotiate permessage-deflate.
+	outReq.Header.Del("Sec-WebSocket-Extensions")
+
+	upstream, err := f.dialUpstream(r.Context(), project, target)
+	if err != nil {
+		logger.LogAndBroadcast(hub, project.ID, "WebSocket upstream %s unreachable: %v", target.Host, err)
+		errorpage.Write(w, r, project, errorpage.UpstreamDown, http.StatusBadGateway, "Bad Gateway: Upstream unreachable")
+		return
+	}
+
+	upstream.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := outReq.Write(upstream); err != nil {
+		upstream.Close()
+		logger.LogAndBroadcast(hub, project.ID, "WebSocket handshake with upstream failed: %v", err)
+		errorpage.Write(w, r, project, errorpage.UpstreamDown, http.StatusBadGateway, "Bad Gateway")
+		return
+	}
+	upstreamReader := bufio.NewReader(upstream)
+	resp, err := http.ReadResponse(upstreamReader, outReq)
+	if err != nil {
+		upstream.Close()
+		logger.LogAndBroadcast(hub, project.ID, "WebSocket handshake with upstream failed: %v", err)
+		errorpage.Write(w, r, project, errorpage.UpstreamDown, http.StatusBadGateway, "Bad Gateway")
+		return
+	}
+	upstream.SetDeadline(time.Time{})
+	applyHeaderRules(resp.Header, project.HeaderRules, "response", headerTemplate(outReq, project))
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// The upstream refused the upgrade; pass its answer on as a normal response.
+		defer upstream.Close()
+		defer resp.Body.Close()
+		for key, values := range resp.Header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		logger.LogAndBroadcast(hub, project.ID, "WebSocket upgrade from %s refused by upstream with status %d", clientIP, resp.StatusCode)
+		return
+	}
+
+	client, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		log.Printf("Failed to hijack WebSocket connection: %v\n", err)
+		return
+	}
+
+	fmt.Fprintf(clientBuf, "HTTP/1.1 101 Switching Protocols\r\n")
+	resp.Header.Write(clientBuf)
+	clientBuf.WriteString("\r\n")
+	if err := clientBuf.Flush(); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+
+	logger.LogAndBroadcast(hub, project.ID, "WebSocket opened from %s to %s%s", clientIP, target.Host, outReq.URL.Path)
+	session := &wsSession{
+		client:         client,
+		clientReader:   clientBuf.Reader,
+		upstream:       upstream,
+		upstreamReader: upstreamReader,
+		policy:         policy,
+		started:        time.Now(),
+	}
+	reason := session.run()
+	logger.LogAndBroadcast(hub, project.ID, "WebSocket from %s closed after %s: %d messages (%d bytes) from client, %d bytes to client, %s",
+		clientIP, time.Since(session.started).Round(time.Millisecond), session.messages, session.clientBytes, session.upstreamBytes, reason)
+}
+
+// dialUpstream opens a connection to the upstream, using the project's TLS settings for HTTPS.
+func (f *Factory) dialUpstream(ctx context.Context, project *storage.Project, target *url.URL) (net.Conn, error) {
+	secure := target.Scheme == "https" || target.Scheme == "wss"
+	host := target.Host
+	if target.Port() == "" {
+		if secure {
+			host = net.JoinHostPort(target.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(target.Hostname(), "80")
+		}
+	}
+
+	var limits storage.Limits
+	if project.Limits != nil {
+		limits = *project.Limits
+	}
+	dialer := &net.Dialer{Timeout: limitSeconds(limits.ConnectTimeout, defaultConnectTimeout), KeepAlive: 30 * time.Second}
+	if !secure {
+		return dialer.DialContext(ctx, "tcp", host)
+	}
+
+	tlsConfig, err := UpstreamTLSConfig(project.UpstreamTLS, project.UpstreamTLSKey, f.box)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream TLS settings: %w", err)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = target.Hostname()
+	}
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	ctx, cancel := context.WithTimeout(ctx, dialer.Timeout+limitSeconds(limits.TLSHandshakeTimeout, defaultTLSHandshakeTimeout))
+	defer cancel()
+	return (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", host)
+}
+
+// wsSession relays one WebSocket connection.
+type wsSession struct {
+	client         net.Conn
+	clientReader   *bufio.Reader
+	upstream       net.Conn
+	upstreamReader *bufio.Reader
+	policy         *WebSocketPolicy
+	started        time.Time
+
+	messages      int64
+	clientBytes   int64
+	upstreamBytes int64
+}
+
+// run relays frames until either side closes or the client violates the policy, and returns
+// a description of why the connection ended.
+func (s *wsSession) run() string {
+	var wg sync.WaitGroup
+	upstreamDone := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(upstreamDone)
+		s.upstreamBytes, _ = io.Copy(s.client, s.upstreamReader)
+		// Unblock the client reader without closing the connection, which may still need a close frame.
+		s.client.SetReadDeadline(time.Now())
+	}()
+
+	var violation *wsViolation
+	var err error
+	if s.policy.Empty() {
+		s.clientBytes, err = io.Copy(s.upstream, s.clientReader)
+	} else {
+		violation, err = s.inspectClient()
+	}
+
+	if violation != nil {
+		// Stop the upstream first so nothing else is written to the client, then tell both
+		// sides why the connection is being closed.
+		s.upstream.Write(closeFrame(violation.code, violation.reason, true))
+		s.upstream.Close()
+		wg.Wait()
+		s.client.Write(closeFrame(violation.code, violation.reason, false))
+		s.client.Close()
+		return "blocked: " + violation.reason
+	}
+
+	reason := "closed by client"
+	select {
+	case <-upstreamDone:
+		reason = "closed by upstream"
+	default:
+		if err != nil && err != io.EOF {
+			reason = "client error: " + err.Error()
+		}
+	}
+	s.upstream.Close()
+	s.client.Close()
+	wg.Wait()
+	return reason
+}
+
+// inspectClient relays frames from the client to the upstream, holding back each inspected
+// message until it is complete so a blocked message is never partially delivered.
+func (s *wsSession) inspectClient() (*wsViolation, error) {
+	var (
+		pending    []byte // Raw frames of the message being inspected
+		message    []byte // Unmasked payload of the message being inspected
+		messageLen int64
+		inspect    bool
+	)
+	for {
+		header, err := readFrameHeader(s.clientReader)
+		if err != nil {
+			return nil, err
+		}
+		if !header.masked {
+			return &wsViolation{code: closeProtocolError, reason: "unmasked client frame"}, nil
+		}
+
+		if header.isControl() {
+			if header.length > 125 {
+				return &wsViolation{code: closeProtocolError, reason: "oversized control frame"}, nil
+			}
+			frame := append(header.raw, make([]byte, header.length)...)
+			if _, err := io.ReadFull(s.clientReader, frame[len(header.raw):]); err != nil {
+				return nil, err
+			}
+			if _, err := s.upstream.Write(frame); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if header.opcode != opContinuation {
+			// First frame of a new message
+			s.messages++
+			messageLen = 0
+			if v := s.policy.allowMessage(time.Now()); v != nil {
+				return v, nil
+			}
+			inspect = header.opcode == opText && s.policy.inspectsText()
+		}
+		messageLen += header.length
+		s.clientBytes += header.length
+		if v := s.policy.checkSize(messageLen, inspect); v != nil {
+			return v, nil
+		}
+
+		if !inspect {
+			if _, err := s.upstream.Write(header.raw); err != nil {
+				return nil, err
+			}
+			if _, err := io.CopyN(s.upstream, s.clientReader, header.length); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		payload := make([]byte, header.length)
+		if _, err := io.ReadFull(s.clientReader, payload); err != nil {
+			return nil, err
+		}
+		pending = append(append(pending, header.raw...), payload...)
+		for i, b := range payload {
+			message = append(message, b^header.mask[i%4])
+		}
+		if !header.fin {
+			continue
+		}
+
+		if v := s.policy.inspectText(message); v != nil {
+			return v, nil
+		}
+		if _, err := s.upstream.Write(pending); err != nil {
+			return nil, err
+		}
+		pending, message = pending[:0], message[:0]
+	}
+}
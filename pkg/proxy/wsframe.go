@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"prism/pkg/storage"
+)
+
+// WebSocket opcodes and close codes from RFC 6455.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opClose        = 0x8
+
+	closePolicyViolation = 1008
+	closeMessageTooBig   = 1009
+	closeProtocolError   = 1002
+)
+
+// maxInspectedMessage bounds how much of a text message is buffered for keyword and regex
+// matching. Larger messages can't be inspected and are rejected when such rules are active.
+const maxInspectedMessage = 1 << 20
+
+// WebSocketPolicy holds a project's rules for messages sent by WebSocket clients. It is built
+// per connection, so rate limits apply to each connection separately.
+type WebSocketPolicy struct {
+	maxMessageSize int64
+	limiters       []*messageLimiter
+	keywords       []string
+	patterns       []*regexp.Regexp
+}
+
+// NewWebSocketPolicy builds a policy from the enabled ws_* rules of a project. Other rule types
+// are ignored. It returns an error if a rule value is invalid.
+func NewWebSocketPolicy(rules []storage.Rule) (*WebSocketPolicy, error) {
+	policy := &WebSocketPolicy{}
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		switch rule.Type {
+		case "ws_max_message_size":
+			size, err := strconv.ParseInt(rule.Value, 10, 64)
+			if err != nil || size <= 0 {
+				return nil, fmt.Errorf("ws_max_message_size must be a positive number of bytes, got '%s'", rule.Value)
+			}
+			if policy.maxMessageSize == 0 || size < policy.maxMessageSize {
+				policy.maxMessageSize = size
+			}
+		case "ws_rate_limit":
+			limiter, err := parseMessageRate(rule.Value)
+			if err != nil {
+				return nil, err
+			}
+			policy.limiters = append(policy.limiters, limiter)
+		case "ws_keyword_block":
+			policy.keywords = append(policy.keywords, rule.Value)
+		case "ws_regex_block":
+			pattern, err := regexp.Compile(rule.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ws_regex_block pattern: %w", err)
+			}
+			policy.patterns = append(policy.patterns, pattern)
+		}
+	}
+	return policy, nil
+}
+
+// Empty reports whether the policy has no rules, in which case frames are relayed untouched.
+func (p *WebSocketPolicy) Empty() bool {
+	return p == nil || (p.maxMessageSize == 0 && len(p.limiters) == 0 && !p.inspectsText())
+}
+
+func (p *WebSocketPolicy) inspectsText() bool {
+	return len(p.keywords) > 0 || len(p.patterns) > 0
+}
+
+// wsViolation describes why a connection is being closed.
+type wsViolation struct {
+	code   int
+	reason string
+}
+
+// allowMessage applies the rate limits when a new message starts.
+func (p *WebSocketPolicy) allowMessage(now time.Time) *wsViolation {
+	for _, limiter := range p.limiters {
+		if !limiter.allow(now) {
+			return &wsViolation{code: closePolicyViolation, reason: "message rate limit exceeded"}
+		}
+	}
+	return nil
+}
+
+// checkSize applies the size limit to the length of the message received so far.
+func (p *WebSocketPolicy) checkSize(length int64, inspected bool) *wsViolation {
+	if p.maxMessageSize > 0 && length > p.maxMessageSize {
+		return &wsViolation{code: closeMessageTooBig, reason: fmt.Sprintf("message exceeds %d bytes", p.maxMessageSize)}
+	}
+	if inspected && length > maxInspectedMessage {
+		return &wsViolation{code: closeMessageTooBig, reason: "message too large to inspect"}
+	}
+	return nil
+}
+
+// inspectText matches a complete text message against the keyword and regex rules.
+func (p *WebSocketPolicy) inspectText(message []byte) *wsViolation {
+	for _, keyword := range p.keywords {
+		if bytes.Contains(message, []byte(keyword)) {
+			return &wsViolation{code: closePolicyViolation, reason: fmt.Sprintf("message contains blocked keyword '%s'", keyword)}
+		}
+	}
+	for _, pattern := range p.patterns {
+		if pattern.Match(message) {
+			return &wsViolation{code: closePolicyViolation, reason: fmt.Sprintf("message matches blocked pattern '%s'", pattern)}
+		}
+	}
+	return nil
+}
+
+// messageLimiter is a token bucket allowing a number of messages per interval, with bursts
+// up to the same number.
+type messageLimiter struct {
+	perSecond float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+}
+
+// parseMessageRate parses a rate such as "20/s", "600/m" or "20" (per second).
+func parseMessageRate(value string) (*messageLimiter, error) {
+	count, unit, _ := strings.Cut(value, "/")
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("ws_rate_limit must look like '20/s' or '600/m', got '%s'", value)
+	}
+	perSecond := n
+	switch unit {
+	case "", "s":
+	case "m":
+		perSecond = n / 60
+	default:
+		return nil, fmt.Errorf("ws_rate_limit must look like '20/s' or '600/m', got '%s'", value)
+	}
+	return &messageLimiter{perSecond: perSecond, burst: n, tokens: n}, nil
+}
+
+func (l *messageLimiter) allow(now time.Time) bool {
+	if !l.last.IsZero() {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.perSecond)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// frameHeader is a parsed WebSocket frame header together with its raw bytes.
+type frameHeader struct {
+	fin    bool
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length int64
+	raw    []byte
+}
+
+func (h *frameHeader) isControl() bool {
+	return h.opcode&0x8 != 0
+}
+
+// readFrameHeader reads the header of the next frame.
+func readFrameHeader(r *bufio.Reader) (*frameHeader, error) {
+	raw := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	h := &frameHeader{fin: raw[0]&0x80 != 0, opcode: raw[0] & 0x0f, masked: raw[1]&0x80 != 0}
+
+	switch length := raw[1] & 0x7f; length {
+	case 126:
+		raw = raw[:4]
+		if _, err := io.ReadFull(r, raw[2:]); err != nil {
+			return nil, err
+		}
+		h.length = int64(binary.BigEndian.Uint16(raw[2:]))
+	case 127:
+		raw = raw[:10]
+		if _, err := io.ReadFull(r, raw[2:]); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint64(raw[2:])
+		if size > 1<<62 {
+			return nil, fmt.Errorf("invalid frame length")
+		}
+		h.length = int64(size)
+	default:
+		h.length = int64(length)
+	}
+
+	if h.masked {
+		n := len(raw)
+		raw = raw[:n+4]
+		if _, err := io.ReadFull(r, raw[n:]); err != nil {
+			return nil, err
+		}
+		copy(h.mask[:], raw[n:])
+	}
+	h.raw = raw
+	return h, nil
+}
+
+// closeFrame builds a close frame. Frames sent to the upstream act as a client and must be masked.
+func closeFrame(code int, reason string, masked bool) []byte {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+
+	frame := []byte{0x80 | opClose, byte(len(payload))}
+	if !masked {
+		return append(frame, payload...)
+	}
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame[1] |= 0x80
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
@@ -0,0 +1,337 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"prism/pkg/storage"
+)
+
+// frame builds a WebSocket frame, masked with mask unless it is nil.
+func frame(fin bool, opcode byte, payload []byte, mask []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	out := []byte{first}
+	maskBit := byte(0)
+	if mask != nil {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		out = append(out, maskBit|byte(n))
+	case n <= 0xffff:
+		out = append(out, maskBit|126)
+		out = binary.BigEndian.AppendUint16(out, uint16(n))
+	default:
+		out = append(out, maskBit|127)
+		out = binary.BigEndian.AppendUint64(out, uint64(n))
+	}
+	if mask == nil {
+		return append(out, payload...)
+	}
+	out = append(out, mask...)
+	for i, b := range payload {
+		out = append(out, b^mask[i%4])
+	}
+	return out
+}
+
+var testMask = []byte{0x37, 0xfa, 0x21, 0x3d}
+
+func TestReadFrameHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    frameHeader
+		wantErr bool
+	}{
+		{
+			name:  "unmasked text",
+			input: frame(true, opText, []byte("hello"), nil),
+			want:  frameHeader{fin: true, opcode: opText, length: 5},
+		},
+		{
+			name:  "masked continuation",
+			input: frame(false, opContinuation, []byte("hello"), testMask),
+			want:  frameHeader{opcode: opContinuation, masked: true, mask: [4]byte(testMask), length: 5},
+		},
+		{
+			name:  "16-bit length",
+			input: frame(true, 0x2, make([]byte, 300), testMask),
+			want:  frameHeader{fin: true, opcode: 0x2, masked: true, mask: [4]byte(testMask), length: 300},
+		},
+		{
+			name:  "64-bit length",
+			input: frame(true, 0x2, make([]byte, 70000), nil),
+			want:  frameHeader{fin: true, opcode: 0x2, length: 70000},
+		},
+		{
+			name:  "close",
+			input: frame(true, opClose, []byte{0x03, 0xe8}, testMask),
+			want:  frameHeader{fin: true, opcode: opClose, masked: true, mask: [4]byte(testMask), length: 2},
+		},
+		{
+			name:    "64-bit length with the high bit set",
+			input:   []byte{0x82, 127, 0x80, 0, 0, 0, 0, 0, 0, 0},
+			wantErr: true,
+		},
+		{name: "empty", input: nil, wantErr: true},
+		{name: "truncated first bytes", input: []byte{0x81}, wantErr: true},
+		{name: "truncated 16-bit length", input: []byte{0x82, 126, 0x01}, wantErr: true},
+		{name: "truncated 64-bit length", input: []byte{0x82, 127, 0, 0, 0}, wantErr: true},
+		{name: "truncated mask", input: []byte{0x81, 0x85, 0x37, 0xfa}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := readFrameHeader(bufio.NewReader(bytes.NewReader(tt.input)))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", h)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.fin != tt.want.fin || h.opcode != tt.want.opcode || h.masked != tt.want.masked || h.mask != tt.want.mask || h.length != tt.want.length {
+				t.Errorf("got %+v, want %+v", *h, tt.want)
+			}
+			// The raw header is relayed as is, so it must be exactly the bytes before the payload
+			if want := tt.input[:len(tt.input)-int(h.length)]; !bytes.Equal(h.raw, want) {
+				t.Errorf("raw header = %x, want %x", h.raw, want)
+			}
+		})
+	}
+}
+
+func TestCloseFrame(t *testing.T) {
+	tests := []struct {
+		name       string
+		reason     string
+		masked     bool
+		wantReason string
+	}{
+		{name: "to client", reason: "message rate limit exceeded", wantReason: "message rate limit exceeded"},
+		{name: "to upstream", reason: "message rate limit exceeded", masked: true, wantReason: "message rate limit exceeded"},
+		{name: "long reason is truncated", reason: strings.Repeat("x", 200), masked: true, wantReason: strings.Repeat("x", 123)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(closeFrame(closePolicyViolation, tt.reason, tt.masked)))
+			h, err := readFrameHeader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !h.fin || h.opcode != opClose || h.masked != tt.masked || h.length > 125 {
+				t.Fatalf("unexpected close frame header %+v", *h)
+			}
+			payload, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(payload)) != h.length {
+				t.Fatalf("payload is %d bytes, header says %d", len(payload), h.length)
+			}
+			for i := range payload {
+				payload[i] ^= h.mask[i%4] // A zero mask when unmasked
+			}
+			if code := binary.BigEndian.Uint16(payload); code != closePolicyViolation {
+				t.Errorf("close code = %d, want %d", code, closePolicyViolation)
+			}
+			if reason := string(payload[2:]); reason != tt.wantReason {
+				t.Errorf("close reason = %q, want %q", reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestNewWebSocketPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     []storage.Rule
+		wantErr   bool
+		wantEmpty bool
+	}{
+		{name: "no rules", wantEmpty: true},
+		{name: "other rule types only", rules: []storage.Rule{{Type: "ip_block", Value: "192.0.2.1", Enabled: true}}, wantEmpty: true},
+		{name: "disabled rules are ignored", rules: []storage.Rule{{Type: "ws_regex_block", Value: "(", Enabled: false}}, wantEmpty: true},
+		{name: "max message size", rules: []storage.Rule{{Type: "ws_max_message_size", Value: "1024", Enabled: true}}},
+		{name: "rate per minute", rules: []storage.Rule{{Type: "ws_rate_limit", Value: "600/m", Enabled: true}}},
+		{name: "keyword", rules: []storage.Rule{{Type: "ws_keyword_block", Value: "DROP TABLE", Enabled: true}}},
+		{name: "negative size", rules: []storage.Rule{{Type: "ws_max_message_size", Value: "-1", Enabled: true}}, wantErr: true},
+		{name: "size not a number", rules: []storage.Rule{{Type: "ws_max_message_size", Value: "1kb", Enabled: true}}, wantErr: true},
+		{name: "rate unit", rules: []storage.Rule{{Type: "ws_rate_limit", Value: "20/h", Enabled: true}}, wantErr: true},
+		{name: "zero rate", rules: []storage.Rule{{Type: "ws_rate_limit", Value: "0/s", Enabled: true}}, wantErr: true},
+		{name: "invalid regex", rules: []storage.Rule{{Type: "ws_regex_block", Value: "(", Enabled: true}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := NewWebSocketPolicy(tt.rules)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && policy.Empty() != tt.wantEmpty {
+				t.Errorf("Empty() = %v, want %v", policy.Empty(), tt.wantEmpty)
+			}
+		})
+	}
+}
+
+func TestMessageLimiter(t *testing.T) {
+	limiter, err := parseMessageRate("2/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(0, 0)
+	for i, want := range []bool{true, true, false} {
+		if got := limiter.allow(now); got != want {
+			t.Fatalf("message %d: allow = %v, want %v", i+1, got, want)
+		}
+	}
+	if !limiter.allow(now.Add(500 * time.Millisecond)) {
+		t.Error("expected a token to be refilled after half a second")
+	}
+	if limiter.allow(now.Add(600 * time.Millisecond)) {
+		t.Error("expected the bucket to be empty again")
+	}
+	if !limiter.allow(now.Add(time.Hour)) || !limiter.allow(now.Add(time.Hour)) || limiter.allow(now.Add(time.Hour)) {
+		t.Error("expected a refill to stop at the burst size")
+	}
+}
+
+// recordConn records what is written to it.
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func TestInspectClient(t *testing.T) {
+	ping := frame(true, 0x9, []byte("ping"), testMask)
+	tests := []struct {
+		name          string
+		rules         []storage.Rule
+		frames        [][]byte
+		wantViolation int    // Close code, or 0 when the client just ran out of frames
+		wantForwarded []byte // Everything relayed to the upstream
+	}{
+		{
+			name:          "clean message is relayed",
+			rules:         []storage.Rule{{Type: "ws_keyword_block", Value: "secret", Enabled: true}},
+			frames:        [][]byte{frame(true, opText, []byte("hello"), testMask)},
+			wantForwarded: frame(true, opText, []byte("hello"), testMask),
+		},
+		{
+			name:          "blocked keyword",
+			rules:         []storage.Rule{{Type: "ws_keyword_block", Value: "secret", Enabled: true}},
+			frames:        [][]byte{frame(true, opText, []byte("the secret is"), testMask)},
+			wantViolation: closePolicyViolation,
+		},
+		{
+			name:  "keyword split across fragments is never partially delivered",
+			rules: []storage.Rule{{Type: "ws_keyword_block", Value: "secret", Enabled: true}},
+			frames: [][]byte{
+				frame(false, opText, []byte("the sec"), testMask),
+				frame(true, opContinuation, []byte("ret is"), []byte{1, 2, 3, 4}),
+			},
+			wantViolation: closePolicyViolation,
+		},
+		{
+			name:  "control frames pass while a fragmented message is held back",
+			rules: []storage.Rule{{Type: "ws_regex_block", Value: `(?i)union\s+select`, Enabled: true}},
+			frames: [][]byte{
+				frame(false, opText, []byte("hel"), testMask),
+				ping,
+				frame(true, opContinuation, []byte("lo"), testMask),
+			},
+			wantForwarded: append(append(append([]byte{}, ping...), frame(false, opText, []byte("hel"), testMask)...), frame(true, opContinuation, []byte("lo"), testMask)...),
+		},
+		{
+			name:          "regex",
+			rules:         []storage.Rule{{Type: "ws_regex_block", Value: `(?i)union\s+select`, Enabled: true}},
+			frames:        [][]byte{frame(true, opText, []byte("1 UNION  SELECT password"), testMask)},
+			wantViolation: closePolicyViolation,
+		},
+		{
+			name:          "binary messages are not inspected",
+			rules:         []storage.Rule{{Type: "ws_keyword_block", Value: "secret", Enabled: true}},
+			frames:        [][]byte{frame(true, 0x2, []byte("secret"), testMask)},
+			wantForwarded: frame(true, 0x2, []byte("secret"), testMask),
+		},
+		{
+			name:          "unmasked client frame",
+			rules:         []storage.Rule{{Type: "ws_max_message_size", Value: "100", Enabled: true}},
+			frames:        [][]byte{frame(true, opText, []byte("hello"), nil)},
+			wantViolation: closeProtocolError,
+		},
+		{
+			name:          "oversized control frame",
+			rules:         []storage.Rule{{Type: "ws_max_message_size", Value: "1000", Enabled: true}},
+			frames:        [][]byte{frame(true, 0x9, make([]byte, 126), testMask)},
+			wantViolation: closeProtocolError,
+		},
+		{
+			name:  "size limit counts every fragment",
+			rules: []storage.Rule{{Type: "ws_max_message_size", Value: "8", Enabled: true}},
+			frames: [][]byte{
+				frame(false, 0x2, []byte("12345"), testMask),
+				frame(true, opContinuation, []byte("6789"), testMask),
+			},
+			wantViolation: closeMessageTooBig,
+			wantForwarded: frame(false, 0x2, []byte("12345"), testMask), // Binary fragments are not held back
+		},
+		{
+			name:  "rate limit",
+			rules: []storage.Rule{{Type: "ws_rate_limit", Value: "2/m", Enabled: true}},
+			frames: [][]byte{
+				frame(true, opText, []byte("a"), testMask),
+				frame(true, opText, []byte("b"), testMask),
+				frame(true, opText, []byte("c"), testMask),
+			},
+			wantViolation: closePolicyViolation,
+			wantForwarded: append(frame(true, opText, []byte("a"), testMask), frame(true, opText, []byte("b"), testMask)...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := NewWebSocketPolicy(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			upstream := &recordConn{}
+			s := &wsSession{
+				clientReader: bufio.NewReader(bytes.NewReader(bytes.Join(tt.frames, nil))),
+				upstream:     upstream,
+				policy:       policy,
+			}
+			violation, err := s.inspectClient()
+
+			if tt.wantViolation == 0 {
+				if violation != nil {
+					t.Fatalf("unexpected violation %+v", *violation)
+				}
+				if !errors.Is(err, io.EOF) {
+					t.Fatalf("expected the client to run out of frames, got %v", err)
+				}
+			} else if violation == nil || violation.code != tt.wantViolation {
+				t.Fatalf("violation = %+v, err = %v; want close code %d", violation, err, tt.wantViolation)
+			}
+
+			if !bytes.Equal(upstream.written.Bytes(), tt.wantForwarded) {
+				t.Errorf("forwarded %q, want %q", upstream.written.Bytes(), tt.wantForwarded)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+// Package proxyproto reads PROXY protocol v1 and v2 headers, which L4 load balancers such as
+// HAProxy send ahead of a connection to pass on the original client address. Headers are only
+// read from trusted peers; anyone else could claim to be any client.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHeaderTimeout is how long a trusted peer has to send its header when no timeout is given.
+const DefaultHeaderTimeout = 5 * time.Second
+
+const (
+	maxV1HeaderLength = 107 // Including CRLF, per the specification
+	v2HeaderLength    = 16
+)
+
+// v2Signature starts every version 2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrMissingHeader is returned when a trusted peer doesn't start with a PROXY protocol header.
+var ErrMissingHeader = errors.New("missing PROXY protocol header")
+
+// ParseTrusted parses the peers allowed to send headers, as IP addresses or CIDRs.
+func ParseTrusted(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted CIDR '%s'", value)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted IP '%s'", value)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Config enables PROXY protocol on a listener. The zero value leaves listeners as they are, so
+// the protocol stays opt-in.
+type Config struct {
+	TrustedFrom   []string      // Peers allowed, and required, to send headers, as IP addresses or CIDRs
+	HeaderTimeout time.Duration // DefaultHeaderTimeout when zero
+}
+
+// ParseConfig parses a comma-separated list of trusted peers, as given in
+// PRISM_PROXY_PROTOCOL_FROM for the HTTP listeners. An empty value disables the protocol.
+func ParseConfig(value string) (Config, error) {
+	var cfg Config
+	for _, peer := range strings.Split(value, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			cfg.TrustedFrom = append(cfg.TrustedFrom, peer)
+		}
+	}
+	if _, err := ParseTrusted(cfg.TrustedFrom); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// Enabled reports whether any peer may send headers.
+func (c Config) Enabled() bool {
+	return len(c.TrustedFrom) > 0
+}
+
+// Wrap returns ln reading headers from the configured peers, or ln itself when the protocol is
+// disabled. Wrap the plain TCP listener, beneath deny sets, connection tracking and TLS, so all
+// of them see the client's address rather than the load balancer's:
+//
+//	ln, err = cfg.Wrap(ln)
+//	ln = conns.Listener(denylist.Wrap(ln, "https", global, nil, hub))
+//	server.ServeTLS(ln, "", "")
+func (c Config) Wrap(ln net.Listener) (net.Listener, error) {
+	if !c.Enabled() {
+		return ln, nil
+	}
+	wrapped, err := NewListener(ln, c.TrustedFrom, c.HeaderTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+// Conn is a connection whose remote address comes from its PROXY protocol header.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader // Holds whatever the peer sent after the header
+	remote net.Addr
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the client address from the header.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// CloseWrite half-closes the connection when the underlying one supports it, as TCP does.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Listener reads the PROXY protocol header of every connection from a trusted peer before
+// returning it from Accept, so layers above it, and http.Request.RemoteAddr, see the original
+// client. Connections from other peers are returned as they are. Headers are read in their own
+// goroutines, so a slow peer never holds up Accept.
+type Listener struct {
+	net.Listener
+	trusted []netip.Prefix
+	timeout time.Duration
+
+	accepted  chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// NewListener wraps ln. Only peers in trusted, as IP addresses or CIDRs, may send headers, and
+// they must: a connection from a trusted peer without a valid header within timeout is closed.
+// A zero timeout means DefaultHeaderTimeout.
+func NewListener(ln net.Listener, trusted []string, timeout time.Duration) (*Listener, error) {
+	prefixes, err := ParseTrusted(trusted)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = DefaultHeaderTimeout
+	}
+	l := &Listener{
+		Listener: ln,
+		trusted:  prefixes,
+		timeout:  timeout,
+		accepted: make(chan acceptResult),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+// Accept returns the next connection, with its header read if it comes from a trusted peer.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case result := <-l.accepted:
+		return result.conn, result.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener; connections still sending their header are closed.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if !l.deliver(acceptResult{err: err}) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+// deliver hands a result to Accept. It reports false, closing any connection, if the listener
+// was closed first.
+func (l *Listener) deliver(result acceptResult) bool {
+	select {
+	case l.accepted <- result:
+		return true
+	case <-l.done:
+		if result.conn != nil {
+			result.conn.Close()
+		}
+		return false
+	}
+}
+
+// handshake reads the header of a connection from a trusted peer, then hands it to Accept.
+func (l *Listener) handshake(conn net.Conn) {
+	if !l.isTrusted(conn.RemoteAddr()) {
+		l.deliver(acceptResult{conn: conn})
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(l.timeout))
+	r := bufio.NewReader(conn)
+	remote, err := ReadHeader(r)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Printf("Closing connection from %s: invalid PROXY protocol header: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr() // A health check from the load balancer itself, or an unknown protocol
+	}
+	l.deliver(acceptResult{conn: &Conn{Conn: conn, r: r, remote: remote}})
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+	for _, prefix := range l.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadHeader reads a version 1 or 2 PROXY protocol header from r and returns the client
+// address it carries. It returns a nil address for headers that carry none: v1 UNKNOWN, v2
+// LOCAL, and v2 headers for protocols other than TCP over IPv4 or IPv6.
+func ReadHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len("PROXY "))
+	if err != nil {
+		return nil, ErrMissingHeader
+	}
+	if string(start) == "PROXY " {
+		return readV1(r)
+	}
+	start, err = r.Peek(len(v2Signature))
+	if err != nil || !bytes.Equal(start, v2Signature) {
+		return nil, ErrMissingHeader
+	}
+	return readV2(r)
+}
+
+// readV1 parses "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1HeaderLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 header is not terminated by CRLF within %d bytes", maxV1HeaderLength)
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header")
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil || addr.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid source address '%s'", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port '%s'", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readV2 parses a binary version 2 header; see section 2.2 of the specification.
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, v2HeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	command, family := header[12]&0x0F, header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0: // LOCAL: the load balancer's own connection, e.g., a health check
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", command)
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("v2 IPv4 address block too short")
+		}
+		addr := netip.AddrFrom4([4]byte(payload[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[8:10]))), nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("v2 IPv6 address block too short")
+		}
+		addr := netip.AddrFrom16([16]byte(payload[0:16]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[32:34]))), nil
+	}
+	return nil, nil // UDP, Unix sockets and unspecified: keep the peer's address
+}
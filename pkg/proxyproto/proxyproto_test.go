@@ -0,0 +1,293 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// v2Header builds a version 2 header with the given command, family and address block.
+func v2Header(versionCommand, family byte, payload []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, versionCommand, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+// ipv4Block is the v2 address block for 192.0.2.1:56324 -> 198.51.100.1:443.
+var ipv4Block = []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+
+func ipv6Block() []byte {
+	block := make([]byte, 36)
+	copy(block[0:16], net.ParseIP("2001:db8::1"))
+	copy(block[16:32], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(block[32:34], 56324)
+	binary.BigEndian.PutUint16(block[34:36], 443)
+	return block
+}
+
+func TestReadHeader(t *testing.T) {
+	const rest = "GET / HTTP/1.1\r\n"
+	tests := []struct {
+		name     string
+		input    []byte
+		wantAddr string // "" for a header without a client address
+		wantErr  bool
+	}{
+		{name: "v1 TCP4", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), wantAddr: "192.0.2.1:56324"},
+		{name: "v1 TCP6", input: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), wantAddr: "[2001:db8::1]:56324"},
+		{name: "v1 UNKNOWN", input: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 UNKNOWN with addresses", input: []byte("PROXY UNKNOWN 2001:db8::1 2001:db8::2 56324 443\r\n")},
+		{name: "v1 longest allowed", input: []byte("PROXY UNKNOWN " + strings.Repeat("x", maxV1HeaderLength-len("PROXY UNKNOWN \r\n")) + "\r\n")},
+		{name: "v1 oversized", input: []byte("PROXY UNKNOWN " + strings.Repeat("x", maxV1HeaderLength) + "\r\n"), wantErr: true},
+		{name: "v1 without CR", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"), wantErr: true},
+		{name: "v1 truncated", input: []byte("PROXY TCP4 192.0.2.1 198.51"), wantErr: true},
+		{name: "v1 missing port", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"), wantErr: true},
+		{name: "v1 unknown protocol", input: []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n"), wantErr: true},
+		{name: "v1 family mismatch", input: []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n"), wantErr: true},
+		{name: "v1 invalid address", input: []byte("PROXY TCP4 192.0.2.300 198.51.100.1 56324 443\r\n"), wantErr: true},
+		{name: "v1 invalid port", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"), wantErr: true},
+		{name: "v2 TCP over IPv4", input: v2Header(0x21, 0x11, ipv4Block), wantAddr: "192.0.2.1:56324"},
+		{name: "v2 TCP over IPv6", input: v2Header(0x21, 0x21, ipv6Block()), wantAddr: "[2001:db8::1]:56324"},
+		{name: "v2 with TLVs", input: v2Header(0x21, 0x11, append(append([]byte{}, ipv4Block...), 0x04, 0x00, 0x01, 0x00)), wantAddr: "192.0.2.1:56324"},
+		{name: "v2 LOCAL", input: v2Header(0x20, 0x00, nil)},
+		{name: "v2 LOCAL with an address block", input: v2Header(0x20, 0x11, ipv4Block)},
+		{name: "v2 UDP", input: v2Header(0x21, 0x12, ipv4Block)},
+		{name: "v2 Unix socket", input: v2Header(0x21, 0x31, make([]byte, 216))},
+		{name: "v2 version 1", input: v2Header(0x11, 0x11, ipv4Block), wantErr: true},
+		{name: "v2 unknown command", input: v2Header(0x22, 0x11, ipv4Block), wantErr: true},
+		{name: "v2 short IPv4 block", input: v2Header(0x21, 0x11, ipv4Block[:8]), wantErr: true},
+		{name: "v2 short IPv6 block", input: v2Header(0x21, 0x21, ipv6Block()[:18]), wantErr: true},
+		{name: "v2 truncated address block", input: v2Header(0x21, 0x11, ipv4Block)[:20], wantErr: true},
+		{name: "v2 truncated header", input: v2Header(0x21, 0x11, ipv4Block)[:14], wantErr: true},
+		{name: "v2 oversized length", input: append(v2Header(0x21, 0x11, nil)[:14], 0xff, 0xff), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Valid headers are followed by the request; invalid ones end where the connection does
+			input := tt.input
+			if !tt.wantErr {
+				input = append(input, rest...)
+			}
+			r := bufio.NewReader(bytes.NewReader(input))
+			addr, err := ReadHeader(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got address %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantAddr == "" {
+				if addr != nil {
+					t.Errorf("expected no address, got %v", addr)
+				}
+			} else if addr == nil || addr.String() != tt.wantAddr {
+				t.Errorf("address = %v, want %s", addr, tt.wantAddr)
+			}
+			// Nothing past the header may be consumed
+			if after, _ := io.ReadAll(r); string(after) != rest {
+				t.Errorf("data after the header = %q, want %q", after, rest)
+			}
+		})
+	}
+}
+
+func TestReadHeaderMissing(t *testing.T) {
+	for _, input := range []string{"", "GET / HTTP/1.1\r\n", "PROXY", "\r\n\r\n\x00\r\nQUIT\r"} {
+		if _, err := ReadHeader(bufio.NewReader(strings.NewReader(input))); !errors.Is(err, ErrMissingHeader) {
+			t.Errorf("ReadHeader(%q) = %v, want ErrMissingHeader", input, err)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		value       string
+		wantTrusted []string
+		wantErr     bool
+	}{
+		{value: ""},
+		{value: " , "},
+		{value: "10.0.0.0/8", wantTrusted: []string{"10.0.0.0/8"}},
+		{value: "10.0.0.0/8, 192.0.2.10 ,2001:db8::/32", wantTrusted: []string{"10.0.0.0/8", "192.0.2.10", "2001:db8::/32"}},
+		{value: "10.0.0.0/33", wantErr: true},
+		{value: "10.0.0.0/8,balancer.internal", wantErr: true},
+	}
+	for _, tt := range tests {
+		cfg, err := ParseConfig(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseConfig(%q): err = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if strings.Join(cfg.TrustedFrom, "|") != strings.Join(tt.wantTrusted, "|") || cfg.Enabled() != (len(tt.wantTrusted) > 0) {
+			t.Errorf("ParseConfig(%q) = %+v, want trusted %v", tt.value, cfg, tt.wantTrusted)
+		}
+	}
+}
+
+func TestParseTrusted(t *testing.T) {
+	prefixes, err := ParseTrusted([]string{"192.0.2.77/24", "::ffff:198.51.100.1", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.0.2.0/24", "198.51.100.1/32", "2001:db8::1/128"}
+	for i, prefix := range prefixes {
+		if prefix.String() != want[i] {
+			t.Errorf("prefix %d = %s, want %s", i, prefix, want[i])
+		}
+	}
+}
+
+// dial connects to ln, sends data and returns the connection Accept produced for it, or an
+// error if Accept returned none within a second.
+func dial(t *testing.T, ln net.Listener, data string) (net.Conn, error) {
+	t.Helper()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if _, err := client.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		t.Cleanup(func() { conn.Close() })
+		return conn, nil
+	case <-time.After(time.Second):
+		return nil, errors.New("nothing accepted")
+	}
+}
+
+func TestListener(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    string
+		data       string
+		wantRemote string // "" for the peer's own address
+		wantRead   string
+		wantClosed bool
+	}{
+		{
+			name:       "trusted peer",
+			trusted:    "127.0.0.0/8",
+			data:       "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello",
+			wantRemote: "192.0.2.1:56324",
+			wantRead:   "hello",
+		},
+		{
+			name:     "trusted health check",
+			trusted:  "127.0.0.1",
+			data:     string(v2Header(0x20, 0x00, nil)) + "hello",
+			wantRead: "hello",
+		},
+		{
+			name:       "trusted peer without a header",
+			trusted:    "127.0.0.1",
+			data:       "GET / HTTP/1.1\r\n\r\n",
+			wantClosed: true,
+		},
+		{
+			name:     "untrusted peer",
+			trusted:  "192.0.2.0/24",
+			data:     "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello",
+			wantRead: "PROXY TCP4",
+		},
+		{
+			name:     "disabled",
+			data:     "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello",
+			wantRead: "PROXY TCP4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcp, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := ParseConfig(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln, err := cfg.Wrap(tcp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			if !cfg.Enabled() && ln != tcp {
+				t.Fatal("a disabled config must leave the listener untouched")
+			}
+
+			conn, err := dial(t, ln, tt.data)
+			if tt.wantClosed {
+				if err == nil {
+					t.Fatal("expected a trusted peer without a header to be dropped")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote := conn.RemoteAddr().String()
+			if tt.wantRemote != "" && remote != tt.wantRemote {
+				t.Errorf("RemoteAddr = %s, want %s", remote, tt.wantRemote)
+			}
+			if tt.wantRemote == "" && !strings.HasPrefix(remote, "127.0.0.1:") {
+				t.Errorf("RemoteAddr = %s, want the peer's own address", remote)
+			}
+			buf := make([]byte, len(tt.wantRead))
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != tt.wantRead {
+				t.Errorf("read %q (%v), want %q", buf, err, tt.wantRead)
+			}
+		})
+	}
+}
+
+func TestListenerSlowPeerDoesNotBlockAccept(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := Config{TrustedFrom: []string{"127.0.0.1"}, HeaderTimeout: time.Minute}.Wrap(tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// A trusted peer that never finishes its header
+	slow, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	slow.Write([]byte("PROXY TCP4 "))
+
+	conn, err := dial(t, ln, "PROXY TCP4 192.0.2.9 198.51.100.1 1234 443\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "192.0.2.9:1234" {
+		t.Errorf("accepted %s, want the second peer", conn.RemoteAddr())
+	}
+
+	ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close = %v, want net.ErrClosed", err)
+	}
+}
@@ -0,0 +1,179 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"prism/pkg/storage"
+)
+
+// Table is an immutable snapshot of every project, indexed by hostname and by path prefix.
+// Path prefixes are stored in a tree keyed by path segment, so "/team/app" and "/team/api"
+// share the "team" node and a request is matched against the longest registered prefix.
+type Table struct {
+	hosts map[string]*storage.Project
+	root  *node
+}
+
+type node struct {
+	children map[string]*node
+	project  *storage.Project
+}
+
+// NewTable builds a routing table from a list of projects.
+func NewTable(projects []storage.Project) *Table {
+	t := &Table{
+		hosts: make(map[string]*storage.Project),
+		root:  &node{children: make(map[string]*node)},
+	}
+	for i := range projects {
+		project := &projects[i]
+		if project.IsTCP() {
+			continue // Reached through its own listener, not over HTTP
+		}
+		for _, hostname := range project.Hostnames {
+			t.hosts[hostname] = project
+		}
+
+		n := t.root
+		for _, segment := range splitPath(project.PathPrefix) {
+			child, ok := n.children[segment]
+			if !ok {
+				child = &node{children: make(map[string]*node)}
+				n.children[segment] = child
+			}
+			n = child
+		}
+		if n != t.root {
+			n.project = project
+		}
+	}
+	return t
+}
+
+// Match resolves a request to a project. Hostname matches win over path prefixes.
+// The returned prefix is the part of the path that belongs to Prism, and rest is the
+// path with the prefix's segments removed, to be proxied upstream. For hostname
+// matches the prefix is empty and rest is the whole path.
+func (t *Table) Match(hostname, path string) (project *storage.Project, prefix, rest string, found bool) {
+	if project, ok := t.hosts[hostname]; ok {
+		return project, "", path, true
+	}
+
+	var match *storage.Project
+	var depth int
+	n := t.root
+	segments := splitPath(path)
+	for i, segment := range segments {
+		child, ok := n.children[segment]
+		if !ok {
+			break
+		}
+		n = child
+		if n.project != nil {
+			match, depth = n.project, i+1
+		}
+	}
+	if match == nil {
+		return nil, "", "", false
+	}
+	return match, "/" + strings.Join(segments[:depth], "/"), trimSegments(path, depth), true
+}
+
+// splitPath returns the non-empty segments of a URL path.
+func splitPath(path string) []string {
+	return strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+}
+
+// trimSegments removes the first n segments of a path, along with the slashes before
+// them, so "//team//app/x" without two segments is "/x", as splitPath counts them.
+func trimSegments(path string, n int) string {
+	for ; n > 0; n-- {
+		path = strings.TrimLeft(path, "/")
+		if i := strings.IndexByte(path, '/'); i >= 0 {
+			path = path[i:]
+		} else {
+			path = ""
+		}
+	}
+	return path
+}
+
+// Router holds the current routing table and swaps it atomically when projects change.
+type Router struct {
+	repo      *storage.Repository
+	table     atomic.Pointer[Table]
+	mu        sync.Mutex // Serializes rebuilds so an older snapshot can never replace a newer one
+	onRebuild []func([]storage.Project)
+}
+
+// NewRouter creates a router with an empty table. Call Rebuild to load the projects and
+// Run to keep them current.
+func NewRouter(repo *storage.Repository) *Router {
+	r := &Router{repo: repo}
+	r.table.Store(NewTable(nil))
+	return r
+}
+
+// Rebuild loads every project from the database and replaces the routing table.
+// It must be called whenever a project is created, updated or deleted.
+func (r *Router) Rebuild(ctx context.Context) error {
+	projects, err := r.rebuild(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Rebuilt routing table with %d projects\n", len(projects))
+	return nil
+}
+
+func (r *Router) rebuild(ctx context.Context) ([]storage.Project, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	projects, err := r.repo.ListProjects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rebuild routing table: %w", err)
+	}
+	r.table.Store(NewTable(projects))
+	for _, fn := range r.onRebuild {
+		fn(projects)
+	}
+	return projects, nil
+}
+
+// Run rebuilds the table every interval until ctx is cancelled. Rebuild only updates the
+// replica whose API made a change, so every replica must run this to pick up changes made
+// through the others, and to recover from a rebuild that failed.
+func (r *Router) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.rebuild(ctx); err != nil {
+				log.Printf("Error in periodic routing table rebuild: %v\n", err)
+			}
+		}
+	}
+}
+
+// OnRebuild registers fn to be called with every project after each rebuild, e.g., to start
+// and stop the listeners of TCP projects. fn runs while rebuilds are serialized, so it sees
+// the projects in order; it must not call Rebuild. Register before the first Rebuild.
+func (r *Router) OnRebuild(fn func([]storage.Project)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onRebuild = append(r.onRebuild, fn)
+}
+
+// Match resolves a request against the current routing table.
+func (r *Router) Match(hostname, path string) (project *storage.Project, prefix, rest string, found bool) {
+	return r.table.Load().Match(hostname, path)
+}
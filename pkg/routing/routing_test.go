@@ -0,0 +1,73 @@
+package routing
+
+import (
+	"testing"
+
+	"prism/pkg/storage"
+)
+
+func TestTableMatch(t *testing.T) {
+	table := NewTable([]storage.Project{
+		{ID: "team", PathPrefix: "/team"},
+		{ID: "team-app", PathPrefix: "/team/app"},
+		{ID: "team-app-v2", PathPrefix: "/team/app/v2/"},
+		{ID: "api", PathPrefix: "/api"},
+		{ID: "shop", PathPrefix: "/shop", Hostnames: []string{"shop.example.com", "store.example.com"}},
+		{ID: "host-only", Hostnames: []string{"app.example.com"}},
+		{ID: "root", PathPrefix: "/"},
+		{ID: "db", PathPrefix: "/db", Hostnames: []string{"db.example.com"}, TCP: &storage.TCPProxy{Enabled: true, ListenPort: 15432, Upstream: "db.internal:5432"}},
+		{ID: "tcp-off", PathPrefix: "/legacy", TCP: &storage.TCPProxy{ListenPort: 15433, Upstream: "legacy.internal:80"}},
+	})
+
+	tests := []struct {
+		name       string
+		host       string
+		path       string
+		wantID     string
+		wantPrefix string
+		wantRest   string
+	}{
+		{name: "exact prefix", path: "/team", wantID: "team", wantPrefix: "/team", wantRest: ""},
+		{name: "prefix with trailing slash", path: "/team/", wantID: "team", wantPrefix: "/team", wantRest: "/"},
+		{name: "longest prefix wins", path: "/team/app/index.html", wantID: "team-app", wantPrefix: "/team/app", wantRest: "/index.html"},
+		{name: "deepest prefix", path: "/team/app/v2/users", wantID: "team-app-v2", wantPrefix: "/team/app/v2", wantRest: "/users"},
+		{name: "falls back to shorter prefix", path: "/team/other", wantID: "team", wantPrefix: "/team", wantRest: "/other"},
+		{name: "partial segment does not match", path: "/teamwork", wantID: ""},
+		{name: "duplicate slashes", path: "//team//app/x", wantID: "team-app", wantPrefix: "/team/app", wantRest: "/x"},
+		{name: "duplicate slashes after prefix", path: "/team/app//x", wantID: "team-app", wantPrefix: "/team/app", wantRest: "//x"},
+		{name: "prefix matched on segments only", path: "/api2/users", wantID: ""},
+		{name: "unknown path", path: "/nope", wantID: ""},
+		{name: "root prefix is never registered", path: "/", wantID: ""},
+		{name: "hostname", host: "shop.example.com", path: "/cart", wantID: "shop", wantPrefix: "", wantRest: "/cart"},
+		{name: "second hostname", host: "store.example.com", path: "/", wantID: "shop", wantPrefix: "", wantRest: "/"},
+		{name: "hostname wins over path", host: "app.example.com", path: "/team/app", wantID: "host-only", wantPrefix: "", wantRest: "/team/app"},
+		{name: "unknown hostname falls back to path", host: "other.example.com", path: "/api/v1", wantID: "api", wantPrefix: "/api", wantRest: "/v1"},
+		{name: "TCP project prefix is not routed", path: "/db/query", wantID: ""},
+		{name: "TCP project hostname is not routed", host: "db.example.com", path: "/api/v1", wantID: "api", wantPrefix: "/api", wantRest: "/v1"},
+		{name: "disabled TCP is routed over HTTP", path: "/legacy/x", wantID: "tcp-off", wantPrefix: "/legacy", wantRest: "/x"},
+		{name: "normalized hostname", host: storage.NormalizeHostname("Shop.Example.COM.:443"), path: "/", wantID: "shop", wantPrefix: "", wantRest: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			project, prefix, rest, found := table.Match(tt.host, tt.path)
+			if tt.wantID == "" {
+				if found {
+					t.Fatalf("Match(%q, %q) = %s, want no match", tt.host, tt.path, project.ID)
+				}
+				return
+			}
+			if !found {
+				t.Fatalf("Match(%q, %q) found nothing, want %s", tt.host, tt.path, tt.wantID)
+			}
+			if project.ID != tt.wantID || prefix != tt.wantPrefix || rest != tt.wantRest {
+				t.Errorf("Match(%q, %q) = %s, %q, %q; want %s, %q, %q", tt.host, tt.path, project.ID, prefix, rest, tt.wantID, tt.wantPrefix, tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestEmptyTable(t *testing.T) {
+	if project, _, _, found := NewTable(nil).Match("app.example.com", "/team"); found {
+		t.Fatalf("empty table matched %s", project.ID)
+	}
+}
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrACMEAccountNotFound is returned when no ACME account exists for a directory.
+var ErrACMEAccountNotFound = fmt.Errorf("acme account not found")
+
+// ErrACMEChallengeNotFound is returned when no pending challenge matches.
+var ErrACMEChallengeNotFound = fmt.Errorf("acme challenge not found")
+
+// GetACMEAccount fetches the account registered with an ACME directory.
+func (r *Repository) GetACMEAccount(ctx context.Context, directoryURL string) (*ACMEAccount, error) {
+	account := &ACMEAccount{}
+	query := `SELECT directory_url, account_url, encrypted_key FROM acme_accounts WHERE directory_url = $1`
+
+	err := r.db.QueryRowContext(ctx, query, directoryURL).Scan(&account.DirectoryURL, &account.AccountURL, &account.EncryptedKey)
+	if err == sql.ErrNoRows {
+		return nil, ErrACMEAccountNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get acme account: %w", err)
+	}
+	return account, nil
+}
+
+// SaveACMEAccount stores the account for an ACME directory. If another replica registered
+// first, its account is kept and returned instead.
+func (r *Repository) SaveACMEAccount(ctx context.Context, account *ACMEAccount) (*ACMEAccount, error) {
+	query := `
+		INSERT INTO acme_accounts (directory_url, account_url, encrypted_key) VALUES ($1, $2, $3)
+		ON CONFLICT (directory_url) DO NOTHING`
+	if _, err := r.db.ExecContext(ctx, query, account.DirectoryURL, account.AccountURL, account.EncryptedKey); err != nil {
+		return nil, fmt.Errorf("failed to save acme account: %w", err)
+	}
+	return r.GetACMEAccount(ctx, account.DirectoryURL)
+}
+
+// PutACMEChallenge stores the response to a pending challenge.
+func (r *Repository) PutACMEChallenge(ctx context.Context, challenge *ACMEChallenge) error {
+	query := `
+		INSERT INTO acme_challenges (token, hostname, type, key_authorization, expires_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (token) DO UPDATE SET hostname = EXCLUDED.hostname, type = EXCLUDED.type,
+			key_authorization = EXCLUDED.key_authorization, expires_at = EXCLUDED.expires_at`
+	_, err := r.db.ExecContext(ctx, query, challenge.Token, challenge.Hostname, challenge.Type, challenge.KeyAuthorization, challenge.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to store acme challenge: %w", err)
+	}
+	return nil
+}
+
+// GetACMEChallengeByToken fetches an unexpired HTTP-01 challenge by its token.
+func (r *Repository) GetACMEChallengeByToken(ctx context.Context, token string) (*ACMEChallenge, error) {
+	query := `SELECT token, hostname, type, key_authorization, expires_at FROM acme_challenges
+		WHERE token = $1 AND type = 'http-01' AND expires_at > NOW()`
+	return r.getACMEChallenge(ctx, query, token)
+}
+
+// ListACMEChallenges fetches every unexpired challenge of a type, e.g., 'tls-alpn-01'.
+func (r *Repository) ListACMEChallenges(ctx context.Context, challengeType string) ([]ACMEChallenge, error) {
+	query := `SELECT token, hostname, type, key_authorization, expires_at FROM acme_challenges
+		WHERE type = $1 AND expires_at > NOW() ORDER BY expires_at`
+
+	rows, err := r.db.QueryContext(ctx, query, challengeType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query acme challenges: %w", err)
+	}
+	defer rows.Close()
+
+	var challenges []ACMEChallenge
+	for rows.Next() {
+		var challenge ACMEChallenge
+		if err := rows.Scan(&challenge.Token, &challenge.Hostname, &challenge.Type, &challenge.KeyAuthorization, &challenge.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("failed to scan acme challenge row: %w", err)
+		}
+		challenges = append(challenges, challenge)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error after iterating rows: %w", err)
+	}
+	return challenges, nil
+}
+
+func (r *Repository) getACMEChallenge(ctx context.Context, query string, arg string) (*ACMEChallenge, error) {
+	challenge := &ACMEChallenge{}
+	err := r.db.QueryRowContext(ctx, query, arg).Scan(
+		&challenge.Token,
+		&challenge.Hostname,
+		&challenge.Type,
+		&challenge.KeyAuthorization,
+		&challenge.ExpiresAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrACMEChallengeNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get acme challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+// DeleteACMEChallenge removes a challenge once it has been validated or abandoned,
+// along with any expired leftovers.
+func (r *Repository) DeleteACMEChallenge(ctx context.Context, token string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM acme_challenges WHERE token = $1 OR expires_at < NOW()`, token)
+	if err != nil {
+		return fmt.Errorf("failed to delete acme challenge: %w", err)
+	}
+	return nil
+}
+
+// AcquireACMELease claims a hostname for issuance for the given duration. It returns false
+// if another replica currently holds the lease.
+func (r *Repository) AcquireACMELease(ctx context.Context, hostname, projectID string, ttl time.Duration) (bool, error) {
+	query := `
+		INSERT INTO acme_status (hostname, project_id, status, locked_until)
+		VALUES ($1, $2, 'pending', NOW() + $3 * INTERVAL '1 second')
+		ON CONFLICT (hostname) DO UPDATE
+			SET project_id = EXCLUDED.project_id, status = 'pending', locked_until = EXCLUDED.locked_until, updated_at = NOW()
+			WHERE acme_status.locked_until IS NULL OR acme_status.locked_until < NOW()
+		RETURNING hostname`
+
+	err := r.db.QueryRowContext(ctx, query, hostname, projectID, ttl.Seconds()).Scan(&hostname)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to acquire acme lease: %w", err)
+	}
+	return true, nil
+}
+
+// SetACMEStatus records the outcome of an issuance attempt and releases the lease.
+func (r *Repository) SetACMEStatus(ctx context.Context, hostname, status, lastError string, nextAttemptAt *time.Time) error {
+	query := `UPDATE acme_status SET status = $2, last_error = $3, next_attempt_at = $4, locked_until = NULL, updated_at = NOW()
+		WHERE hostname = $1`
+	if _, err := r.db.ExecContext(ctx, query, hostname, status, lastError, nextAttemptAt); err != nil {
+		return fmt.Errorf("failed to set acme status: %w", err)
+	}
+	return nil
+}
+
+// GetACMEStatus fetches the issuance status of a hostname.
+func (r *Repository) GetACMEStatus(ctx context.Context, hostname string) (*ACMEStatus, error) {
+	statuses, err := r.queryACMEStatuses(ctx, `WHERE hostname = $1`, hostname)
+	if err != nil {
+		return nil, err
+	}
+	if len(statuses) == 0 {
+		return nil, nil
+	}
+	return &statuses[0], nil
+}
+
+// GetACMEStatusesByProjectID fetches the issuance status of every hostname of a project
+// after verifying user ownership.
+func (r *Repository) GetACMEStatusesByProjectID(ctx context.Context, userID, projectID string) ([]ACMEStatus, error) {
+	if err := r.verifyProjectOwner(ctx, userID, projectID); err != nil {
+		return nil, err
+	}
+	return r.queryACMEStatuses(ctx, `WHERE project_id = $1`, projectID)
+}
+
+func (r *Repository) queryACMEStatuses(ctx context.Context, where string, arg string) ([]ACMEStatus, error) {
+	query := `SELECT hostname, project_id, status, COALESCE(last_error, ''), next_attempt_at, updated_at FROM acme_status ` + where
+
+	rows, err := r.db.QueryContext(ctx, query, arg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query acme status: %w", err)
+	}
+	defer rows.Close()
+
+	var statuses []ACMEStatus
+	for rows.Next() {
+		var status ACMEStatus
+		var nextAttemptAt sql.NullTime
+		if err := rows.Scan(&status.Hostname, &status.ProjectID, &status.Status, &status.LastError, &nextAttemptAt, &status.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan acme status row: %w", err)
+		}
+		if nextAttemptAt.Valid {
+			status.NextAttemptAt = &nextAttemptAt.Time
+		}
+		statuses = append(statuses, status)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error after iterating rows: %w", err)
+	}
+	return statuses, nil
+}
+
+// ReplaceACMECertificate stores a newly issued certificate and removes earlier ACME
+// certificates of the project for the same hostnames.
+func (r *Repository) ReplaceACMECertificate(ctx context.Context, cert *Certificate) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM certificates WHERE project_id = $1 AND source = 'acme' AND hostnames = $2`,
+		cert.ProjectID, pq.Array(cert.Hostnames))
+	if err != nil {
+		return fmt.Errorf("failed to remove previous acme certificate: %w", err)
+	}
+
+	query := `
+		INSERT INTO certificates (project_id, hostnames, cert_pem, encrypted_key, source, not_before, not_after)
+		VALUES ($1, $2, $3, $4, 'acme', $5, $6)`
+	_, err = tx.ExecContext(ctx, query, cert.ProjectID, pq.Array(cert.Hostnames), cert.CertPEM, cert.EncryptedKey, cert.NotBefore, cert.NotAfter)
+	if err != nil {
+		return fmt.Errorf("failed to store acme certificate: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit acme certificate: %w", err)
+	}
+
+	log.Printf("Stored ACME certificate for project %s covering %v\n", cert.ProjectID, cert.Hostnames)
+	return nil
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+)
+
+// ErrCertificateNotFound is returned when a certificate is not found.
+var ErrCertificateNotFound = fmt.Errorf("certificate not found")
+
+const certificateColumns = `id, project_id, hostnames, cert_pem, encrypted_key, source, not_before, not_after, created_at, updated_at`
+
+func scanCertificate(row rowScanner, cert *Certificate) error {
+	return row.Scan(
+		&cert.ID,
+		&cert.ProjectID,
+		pq.Array(&cert.Hostnames),
+		&cert.CertPEM,
+		&cert.EncryptedKey,
+		&cert.Source,
+		&cert.NotBefore,
+		&cert.NotAfter,
+		&cert.CreatedAt,
+		&cert.UpdatedAt,
+	)
+}
+
+// verifyProjectOwner returns ErrProjectNotFound unless the project exists and belongs to the user.
+func (r *Repository) verifyProjectOwner(ctx context.Context, userID, projectID string) error {
+	var ownerUserID string
+	err := r.db.QueryRowContext(ctx, "SELECT user_id FROM projects WHERE id = $1", projectID).Scan(&ownerUserID)
+	if err == sql.ErrNoRows {
+		return ErrProjectNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to verify project ownership: %w", err)
+	}
+	if ownerUserID != userID {
+		return ErrProjectNotFound
+	}
+	return nil
+}
+
+// CreateCertificate stores a certificate for a project, verifying ownership first.
+// The private key must already be encrypted.
+func (r *Repository) CreateCertificate(ctx context.Context, userID string, cert *Certificate) (*Certificate, error) {
+	if err := r.verifyProjectOwner(ctx, userID, cert.ProjectID); err != nil {
+		return nil, err
+	}
+
+	created := &Certificate{}
+	query := `
+		INSERT INTO certificates (project_id, hostnames, cert_pem, encrypted_key, source, not_before, not_after)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING ` + certificateColumns
+
+	err := scanCertificate(r.db.QueryRowContext(ctx, query,
+		cert.ProjectID, pq.Array(cert.Hostnames), cert.CertPEM, cert.EncryptedKey, cert.Source, cert.NotBefore, cert.NotAfter,
+	), created)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	log.Printf("Created certificate %s for project %s covering %v\n", created.ID, created.ProjectID, created.Hostnames)
+	return created, nil
+}
+
+// GetCertificatesByProjectID fetches all certificates of a project after verifying user ownership.
+func (r *Repository) GetCertificatesByProjectID(ctx context.Context, userID, projectID string) ([]Certificate, error) {
+	if err := r.verifyProjectOwner(ctx, userID, projectID); err != nil {
+		return nil, err
+	}
+	return r.queryCertificates(ctx, `SELECT `+certificateColumns+` FROM certificates WHERE project_id = $1 ORDER BY not_after DESC`, projectID)
+}
+
+// ListCertificates fetches every stored certificate. It is used to load the certificate store.
+func (r *Repository) ListCertificates(ctx context.Context) ([]Certificate, error) {
+	return r.queryCertificates(ctx, `SELECT `+certificateColumns+` FROM certificates`)
+}
+
+func (r *Repository) queryCertificates(ctx context.Context, query string, args ...interface{}) ([]Certificate, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query certificates: %w", err)
+	}
+	defer rows.Close()
+
+	var certs []Certificate
+	for rows.Next() {
+		var cert Certificate
+		if err := scanCertificate(rows, &cert); err != nil {
+			return nil, fmt.Errorf("failed to scan certificate row: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error after iterating rows: %w", err)
+	}
+	return certs, nil
+}
+
+// DeleteCertificate deletes a certificate, verifying ownership via a subquery.
+func (r *Repository) DeleteCertificate(ctx context.Context, userID, projectID, certID string) error {
+	query := `
+		DELETE FROM certificates
+		WHERE id = $1 AND project_id = $2
+		  AND project_id IN (SELECT id FROM projects WHERE user_id = $3)`
+
+	result, err := r.db.ExecContext(ctx, query, certID, projectID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete certificate: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected after delete certificate: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return ErrCertificateNotFound
+	}
+
+	log.Printf("Deleted certificate %s", certID)
+	return nil
+}
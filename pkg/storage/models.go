@@ -2,6 +2,8 @@ package storage
 
 import (
 	//"database/sql"
+	"net"
+	"strings"
 	"time"
 )
 
@@ -12,9 +14,262 @@ type Project struct {
 	Name        string    `json:"name"`
 	PathPrefix  string    `json:"path_prefix"`
 	UpstreamURL string    `json:"upstream_url"`
+	Hostnames   []string  `json:"hostnames"` // Virtual hosts routed to this project, e.g. "app.example.com"
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 	Status      string    `json:"status`
+
+	// Hostnames the project has claimed whose ownership is not verified yet. They are not routed.
+	PendingHostnames []string `json:"pending_hostnames"`
+
+	// Protocol spoken to the upstream: '' (HTTP/1.1, or HTTP/2 when negotiated over TLS),
+	// 'http1' (never HTTP/2) or 'h2c' (cleartext HTTP/2, e.g., for gRPC servers without TLS).
+	UpstreamProtocol string `json:"upstream_protocol,omitempty"`
+
+	// Optional per-project settings, each stored as a JSONB column. Nil means the feature is off.
+	ResponseRewrite *ResponseRewrite   `json:"response_rewrite,omitempty"`
+	ACME            *ACMEConfig        `json:"acme,omitempty"`
+	UpstreamTLS     *UpstreamTLS       `json:"upstream_tls,omitempty"`
+	UpstreamTLSKey  []byte             `json:"-"` // Encrypted client key for UpstreamTLS, kept in its own column
+	Cache           *CacheConfig       `json:"cache,omitempty"`
+	Compression     *CompressionConfig `json:"compression,omitempty"`
+	HeaderRules     []HeaderRule       `json:"header_rules,omitempty"`
+	SecurityHeaders *SecurityHeaders   `json:"security_headers,omitempty"`
+	ErrorPages      *ErrorPages        `json:"error_pages,omitempty"`
+	Maintenance     *Maintenance       `json:"maintenance,omitempty"`
+	Canary          *Canary            `json:"canary,omitempty"`
+	Mirror          *Mirror            `json:"mirror,omitempty"`
+	Limits          *Limits            `json:"limits,omitempty"`
+	Concurrency     *ConcurrencyLimit  `json:"concurrency,omitempty"`
+	UpstreamPool    *UpstreamPool      `json:"upstream_pool,omitempty"`
+	URLRules        *URLRules          `json:"url_rules,omitempty"`
+	TCP             *TCPProxy          `json:"tcp,omitempty"`
+}
+
+// ResponseRewrite configures how responses are rewritten for a project mounted under a path prefix.
+// Prism strips the prefix before proxying, so an upstream that redirects to "/login" or sets a
+// cookie on "/" would otherwise send the browser outside the project.
+type ResponseRewrite struct {
+	Enabled     bool `json:"enabled"`      // Rewrite Location, Content-Location and Set-Cookie paths
+	RewriteBody bool `json:"rewrite_body"` // Also rewrite root-relative URLs in HTML and CSS bodies
+}
+
+// ACMEConfig enables automatic certificate issuance for a project's hostnames.
+type ACMEConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Challenge string `json:"challenge,omitempty"` // 'http-01' (default) or 'tls-alpn-01'
+}
+
+// UpstreamTLS configures how Prism connects to an HTTPS upstream: which CAs to trust, which
+// client certificate to present and which TLS versions to accept.
+type UpstreamTLS struct {
+	CABundle           string `json:"ca_bundle,omitempty"`            // PEM roots trusted instead of the system pool
+	ClientCertPEM      string `json:"client_certificate,omitempty"`   // Presented for mutual TLS; the key is in UpstreamTLSKey
+	ServerName         string `json:"server_name,omitempty"`          // SNI and verification name, if not the upstream host
+	MinVersion         string `json:"min_version,omitempty"`          // '1.0', '1.1', '1.2' (default) or '1.3'
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"` // DANGEROUS: accepts any upstream certificate
+}
+
+// CacheConfig enables caching of upstream GET responses. Responses are cached as the upstream's
+// Cache-Control allows; the stale windows apply when the upstream doesn't set its own.
+type CacheConfig struct {
+	Enabled              bool `json:"enabled"`
+	StaleWhileRevalidate int  `json:"stale_while_revalidate,omitempty"` // Seconds a stale response may be served while refreshing
+	StaleIfError         int  `json:"stale_if_error,omitempty"`         // Seconds a stale response may replace an upstream error
+}
+
+// CompressionConfig enables compressing upstream responses that arrive uncompressed.
+type CompressionConfig struct {
+	Enabled   bool     `json:"enabled"`
+	MinSize   int      `json:"min_size,omitempty"`   // Smallest body in bytes worth compressing, 1024 by default
+	MimeTypes []string `json:"mime_types,omitempty"` // e.g., "text/*", "application/json"; common text types by default
+}
+
+// HeaderRule is one header operation applied to requests before they are proxied or to
+// responses on their way back. Rules of a phase run in the order they are listed.
+type HeaderRule struct {
+	Phase string `json:"phase"`           // 'request' or 'response'
+	Op    string `json:"op"`              // 'set', 'add', 'remove' or 'rename'
+	Name  string `json:"name"`            // Header name; a remove may end in "*" to match a prefix
+	Value string `json:"value,omitempty"` // Value for set/add, with placeholders like {client_ip}; new name for rename
+}
+
+// SecurityHeaders is a managed policy of browser security headers added to upstream responses.
+type SecurityHeaders struct {
+	Enabled      bool              `json:"enabled"`
+	Preset       string            `json:"preset,omitempty"`        // 'strict-spa', 'api', or '' to use only the overrides
+	Overrides    map[string]string `json:"overrides,omitempty"`     // Header name to value; an empty value drops it from the preset
+	KeepUpstream bool              `json:"keep_upstream,omitempty"` // Leave headers the upstream already sets untouched
+}
+
+// ErrorPages customizes the responses Prism sends when it blocks or cannot serve a request.
+type ErrorPages struct {
+	Enabled          bool                 `json:"enabled"`
+	SupportReference string               `json:"support_reference,omitempty"` // e.g., "support@example.com", shown with the request ID
+	Pages            map[string]ErrorPage `json:"pages,omitempty"`             // By kind: 'block', 'rate_limit', 'maintenance', 'upstream_down', 'overloaded' or 'error'
+}
+
+// ErrorPage is the content for one kind of error. Empty fields fall back to Prism's defaults.
+type ErrorPage struct {
+	Title  string `json:"title,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	Type   string `json:"type,omitempty"` // Problem type URI for JSON responses, "about:blank" by default
+	HTML   string `json:"html,omitempty"` // Go html/template, e.g., "<p>Quote {{.RequestID}}</p>"
+}
+
+// Maintenance takes a project offline for everyone except allowlisted clients, either right away
+// or during a scheduled window.
+type Maintenance struct {
+	Enabled      bool       `json:"enabled"`
+	StartsAt     *time.Time `json:"starts_at,omitempty"`     // Window start; nil means as soon as enabled
+	EndsAt       *time.Time `json:"ends_at,omitempty"`       // Window end; nil means until disabled
+	RetryAfter   int        `json:"retry_after,omitempty"`   // Seconds; defaults to the time left in the window, or 300
+	Message      string     `json:"message,omitempty"`       // Plain-text response body
+	AllowIPs     []string   `json:"allow_ips,omitempty"`     // IPs or CIDRs that still reach the upstream
+	BypassHeader string     `json:"bypass_header,omitempty"` // e.g., "X-Maintenance-Bypass"
+	BypassToken  string     `json:"bypass_token,omitempty"`  // Value of BypassHeader that lets a request through
+}
+
+// Canary sends part of a project's traffic to an alternate upstream, e.g., a new backend version.
+type Canary struct {
+	Enabled     bool   `json:"enabled"`
+	UpstreamURL string `json:"upstream_url"`
+	Weight      int    `json:"weight"`                 // Percentage of clients sent to the canary, 0-100
+	Header      string `json:"header,omitempty"`       // Requests with this header always go to the canary
+	HeaderValue string `json:"header_value,omitempty"` // ...when it has this value; any value if empty
+	Cookie      string `json:"cookie,omitempty"`       // Requests with this cookie always go to the canary
+	CookieValue string `json:"cookie_value,omitempty"` // ...when it has this value; any value if empty
+}
+
+// Mirror sends a copy of a sample of a project's requests to a shadow upstream, whose responses
+// are discarded.
+type Mirror struct {
+	Enabled     bool    `json:"enabled"`
+	UpstreamURL string  `json:"upstream_url"`
+	SampleRate  float64 `json:"sample_rate"`             // Fraction of requests mirrored, 0-1
+	MaxBodySize int     `json:"max_body_size,omitempty"` // Requests with larger bodies aren't mirrored; 1 MiB by default
+}
+
+// Limits bounds the requests a project accepts and how long Prism waits on its upstream.
+// Zero values mean Prism's defaults: the timeouts noted below, and no size or duration limits.
+type Limits struct {
+	ConnectTimeout        int   `json:"connect_timeout,omitempty"`         // Seconds to connect to the upstream; 30
+	TLSHandshakeTimeout   int   `json:"tls_handshake_timeout,omitempty"`   // Seconds for the upstream TLS handshake; 10
+	ResponseHeaderTimeout int   `json:"response_header_timeout,omitempty"` // Seconds to wait for response headers; 60
+	IdleTimeout           int   `json:"idle_timeout,omitempty"`            // Seconds an idle upstream connection is kept; 90
+	RequestTimeout        int   `json:"request_timeout,omitempty"`         // Seconds for a whole request, body included
+	MaxBodyBytes          int64 `json:"max_body_bytes,omitempty"`
+	MaxHeaderBytes        int   `json:"max_header_bytes,omitempty"`
+	MaxURLLength          int   `json:"max_url_length,omitempty"`
+}
+
+// ConcurrencyLimit caps a project's in-flight upstream requests. Requests over the cap wait in
+// a bounded queue; those that don't fit or wait too long are rejected with a 503.
+type ConcurrencyLimit struct {
+	MaxInFlight    int `json:"max_in_flight"`              // 0 means no limit
+	MaxQueue       int `json:"max_queue"`                  // Requests allowed to wait for a slot
+	QueueTimeoutMs int `json:"queue_timeout_ms,omitempty"` // How long a request may wait; 5000 by default
+}
+
+// UpstreamPool spreads a project's traffic over more targets than its upstream URL. Targets
+// that keep failing are taken out of rotation for a cooldown; clients pinned to one by
+// affinity move to another healthy target meanwhile.
+type UpstreamPool struct {
+	Targets          []string `json:"targets"`                     // Upstream URLs served alongside the project's upstream URL
+	Affinity         string   `json:"affinity,omitempty"`          // '' (round robin), 'cookie' (Prism-issued), 'hash' or 'ip'
+	HashOn           string   `json:"hash_on,omitempty"`           // For 'hash': "header:<name>" or "cookie:<name>"
+	FailureThreshold int      `json:"failure_threshold,omitempty"` // Consecutive failures that take a target out; 3 by default
+	Cooldown         int      `json:"cooldown,omitempty"`          // Seconds a failing target stays out; 30 by default
+}
+
+// URLRules rewrites request URLs before they are proxied, and redirects requests Prism answers
+// itself. Both match regular expressions against the path as the upstream sees it, without the
+// project's prefix, and are tried in order.
+type URLRules struct {
+	Rewrites  []RewriteRule  `json:"rewrites,omitempty"`
+	Redirects []RedirectRule `json:"redirects,omitempty"`
+}
+
+// RewriteRule replaces a matching path; $1 or ${name} in Replace and SetQuery values expand
+// capture groups.
+type RewriteRule struct {
+	Match       string            `json:"match"`
+	Replace     string            `json:"replace,omitempty"`      // New path; empty keeps the path
+	SetQuery    map[string]string `json:"set_query,omitempty"`    // Query parameters to set
+	RemoveQuery []string          `json:"remove_query,omitempty"` // Query parameters to remove
+	Last        bool              `json:"last,omitempty"`         // Stop at this rule when it matches
+}
+
+// RedirectRule answers a matching request with a redirect to Target, a template that may use
+// capture groups and {scheme}, {host}, {path} (as requested, prefix included), {prefix} and
+// {query} (with its leading '?', or empty).
+type RedirectRule struct {
+	Match  string `json:"match"`
+	Target string `json:"target"`
+	Status int    `json:"status,omitempty"` // 301, 302 (default), 307 or 308
+	Scheme string `json:"scheme,omitempty"` // Only redirect requests over 'http' or 'https'; empty for both
+}
+
+// TCPProxy makes a project a raw TCP proxy: Prism listens on ListenPort and forwards each
+// connection to Upstream. While enabled, the project is not reachable over HTTP, and only its
+// ip_allow and ip_block rules apply.
+type TCPProxy struct {
+	Enabled        bool   `json:"enabled"`
+	ListenPort     int    `json:"listen_port"`
+	Upstream       string `json:"upstream"`                  // "host:port"
+	ConnectTimeout int    `json:"connect_timeout,omitempty"` // Seconds to connect to the upstream; 10
+	IdleTimeout    int    `json:"idle_timeout,omitempty"`    // Seconds without traffic before a connection is closed; 0 for none
+	MaxConnections int    `json:"max_connections,omitempty"` // Connections accepted at once; 0 for no limit
+
+	// Load balancers, as IPs or CIDRs, that send a PROXY protocol header with the client address
+	ProxyProtocolFrom []string `json:"proxy_protocol_from,omitempty"`
+}
+
+// IsTCP reports whether the project is a TCP proxy rather than an HTTP one.
+func (p *Project) IsTCP() bool {
+	return p.TCP != nil && p.TCP.Enabled
+}
+
+// Certificate represents a TLS certificate served for some of a project's hostnames.
+// The private key is stored encrypted and never leaves the server.
+type Certificate struct {
+	ID           string    `json:"id"`
+	ProjectID    string    `json:"project_id"`
+	Hostnames    []string  `json:"hostnames"` // DNS names covered by the certificate
+	CertPEM      string    `json:"certificate_pem"`
+	EncryptedKey []byte    `json:"-"`
+	Source       string    `json:"source"` // 'upload' or 'acme'
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// ACMEAccount is the account Prism holds with an ACME directory. It is shared by all replicas.
+type ACMEAccount struct {
+	DirectoryURL string
+	AccountURL   string
+	EncryptedKey []byte
+}
+
+// ACMEChallenge is a pending challenge response. It is stored so that whichever replica
+// receives the CA's validation request can answer it.
+type ACMEChallenge struct {
+	Token            string
+	Hostname         string
+	Type             string // 'http-01' or 'tls-alpn-01'
+	KeyAuthorization string
+	ExpiresAt        time.Time
+}
+
+// ACMEStatus tracks automatic issuance for one hostname.
+type ACMEStatus struct {
+	Hostname      string     `json:"hostname"`
+	ProjectID     string     `json:"project_id"`
+	Status        string     `json:"status"` // 'pending', 'valid' or 'failed'
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at"`
 }
 
 // Rule represents a firewall rule stored in the database.
@@ -28,3 +283,21 @@ type Rule struct {
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
+
+// HostnameClaim is a hostname a project has claimed, with the token its owner publishes
+// in DNS to prove control of it.
+type HostnameClaim struct {
+	Hostname          string     `json:"hostname"`
+	VerificationToken string     `json:"verification_token"`
+	VerifiedAt        *time.Time `json:"verified_at,omitempty"` // Nil until ownership is verified
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+// NormalizeHostname lowercases a hostname and strips any port and trailing dot,
+// so "App.Example.com:443" and "app.example.com." both map to "app.example.com".
+func NormalizeHostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
@@ -2,13 +2,18 @@ package storage
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
 
-	// The blank import is required for the Postgres driver to register itself.
-	_ "github.com/lib/pq"
+	// The pq package registers the Postgres driver and provides array support.
+	"github.com/lib/pq"
 )
 
 // ErrProjectNotFound is returned when a project is not found.
@@ -17,6 +22,12 @@ var ErrProjectNotFound = fmt.Errorf("project not found")
 // ErrRuleNotFound is returned when a rule is not found.
 var ErrRuleNotFound = fmt.Errorf("rule not found")
 
+// ErrHostnameTaken is returned when a hostname is already verified by another project.
+var ErrHostnameTaken = fmt.Errorf("hostname already in use")
+
+// ErrHostnameNotFound is returned when a project has not claimed a hostname.
+var ErrHostnameNotFound = fmt.Errorf("hostname not found")
+
 // Repository provides methods for interacting with the database.
 type Repository struct {
 	db *sql.DB
@@ -42,25 +53,158 @@ func NewDB(connStr string) (*sql.DB, error) {
 	return db, nil
 }
 
-// CreateProject inserts a new project into the database.
-func (r *Repository) CreateProject(ctx context.Context, userID, name, pathPrefix, upstreamURL string) (*Project, error) {
-	project := &Project{}
-	query := `INSERT INTO projects (user_id, name, path_prefix, upstream_url) VALUES ($1, $2, $3, $4) RETURNING id, user_id, name, path_prefix, upstream_url, created_at, updated_at`
+// projectColumns is the column list shared by every query that returns a Project.
+// Hostnames live in their own table and are aggregated into arrays, verified and pending,
+// so a project can still be read with a single row scan.
+const projectColumns = `id, user_id, name, path_prefix, upstream_url, COALESCE(upstream_protocol, ''), created_at, updated_at, status,
+	COALESCE((SELECT array_agg(h.hostname ORDER BY h.hostname) FROM project_hostnames h WHERE h.project_id = projects.id AND h.verified_at IS NOT NULL), '{}'),
+	COALESCE((SELECT array_agg(h.hostname ORDER BY h.hostname) FROM project_hostnames h WHERE h.project_id = projects.id AND h.verified_at IS NULL), '{}'),
+	response_rewrite, acme, upstream_tls, upstream_tls_key, cache, compression, header_rules, security_headers, error_pages, maintenance, canary, mirror, limits, concurrency, upstream_pool, url_rules, tcp`
+
+// jsonColumn adapts a Go value to a JSONB column, both as a Scan destination and as a query argument.
+// Scanning NULL leaves the destination untouched, so nil settings stay nil.
+type jsonColumn struct {
+	v interface{}
+}
+
+// Scan implements sql.Scanner.
+func (j jsonColumn) Scan(src interface{}) error {
+	switch data := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(data, j.v)
+	case string:
+		return json.Unmarshal([]byte(data), j.v)
+	default:
+		return fmt.Errorf("unsupported JSON column type %T", src)
+	}
+}
+
+// Value implements driver.Valuer.
+func (j jsonColumn) Value() (driver.Value, error) {
+	data, err := json.Marshal(j.v)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
 
-	err := r.db.QueryRowContext(ctx, query, userID, name, pathPrefix, upstreamURL).Scan(
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanProject reads a row selected with projectColumns into a Project.
+func scanProject(row rowScanner, project *Project) error {
+	var status sql.NullString
+	err := row.Scan(
 		&project.ID,
 		&project.UserID,
 		&project.Name,
 		&project.PathPrefix,
 		&project.UpstreamURL,
+		&project.UpstreamProtocol,
 		&project.CreatedAt,
 		&project.UpdatedAt,
+		&status,
+		pq.Array(&project.Hostnames),
+		pq.Array(&project.PendingHostnames),
+		jsonColumn{&project.ResponseRewrite},
+		jsonColumn{&project.ACME},
+		jsonColumn{&project.UpstreamTLS},
+		&project.UpstreamTLSKey,
+		jsonColumn{&project.Cache},
+		jsonColumn{&project.Compression},
+		jsonColumn{&project.HeaderRules},
+		jsonColumn{&project.SecurityHeaders},
+		jsonColumn{&project.ErrorPages},
+		jsonColumn{&project.Maintenance},
+		jsonColumn{&project.Canary},
+		jsonColumn{&project.Mirror},
+		jsonColumn{&project.Limits},
+		jsonColumn{&project.Concurrency},
+		jsonColumn{&project.UpstreamPool},
+		jsonColumn{&project.URLRules},
+		jsonColumn{&project.TCP},
 	)
+	project.Status = status.String
+	return err
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
 
+// newVerificationToken returns a random token a project owner publishes to prove they control a hostname.
+func newVerificationToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate verification token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// replaceHostnames sets the hostnames a project claims inside an open transaction.
+// Hostnames the project already claims keep their token and verification; new ones get
+// a fresh token and are not routed until verified. A hostname verified by another
+// project cannot be claimed.
+func replaceHostnames(ctx context.Context, tx *sql.Tx, projectID string, hostnames []string) error {
+	query := `DELETE FROM project_hostnames WHERE project_id = $1 AND NOT (hostname = ANY($2))`
+	if _, err := tx.ExecContext(ctx, query, projectID, pq.Array(hostnames)); err != nil {
+		return fmt.Errorf("failed to clear hostnames: %w", err)
+	}
+	for _, hostname := range hostnames {
+		var taken bool
+		query = `SELECT EXISTS (SELECT 1 FROM project_hostnames WHERE hostname = $1 AND project_id <> $2 AND verified_at IS NOT NULL)`
+		if err := tx.QueryRowContext(ctx, query, hostname, projectID).Scan(&taken); err != nil {
+			return fmt.Errorf("failed to check hostname '%s': %w", hostname, err)
+		}
+		if taken {
+			return ErrHostnameTaken
+		}
+		token, err := newVerificationToken()
+		if err != nil {
+			return err
+		}
+		query = `INSERT INTO project_hostnames (hostname, project_id, verification_token) VALUES ($1, $2, $3) ON CONFLICT (hostname, project_id) DO NOTHING`
+		if _, err := tx.ExecContext(ctx, query, hostname, projectID, token); err != nil {
+			return fmt.Errorf("failed to add hostname '%s': %w", hostname, err)
+		}
+	}
+	return nil
+}
+
+// CreateProject inserts a new project and its hostnames into the database.
+func (r *Repository) CreateProject(ctx context.Context, userID, name, pathPrefix, upstreamURL string, hostnames []string) (*Project, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var projectID string
+	query := `INSERT INTO projects (user_id, name, path_prefix, upstream_url) VALUES ($1, $2, $3, $4) RETURNING id`
+	if err := tx.QueryRowContext(ctx, query, userID, name, pathPrefix, upstreamURL).Scan(&projectID); err != nil {
 		return nil, fmt.Errorf("failed to create project: %w", err)
 	}
 
+	if err := replaceHostnames(ctx, tx, projectID, hostnames); err != nil {
+		return nil, err
+	}
+
+	project := &Project{}
+	query = `SELECT ` + projectColumns + ` FROM projects WHERE id = $1`
+	if err := scanProject(tx.QueryRowContext(ctx, query, projectID), project); err != nil {
+		return nil, fmt.Errorf("failed to read created project: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit project: %w", err)
+	}
+
 	log.Printf("Created project: %+v\n", project)
 	return project, nil
 }
@@ -68,17 +212,9 @@ func (r *Repository) CreateProject(ctx context.Context, userID, name, pathPrefix
 // GetProjectByPathPrefix fetches a project by its path prefix.
 func (r *Repository) GetProjectByPathPrefix(ctx context.Context, pathPrefix string) (*Project, error) {
 	project := &Project{}
-	query := `SELECT id, user_id, name, path_prefix, upstream_url, created_at, updated_at FROM projects WHERE path_prefix = $1`
+	query := `SELECT ` + projectColumns + ` FROM projects WHERE path_prefix = $1`
 
-	err := r.db.QueryRowContext(ctx, query, pathPrefix).Scan(
-		&project.ID,
-		&project.UserID,
-		&project.Name,
-		&project.PathPrefix,
-		&project.UpstreamURL,
-		&project.CreatedAt,
-		&project.UpdatedAt,
-	)
+	err := scanProject(r.db.QueryRowContext(ctx, query, pathPrefix), project)
 
 	if err == sql.ErrNoRows {
 		return nil, ErrProjectNotFound
@@ -90,20 +226,72 @@ func (r *Repository) GetProjectByPathPrefix(ctx context.Context, pathPrefix stri
 	return project, nil
 }
 
+// GetProjectByHostname fetches the project that has verified the given hostname.
+func (r *Repository) GetProjectByHostname(ctx context.Context, hostname string) (*Project, error) {
+	project := &Project{}
+	query := `SELECT ` + projectColumns + ` FROM projects WHERE id = (SELECT project_id FROM project_hostnames WHERE hostname = $1 AND verified_at IS NOT NULL)`
+
+	err := scanProject(r.db.QueryRowContext(ctx, query, hostname), project)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrProjectNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get project by hostname: %w", err)
+	}
+
+	log.Printf("Fetched project for hostname %s: %+v\n", hostname, project)
+	return project, nil
+}
+
+// GetHostnameClaims fetches the hostnames a project has claimed, with their verification state.
+func (r *Repository) GetHostnameClaims(ctx context.Context, projectID string) ([]HostnameClaim, error) {
+	query := `SELECT hostname, verification_token, verified_at, created_at FROM project_hostnames WHERE project_id = $1 ORDER BY hostname`
+	rows, err := r.db.QueryContext(ctx, query, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query hostname claims: %w", err)
+	}
+	defer rows.Close()
+
+	claims := []HostnameClaim{}
+	for rows.Next() {
+		var claim HostnameClaim
+		if err := rows.Scan(&claim.Hostname, &claim.VerificationToken, &claim.VerifiedAt, &claim.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan hostname claim: %w", err)
+		}
+		claims = append(claims, claim)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during hostname claim rows iteration: %w", err)
+	}
+	return claims, nil
+}
+
+// MarkHostnameVerified records that a project's owner has proven control of a hostname,
+// which makes it routable. It returns ErrHostnameTaken if another project verified it first.
+func (r *Repository) MarkHostnameVerified(ctx context.Context, projectID, hostname string) error {
+	query := `UPDATE project_hostnames SET verified_at = COALESCE(verified_at, NOW()) WHERE project_id = $1 AND hostname = $2`
+	result, err := r.db.ExecContext(ctx, query, projectID, hostname)
+	if isUniqueViolation(err) {
+		return ErrHostnameTaken
+	} else if err != nil {
+		return fmt.Errorf("failed to verify hostname: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to verify hostname: %w", err)
+	} else if n == 0 {
+		return ErrHostnameNotFound
+	}
+
+	log.Printf("Verified hostname %s for project %s\n", hostname, projectID)
+	return nil
+}
+
 // GetProjectByIDAndUserID fetches a project by its ID and ensures it belongs to the given user ID.
 func (r *Repository) GetProjectByIDAndUserID(ctx context.Context, projectID, userID string) (*Project, error) {
 	project := &Project{}
-	query := `SELECT id, user_id, name, path_prefix, upstream_url, created_at, updated_at FROM projects WHERE id = $1 AND user_id = $2`
+	query := `SELECT ` + projectColumns + ` FROM projects WHERE id = $1 AND user_id = $2`
 
-	err := r.db.QueryRowContext(ctx, query, projectID, userID).Scan(
-		&project.ID,
-		&project.UserID,
-		&project.Name,
-		&project.PathPrefix,
-		&project.UpstreamURL,
-		&project.CreatedAt,
-		&project.UpdatedAt,
-	)
+	err := scanProject(r.db.QueryRowContext(ctx, query, projectID, userID), project)
 
 	if err == sql.ErrNoRows {
 		return nil, ErrProjectNotFound
@@ -115,54 +303,201 @@ func (r *Repository) GetProjectByIDAndUserID(ctx context.Context, projectID, use
 	return project, nil
 }
 
+// ProjectUpdate holds the fields of a project that may be changed. Nil fields are left untouched.
+type ProjectUpdate struct {
+	Name        *string
+	PathPrefix  *string
+	UpstreamURL *string
+	Hostnames   *[]string
+
+	UpstreamProtocol *string
+
+	ResponseRewrite *ResponseRewrite
+	ACME            *ACMEConfig
+
+	// UpstreamTLS and UpstreamTLSKey are replaced together; a nil key clears any stored client key.
+	UpstreamTLS    *UpstreamTLS
+	UpstreamTLSKey []byte
+
+	Cache           *CacheConfig
+	Compression     *CompressionConfig
+	HeaderRules     *[]HeaderRule
+	SecurityHeaders *SecurityHeaders
+	ErrorPages      *ErrorPages
+	Maintenance     *Maintenance
+	Canary          *Canary
+	Mirror          *Mirror
+	Limits          *Limits
+	Concurrency     *ConcurrencyLimit
+	UpstreamPool    *UpstreamPool
+	URLRules        *URLRules
+	TCP             *TCPProxy
+}
+
 // UpdateProject updates an existing project in the database.
-func (r *Repository) UpdateProject(ctx context.Context, projectID, userID string, name, pathPrefix, upstreamURL *string) (*Project, error) {
+func (r *Repository) UpdateProject(ctx context.Context, projectID, userID string, update ProjectUpdate) (*Project, error) {
 	// Start building the query dynamically
 	sets := []string{}
 	args := []interface{}{}
 	argCounter := 1
 
-	if name != nil {
+	if update.Name != nil {
 		sets = append(sets, fmt.Sprintf("name = $%d", argCounter))
-		args = append(args, *name)
+		args = append(args, *update.Name)
 		argCounter++
 	}
-	if pathPrefix != nil {
+	if update.PathPrefix != nil {
 		sets = append(sets, fmt.Sprintf("path_prefix = $%d", argCounter))
-		args = append(args, *pathPrefix)
+		args = append(args, *update.PathPrefix)
 		argCounter++
 	}
-	if upstreamURL != nil {
+	if update.UpstreamURL != nil {
 		sets = append(sets, fmt.Sprintf("upstream_url = $%d", argCounter))
-		args = append(args, *upstreamURL)
+		args = append(args, *update.UpstreamURL)
 		argCounter++
 	}
 
-	if len(sets) == 0 {
+	if update.UpstreamProtocol != nil {
+		sets = append(sets, fmt.Sprintf("upstream_protocol = $%d", argCounter))
+		args = append(args, *update.UpstreamProtocol)
+		argCounter++
+	}
+
+	if update.ResponseRewrite != nil {
+		sets = append(sets, fmt.Sprintf("response_rewrite = $%d", argCounter))
+		args = append(args, jsonColumn{update.ResponseRewrite})
+		argCounter++
+	}
+
+	if update.ACME != nil {
+		sets = append(sets, fmt.Sprintf("acme = $%d", argCounter))
+		args = append(args, jsonColumn{update.ACME})
+		argCounter++
+	}
+
+	if update.UpstreamTLS != nil {
+		sets = append(sets, fmt.Sprintf("upstream_tls = $%d, upstream_tls_key = $%d", argCounter, argCounter+1))
+		args = append(args, jsonColumn{update.UpstreamTLS}, update.UpstreamTLSKey)
+		argCounter += 2
+	}
+
+	if update.Cache != nil {
+		sets = append(sets, fmt.Sprintf("cache = $%d", argCounter))
+		args = append(args, jsonColumn{update.Cache})
+		argCounter++
+	}
+
+	if update.Compression != nil {
+		sets = append(sets, fmt.Sprintf("compression = $%d", argCounter))
+		args = append(args, jsonColumn{update.Compression})
+		argCounter++
+	}
+
+	if update.HeaderRules != nil {
+		sets = append(sets, fmt.Sprintf("header_rules = $%d", argCounter))
+		args = append(args, jsonColumn{*update.HeaderRules})
+		argCounter++
+	}
+
+	if update.SecurityHeaders != nil {
+		sets = append(sets, fmt.Sprintf("security_headers = $%d", argCounter))
+		args = append(args, jsonColumn{update.SecurityHeaders})
+		argCounter++
+	}
+
+	if update.ErrorPages != nil {
+		sets = append(sets, fmt.Sprintf("error_pages = $%d", argCounter))
+		args = append(args, jsonColumn{update.ErrorPages})
+		argCounter++
+	}
+
+	if update.Maintenance != nil {
+		sets = append(sets, fmt.Sprintf("maintenance = $%d", argCounter))
+		args = append(args, jsonColumn{update.Maintenance})
+		argCounter++
+	}
+
+	if update.Canary != nil {
+		sets = append(sets, fmt.Sprintf("canary = $%d", argCounter))
+		args = append(args, jsonColumn{update.Canary})
+		argCounter++
+	}
+
+	if update.Mirror != nil {
+		sets = append(sets, fmt.Sprintf("mirror = $%d", argCounter))
+		args = append(args, jsonColumn{update.Mirror})
+		argCounter++
+	}
+
+	if update.Limits != nil {
+		sets = append(sets, fmt.Sprintf("limits = $%d", argCounter))
+		args = append(args, jsonColumn{update.Limits})
+		argCounter++
+	}
+
+	if update.Concurrency != nil {
+		sets = append(sets, fmt.Sprintf("concurrency = $%d", argCounter))
+		args = append(args, jsonColumn{update.Concurrency})
+		argCounter++
+	}
+
+	if update.UpstreamPool != nil {
+		sets = append(sets, fmt.Sprintf("upstream_pool = $%d", argCounter))
+		args = append(args, jsonColumn{update.UpstreamPool})
+		argCounter++
+	}
+
+	if update.URLRules != nil {
+		sets = append(sets, fmt.Sprintf("url_rules = $%d", argCounter))
+		args = append(args, jsonColumn{update.URLRules})
+		argCounter++
+	}
+
+	if update.TCP != nil {
+		sets = append(sets, fmt.Sprintf("tcp = $%d", argCounter))
+		args = append(args, jsonColumn{update.TCP})
+		argCounter++
+	}
+
+	if len(sets) == 0 && update.Hostnames == nil {
 		return nil, fmt.Errorf("no fields to update")
 	}
 
-	query := fmt.Sprintf("UPDATE projects SET %s, updated_at = NOW() WHERE id = $%d AND user_id = $%d RETURNING id, user_id, name, path_prefix, upstream_url, created_at, updated_at",
-		strings.Join(sets, ", "), argCounter, argCounter+1)
-	args = append(args, projectID, userID)
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
 
-	project := &Project{}
-	err := r.db.QueryRowContext(ctx, query, args...).Scan(
-		&project.ID,
-		&project.UserID,
-		&project.Name,
-		&project.PathPrefix,
-		&project.UpstreamURL,
-		&project.CreatedAt,
-		&project.UpdatedAt,
-	)
+	// The update always touches updated_at, which also serves as the ownership check
+	// when only the hostnames change.
+	query := fmt.Sprintf("UPDATE projects SET %s WHERE id = $%d AND user_id = $%d RETURNING id",
+		strings.Join(append(sets, "updated_at = NOW()"), ", "), argCounter, argCounter+1)
+	args = append(args, projectID, userID)
 
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&projectID)
 	if err == sql.ErrNoRows {
 		return nil, ErrProjectNotFound
 	} else if err != nil {
 		return nil, fmt.Errorf("failed to update project: %w", err)
 	}
 
+	if update.Hostnames != nil {
+		if err := replaceHostnames(ctx, tx, projectID, *update.Hostnames); err != nil {
+			return nil, err
+		}
+	}
+
+	project := &Project{}
+	query = `SELECT ` + projectColumns + ` FROM projects WHERE id = $1`
+	if err := scanProject(tx.QueryRowContext(ctx, query, projectID), project); err != nil {
+		return nil, fmt.Errorf("failed to read updated project: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit project update: %w", err)
+	}
+
 	log.Printf("Updated project %s for user %s: %+v\n", projectID, userID, project)
 	return project, nil
 }
@@ -170,7 +505,7 @@ func (r *Repository) UpdateProject(ctx context.Context, projectID, userID string
 // GetProjectsByUserID fetches all projects for a given user ID.
 func (r *Repository) GetProjectsByUserID(ctx context.Context, userID string) ([]Project, error) {
 	var projects []Project
-	query := `SELECT id, user_id, name, path_prefix, upstream_url, created_at, updated_at, status FROM projects WHERE user_id = $1`
+	query := `SELECT ` + projectColumns + ` FROM projects WHERE user_id = $1`
 
 	rows, err := r.db.QueryContext(ctx, query, userID)
 	if err != nil {
@@ -180,17 +515,7 @@ func (r *Repository) GetProjectsByUserID(ctx context.Context, userID string) ([]
 
 	for rows.Next() {
 		var project Project
-		err := rows.Scan(
-			&project.ID,
-			&project.UserID,
-			&project.Name,
-			&project.PathPrefix,
-			&project.UpstreamURL,
-			&project.CreatedAt,
-			&project.UpdatedAt,
-			&project.Status,
-		)
-		if err != nil {
+		if err := scanProject(rows, &project); err != nil {
 			return nil, fmt.Errorf("failed to scan project row: %w", err)
 		}
 		projects = append(projects, project)
@@ -204,6 +529,32 @@ func (r *Repository) GetProjectsByUserID(ctx context.Context, userID string) ([]
 	return projects, nil
 }
 
+// ListProjects fetches every project regardless of owner. It is used to build the routing table.
+func (r *Repository) ListProjects(ctx context.Context) ([]Project, error) {
+	var projects []Project
+	query := `SELECT ` + projectColumns + ` FROM projects`
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query projects: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var project Project
+		if err := scanProject(rows, &project); err != nil {
+			return nil, fmt.Errorf("failed to scan project row: %w", err)
+		}
+		projects = append(projects, project)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error after iterating rows: %w", err)
+	}
+
+	return projects, nil
+}
+
 // GetRulesByProjectID fetches all rules for a given project ID after verifying user ownership.
 func (r *Repository) GetRulesByProjectID(ctx context.Context, userID, projectID string) ([]Rule, error) {
 	// 1. Verify the user owns the project.
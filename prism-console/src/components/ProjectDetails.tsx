@@ -11,6 +11,7 @@ import ProjectCard from './projectCard';
 import { EditRuleDialog } from './editRuleDialog';
 import { AddRuleDialog } from './addRuleDialog';
 import { RulesTable } from './rulesTable'; // Import the new component
+import { CertificateStatus } from './certificateStatus';
 import { useRawLogStream } from '@/hooks/useRawLogStream';
 import { Prism as SyntaxHighlighter } from 'react-syntax-highlighter';
 import { materialDark } from 'react-syntax-highlighter/dist/esm/styles/prism';
@@ -202,6 +203,10 @@ const ProjectDetails = () => {
         <ProjectCard project={project} />
       </div>
 
+      <div className="mb-6">
+        <CertificateStatus projectId={project.id} />
+      </div>
+
       {/* Filter Input */}
       <div className="mb-4 flex items-center gap-4">
         <Input
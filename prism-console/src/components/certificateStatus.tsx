@@ -0,0 +1,67 @@
+import { useQuery } from '@tanstack/react-query';
+import { Badge } from "@/components/ui/badge";
+import { getCertificateStatus } from '@/lib/api';
+import { useSession } from './SessionProvider';
+
+interface HostnameCertificateStatus {
+  hostname: string;
+  status: 'valid' | 'expiring' | 'expired' | 'pending' | 'failed' | 'none';
+  source?: string;
+  not_after?: string;
+  last_error?: string;
+  next_attempt_at?: string;
+}
+
+const statusVariant = (status: HostnameCertificateStatus['status']) => {
+  switch (status) {
+    case 'valid':
+      return 'default';
+    case 'expiring':
+    case 'pending':
+      return 'secondary';
+    case 'expired':
+    case 'failed':
+      return 'destructive';
+    default:
+      return 'outline';
+  }
+};
+
+export function CertificateStatus({ projectId }: { projectId: string }) {
+  const { session } = useSession();
+
+  const { data: statuses } = useQuery<HostnameCertificateStatus[], Error>({
+    queryKey: ['certificate-status', projectId, session],
+    queryFn: () => getCertificateStatus(session!, projectId),
+    enabled: !!session,
+    refetchInterval: 30000,
+  });
+
+  if (!statuses || statuses.length === 0) {
+    return null;
+  }
+
+  return (
+    <div className="rounded border">
+      <div className="p-2 border-b">
+        <h2 className="text-lg font-semibold">Certificates</h2>
+      </div>
+      <ul className="divide-y">
+        {statuses.map((s) => (
+          <li key={s.hostname} className="flex items-center justify-between gap-4 p-2 text-sm">
+            <span className="font-mono">{s.hostname}</span>
+            <span className="flex items-center gap-2 opacity-80">
+              {s.not_after && `${s.source} · expires ${new Date(s.not_after).toLocaleDateString()}`}
+              {s.last_error && (
+                <span className="text-destructive" title={s.last_error}>
+                  retry {s.next_attempt_at ? new Date(s.next_attempt_at).toLocaleString() : 'pending'}
+                </span>
+              )}
+              <Badge variant={statusVariant(s.status)}>{s.status}</Badge>
+            </span>
+          </li>
+        ))}
+      </ul>
+    </div>
+  );
+}
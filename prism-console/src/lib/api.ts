@@ -85,3 +85,16 @@ export const updateProject = async (
 
 
 
+export const getCertificateStatus = async (session: Session, projectId: string) => {
+  const response = await fetch(`${API_URL}/projects/${projectId}/certificate-status`, {
+    headers: {
+      'Authorization': `Bearer ${session.access_token}`,
+    },
+  });
+
+  if (!response.ok) {
+    throw new Error('Failed to fetch certificate status');
+  }
+
+  return response.json();
+};